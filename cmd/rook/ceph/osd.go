@@ -16,11 +16,13 @@ limitations under the License.
 package ceph
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/rook/rook/cmd/rook/rook"
+	"github.com/rook/rook/pkg/clusterd"
 	"github.com/rook/rook/pkg/daemon/ceph/client"
 	"github.com/rook/rook/pkg/daemon/ceph/mon"
 	"github.com/rook/rook/pkg/daemon/ceph/osd"
@@ -37,8 +39,23 @@ var osdCmd = &cobra.Command{
 	Short:  "Generates osd config and runs the osd daemon",
 	Hidden: true,
 }
+var prepareOSDCmd = &cobra.Command{
+	Use:    "prepare",
+	Short:  "Prepares the osds of the node without running them",
+	Hidden: true,
+}
+var startOSDCmd = &cobra.Command{
+	Use:    "start",
+	Short:  "Runs a single prepared osd of the node",
+	Hidden: true,
+}
 var (
+	osdID               int
 	osdDataDeviceFilter string
+	osdDataDeviceConfig string
+	osdReplaceOSDs      string
+	osdDeviceSelection  string
+	osdMemoryLimit      int64
 	ownerRefID          string
 )
 
@@ -46,39 +63,118 @@ func addOSDFlags(command *cobra.Command) {
 	command.Flags().StringVar(&cfg.devices, "data-devices", "", "comma separated list of devices to use for storage")
 	command.Flags().StringVar(&ownerRefID, "cluster-id", "", "the UID of the cluster CRD that owns this cluster")
 	command.Flags().StringVar(&osdDataDeviceFilter, "data-device-filter", "", "a regex filter for the device names to use, or \"all\"")
+	command.Flags().StringVar(&osdDataDeviceConfig, "data-device-config", "", "json map of device names to the config of each device")
+	command.Flags().StringVar(&osdDeviceSelection, "device-selection", "", "json of the devices declared for the node, whose deselected devices have their osds removed")
 	command.Flags().StringVar(&cfg.directories, "data-directories", "", "comma separated list of directory paths to use for storage")
-	command.Flags().StringVar(&cfg.metadataDevice, "metadata-device", "", "device to use for metadata (e.g. a high performance SSD/NVMe device)")
+	command.Flags().StringVar(&cfg.metadataDevice, "metadata-device", "", "comma separated list of devices to use for metadata (e.g. high performance SSD/NVMe devices)")
 	command.Flags().StringVar(&cfg.location, "location", "", "location of this node for CRUSH placement")
 	command.Flags().BoolVar(&cfg.forceFormat, "force-format", false,
 		"true to force the format of any specified devices, even if they already have a filesystem.  BE CAREFUL!")
 	command.Flags().StringVar(&cfg.nodeName, "node-name", os.Getenv("HOSTNAME"), "the host name of the node")
+	command.Flags().StringVar(&osdReplaceOSDs, "replace-osds", "", "comma separated list of the IDs of destroyed osds whose failed devices are replaced")
+	command.Flags().Int64Var(&osdMemoryLimit, "osd-memory-limit", 0, "memory limit (bytes) of the container, divided between its osds")
 
 	// OSD store config flags
 	command.Flags().IntVar(&cfg.storeConfig.WalSizeMB, "osd-wal-size", osdcfg.WalDefaultSizeMB, "default size (MB) for OSD write ahead log (WAL) (bluestore)")
 	command.Flags().IntVar(&cfg.storeConfig.DatabaseSizeMB, "osd-database-size", osdcfg.DBDefaultSizeMB, "default size (MB) for OSD database (bluestore)")
 	command.Flags().IntVar(&cfg.storeConfig.JournalSizeMB, "osd-journal-size", osdcfg.JournalDefaultSizeMB, "default size (MB) for OSD journal (filestore)")
 	command.Flags().StringVar(&cfg.storeConfig.StoreType, "osd-store", "", "type of backing OSD store to use (bluestore or filestore)")
+	command.Flags().StringVar(&cfg.storeConfig.Provisioner, "osd-provisioner", "", "provisioner of OSDs on devices (partition or ceph-volume)")
+	command.Flags().BoolVar(&cfg.storeConfig.EncryptedDevice, "osd-encrypted-device", false, "true to encrypt the OSDs on devices with dm-crypt")
+	command.Flags().Float64Var(&cfg.storeConfig.WeightRampStep, "osd-weight-ramp-step", 0,
+		"fraction of the full crush weight by which new osds are raised and removed osds are drained at each step, 0 to change the weight at once")
+	command.Flags().IntVar(&cfg.storeConfig.OSDsPerDevice, "osds-per-device", 1, "number of osds that share each new device")
+	command.Flags().Float64Var(&cfg.storeConfig.DatabaseSizePercent, "osd-database-size-percent", 0,
+		"size of the OSD database as a percentage of the data device, 0 for the fixed size (bluestore)")
+	command.Flags().Float64Var(&cfg.storeConfig.WalSizePercent, "osd-wal-size-percent", 0,
+		"size of the OSD write ahead log (WAL) as a percentage of the data device, 0 for the fixed size (bluestore)")
+	command.Flags().BoolVar(&cfg.storeConfig.AutoMetadataSize, "osd-auto-metadata-size", false,
+		"true to split the free space of a metadata device between the databases of its new OSDs (bluestore)")
 }
 
 func init() {
-	addOSDFlags(osdCmd)
-	addCephFlags(osdCmd)
-	flags.SetFlagsFromEnv(osdCmd.Flags(), rook.RookEnvVarPrefix)
+	startOSDCmd.Flags().IntVar(&osdID, "osd-id", -1, "the id of the osd to run")
+	for _, command := range []*cobra.Command{osdCmd, prepareOSDCmd, startOSDCmd} {
+		addOSDFlags(command)
+		addCephFlags(command)
+		flags.SetFlagsFromEnv(command.Flags(), rook.RookEnvVarPrefix)
+	}
+
+	osdCmd.AddCommand(prepareOSDCmd, startOSDCmd)
 
 	osdCmd.RunE = startOSD
+	prepareOSDCmd.RunE = prepareOSDs
+	startOSDCmd.RunE = startDedicatedOSD
 }
 
 func startOSD(cmd *cobra.Command, args []string) error {
-	required := []string{"cluster-name", "cluster-id", "mon-endpoints", "mon-secret", "admin-secret", "node-name", "public-ipv4", "private-ipv4"}
-	if err := flags.VerifyRequiredFlags(osdCmd, required); err != nil {
+	context, agent, err := createOSDAgent(cmd)
+	if err != nil {
+		return err
+	}
+
+	err = osd.Run(context, agent, nil)
+	if err != nil {
+		terminateOrchestration(context, err)
+	}
+
+	return nil
+}
+
+func prepareOSDs(cmd *cobra.Command, args []string) error {
+	context, agent, err := createOSDAgent(cmd)
+	if err != nil {
 		return err
 	}
 
+	err = osd.PrepareOSDs(context, agent)
+	if err != nil {
+		terminateOrchestration(context, err)
+	}
+
+	return nil
+}
+
+func startDedicatedOSD(cmd *cobra.Command, args []string) error {
+	if osdID < 0 {
+		return fmt.Errorf("--osd-id is required")
+	}
+
+	context, agent, err := createOSDAgent(cmd)
+	if err != nil {
+		return err
+	}
+
+	err = osd.RunDedicatedOSD(context, agent, osdID)
+	if err != nil {
+		rook.TerminateFatal(err)
+	}
+
+	return nil
+}
+
+// something failed in the OSD orchestration, update the status map with failure details
+func terminateOrchestration(context *clusterd.Context, err error) {
+	status := oposd.OrchestrationStatus{
+		Status:  oposd.OrchestrationStatusFailed,
+		Message: err.Error(),
+	}
+	oposd.UpdateOrchestrationStatusMap(context.Clientset, clusterInfo.Name, cfg.nodeName, status)
+
+	rook.TerminateFatal(err)
+}
+
+func createOSDAgent(cmd *cobra.Command) (*clusterd.Context, *osd.OsdAgent, error) {
+	required := []string{"cluster-name", "cluster-id", "mon-endpoints", "mon-secret", "admin-secret", "node-name", "public-ipv4", "private-ipv4"}
+	if err := flags.VerifyRequiredFlags(cmd, required); err != nil {
+		return nil, nil, err
+	}
+
 	var dataDevices string
 	var usingDeviceFilter bool
 	if osdDataDeviceFilter != "" {
 		if cfg.devices != "" {
-			return fmt.Errorf("Only one of --data-devices and --data-device-filter can be specified.")
+			return nil, nil, fmt.Errorf("Only one of --data-devices and --data-device-filter can be specified.")
 		}
 
 		dataDevices = osdDataDeviceFilter
@@ -87,9 +183,21 @@ func startOSD(cmd *cobra.Command, args []string) error {
 		dataDevices = cfg.devices
 	}
 
+	var deviceConfig map[string]map[string]string
+	if osdDataDeviceConfig != "" {
+		if err := json.Unmarshal([]byte(osdDataDeviceConfig), &deviceConfig); err != nil {
+			return nil, nil, fmt.Errorf("invalid --data-device-config. %+v", err)
+		}
+	}
+
+	deviceSelection, err := oposd.ParseDeviceSelection(osdDeviceSelection)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	rook.SetLogLevel()
 
-	rook.LogStartupInfo(osdCmd.Flags())
+	rook.LogStartupInfo(cmd.Flags())
 
 	clientset, _, rookClientset, err := rook.GetClientset()
 	if err != nil {
@@ -110,20 +218,8 @@ func startOSD(cmd *cobra.Command, args []string) error {
 	clusterInfo.Monitors = mon.ParseMonEndpoints(cfg.monEndpoints)
 	ownerRef := cluster.ClusterOwnerRef(clusterInfo.Name, ownerRefID)
 	kv := k8sutil.NewConfigMapKVStore(clusterInfo.Name, clientset, ownerRef)
-	agent := osd.NewAgent(context, dataDevices, usingDeviceFilter, cfg.metadataDevice, cfg.directories, forceFormat,
-		crushLocation, cfg.storeConfig, &clusterInfo, cfg.nodeName, kv)
-
-	err = osd.Run(context, agent, nil)
-	if err != nil {
-		// something failed in the OSD orchestration, update the status map with failure details
-		status := oposd.OrchestrationStatus{
-			Status:  oposd.OrchestrationStatusFailed,
-			Message: err.Error(),
-		}
-		oposd.UpdateOrchestrationStatusMap(clientset, clusterInfo.Name, cfg.nodeName, status)
+	agent := osd.NewAgent(context, dataDevices, usingDeviceFilter, deviceSelection, deviceConfig, cfg.metadataDevice, cfg.directories,
+		forceFormat, crushLocation, cfg.storeConfig, oposd.ParseReplaceOSDs(osdReplaceOSDs), osdMemoryLimit, &clusterInfo, cfg.nodeName, kv)
 
-		rook.TerminateFatal(err)
-	}
-
-	return nil
+	return context, agent, nil
 }
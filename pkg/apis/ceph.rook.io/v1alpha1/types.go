@@ -65,11 +65,113 @@ type ClusterSpec struct {
 
 	// MonCount sets the mon size
 	MonCount int `json:"monCount,omitempty"`
+
+	// The number of storage nodes whose OSDs are orchestrated at the same time. One node at a time if not specified.
+	OSDNodeConcurrency int `json:"osdNodeConcurrency,omitempty"`
+
+	// The settings of the automatic reweighting of the OSDs by their utilization
+	Reweight ReweightSpec `json:"reweight,omitempty"`
+
+	// The windows in which the OSDs are allowed to scrub. The OSDs can scrub at any time if not specified.
+	ScrubSchedule *ScrubScheduleSpec `json:"scrubSchedule,omitempty"`
+}
+
+// ReweightSpec represents the settings of the operator reweighting the OSDs whose utilization drifts from the average,
+// for clusters where the mgr balancer is not available
+type ReweightSpec struct {
+	// Whether the operator reweights the OSDs by their utilization
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Whether the CRUSH weight is changed instead of the override reweight of the OSDs
+	UseCrushWeight bool `json:"useCrushWeight,omitempty"`
+
+	// The largest fraction by which the weight of an OSD is changed in a cycle
+	MaxChange float64 `json:"maxChange,omitempty"`
+
+	// How far the utilization of an OSD can be from the average utilization, as a fraction of the average, before its
+	// weight is changed
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// ScrubScheduleSpec represents the days and hours in which the OSDs are allowed to scrub
+type ScrubScheduleSpec struct {
+	// The days of the week on which scrubbing is allowed, for example "saturday". Scrubbing is allowed on all days if empty.
+	Days []string `json:"days,omitempty"`
+
+	// The ranges of hours in which scrubbing is allowed. Scrubbing is allowed at all hours if empty.
+	Hours []HourRange `json:"hours,omitempty"`
+
+	// The time zone of the days and hours, for example "America/New_York". UTC if not specified.
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// HourRange represents the hours from the begin hour up to the end hour, which wraps past midnight when the end hour is
+// before the begin hour
+type HourRange struct {
+	// The first hour of the range, between 0 and 23
+	Begin int `json:"begin"`
+
+	// The hour at which the range ends, between 0 and 24
+	End int `json:"end"`
 }
 
 type ClusterStatus struct {
 	State   ClusterState `json:"state,omitempty"`
 	Message string       `json:"message,omitempty"`
+
+	// Whether the scrub schedule currently allows the OSDs to scrub, only set when the cluster has a scrub schedule
+	ScrubPermitted *bool `json:"scrubPermitted,omitempty"`
+
+	// The devices selected for the OSDs that cannot be used by an OSD, found when the OSDs were last orchestrated
+	RejectedDevices []RejectedDevice `json:"rejectedDevices,omitempty"`
+
+	// The orchestration status of the OSDs of each storage node
+	OSDNodes []OSDNodeStatus `json:"osdNodes,omitempty"`
+
+	// The progress of the OSDs whose weight is being raised or drained in steps
+	WeightRamps []OSDWeightRampStatus `json:"weightRamps,omitempty"`
+}
+
+// OSDNodeStatus is the orchestration status of the OSDs of a storage node
+type OSDNodeStatus struct {
+	// The name of the node, or the name of the volume claim of an OSD of a storage class device set
+	Node string `json:"node"`
+
+	// The state of the orchestration: starting, computingDiff, orchestrating, completed or failed
+	State string `json:"state"`
+
+	// The details of the state, such as the reason of a failure
+	Message string `json:"message,omitempty"`
+
+	// The IDs of the OSDs of the node, set when the orchestration is completed
+	OSDs []int `json:"osds,omitempty"`
+}
+
+// RejectedDevice is a device of a node that cannot be used by an OSD
+type RejectedDevice struct {
+	// The name of the node of the device
+	Node string `json:"node"`
+
+	// The name of the device
+	Name string `json:"name"`
+
+	// Why the device cannot be used, for example because it has partitions or a filesystem
+	Reason string `json:"reason"`
+}
+
+// OSDWeightRampStatus is the progress of an OSD whose CRUSH weight is being changed in steps
+type OSDWeightRampStatus struct {
+	// The ID of the OSD
+	OSD int `json:"osd"`
+
+	// Whether the weight of the OSD is being raised or drained: rampingUp or draining
+	State string `json:"state"`
+
+	// The current CRUSH weight of the OSD
+	Weight float64 `json:"weight"`
+
+	// The CRUSH weight the OSD will have at the end of the ramp
+	TargetWeight float64 `json:"targetWeight"`
 }
 
 type ClusterState string
@@ -107,6 +209,9 @@ type PoolSpec struct {
 	// The root of the crush hierarchy utilized by the pool
 	CrushRoot string `json:"crushRoot"`
 
+	// The device class the OSDs of the pool must have: hdd, ssd, nvme or a custom class (optional)
+	DeviceClass string `json:"deviceClass,omitempty"`
+
 	// The replication settings
 	Replicated ReplicatedSpec `json:"replicated"`
 
@@ -31,7 +31,7 @@ func (in *Cluster) DeepCopyInto(out *Cluster) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -109,6 +109,16 @@ func (in *ClusterSpec) DeepCopyInto(out *ClusterSpec) {
 			(*out)[key] = *val.DeepCopy()
 		}
 	}
+	out.Reweight = in.Reweight
+	if in.ScrubSchedule != nil {
+		in, out := &in.ScrubSchedule, &out.ScrubSchedule
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(ScrubScheduleSpec)
+			(*in).DeepCopyInto(*out)
+		}
+	}
 	return
 }
 
@@ -125,6 +135,32 @@ func (in *ClusterSpec) DeepCopy() *ClusterSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClusterStatus) DeepCopyInto(out *ClusterStatus) {
 	*out = *in
+	if in.ScrubPermitted != nil {
+		in, out := &in.ScrubPermitted, &out.ScrubPermitted
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(bool)
+			**out = **in
+		}
+	}
+	if in.RejectedDevices != nil {
+		in, out := &in.RejectedDevices, &out.RejectedDevices
+		*out = make([]RejectedDevice, len(*in))
+		copy(*out, *in)
+	}
+	if in.OSDNodes != nil {
+		in, out := &in.OSDNodes, &out.OSDNodes
+		*out = make([]OSDNodeStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.WeightRamps != nil {
+		in, out := &in.WeightRamps, &out.WeightRamps
+		*out = make([]OSDWeightRampStatus, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -257,6 +293,22 @@ func (in *GatewaySpec) DeepCopy() *GatewaySpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HourRange) DeepCopyInto(out *HourRange) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HourRange.
+func (in *HourRange) DeepCopy() *HourRange {
+	if in == nil {
+		return nil
+	}
+	out := new(HourRange)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *MetadataServerSpec) DeepCopyInto(out *MetadataServerSpec) {
 	*out = *in
@@ -275,6 +327,43 @@ func (in *MetadataServerSpec) DeepCopy() *MetadataServerSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OSDNodeStatus) DeepCopyInto(out *OSDNodeStatus) {
+	*out = *in
+	if in.OSDs != nil {
+		in, out := &in.OSDs, &out.OSDs
+		*out = make([]int, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OSDNodeStatus.
+func (in *OSDNodeStatus) DeepCopy() *OSDNodeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(OSDNodeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OSDWeightRampStatus) DeepCopyInto(out *OSDWeightRampStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OSDWeightRampStatus.
+func (in *OSDWeightRampStatus) DeepCopy() *OSDWeightRampStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(OSDWeightRampStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ObjectStore) DeepCopyInto(out *ObjectStore) {
 	*out = *in
@@ -436,6 +525,22 @@ func (in *PoolSpec) DeepCopy() *PoolSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RejectedDevice) DeepCopyInto(out *RejectedDevice) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RejectedDevice.
+func (in *RejectedDevice) DeepCopy() *RejectedDevice {
+	if in == nil {
+		return nil
+	}
+	out := new(RejectedDevice)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ReplicatedSpec) DeepCopyInto(out *ReplicatedSpec) {
 	*out = *in
@@ -451,3 +556,45 @@ func (in *ReplicatedSpec) DeepCopy() *ReplicatedSpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReweightSpec) DeepCopyInto(out *ReweightSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReweightSpec.
+func (in *ReweightSpec) DeepCopy() *ReweightSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ReweightSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScrubScheduleSpec) DeepCopyInto(out *ScrubScheduleSpec) {
+	*out = *in
+	if in.Days != nil {
+		in, out := &in.Days, &out.Days
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Hours != nil {
+		in, out := &in.Hours, &out.Hours
+		*out = make([]HourRange, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScrubScheduleSpec.
+func (in *ScrubScheduleSpec) DeepCopy() *ScrubScheduleSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ScrubScheduleSpec)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -83,6 +83,10 @@ func (s *StorageScopeSpec) resolveNodeSelection(node *Node) {
 
 	resolveString(&(node.Selection.DeviceFilter), s.Selection.DeviceFilter, "")
 
+	if node.Selection.DeviceSelector == nil {
+		node.Selection.DeviceSelector = s.Selection.DeviceSelector
+	}
+
 	if len(node.Selection.Devices) == 0 {
 		node.Selection.Devices = s.Devices
 	}
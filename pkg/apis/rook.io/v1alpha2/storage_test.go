@@ -50,9 +50,10 @@ func TestResolveNodeInherentFromCluster(t *testing.T) {
 	storageSpec := StorageScopeSpec{
 		Location: "root=default,row=a,rack=a2,chassis=a2a,host=a2a1",
 		Selection: Selection{
-			DeviceFilter: "^sd.",
-			Directories:  []Directory{{Path: "/rook/datadir1"}},
-			Devices:      []Device{{Name: "sda"}},
+			DeviceFilter:   "^sd.",
+			DeviceSelector: &DeviceSelector{Rotational: newBool(false)},
+			Directories:    []Directory{{Path: "/rook/datadir1"}},
+			Devices:        []Device{{Name: "sda"}},
 		},
 		Config: map[string]string{
 			"foo": "bar",
@@ -65,6 +66,7 @@ func TestResolveNodeInherentFromCluster(t *testing.T) {
 	node := storageSpec.ResolveNode("node1")
 	assert.NotNil(t, node)
 	assert.Equal(t, "^sd.", node.Selection.DeviceFilter)
+	assert.False(t, *node.Selection.DeviceSelector.Rotational)
 	assert.False(t, node.Selection.GetUseAllDevices())
 	assert.Equal(t, "root=default,row=a,rack=a2,chassis=a2a,host=a2a1", node.Location)
 	assert.Equal(t, "bar", node.Config["foo"])
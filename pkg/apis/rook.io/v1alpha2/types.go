@@ -17,6 +17,7 @@ package v1alpha2
 
 import (
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -36,6 +37,7 @@ type StorageScopeSpec struct {
 	Location        string            `json:"location,omitempty"`
 	Config          map[string]string `json:"config"`
 	Selection
+	StorageClassDeviceSets []StorageClassDeviceSet `json:"storageClassDeviceSets,omitempty"`
 }
 
 type Node struct {
@@ -47,8 +49,10 @@ type Node struct {
 }
 
 type Device struct {
-	Name     string            `json:"name,omitempty"`
-	FullPath string            // TODO: FullPath to be supported for devices
+	Name string `json:"name,omitempty"`
+	// A persistent path of the device such as /dev/disk/by-id/... or /dev/disk/by-path/..., which is resolved to the
+	// current name of the device on the node
+	FullPath string            `json:"fullPath,omitempty"`
 	Config   map[string]string `json:"config"`
 }
 
@@ -64,11 +68,56 @@ type Selection struct {
 	// A regular expression to allow more fine-grained selection of devices on nodes across the cluster
 	DeviceFilter string `json:"deviceFilter,omitempty"`
 
+	// Selects the devices on nodes by their attributes, such as their size or whether they are rotational
+	DeviceSelector *DeviceSelector `json:"deviceSelector,omitempty"`
+
 	Devices []Device `json:"devices,omitempty"`
 
 	Directories []Directory `json:"directories,omitempty"`
 }
 
+// DeviceSelector selects devices by the attributes discovered on the nodes. A device is selected if it matches all
+// the attributes that are specified.
+type DeviceSelector struct {
+	// Minimum size of the devices
+	MinSize *resource.Quantity `json:"minSize,omitempty"`
+
+	// Maximum size of the devices
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+
+	// Whether the devices are rotational (hdd) or not (ssd and nvme)
+	Rotational *bool `json:"rotational,omitempty"`
+
+	// Regular expressions matched against the vendor, model, world wide name and serial number of the devices
+	Vendor string `json:"vendor,omitempty"`
+	Model  string `json:"model,omitempty"`
+	WWN    string `json:"wwn,omitempty"`
+	Serial string `json:"serial,omitempty"`
+
+	// A regular expression matched against the paths of the devices, such as /dev/sda or /dev/disk/by-path/...
+	DevicePath string `json:"devicePath,omitempty"`
+}
+
+// StorageClassDeviceSet is a set of OSDs that are backed by volumes claimed from a storage class rather than by
+// the devices and directories of specific nodes
+type StorageClassDeviceSet struct {
+	// Name of the set, used to name the claims and the OSD pods of the set
+	Name string `json:"name,omitempty"`
+
+	// Number of claims (and therefore OSDs) in the set
+	Count int `json:"count,omitempty"`
+
+	// Storage class to claim the volumes from
+	StorageClassName string `json:"storageClassName,omitempty"`
+
+	// Requested size of each volume
+	Size resource.Quantity `json:"size,omitempty"`
+
+	Placement Placement               `json:"placement,omitempty"`
+	Resources v1.ResourceRequirements `json:"resources,omitempty"`
+	Config    map[string]string       `json:"config"`
+}
+
 type PlacementSpec map[string]Placement
 
 type Placement struct {
@@ -22,6 +22,7 @@ package v1alpha2
 
 import (
 	v1 "k8s.io/api/core/v1"
+	resource "k8s.io/apimachinery/pkg/api/resource"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -64,6 +65,49 @@ func (in *Device) DeepCopy() *Device {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceSelector) DeepCopyInto(out *DeviceSelector) {
+	*out = *in
+	if in.MinSize != nil {
+		in, out := &in.MinSize, &out.MinSize
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(resource.Quantity)
+			**out = (*in).DeepCopy()
+		}
+	}
+	if in.MaxSize != nil {
+		in, out := &in.MaxSize, &out.MaxSize
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(resource.Quantity)
+			**out = (*in).DeepCopy()
+		}
+	}
+	if in.Rotational != nil {
+		in, out := &in.Rotational, &out.Rotational
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(bool)
+			**out = **in
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceSelector.
+func (in *DeviceSelector) DeepCopy() *DeviceSelector {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceSelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Directory) DeepCopyInto(out *Directory) {
 	*out = *in
@@ -212,6 +256,15 @@ func (in *Selection) DeepCopyInto(out *Selection) {
 			**out = **in
 		}
 	}
+	if in.DeviceSelector != nil {
+		in, out := &in.DeviceSelector, &out.DeviceSelector
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(DeviceSelector)
+			(*in).DeepCopyInto(*out)
+		}
+	}
 	if in.Devices != nil {
 		in, out := &in.Devices, &out.Devices
 		*out = make([]Device, len(*in))
@@ -239,6 +292,32 @@ func (in *Selection) DeepCopy() *Selection {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageClassDeviceSet) DeepCopyInto(out *StorageClassDeviceSet) {
+	*out = *in
+	out.Size = in.Size.DeepCopy()
+	in.Placement.DeepCopyInto(&out.Placement)
+	in.Resources.DeepCopyInto(&out.Resources)
+	if in.Config != nil {
+		in, out := &in.Config, &out.Config
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageClassDeviceSet.
+func (in *StorageClassDeviceSet) DeepCopy() *StorageClassDeviceSet {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageClassDeviceSet)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *StorageScopeSpec) DeepCopyInto(out *StorageScopeSpec) {
 	*out = *in
@@ -258,6 +337,13 @@ func (in *StorageScopeSpec) DeepCopyInto(out *StorageScopeSpec) {
 		}
 	}
 	in.Selection.DeepCopyInto(&out.Selection)
+	if in.StorageClassDeviceSets != nil {
+		in, out := &in.StorageClassDeviceSets, &out.StorageClassDeviceSets
+		*out = make([]StorageClassDeviceSet, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -16,8 +16,10 @@ limitations under the License.
 package clusterd
 
 import (
+	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/coreos/pkg/capnslog"
 
@@ -35,15 +37,45 @@ func GetAvailableDevices(devices []*sys.LocalDisk) []string {
 	var available []string
 	for _, device := range devices {
 		logger.Debugf("Evaluating device %+v", device)
-		if getDeviceEmpty(device) {
+		if ok, reason := GetDeviceAvailability(device); ok {
 			logger.Debugf("Available device: %s", device.Name)
 			available = append(available, device.Name)
+		} else {
+			logger.Debugf("Unavailable device %s: %s", device.Name, reason)
 		}
 	}
 
 	return available
 }
 
+// GetDeviceAvailability returns whether the device can be used by an OSD, or else the reason it cannot be used. The
+// partitions, logical volumes and filesystem of the device must have been discovered. The partitions created by rook
+// and the logical volumes created by ceph-volume for the OSDs on the device do not make the device unavailable.
+func GetDeviceAvailability(device *sys.LocalDisk) (bool, string) {
+	if device.Parent != "" {
+		return false, fmt.Sprintf("child device of %s", device.Parent)
+	}
+	if device.Type != sys.DiskType && device.Type != sys.SSDType && device.Type != sys.CryptType {
+		return false, fmt.Sprintf("unsupported device type %q", device.Type)
+	}
+	if device.Readonly {
+		return false, "read-only device"
+	}
+	if device.Filesystem != "" && !(device.Filesystem == sys.LVMPhysicalVolumeFS && sys.CephVolumeOwnsVolumes(device.LogicalVolumes)) {
+		return false, fmt.Sprintf("has a filesystem: %s", device.Filesystem)
+	}
+	var foreign []string
+	for _, p := range device.Partitions {
+		if !sys.RookOwnsPartitions([]sys.Partition{p}) {
+			foreign = append(foreign, p.Name)
+		}
+	}
+	if len(foreign) > 0 {
+		return false, fmt.Sprintf("has partitions not created by rook: %s", strings.Join(foreign, ", "))
+	}
+	return true, ""
+}
+
 // check whether a device is completely empty
 func getDeviceEmpty(device *sys.LocalDisk) bool {
 	return device.Parent == "" && (device.Type == sys.DiskType || device.Type == sys.SSDType || device.Type == sys.CryptType) && device.Filesystem == ""
@@ -63,98 +95,106 @@ func DiscoverDevices(executor exec.Executor) ([]*sys.LocalDisk, error) {
 	}
 
 	for _, d := range devices {
-
-		if ignoreDevice(d) {
-			// skip device
-			continue
-		}
-
-		diskProps, err := sys.GetDeviceProperties(d, executor)
+		disk, err := PopulateDeviceInfo(d, executor)
 		if err != nil {
 			logger.Warningf("skipping device %s: %+v", d, err)
 			continue
 		}
-
-		diskType, ok := diskProps["TYPE"]
-		if !ok || (diskType != sys.SSDType && diskType != sys.CryptType && diskType != sys.DiskType && diskType != sys.PartType) {
-			// unsupported disk type, just continue
-			continue
+		if disk != nil {
+			disks = append(disks, disk)
 		}
+	}
 
-		// get the UUID for disks
-		var diskUUID string
-		if diskType != sys.PartType {
-			diskUUID, err = sys.GetFSUUID(d, executor)
-			if err != nil {
-				logger.Warningf("skipping device %s with an unknown uuid. %+v", d, err)
-				continue
-			}
-		}
+	return disks, nil
+}
 
-		udevInfo, err := sys.GetUdevInfo(d, executor)
-		if err != nil {
-			logger.Warningf("failed to get udev info for device %s: %+v", d, err)
-			continue
-		}
+// PopulateDeviceInfo returns the details of a device on the local node, or nil if the device is not supported
+func PopulateDeviceInfo(d string, executor exec.Executor) (*sys.LocalDisk, error) {
+	if ignoreDevice(d) {
+		// skip device
+		return nil, nil
+	}
 
-		disk := &sys.LocalDisk{Name: d, UUID: diskUUID}
+	diskProps, err := sys.GetDeviceProperties(d, executor)
+	if err != nil {
+		return nil, err
+	}
 
-		if val, ok := diskProps["TYPE"]; ok {
-			disk.Type = val
-		}
-		if val, ok := diskProps["SIZE"]; ok {
-			if size, err := strconv.ParseUint(val, 10, 64); err == nil {
-				disk.Size = size
-			}
-		}
-		if val, ok := diskProps["ROTA"]; ok {
-			if rotates, err := strconv.ParseBool(val); err == nil {
-				disk.Rotational = rotates
-			}
-		}
-		if val, ok := diskProps["RO"]; ok {
-			if ro, err := strconv.ParseBool(val); err == nil {
-				disk.Readonly = ro
-			}
-		}
-		if val, ok := diskProps["PKNAME"]; ok {
-			disk.Parent = val
+	diskType, ok := diskProps["TYPE"]
+	if !ok || (diskType != sys.SSDType && diskType != sys.CryptType && diskType != sys.DiskType && diskType != sys.PartType) {
+		// unsupported disk type
+		return nil, nil
+	}
+
+	// get the UUID for disks
+	var diskUUID string
+	if diskType != sys.PartType {
+		diskUUID, err = sys.GetFSUUID(d, executor)
+		if err != nil {
+			return nil, fmt.Errorf("unknown uuid. %+v", err)
 		}
+	}
+
+	udevInfo, err := sys.GetUdevInfo(d, executor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get udev info. %+v", err)
+	}
 
-		disk.Empty = getDeviceEmpty(disk)
+	disk := &sys.LocalDisk{Name: d, UUID: diskUUID}
 
-		// parse udev info output
-		if val, ok := udevInfo["DEVLINKS"]; ok {
-			disk.DevLinks = val
-		}
-		if val, ok := udevInfo["ID_FS_UUID"]; ok {
-			disk.UUID = val
+	if val, ok := diskProps["TYPE"]; ok {
+		disk.Type = val
+	}
+	if val, ok := diskProps["SIZE"]; ok {
+		if size, err := strconv.ParseUint(val, 10, 64); err == nil {
+			disk.Size = size
 		}
-		if val, ok := udevInfo["ID_FS_TYPE"]; ok {
-			disk.Filesystem = val
+	}
+	if val, ok := diskProps["ROTA"]; ok {
+		if rotates, err := strconv.ParseBool(val); err == nil {
+			disk.Rotational = rotates
 		}
-		if val, ok := udevInfo["ID_SERIAL"]; ok {
-			disk.Serial = val
+	}
+	if val, ok := diskProps["RO"]; ok {
+		if ro, err := strconv.ParseBool(val); err == nil {
+			disk.Readonly = ro
 		}
+	}
+	if val, ok := diskProps["PKNAME"]; ok {
+		disk.Parent = val
+	}
 
-		if val, ok := udevInfo["ID_VENDOR"]; ok {
-			disk.Vendor = val
-		}
+	disk.Empty = getDeviceEmpty(disk)
 
-		if val, ok := udevInfo["ID_MODEL"]; ok {
-			disk.Model = val
-		}
+	// parse udev info output
+	if val, ok := udevInfo["DEVLINKS"]; ok {
+		disk.DevLinks = val
+	}
+	if val, ok := udevInfo["ID_FS_UUID"]; ok {
+		disk.UUID = val
+	}
+	if val, ok := udevInfo["ID_FS_TYPE"]; ok {
+		disk.Filesystem = val
+	}
+	if val, ok := udevInfo["ID_SERIAL"]; ok {
+		disk.Serial = val
+	}
 
-		if val, ok := udevInfo["ID_WWN_WITH_EXTENSION"]; ok {
-			disk.WWNVendorExtension = val
-		}
+	if val, ok := udevInfo["ID_VENDOR"]; ok {
+		disk.Vendor = val
+	}
 
-		if val, ok := udevInfo["ID_WWN"]; ok {
-			disk.WWN = val
-		}
+	if val, ok := udevInfo["ID_MODEL"]; ok {
+		disk.Model = val
+	}
 
-		disks = append(disks, disk)
+	if val, ok := udevInfo["ID_WWN_WITH_EXTENSION"]; ok {
+		disk.WWNVendorExtension = val
 	}
 
-	return disks, nil
+	if val, ok := udevInfo["ID_WWN"]; ok {
+		disk.WWN = val
+	}
+
+	return disk, nil
 }
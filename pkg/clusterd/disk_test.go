@@ -58,6 +58,49 @@ func TestAvailableDisks(t *testing.T) {
 
 }
 
+func TestDeviceAvailability(t *testing.T) {
+	disk := &sys.LocalDisk{Name: "sda", Type: sys.DiskType}
+	available, reason := GetDeviceAvailability(disk)
+	assert.True(t, available)
+	assert.Equal(t, "", reason)
+
+	// the partitions of the rook osds do not make the device unavailable
+	disk.Partitions = []sys.Partition{{Name: "sda1", Label: "ROOK-OSD0-WAL"}, {Name: "sda2", Label: "ROOK-OSD0-DB"}}
+	available, reason = GetDeviceAvailability(disk)
+	assert.True(t, available)
+
+	disk.Partitions = append(disk.Partitions, sys.Partition{Name: "sda3", Label: "primary"}, sys.Partition{Name: "sda4"})
+	available, reason = GetDeviceAvailability(disk)
+	assert.False(t, available)
+	assert.Equal(t, "has partitions not created by rook: sda3, sda4", reason)
+
+	available, reason = GetDeviceAvailability(&sys.LocalDisk{Name: "sdb", Type: sys.SSDType, Filesystem: "xfs"})
+	assert.False(t, available)
+	assert.Equal(t, "has a filesystem: xfs", reason)
+
+	// the logical volumes of a ceph-volume osd do not make the device unavailable, other volume groups do
+	disk = &sys.LocalDisk{Name: "sdd", Type: sys.DiskType, Filesystem: "LVM2_member",
+		LogicalVolumes: []string{"ceph--4f2b1c6e--8a4d--4c1e--9b7a--2d5e3f6a7b8c-osd--block--0e1f2a3b--4c5d--6e7f--8091--a2b3c4d5e6f7"}}
+	available, reason = GetDeviceAvailability(disk)
+	assert.True(t, available)
+	disk.LogicalVolumes = append(disk.LogicalVolumes, "centos-root")
+	available, reason = GetDeviceAvailability(disk)
+	assert.False(t, available)
+	assert.Equal(t, "has a filesystem: LVM2_member", reason)
+
+	available, reason = GetDeviceAvailability(&sys.LocalDisk{Name: "sr0", Type: sys.DiskType, Readonly: true})
+	assert.False(t, available)
+	assert.Equal(t, "read-only device", reason)
+
+	available, reason = GetDeviceAvailability(&sys.LocalDisk{Name: "sdc1", Type: sys.PartType, Parent: "sdc"})
+	assert.False(t, available)
+	assert.Equal(t, "child device of sdc", reason)
+
+	available, reason = GetDeviceAvailability(&sys.LocalDisk{Name: "loop0", Type: "loop"})
+	assert.False(t, available)
+	assert.Equal(t, `unsupported device type "loop"`, reason)
+}
+
 func TestDiscoverDevices(t *testing.T) {
 	executor := &exectest.MockExecutor{
 		MockExecuteCommand: func(debug bool, actionName string, command string, arg ...string) error {
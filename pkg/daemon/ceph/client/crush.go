@@ -162,7 +162,7 @@ func SetCrushTunables(context *clusterd.Context, clusterName, profile string) (s
 }
 
 func CrushReweight(context *clusterd.Context, clusterName string, id int, weight float64) (string, error) {
-	args := []string{"osd", "crush", "reweight", fmt.Sprintf("osd.%d", id), fmt.Sprintf("%.1f", weight)}
+	args := []string{"osd", "crush", "reweight", fmt.Sprintf("osd.%d", id), fmt.Sprintf("%.4f", weight)}
 	buf, err := ExecuteCephCommand(context, clusterName, args)
 	if err != nil {
 		return "", fmt.Errorf("failed to crush reweight: %+v, %s", err, string(buf))
@@ -171,6 +171,24 @@ func CrushReweight(context *clusterd.Context, clusterName string, id int, weight
 	return string(buf), nil
 }
 
+// sets the device class of the given OSD, replacing the class that was set before
+func SetDeviceClass(context *clusterd.Context, clusterName string, osdID int, deviceClass string) error {
+	osdEntity := fmt.Sprintf("osd.%d", osdID)
+
+	// an existing device class needs to be removed before a new one can be set
+	args := []string{"osd", "crush", "rm-device-class", osdEntity}
+	if buf, err := ExecuteCephCommand(context, clusterName, args); err != nil {
+		return fmt.Errorf("failed to remove device class of %s: %+v, %s", osdEntity, err, string(buf))
+	}
+
+	args = []string{"osd", "crush", "set-device-class", deviceClass, osdEntity}
+	if buf, err := ExecuteCephCommand(context, clusterName, args); err != nil {
+		return fmt.Errorf("failed to set device class %s on %s: %+v, %s", deviceClass, osdEntity, err, string(buf))
+	}
+
+	return nil
+}
+
 func CrushRemove(context *clusterd.Context, clusterName, name string) (string, error) {
 	args := []string{"osd", "crush", "rm", name}
 	buf, err := ExecuteCephCommand(context, clusterName, args)
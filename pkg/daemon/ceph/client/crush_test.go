@@ -273,3 +273,23 @@ func TestCrushLocation(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "is not in a valid format")
 }
+
+func TestSetDeviceClass(t *testing.T) {
+	var commands [][]string
+	executor := &exectest.MockExecutor{}
+	executor.MockExecuteCommandWithOutputFile = func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+		logger.Infof("Command: %s %v", command, args)
+		if args[0] == "osd" && args[1] == "crush" {
+			commands = append(commands, args[2:5])
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected ceph command '%v'", args)
+	}
+
+	// the class is removed before the new class is set
+	err := SetDeviceClass(&clusterd.Context{Executor: executor}, "rook", 3, "nvme")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(commands))
+	assert.Equal(t, []string{"rm-device-class", "osd.3"}, commands[0][:2])
+	assert.Equal(t, []string{"set-device-class", "nvme", "osd.3"}, commands[1])
+}
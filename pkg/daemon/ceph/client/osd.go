@@ -59,9 +59,10 @@ type OSDPerfStats struct {
 
 type OSDDump struct {
 	OSDs []struct {
-		OSD json.Number `json:"osd"`
-		Up  json.Number `json:"up"`
-		In  json.Number `json:"in"`
+		OSD   json.Number `json:"osd"`
+		Up    json.Number `json:"up"`
+		In    json.Number `json:"in"`
+		State []string    `json:"state"`
 	} `json:"osds"`
 }
 
@@ -91,6 +92,22 @@ func (dump *OSDDump) StatusByID(id int64) (int64, int64, error) {
 	return 0, 0, fmt.Errorf("not found osd.%d in OSDDump", id)
 }
 
+// IsDestroyed returns whether the given OSD was destroyed, in which case its ID and CRUSH position are kept for a new OSD
+func (dump *OSDDump) IsDestroyed(id int) bool {
+	for _, d := range dump.OSDs {
+		if i, err := d.OSD.Int64(); err != nil || int(i) != id {
+			continue
+		}
+		for _, state := range d.State {
+			if state == "destroyed" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func GetOSDUsage(context *clusterd.Context, clusterName string) (*OSDUsage, error) {
 	args := []string{"osd", "df"}
 	buf, err := ExecuteCephCommand(context, clusterName, args)
@@ -142,6 +159,30 @@ func OSDOut(context *clusterd.Context, clusterName string, osdID int) (string, e
 	return string(buf), err
 }
 
+func OSDIn(context *clusterd.Context, clusterName string, osdID int) (string, error) {
+	args := []string{"osd", "in", strconv.Itoa(osdID)}
+	buf, err := ExecuteCephCommand(context, clusterName, args)
+	return string(buf), err
+}
+
+// OSDReweight sets the override reweight of an OSD, the fraction of its CRUSH weight between 0 and 1 that it is given
+func OSDReweight(context *clusterd.Context, clusterName string, osdID int, reweight float64) (string, error) {
+	args := []string{"osd", "reweight", strconv.Itoa(osdID), fmt.Sprintf("%.4f", reweight)}
+	buf, err := ExecuteCephCommand(context, clusterName, args)
+	if err != nil {
+		return "", fmt.Errorf("failed to reweight osd.%d: %+v, %s", osdID, err, string(buf))
+	}
+	return string(buf), nil
+}
+
+// OSDDestroy removes the keys of the given OSD and marks it destroyed, its ID and CRUSH position are kept so that a new OSD
+// can replace it
+func OSDDestroy(context *clusterd.Context, clusterName string, osdID int) (string, error) {
+	args := []string{"osd", "destroy", strconv.Itoa(osdID), confirmFlag}
+	buf, err := ExecuteCephCommand(context, clusterName, args)
+	return string(buf), err
+}
+
 func OSDRemove(context *clusterd.Context, clusterName string, osdID int) (string, error) {
 	args := []string{"osd", "rm", strconv.Itoa(osdID)}
 	buf, err := ExecuteCephCommand(context, clusterName, args)
@@ -180,6 +221,17 @@ func EnableScrubbing(context *clusterd.Context, clusterName string) (string, err
 	return string(buf), nil
 }
 
+// SetScrubHours sets the hours of the day in which the running OSDs start scrubs, in the local time of the OSDs
+func SetScrubHours(context *clusterd.Context, clusterName string, beginHour, endHour int) (string, error) {
+	args := []string{"tell", "osd.*", "injectargs",
+		fmt.Sprintf("--osd_scrub_begin_hour=%d --osd_scrub_end_hour=%d", beginHour, endHour)}
+	buf, err := ExecuteCephCommandPlain(context, clusterName, args)
+	if err != nil {
+		return string(buf), fmt.Errorf("failed to set the scrub hours: %+v", err)
+	}
+	return string(buf), nil
+}
+
 func (usage *OSDUsage) ByID(osdID int) *OSDNodeUsage {
 	for i := range usage.OSDNodes {
 		if usage.OSDNodes[i].ID == osdID {
@@ -42,6 +42,7 @@ type CephStoragePoolDetails struct {
 	ErasureCodeProfile string `json:"erasure_code_profile"`
 	FailureDomain      string `json:"failureDomain"`
 	CrushRoot          string `json:"crushRoot"`
+	DeviceClass        string `json:"deviceClass"`
 }
 
 type CephStoragePoolStats struct {
@@ -128,7 +129,7 @@ func CreatePoolWithProfile(context *clusterd.Context, clusterName string, newPoo
 	if newPoolReq.Type == model.ErasureCoded {
 		// create a new erasure code profile for the new pool
 		if err := CreateErasureCodeProfile(context, clusterName, newPoolReq.ErasureCodedConfig, newPool.ErasureCodeProfile,
-			newPoolReq.FailureDomain, newPoolReq.CrushRoot); err != nil {
+			newPoolReq.FailureDomain, newPoolReq.CrushRoot, newPoolReq.DeviceClass); err != nil {
 
 			return fmt.Errorf("failed to create erasure code profile for pool '%s': %+v", newPoolReq.Name, err)
 		}
@@ -246,6 +247,10 @@ func createReplicationCrushRule(context *clusterd.Context, clusterName string, n
 	}
 
 	args := []string{"osd", "crush", "rule", "create-simple", ruleName, crushRoot, failureDomain}
+	if newPool.DeviceClass != "" {
+		// only the OSDs with the device class are chosen by the rule
+		args = []string{"osd", "crush", "rule", "create-replicated", ruleName, crushRoot, failureDomain, newPool.DeviceClass}
+	}
 	_, err := ExecuteCephCommand(context, clusterName, args)
 	if err != nil {
 		return fmt.Errorf("failed to create crush rule %s. %+v", ruleName, err)
@@ -351,6 +356,7 @@ func cephPoolToModelPool(cephPool CephStoragePoolDetails, ecpDetails map[string]
 		pool.ErasureCodedConfig.DataChunkCount = ecpDetails.DataChunkCount
 		pool.ErasureCodedConfig.CodingChunkCount = ecpDetails.CodingChunkCount
 		pool.ErasureCodedConfig.Algorithm = fmt.Sprintf("%s::%s", ecpDetails.Plugin, ecpDetails.Technique)
+		pool.DeviceClass = ecpDetails.DeviceClass
 	} else if cephPool.Size > 0 {
 		pool.Type = model.Replicated
 		pool.ReplicatedConfig.Size = cephPool.Size
@@ -142,3 +142,26 @@ func testCreateReplicaPool(t *testing.T, failureDomain, crushRoot string) {
 	assert.Nil(t, err)
 	assert.True(t, crushRuleCreated)
 }
+
+func TestCreateReplicaPoolWithDeviceClass(t *testing.T) {
+	crushRuleCreated := false
+	executor := &exectest.MockExecutor{}
+	context := &clusterd.Context{Executor: executor}
+	executor.MockExecuteCommandWithOutputFile = func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+		logger.Infof("Command: %s %v", command, args)
+		if args[1] == "pool" {
+			return "", nil
+		}
+		if args[1] == "crush" {
+			crushRuleCreated = true
+			assert.Equal(t, []string{"rule", "create-replicated", "mypool", "default", "host", "ssd"}, args[2:8])
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected ceph command '%v'", args)
+	}
+
+	p := CephStoragePoolDetails{Name: "mypool", Size: 3, DeviceClass: "ssd"}
+	err := CreateReplicatedPoolForApp(context, "myns", p, "myapp")
+	assert.Nil(t, err)
+	assert.True(t, crushRuleCreated)
+}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -30,10 +31,12 @@ import (
 	"github.com/rook/rook/pkg/clusterd"
 	"github.com/rook/rook/pkg/daemon/ceph/client"
 	"github.com/rook/rook/pkg/daemon/ceph/mon"
+	oposd "github.com/rook/rook/pkg/operator/ceph/cluster/osd"
 	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
 	"github.com/rook/rook/pkg/operator/k8sutil"
 	"github.com/rook/rook/pkg/util"
 	"github.com/rook/rook/pkg/util/proc"
+	"github.com/rook/rook/pkg/util/sys"
 )
 
 const (
@@ -41,6 +44,9 @@ const (
 	deviceKey       = "device"
 	dirKey          = "dir"
 	unassignedOSDID = -1
+
+	// the smallest journal an OSD will get when sharing the space of a metadata device
+	minJournalSizeMB = 1024
 )
 
 type OsdAgent struct {
@@ -51,22 +57,43 @@ type OsdAgent struct {
 	osdProc           map[int]*proc.MonitoredProc
 	devices           string
 	usingDeviceFilter bool
+	deviceConfig      map[string]map[string]string
+	devicePaths       map[string]string
 	metadataDevice    string
 	directories       string
 	procMan           *proc.ProcManager
 	storeConfig       config.StoreConfig
+	replaceOSDs       []int
 	kv                *k8sutil.ConfigMapKVStore
 	configCounter     int32
 	osdsCompleted     chan struct{}
+	// the OSDs are only prepared and reported to the operator, which runs each of them in its own pod
+	prepareOnly  bool
+	preparedOSDs map[int]oposd.OSDInfo
+	// the OSD is the only process of the pod and is run in the foreground
+	foreground bool
+	// the memory limit (bytes) of the pod, which is divided between the OSDs of the pod
+	memoryLimit int64
+	osdCount    int
+	// the IDs of the OSDs configured on the node, which are reported in the orchestration status
+	configuredOSDs map[int]bool
+	// the devices declared for the node in the storage spec, which decide the OSDs that are removed
+	deviceSelection *oposd.DeviceSelection
+	// the orchestration was only triggered by new devices, none of the OSDs are removed or converted
+	keepOSDs bool
 }
 
-func NewAgent(context *clusterd.Context, devices string, usingDeviceFilter bool, metadataDevice, directories string, forceFormat bool,
-	location string, storeConfig config.StoreConfig, cluster *mon.ClusterInfo, nodeName string, kv *k8sutil.ConfigMapKVStore) *OsdAgent {
-
-	return &OsdAgent{devices: devices, usingDeviceFilter: usingDeviceFilter, metadataDevice: metadataDevice,
-		directories: directories, forceFormat: forceFormat, location: location, storeConfig: storeConfig,
-		cluster: cluster, nodeName: nodeName, kv: kv,
-		procMan: proc.New(context.Executor), osdProc: make(map[int]*proc.MonitoredProc),
+func NewAgent(context *clusterd.Context, devices string, usingDeviceFilter bool, deviceSelection *oposd.DeviceSelection,
+	deviceConfig map[string]map[string]string, metadataDevice, directories string, forceFormat bool, location string,
+	storeConfig config.StoreConfig, replaceOSDs []int, memoryLimit int64, cluster *mon.ClusterInfo, nodeName string,
+	kv *k8sutil.ConfigMapKVStore) *OsdAgent {
+
+	return &OsdAgent{devices: devices, usingDeviceFilter: usingDeviceFilter, deviceSelection: deviceSelection,
+		deviceConfig: deviceConfig, metadataDevice: metadataDevice,
+		directories: directories, forceFormat: forceFormat, location: location, storeConfig: storeConfig, replaceOSDs: replaceOSDs,
+		memoryLimit: memoryLimit, cluster: cluster, nodeName: nodeName, kv: kv,
+		procMan: proc.New(context.Executor), osdProc: make(map[int]*proc.MonitoredProc), preparedOSDs: make(map[int]oposd.OSDInfo),
+		configuredOSDs: make(map[int]bool),
 	}
 }
 
@@ -146,10 +173,10 @@ func (a *OsdAgent) configureDevices(context *clusterd.Context, devices *DeviceOs
 		return fmt.Errorf("failed to get OSD partition scheme: %+v", err)
 	}
 
-	if scheme.Metadata != nil {
+	for _, metadata := range scheme.MetadataDevices {
 		// partition the dedicated metadata device
-		if err := partitionMetadata(context, scheme.Metadata, a.kv, config.GetConfigStoreName(a.nodeName)); err != nil {
-			return fmt.Errorf("failed to partition metadata %+v: %+v", scheme.Metadata, err)
+		if err := partitionMetadata(context, metadata, a.kv, config.GetConfigStoreName(a.nodeName)); err != nil {
+			return fmt.Errorf("failed to partition metadata %+v: %+v", metadata, err)
 		}
 	}
 
@@ -164,6 +191,13 @@ func (a *OsdAgent) configureDevices(context *clusterd.Context, devices *DeviceOs
 		} else {
 			succeeded++
 		}
+
+		if isReplacedOSD(scheme, entry.ID) {
+			// the destroyed osd was marked out by the operator, it takes its place in the cluster again on the new device
+			if o, err := client.OSDIn(context, a.cluster.Name, entry.ID); err != nil {
+				return fmt.Errorf("failed to mark replaced osd.%d in: %+v. %s", entry.ID, err, o)
+			}
+		}
 	}
 
 	logger.Infof("%d/%d osd devices succeeded on this node", succeeded, len(scheme.Entries))
@@ -189,7 +223,11 @@ func (a *OsdAgent) removeDevices(context *clusterd.Context, removedDevicesScheme
 			continue
 		}
 
-		// remove OSD from partition scheme map
+		// remove OSD from partition scheme map. its partitions on a metadata device stay reserved since the partitions
+		// of a metadata device are numbered by their position.
+		if metadata, ok := entry.Partitions[entry.GetMetadataPartitionType()]; ok && !entry.IsCollocated() {
+			logger.Warningf("the metadata partitions of osd.%d on %s stay reserved until the metadata device is wiped", entry.ID, metadata.Device)
+		}
 		if err := config.RemoveFromScheme(entry, a.kv, config.GetConfigStoreName(a.nodeName)); err != nil {
 			errMsg := fmt.Sprintf("failed to remove osd.%d from scheme. %+v", entry.ID, err)
 			logger.Error(errMsg)
@@ -223,42 +261,85 @@ func (a *OsdAgent) getPartitionPerfScheme(context *clusterd.Context, devices *De
 		}
 	}
 
-	numDataNeeded := 0
-	var metadataEntry *DeviceOsdIDEntry
-
-	// enumerate the device to OSD mapping to see if we have any new data devices to create and any
-	// metadata devices to store their metadata on
-	for name, mapping := range devices.Entries {
-		if isDeviceInUse(name, nameToUUID, perfScheme) {
+	// enumerate the device to OSD mapping in a predictable order to see if we have any new data devices to create and
+	// any metadata devices to store their metadata on
+	var names []string
+	for name := range devices.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var dataNeeded []string
+	var metadataNames []string
+	metadataDevices := map[string]*config.MetadataDeviceInfo{}
+	for _, name := range names {
+		mapping := devices.Entries[name]
+		if isDeviceDesiredForMetadata(mapping, perfScheme) {
+			// device is desired to store metadata for other OSDs, it may already be partitioned for existing OSDs
+			refreshDeviceInfo(name, nameToUUID, perfScheme)
+			metadata := perfScheme.GetMetadataDevice(nameToUUID[name])
+			if metadata == nil {
+				metadata = config.NewMetadataDeviceInfo(name)
+				perfScheme.MetadataDevices = append(perfScheme.MetadataDevices, metadata)
+			}
+			metadataDevices[name] = metadata
+			metadataNames = append(metadataNames, name)
+		} else if isDeviceInUse(name, nameToUUID, perfScheme) {
 			// device is already in use for either data or metadata, update the details for each of its partitions
 			// (i.e. device name could have changed)
 			refreshDeviceInfo(name, nameToUUID, perfScheme)
 		} else if isDeviceDesiredForData(mapping) {
 			// device needs data partitioning
-			numDataNeeded++
-		} else if isDeviceDesiredForMetadata(mapping, perfScheme) {
-			// device is desired to store metadata for other OSDs
-			if perfScheme.Metadata != nil {
-				// TODO: this perf scheme creation algorithm assumes either zero or one metadata device, enhance to allow multiple
-				// https://github.com/rook/rook/issues/341
-				return nil, fmt.Errorf("%s is desired for metadata, but %s (%s) is already the metadata device",
-					name, perfScheme.Metadata.Device, perfScheme.Metadata.DiskUUID)
-			}
-
-			metadataEntry = mapping
-			perfScheme.Metadata = config.NewMetadataDeviceInfo(name)
+			dataNeeded = append(dataNeeded, name)
 		}
 	}
 
-	if numDataNeeded > 0 {
-		// register each data device and compute its desired partition scheme
-		for name, mapping := range devices.Entries {
-			if !isDeviceDesiredForData(mapping) || isDeviceInUse(name, nameToUUID, perfScheme) {
-				continue
-			}
+	// assign the new data devices to the metadata devices that will store their metadata
+	assignments, err := a.assignMetadataDevices(dataNeeded, metadataNames, metadataDevices)
+	if err != nil {
+		return nil, err
+	}
+	storeConfigs, shares, err := a.getMetadataStoreConfigs(context, assignments, metadataDevices)
+	if err != nil {
+		return nil, err
+	}
 
-			// register/create the OSD with ceph, which will assign it a cluster wide ID
-			osdID, osdUUID, err := registerOSD(context, a.cluster.Name)
+	// register each data device and compute its desired partition scheme. the new devices replace the failed devices of
+	// the destroyed osds first.
+	replacedIDs := append([]int{}, perfScheme.ReplacedOSDs...)
+	for _, name := range dataNeeded {
+		mapping := devices.Entries[name]
+
+		// the device is split between its osds, which all get the disk uuid of the first osd
+		count := a.osdsPerDevice(name)
+		var sizeMB int
+		if count > 1 {
+			size, err := getDiskSize(context, name)
+			if err != nil || size == 0 {
+				return nil, fmt.Errorf("failed to get the size of device %s to split it between %d osds. %+v", name, count, err)
+			}
+			sizeMB = int(size / 1048576)
+		} else if _, ok := assignments[name]; ok && derivesMetadataSizes(a.storeConfig) {
+			// the metadata sizes are derived from the size of the device, the fixed sizes are used if it is unknown
+			size, err := getDiskSize(context, name)
+			if err != nil {
+				logger.Warningf("failed to get the size of device %s to derive its metadata sizes. %+v", name, err)
+			}
+			sizeMB = int(size / 1048576)
+		}
+		diskUUID := ""
+
+		for index := 0; index < count; index++ {
+			var osdID *int
+			var osdUUID *uuid.UUID
+			if len(replacedIDs) > 0 {
+				// recreate the destroyed OSD with its ID
+				osdID, osdUUID, err = replaceOSD(context, a.cluster.Name, replacedIDs[0])
+				replacedIDs = replacedIDs[1:]
+			} else {
+				// register/create the OSD with ceph, which will assign it a cluster wide ID
+				osdID, osdUUID, err = registerOSD(context, a.cluster.Name)
+			}
 			if err != nil {
 				return nil, fmt.Errorf("failed to register OSD for device %s: %+v", name, err)
 			}
@@ -266,14 +347,20 @@ func (a *OsdAgent) getPartitionPerfScheme(context *clusterd.Context, devices *De
 			schemeEntry := config.NewPerfSchemeEntry(a.storeConfig.StoreType)
 			schemeEntry.ID = *osdID
 			schemeEntry.OsdUUID = *osdUUID
+			schemeEntry.DeviceClass = a.getDeviceClass(context, name)
+			schemeEntry.Encrypted = a.storeConfig.EncryptedDevice
 
-			if metadataEntry != nil && perfScheme.Metadata != nil {
+			if metadataName, ok := assignments[name]; ok {
 				// we have a metadata device, so put the metadata partitions on it and the data partition on its own disk
+				metadataEntry := devices.Entries[metadataName]
 				metadataEntry.Metadata = append(metadataEntry.Metadata, *osdID)
-				mapping.Data = *osdID
+				if index == 0 {
+					mapping.Data = *osdID
+				}
 
 				// populate the perf partition scheme entry with distributed partition details
-				err := config.PopulateDistributedPerfSchemeEntry(schemeEntry, name, perfScheme.Metadata, a.storeConfig)
+				sizes := config.DeviceSizes{DataMB: sizeMB / count, MetadataShareMB: shares[metadataName]}
+				err := config.PopulateDistributedPerfSchemeEntry(schemeEntry, name, metadataDevices[metadataName], storeConfigs[metadataName], sizes)
 				if err != nil {
 					return nil, fmt.Errorf("failed to create distributed perf scheme entry for %s: %+v", name, err)
 				}
@@ -281,8 +368,12 @@ func (a *OsdAgent) getPartitionPerfScheme(context *clusterd.Context, devices *De
 				// there is no metadata device to use, store everything on the data device
 
 				// update the device OSD mapping, saying this device will store the current OSDs data and metadata
-				mapping.Data = *osdID
-				mapping.Metadata = []int{*osdID}
+				if index == 0 {
+					mapping.Data = *osdID
+					mapping.Metadata = []int{*osdID}
+				} else {
+					mapping.Metadata = append(mapping.Metadata, *osdID)
+				}
 
 				// populate the perf partition scheme entry with collocated partition details
 				err := config.PopulateCollocatedPerfSchemeEntry(schemeEntry, name, a.storeConfig)
@@ -291,6 +382,20 @@ func (a *OsdAgent) getPartitionPerfScheme(context *clusterd.Context, devices *De
 				}
 			}
 
+			if count > 1 {
+				if index == 0 {
+					diskUUID = schemeEntry.Partitions[schemeEntry.GetDataPartitionType()].DiskUUID
+				}
+				if err := config.ShareDataDevice(schemeEntry, diskUUID, index, count, sizeMB); err != nil {
+					return nil, fmt.Errorf("failed to share device %s between %d osds: %+v", name, count, err)
+				}
+			}
+
+			// record the persistent paths of the devices so the osd can be matched to its devices after they are renamed
+			for _, details := range schemeEntry.Partitions {
+				details.DevicePath = a.devicePaths[details.Device]
+			}
+
 			perfScheme.Entries = append(perfScheme.Entries, schemeEntry)
 		}
 	}
@@ -298,6 +403,146 @@ func (a *OsdAgent) getPartitionPerfScheme(context *clusterd.Context, devices *De
 	return perfScheme, nil
 }
 
+// assigns each of the given new data devices to a metadata device. A device is assigned to the metadata device in
+// its own config if there is one, otherwise to the metadata device that stores the metadata of the fewest OSDs so the
+// data devices are spread evenly across the metadata devices.
+func (a *OsdAgent) assignMetadataDevices(dataDevices, metadataNames []string,
+	metadataDevices map[string]*config.MetadataDeviceInfo) (map[string]string, error) {
+
+	assignments := map[string]string{}
+	if len(metadataNames) == 0 {
+		return assignments, nil
+	}
+
+	counts := map[string]int{}
+	for _, name := range metadataNames {
+		counts[name] = metadataDevices[name].OSDCount()
+	}
+
+	// the explicit assignments go first so that the remaining devices are balanced around them
+	var unassigned []string
+	for _, name := range dataDevices {
+		metadataName := config.MetadataDevice(a.deviceConfig[name])
+		if metadataName == "" {
+			unassigned = append(unassigned, name)
+			continue
+		}
+		if _, ok := metadataDevices[metadataName]; !ok {
+			return nil, fmt.Errorf("device %s is configured with metadata device %s, which is not an available metadata device", name, metadataName)
+		}
+		assignments[name] = metadataName
+		counts[metadataName] += a.osdsPerDevice(name)
+	}
+
+	for _, name := range unassigned {
+		leastUsed := metadataNames[0]
+		for _, metadataName := range metadataNames[1:] {
+			if counts[metadataName] < counts[leastUsed] {
+				leastUsed = metadataName
+			}
+		}
+		assignments[name] = leastUsed
+		counts[leastUsed] += a.osdsPerDevice(name)
+	}
+
+	return assignments, nil
+}
+
+// gets the store config for the new OSDs on each metadata device and the share (MB) of the remaining space of the
+// metadata device for each of them. If the remaining space of a metadata device is not enough for the configured
+// metadata sizes of its new OSDs, the remaining space is shared equally between them by reducing the size of their DBs
+// (bluestore) or journals (filestore). The bluestore metadata sizes derived from the capacity of the devices are
+// bounded by the share instead.
+func (a *OsdAgent) getMetadataStoreConfigs(context *clusterd.Context, assignments map[string]string,
+	metadataDevices map[string]*config.MetadataDeviceInfo) (map[string]config.StoreConfig, map[string]int, error) {
+
+	newOSDs := map[string]int{}
+	for name, metadataName := range assignments {
+		newOSDs[metadataName] += a.osdsPerDevice(name)
+	}
+
+	storeConfigs := map[string]config.StoreConfig{}
+	shares := map[string]int{}
+	for metadataName, count := range newOSDs {
+		storeConfig := a.storeConfig
+		storeConfigs[metadataName] = storeConfig
+
+		var sizeMB int
+		for _, disk := range context.Devices {
+			if disk.Name == metadataName {
+				sizeMB = int(disk.Size / 1048576)
+				break
+			}
+		}
+		if sizeMB == 0 {
+			// the size of the device is unknown, go with the configured sizes
+			continue
+		}
+
+		// the WAL keeps its size, the DB or the journal shrinks if needed
+		fixedSize := 0
+		sharedSize := config.JournalDefaultSizeMB
+		minSize := minJournalSizeMB
+		if storeConfig.StoreType == config.Filestore {
+			if storeConfig.JournalSizeMB > 0 {
+				sharedSize = storeConfig.JournalSizeMB
+			}
+		} else {
+			fixedSize = config.WalDefaultSizeMB
+			if storeConfig.WalSizeMB > 0 {
+				fixedSize = storeConfig.WalSizeMB
+			}
+			sharedSize = config.DBDefaultSizeMB
+			if storeConfig.DatabaseSizeMB > 0 {
+				sharedSize = storeConfig.DatabaseSizeMB
+			}
+			minSize = config.DBMinSizeMB
+		}
+
+		availableMB := sizeMB - metadataDevices[metadataName].NextOffsetMB()
+		shares[metadataName] = availableMB / count
+		if count*(fixedSize+sharedSize) <= availableMB || (derivesMetadataSizes(storeConfig) && shares[metadataName] > 0) {
+			continue
+		}
+
+		reducedSize := availableMB/count - fixedSize
+		if reducedSize < minSize {
+			return nil, nil, fmt.Errorf("metadata device %s has %d MB available, not enough for the metadata of %d more osds",
+				metadataName, availableMB, count)
+		}
+		logger.Infof("metadata device %s has %d MB available, reducing the metadata size of its %d new osds from %d MB to %d MB",
+			metadataName, availableMB, count, sharedSize, reducedSize)
+		if storeConfig.StoreType == config.Filestore {
+			storeConfig.JournalSizeMB = reducedSize
+		} else {
+			storeConfig.WalSizeMB = fixedSize
+			storeConfig.DatabaseSizeMB = reducedSize
+		}
+		storeConfigs[metadataName] = storeConfig
+	}
+
+	return storeConfigs, shares, nil
+}
+
+// determines if the bluestore metadata sizes are derived from the capacity of the devices instead of the fixed sizes
+func derivesMetadataSizes(storeConfig config.StoreConfig) bool {
+	if storeConfig.StoreType == config.Filestore {
+		return false
+	}
+	return storeConfig.DatabaseSizePercent > 0 || storeConfig.WalSizePercent > 0 || storeConfig.AutoMetadataSize
+}
+
+// gets the number of osds that share the given new device, from the config of the device or else the store config
+func (a *OsdAgent) osdsPerDevice(name string) int {
+	if count := config.OSDsPerDevice(a.deviceConfig[name]); count > 0 {
+		return count
+	}
+	if a.storeConfig.OSDsPerDevice > 0 {
+		return a.storeConfig.OSDsPerDevice
+	}
+	return 1
+}
+
 // determines if the given device name is already in use with existing/committed partitions
 func isDeviceInUse(name string, nameToUUID map[string]string, scheme *config.PerfScheme) bool {
 	parts := findPartitionsForDevice(name, nameToUUID, scheme)
@@ -341,6 +586,113 @@ func findPartitionsForDevice(name string, nameToUUID map[string]string, scheme *
 	return parts
 }
 
+// resolves the devices of the node that are specified by a persistent path such as /dev/disk/by-id/... to their current
+// names, which can change across reboots. The persistent path of each device is kept to be recorded in the partition
+// scheme. A path that is not a link of any device, such as a raw block volume attached to the pod, is looked up with
+// lsblk. A path that is not found on the node is kept as it is.
+func (a *OsdAgent) resolveDevicePaths(context *clusterd.Context) {
+	a.devicePaths = map[string]string{}
+	for _, disk := range context.Devices {
+		if path := sys.GetPersistentDevicePath(disk); path != "" {
+			a.devicePaths[disk.Name] = path
+		}
+	}
+
+	resolve := func(device string) string {
+		if !strings.HasPrefix(device, "/") {
+			return device
+		}
+		if disk := findDiskByPath(context, device); disk != nil {
+			logger.Infof("device %s is %s", device, disk.Name)
+			a.devicePaths[disk.Name] = device
+			return disk.Name
+		}
+		// a raw block volume is attached to the pod under a path of its own that is not a link of the device
+		if name, err := sys.GetDeviceName(device, context.Executor); err == nil && findDiskByName(context, name) != nil {
+			logger.Infof("device %s is %s", device, name)
+			a.devicePaths[name] = device
+			return name
+		}
+		logger.Warningf("device %s not found on node %s", device, a.nodeName)
+		return device
+	}
+	resolveList := func(devices string) string {
+		if devices == "" {
+			return devices
+		}
+		names := strings.Split(devices, ",")
+		for i := range names {
+			names[i] = resolve(names[i])
+		}
+		return strings.Join(names, ",")
+	}
+
+	if !a.usingDeviceFilter {
+		a.devices = resolveList(a.devices)
+	}
+	if a.deviceSelection != nil {
+		for i, device := range a.deviceSelection.Devices {
+			a.deviceSelection.Devices[i] = resolve(device)
+		}
+	}
+	a.metadataDevice = resolveList(a.metadataDevice)
+	deviceConfig := map[string]map[string]string{}
+	for device, c := range a.deviceConfig {
+		if metadataDevice, ok := c[config.MetadataDeviceKey]; ok {
+			c[config.MetadataDeviceKey] = resolveList(metadataDevice)
+		}
+		deviceConfig[resolve(device)] = c
+	}
+	a.deviceConfig = deviceConfig
+}
+
+// finds the disk on the node with the given path under /dev
+func findDiskByPath(context *clusterd.Context, path string) *sys.LocalDisk {
+	for _, disk := range context.Devices {
+		if sys.HasDevicePath(disk, path) {
+			return disk
+		}
+	}
+	return nil
+}
+
+// finds the disk on the node with the given name
+func findDiskByName(context *clusterd.Context, name string) *sys.LocalDisk {
+	for _, disk := range context.Devices {
+		if name != "" && disk.Name == name {
+			return disk
+		}
+	}
+	return nil
+}
+
+// gets the crush device class of the given device from its config, otherwise the class is determined by the type of
+// the device
+func (a *OsdAgent) getDeviceClass(context *clusterd.Context, name string) string {
+	if deviceClass := config.DeviceClass(a.deviceConfig[name]); deviceClass != "" {
+		return deviceClass
+	}
+
+	for _, disk := range context.Devices {
+		if disk.Name == name {
+			return getDiskDeviceClass(disk)
+		}
+	}
+
+	logger.Warningf("device %s not found, cannot determine its device class", name)
+	return ""
+}
+
+func getDiskDeviceClass(disk *sys.LocalDisk) string {
+	if strings.HasPrefix(disk.Name, "nvme") {
+		return config.NvmeDeviceClass
+	}
+	if disk.Rotational {
+		return config.HddDeviceClass
+	}
+	return config.SsdDeviceClass
+}
+
 // if a device name has changed, this function will find all partition entries with the device's static UUID and
 // then update the device name on them
 func refreshDeviceInfo(name string, nameToUUID map[string]string, scheme *config.PerfScheme) {
@@ -354,19 +706,21 @@ func refreshDeviceInfo(name string, nameToUUID map[string]string, scheme *config
 		p.Device = name
 	}
 
-	// also update the device name if the given device is in use as the metadata device
-	if scheme.Metadata != nil {
-		if diskUUID, ok := nameToUUID[name]; ok {
-			if scheme.Metadata.DiskUUID == diskUUID {
-				scheme.Metadata.Device = name
-			}
-		}
+	// also update the device name if the given device is in use as a metadata device
+	if metadata := scheme.GetMetadataDevice(nameToUUID[name]); metadata != nil {
+		metadata.Device = name
 	}
 }
 
 func (a *OsdAgent) startOSD(context *clusterd.Context, cfg *osdConfig) error {
 
 	cfg.rootPath = getOSDRootDir(cfg.configRoot, cfg.id)
+	cfg.memoryLimit = a.osdMemoryLimit()
+
+	// the partitions of an encrypted osd must be opened before they can be used
+	if err := a.prepareEncryption(context, cfg); err != nil {
+		return err
+	}
 
 	// if the osd is using filestore on a device and it's previously been formatted/partitioned,
 	// go ahead and remount the device now.
@@ -460,6 +814,17 @@ func prepareOSDRoot(cfg *osdConfig) (newOSD bool, err error) {
 
 // runs an OSD with the given config in a child process
 func (a *OsdAgent) runOSD(context *clusterd.Context, clusterName string, config *osdConfig) error {
+	if a.configuredOSDs == nil {
+		a.configuredOSDs = map[int]bool{}
+	}
+	a.configuredOSDs[config.id] = true
+
+	if a.prepareOnly {
+		// the osd is ready to be run by its own pod
+		a.addPreparedOSD(config)
+		return nil
+	}
+
 	// start the OSD daemon in the foreground with the given config
 	logger.Infof("starting osd %d at %s", config.id, config.rootPath)
 
@@ -477,7 +842,12 @@ func (a *OsdAgent) runOSD(context *clusterd.Context, clusterName string, config
 	}
 
 	if isFilestore(config) {
-		params = append(params, fmt.Sprintf("--osd-journal=%s", getOSDJournalPath(config.rootPath)))
+		params = append(params, fmt.Sprintf("--osd-journal=%s", getFilestoreJournalPath(config)))
+	}
+
+	if a.foreground {
+		// the pod exits with the osd so that it is restarted
+		return a.procMan.Run(fmt.Sprintf("osd%d", config.id), "ceph-osd", params...)
 	}
 
 	process, err := a.procMan.Start(
@@ -506,9 +876,8 @@ func (a *OsdAgent) removeOSD(context *clusterd.Context, config *osdConfig) error
 	}
 
 	// first reweight the OSD to be 0.0, which will begin the data migration
-	o, err := client.CrushReweight(context, a.cluster.Name, config.id, 0.0)
-	if err != nil {
-		return fmt.Errorf("failed to reweight osd.%d to 0.0: %+v. %s", config.id, err, o)
+	if err := a.drainOSD(context, config, initialUsage); err != nil {
+		return err
 	}
 
 	// mark the OSD as out
@@ -532,6 +901,23 @@ func (a *OsdAgent) removeOSD(context *clusterd.Context, config *osdConfig) error
 	if err := purgeOSD(context, a.cluster.Name, config.id); err != nil {
 		return fmt.Errorf("failed to purge osd.%d from the cluster: %+v", config.id, err)
 	}
+	delete(a.preparedOSDs, config.id)
+	delete(a.configuredOSDs, config.id)
+	if config.storeConfig.WeightRampStep > 0 {
+		if err := oposd.DeleteWeightRamp(context.Clientset, a.cluster.Name, config.id); err != nil {
+			logger.Warningf("failed to delete the weight ramp of osd.%d. %+v", config.id, err)
+		}
+	}
+
+	if config.partitionScheme != nil && config.partitionScheme.Encrypted {
+		// close the encrypted partitions and destroy the key, the data on them cannot be recovered anymore
+		if err := closePartitions(context, config); err != nil {
+			logger.Warningf("failed to close the encrypted partitions of osd.%d. %+v", config.id, err)
+		}
+		if err := deleteEncryptionKey(context, a.cluster.Name, config.id); err != nil {
+			return err
+		}
+	}
 
 	// delete any backups of the OSD filesystem
 	if err := deleteOSDFileSystem(config); err != nil {
@@ -352,7 +352,7 @@ func createTestAgent(t *testing.T, devices, configDir, nodeName string, storeCon
 	}
 	cluster := &mon.ClusterInfo{Name: "myclust"}
 	context := &clusterd.Context{ConfigDir: configDir, Executor: executor, Clientset: testop.New(1)}
-	agent := NewAgent(context, devices, false, "", "", forceFormat, location, *storeConfig,
+	agent := NewAgent(context, devices, false, nil, nil, "", "", forceFormat, location, *storeConfig, nil, 0,
 		cluster, nodeName, mockKVStore())
 
 	return agent, executor, context
@@ -427,9 +427,9 @@ func TestGetPartitionPerfScheme(t *testing.T) {
 	assert.Equal(t, 2, len(scheme.Entries))
 
 	// verify the metadata entries, they should be on sdc and there should be 2 of them (2 per OSD)
-	require.NotNil(t, scheme.Metadata)
-	assert.Equal(t, "sdc", scheme.Metadata.Device)
-	assert.Equal(t, 4, len(scheme.Metadata.Partitions))
+	require.Equal(t, 1, len(scheme.MetadataDevices))
+	assert.Equal(t, "sdc", scheme.MetadataDevices[0].Device)
+	assert.Equal(t, 4, len(scheme.MetadataDevices[0].Partitions))
 
 	// verify the first entry in the performance partition scheme.  note that the block device will either be sda or
 	// sdb because ordering of map traversal in golang isn't guaranteed.  Ensure that the first is either sda or sdb
@@ -456,6 +456,237 @@ func TestGetPartitionPerfScheme(t *testing.T) {
 	verifyPartitionEntry(t, entry.Partitions[config.DatabasePartitionType], "sdc", config.DBDefaultSizeMB, 21633)
 }
 
+func TestGetPartitionPerfSchemeOSDsPerDevice(t *testing.T) {
+	configDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(configDir)
+	test.CreateConfigDir(configDir)
+
+	// the nvme device is split between 2 osds, the other device has a single osd
+	a := &OsdAgent{devices: "nvme0n1,sda", kv: mockKVStore(), nodeName: "a", cluster: &mon.ClusterInfo{Name: "myclust"},
+		deviceConfig: map[string]map[string]string{"nvme0n1": {config.OSDsPerDeviceKey: "2"}}}
+	context := &clusterd.Context{ConfigDir: configDir, Devices: []*sys.LocalDisk{
+		{Name: "nvme0n1", Size: 107374182400}, // 100 GB
+		{Name: "sda", Size: 107374182400},
+	}}
+
+	currOsdID := 0
+	context.Executor = &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName string, command string, outFileArg string, args ...string) (string, error) {
+			if args[0] == "osd" && args[1] == "create" {
+				currOsdID++
+				return fmt.Sprintf(`{"osdid": %d}`, currOsdID), nil
+			}
+			return "", fmt.Errorf("unexpected command '%v'", args)
+		},
+		MockExecuteCommandWithOutput: func(debug bool, actionName string, command string, args ...string) (string, error) {
+			if command == "lsblk" {
+				name := strings.TrimPrefix(args[0], "/dev/")
+				return fmt.Sprintf(`NAME="%s" SIZE="107374182400" TYPE="disk" PKNAME=""`, name), nil
+			}
+			if command == "blkid" || command == "udevadm" {
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", command, args)
+		},
+	}
+
+	devices, err := getAvailableDevices(context, "nvme0n1,sda", "", false)
+	assert.Nil(t, err)
+	scheme, err := a.getPartitionPerfScheme(context, devices)
+	assert.Nil(t, err)
+	require.Equal(t, 3, len(scheme.Entries))
+	assert.Equal(t, 3, a.countDataOSDs(devices))
+
+	// each osd on the nvme device has its metadata and data in its half of the device
+	first, second := scheme.Entries[0], scheme.Entries[1]
+	assert.Equal(t, 0, first.DeviceIndex)
+	verifyPartitionEntry(t, first.Partitions[config.WalPartitionType], "nvme0n1", config.WalDefaultSizeMB, 1)
+	verifyPartitionEntry(t, first.Partitions[config.DatabasePartitionType], "nvme0n1", config.DBDefaultSizeMB, 577)
+	verifyPartitionEntry(t, first.Partitions[config.BlockPartitionType], "nvme0n1", 30143, 21057)
+	assert.Equal(t, 1, second.DeviceIndex)
+	verifyPartitionEntry(t, second.Partitions[config.WalPartitionType], "nvme0n1", config.WalDefaultSizeMB, 51200)
+	verifyPartitionEntry(t, second.Partitions[config.DatabasePartitionType], "nvme0n1", config.DBDefaultSizeMB, 51776)
+	verifyPartitionEntry(t, second.Partitions[config.BlockPartitionType], "nvme0n1", -1, 72256)
+	assert.Equal(t, first.Partitions[config.BlockPartitionType].DiskUUID, second.Partitions[config.BlockPartitionType].DiskUUID)
+	assert.Equal(t, []int{first.ID, second.ID}, devices.Entries["nvme0n1"].Metadata)
+
+	// the other device is not split
+	verifyPartitionEntry(t, scheme.Entries[2].Partitions[config.BlockPartitionType], "sda", -1, 21057)
+	assert.Equal(t, 0, scheme.Entries[2].DeviceIndex)
+}
+
+func TestGetPartitionPerfSchemeDerivedMetadataSizes(t *testing.T) {
+	configDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(configDir)
+	test.CreateConfigDir(configDir)
+
+	// the free space of the metadata device is split between the dbs of the 2 new osds
+	a := &OsdAgent{devices: "sda,sdb", metadataDevice: "sdc", kv: mockKVStore(), nodeName: "a", cluster: &mon.ClusterInfo{Name: "myclust"},
+		storeConfig: config.StoreConfig{StoreType: config.Bluestore, AutoMetadataSize: true}}
+	context := &clusterd.Context{ConfigDir: configDir, Devices: []*sys.LocalDisk{
+		{Name: "sda", Size: 1099511627776}, // 1 TB
+		{Name: "sdb", Size: 1099511627776},
+		{Name: "sdc", Size: 107374182400}, // 100 GB
+	}}
+
+	currOsdID := 0
+	context.Executor = &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName string, command string, outFileArg string, args ...string) (string, error) {
+			if args[0] == "osd" && args[1] == "create" {
+				currOsdID++
+				return fmt.Sprintf(`{"osdid": %d}`, currOsdID), nil
+			}
+			return "", fmt.Errorf("unexpected command '%v'", args)
+		},
+		MockExecuteCommandWithOutput: func(debug bool, actionName string, command string, args ...string) (string, error) {
+			if command == "lsblk" {
+				name := strings.TrimPrefix(args[0], "/dev/")
+				return fmt.Sprintf(`NAME="%s" SIZE="107374182400" TYPE="disk" PKNAME=""`, name), nil
+			}
+			if command == "blkid" || command == "udevadm" {
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", command, args)
+		},
+	}
+
+	devices, err := getAvailableDevices(context, "sda,sdb", "sdc", false)
+	assert.Nil(t, err)
+	scheme, err := a.getPartitionPerfScheme(context, devices)
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(scheme.Entries))
+	for i, entry := range scheme.Entries {
+		assert.Equal(t, config.WalDefaultSizeMB, entry.WalSizeMB)
+		assert.Equal(t, 50623, entry.DatabaseSizeMB)
+		verifyPartitionEntry(t, entry.Partitions[config.WalPartitionType], "sdc", config.WalDefaultSizeMB, 1+i*51199)
+		verifyPartitionEntry(t, entry.Partitions[config.DatabasePartitionType], "sdc", 50623, 577+i*51199)
+	}
+
+	// the dbs are a percentage of the data devices instead
+	a.storeConfig = config.StoreConfig{StoreType: config.Bluestore, DatabaseSizePercent: 2}
+	devices, err = getAvailableDevices(context, "sda,sdb", "sdc", false)
+	assert.Nil(t, err)
+	scheme, err = a.getPartitionPerfScheme(context, devices)
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(scheme.Entries))
+	assert.Equal(t, 20971, scheme.Entries[0].DatabaseSizeMB)
+	assert.Equal(t, 20971, scheme.Entries[1].DatabaseSizeMB)
+}
+
+func TestGetPartitionPerfSchemeMultipleMetadataDevices(t *testing.T) {
+	configDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(configDir)
+	context := &clusterd.Context{Devices: []*sys.LocalDisk{}, ConfigDir: configDir}
+	test.CreateConfigDir(configDir)
+
+	// 4 data disks sharing 2 metadata devices, sdd is explicitly configured to store its metadata on nvme0
+	deviceConfig := map[string]map[string]string{"sdd": {config.MetadataDeviceKey: "nvme0"}}
+	a := &OsdAgent{devices: "sda,sdb,sdc,sdd", deviceConfig: deviceConfig, metadataDevice: "nvme0,nvme1", kv: mockKVStore(), nodeName: "a",
+		cluster: &mon.ClusterInfo{Name: "myclust"}}
+	assert.Equal(t, []string{"nvme0", "nvme1"}, a.getMetadataDevices())
+	context.Devices = []*sys.LocalDisk{
+		{Name: "sda", Size: 107374182400},   // 100 GB
+		{Name: "sdb", Size: 107374182400},   // 100 GB
+		{Name: "sdc", Size: 107374182400},   // 100 GB
+		{Name: "sdd", Size: 107374182400},   // 100 GB
+		{Name: "sde", Size: 107374182400},   // 100 GB
+		{Name: "nvme0", Size: 107374182400}, // 100 GB
+		{Name: "nvme1", Size: 10738466816},  // 1 MB (starting offset) + 10 GB, not enough for 2 DBs of 20 GB
+	}
+
+	currOsdID := 10
+	context.Executor = &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName string, command string, outFileArg string, args ...string) (string, error) {
+			if args[0] == "osd" && args[1] == "create" {
+				currOsdID++
+				return fmt.Sprintf(`{"osdid": %d}`, currOsdID), nil
+			}
+			return "", fmt.Errorf("unexpected command '%v'", args)
+		},
+		MockExecuteCommandWithOutput: func(debug bool, actionName string, command string, args ...string) (string, error) {
+			if command == "lsblk" {
+				name := strings.TrimPrefix(args[0], "/dev/")
+				return fmt.Sprintf(`NAME="%s" SIZE="107374182400" TYPE="disk" PKNAME=""`, name), nil
+			}
+			if command == "blkid" || command == "udevadm" {
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", command, args)
+		},
+	}
+
+	devices, err := getAvailableDevices(context, a.devices, strings.Join(a.getMetadataDevices(), ","), false)
+	assert.Nil(t, err)
+	scheme, err := a.getPartitionPerfScheme(context, devices)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(scheme.Entries))
+	require.Equal(t, 2, len(scheme.MetadataDevices))
+	nvme0 := scheme.MetadataDevices[0]
+	nvme1 := scheme.MetadataDevices[1]
+	assert.Equal(t, "nvme0", nvme0.Device)
+	assert.Equal(t, "nvme1", nvme1.Device)
+	assert.Equal(t, 2, nvme0.OSDCount())
+	assert.Equal(t, 2, nvme1.OSDCount())
+
+	// sdd goes to nvme0 as configured, the others are spread evenly in the order of their names
+	expected := map[string]string{"sda": "nvme1", "sdb": "nvme0", "sdc": "nvme1", "sdd": "nvme0"}
+	for _, entry := range scheme.Entries {
+		dataDevice := entry.Partitions[config.BlockPartitionType].Device
+		assert.Equal(t, expected[dataDevice], entry.Partitions[config.WalPartitionType].Device, dataDevice)
+		assert.Equal(t, expected[dataDevice], entry.Partitions[config.DatabasePartitionType].Device, dataDevice)
+	}
+
+	// the OSDs on nvme0 get the default sizes, the OSDs on nvme1 share its space equally
+	assert.Equal(t, config.DBDefaultSizeMB, nvme0.Partitions[1].SizeMB)
+	assert.Equal(t, config.DBDefaultSizeMB, nvme0.Partitions[3].SizeMB)
+	assert.Equal(t, config.WalDefaultSizeMB, nvme1.Partitions[0].SizeMB)
+	assert.Equal(t, 5120-config.WalDefaultSizeMB, nvme1.Partitions[1].SizeMB)
+	assert.Equal(t, 5120-config.WalDefaultSizeMB, nvme1.Partitions[3].SizeMB)
+	assert.Equal(t, 10241, nvme1.NextOffsetMB())
+
+	// save the scheme as if it was committed, with the devices now reporting their disk UUIDs
+	err = scheme.SaveScheme(a.kv, config.GetConfigStoreName(a.nodeName))
+	assert.Nil(t, err)
+	for _, disk := range context.Devices {
+		for _, entry := range scheme.Entries {
+			if entry.Partitions[config.BlockPartitionType].Device == disk.Name {
+				disk.UUID = entry.Partitions[config.BlockPartitionType].DiskUUID
+			}
+		}
+		for _, metadata := range scheme.MetadataDevices {
+			if metadata.Device == disk.Name {
+				disk.UUID = metadata.DiskUUID
+			}
+		}
+	}
+
+	// adding a data device later adds its metadata partitions after the existing ones on the metadata devices
+	a.devices = "sda,sdb,sdc,sdd,sde"
+	devices, err = getAvailableDevices(context, a.devices, strings.Join(a.getMetadataDevices(), ","), false)
+	assert.Nil(t, err)
+	scheme, err = a.getPartitionPerfScheme(context, devices)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(scheme.Entries))
+	require.Equal(t, 2, len(scheme.MetadataDevices))
+	nvme0 = scheme.MetadataDevices[0]
+	assert.Equal(t, 3, nvme0.OSDCount())
+	assert.Equal(t, 6, len(nvme0.Partitions))
+	entry := scheme.Entries[4]
+	assert.Equal(t, 15, entry.ID)
+	verifyPartitionEntry(t, entry.Partitions[config.BlockPartitionType], "sde", -1, 1)
+	verifyPartitionEntry(t, entry.Partitions[config.WalPartitionType], "nvme0", config.WalDefaultSizeMB, 42113)
+	verifyPartitionEntry(t, entry.Partitions[config.DatabasePartitionType], "nvme0", config.DBDefaultSizeMB, 42689)
+
+	// the space on nvme1 is used up
+	a.deviceConfig = map[string]map[string]string{"sdf": {config.MetadataDeviceKey: "nvme1"}}
+	context.Devices = append(context.Devices, &sys.LocalDisk{Name: "sdf", Size: 107374182400})
+	a.devices = "sda,sdb,sdc,sdd,sdf"
+	devices, err = getAvailableDevices(context, a.devices, strings.Join(a.getMetadataDevices(), ","), false)
+	assert.Nil(t, err)
+	_, err = a.getPartitionPerfScheme(context, devices)
+	assert.NotNil(t, err)
+}
+
 func TestGetPartitionSchemeDiskInUse(t *testing.T) {
 	configDir, err := ioutil.TempDir("", "TestGetPartitionPerfSchemeDiskInUse")
 	if err != nil {
@@ -512,7 +743,7 @@ func TestGetPartitionSchemeDiskInUse(t *testing.T) {
 	}
 
 	// there should be no dedicated metadata partitioning because sda has osd 1 collocated on it
-	assert.Nil(t, scheme.Metadata)
+	assert.Equal(t, 0, len(scheme.MetadataDevices))
 }
 
 func TestGetPartitionSchemeDiskNameChanged(t *testing.T) {
@@ -570,7 +801,7 @@ func TestGetPartitionSchemeDiskNameChanged(t *testing.T) {
 	assert.Nil(t, err)
 	require.NotNil(t, scheme)
 	assert.Equal(t, "sda-changed", scheme.Entries[0].Partitions[config.BlockPartitionType].Device)
-	assert.Equal(t, "nvme01", scheme.Metadata.Device)
+	assert.Equal(t, "nvme01", scheme.MetadataDevices[0].Device)
 	assert.Equal(t, "nvme01", scheme.Entries[0].Partitions[config.WalPartitionType].Device)
 	assert.Equal(t, "nvme01", scheme.Entries[0].Partitions[config.DatabasePartitionType].Device)
 }
@@ -647,22 +878,91 @@ func mockDistributedPartitionScheme(t *testing.T, osdID int, metadataDevice, dev
 	kv *k8sutil.ConfigMapKVStore, nodeName string) (*config.PerfScheme, string, string) {
 
 	scheme := config.NewPerfScheme()
-	scheme.Metadata = config.NewMetadataDeviceInfo(metadataDevice)
+	metadata := config.NewMetadataDeviceInfo(metadataDevice)
+	scheme.MetadataDevices = append(scheme.MetadataDevices, metadata)
 
 	entry := config.NewPerfSchemeEntry(config.Bluestore)
 	entry.ID = osdID
 	entry.OsdUUID = uuid.Must(uuid.NewRandom())
 
-	config.PopulateDistributedPerfSchemeEntry(entry, device, scheme.Metadata, config.StoreConfig{})
+	config.PopulateDistributedPerfSchemeEntry(entry, device, metadata, config.StoreConfig{}, config.DeviceSizes{})
 	scheme.Entries = append(scheme.Entries, entry)
 	err := scheme.SaveScheme(kv, config.GetConfigStoreName(nodeName))
 	assert.Nil(t, err)
 
 	// return the full partition scheme, the metadata device UUID and the data device UUID
-	return scheme, scheme.Metadata.DiskUUID, entry.Partitions[config.BlockPartitionType].DiskUUID
+	return scheme, metadata.DiskUUID, entry.Partitions[config.BlockPartitionType].DiskUUID
 }
 
 func mockKVStore() *k8sutil.ConfigMapKVStore {
 	clientset := testop.New(1)
 	return k8sutil.NewConfigMapKVStore("myns", clientset, metav1.OwnerReference{})
 }
+
+func TestGetDeviceClass(t *testing.T) {
+	a := &OsdAgent{deviceConfig: map[string]map[string]string{"sdc": {config.DeviceClassKey: "fast"}}}
+	context := &clusterd.Context{Devices: []*sys.LocalDisk{
+		{Name: "sda", Rotational: true},
+		{Name: "sdb", Rotational: false},
+		{Name: "sdc", Rotational: true},
+		{Name: "nvme0n1", Rotational: false},
+	}}
+
+	// the class is detected from the type of the device
+	assert.Equal(t, config.HddDeviceClass, a.getDeviceClass(context, "sda"))
+	assert.Equal(t, config.SsdDeviceClass, a.getDeviceClass(context, "sdb"))
+	assert.Equal(t, config.NvmeDeviceClass, a.getDeviceClass(context, "nvme0n1"))
+
+	// the class in the config of the device takes precedence
+	assert.Equal(t, "fast", a.getDeviceClass(context, "sdc"))
+
+	// the class of an unknown device is left to ceph
+	assert.Equal(t, "", a.getDeviceClass(context, "sdd"))
+}
+
+func TestResolveDevicePaths(t *testing.T) {
+	a := &OsdAgent{
+		devices:        "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4,sdc,/dev/disk/by-id/missing",
+		metadataDevice: "/dev/disk/by-path/pci-0000:00:1f.2-nvme-1",
+		deviceConfig: map[string]map[string]string{
+			"/dev/disk/by-id/wwn-0x5000c500a1b2c3d4": {config.MetadataDeviceKey: "/dev/disk/by-path/pci-0000:00:1f.2-nvme-1"},
+		},
+	}
+	executor := &exectest.MockExecutor{}
+	context := &clusterd.Context{Executor: executor, Devices: []*sys.LocalDisk{
+		{Name: "sdb", DevLinks: "/dev/disk/by-path/pci-0000:00:1f.2-ata-2 /dev/disk/by-id/wwn-0x5000c500a1b2c3d4"},
+		{Name: "sdc", DevLinks: "/dev/disk/by-id/ata-ST1000_Z1D2"},
+		{Name: "nvme0n1", DevLinks: "/dev/disk/by-path/pci-0000:00:1f.2-nvme-1"},
+		{Name: "xvdf"},
+	}}
+
+	// the paths are resolved to the current names, a path that is not found is kept
+	a.resolveDevicePaths(context)
+	assert.Equal(t, "sdb,sdc,/dev/disk/by-id/missing", a.devices)
+	assert.Equal(t, "nvme0n1", a.metadataDevice)
+	assert.Equal(t, "nvme0n1", config.MetadataDevice(a.deviceConfig["sdb"]))
+
+	// the persistent paths of the devices are known to be recorded in the scheme
+	assert.Equal(t, "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4", a.devicePaths["sdb"])
+	assert.Equal(t, "/dev/disk/by-id/ata-ST1000_Z1D2", a.devicePaths["sdc"])
+	assert.Equal(t, "/dev/disk/by-path/pci-0000:00:1f.2-nvme-1", a.devicePaths["nvme0n1"])
+
+	// a device filter is not resolved
+	a.devices = "^sd."
+	a.usingDeviceFilter = true
+	a.resolveDevicePaths(context)
+	assert.Equal(t, "^sd.", a.devices)
+
+	// a raw block volume attached to the pod is looked up by the name of its device node
+	executor.MockExecuteCommandWithOutput = func(debug bool, actionName string, command string, args ...string) (string, error) {
+		if command == "lsblk" && args[0] == "/mnt/rook-osd-data" {
+			return "xvdf\n", nil
+		}
+		return "", nil
+	}
+	a.devices = "/mnt/rook-osd-data"
+	a.usingDeviceFilter = false
+	a.resolveDevicePaths(context)
+	assert.Equal(t, "xvdf", a.devices)
+	assert.Equal(t, "/mnt/rook-osd-data", a.devicePaths["xvdf"])
+}
@@ -0,0 +1,295 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/client"
+	oposd "github.com/rook/rook/pkg/operator/ceph/cluster/osd"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	"github.com/rook/rook/pkg/util"
+	"github.com/rook/rook/pkg/util/sys"
+)
+
+var (
+	// the time to wait for the cluster to be clean before an OSD is converted, and for the data of an OSD that was
+	// marked out to move again after it stopped moving. The conversion is given up until the next orchestration when
+	// the wait runs out.
+	conversionRetries    = 40
+	conversionRetryDelay = 15 * time.Second
+)
+
+// converts the filestore OSDs on the devices of the node to bluestore when the store type of the node was changed to
+// bluestore. The OSDs are converted one at a time, each after the cluster is healthy again: the OSD is marked out and
+// its data moves to the other OSDs, then it is destroyed and recreated as bluestore on the same device with its ID. The
+// operator orchestrates one node at a time while there are OSDs to convert, so only one OSD of the cluster is out.
+func (a *OsdAgent) convertFilestoreOSDs(context *clusterd.Context) error {
+	if a.storeConfig.StoreType != config.Bluestore {
+		return nil
+	}
+	if a.keepOSDs {
+		// the other nodes may be orchestrated at the same time for their new devices
+		logger.Infof("not converting the filestore osds of node %s while it is orchestrated for its new devices", a.nodeName)
+		return nil
+	}
+
+	storeName := config.GetConfigStoreName(a.nodeName)
+	scheme, err := config.LoadScheme(a.kv, storeName)
+	if err != nil {
+		return fmt.Errorf("failed to load partition scheme: %+v", err)
+	}
+	entries := config.FilestoreConversions(scheme)
+	if len(entries) == 0 {
+		return nil
+	}
+	if a.prepareOnly {
+		// the osds run in their own pods, they can't be stopped by the agent
+		logger.Warningf("not converting the %d filestore osds of node %s to bluestore, their dedicated pods must be removed first",
+			len(entries), a.nodeName)
+		return nil
+	}
+
+	logger.Infof("converting %d filestore osds of node %s to bluestore", len(entries), a.nodeName)
+	for _, entry := range entries {
+		status := oposd.OrchestrationStatus{Status: oposd.OrchestrationStatusOrchestrating,
+			Message: fmt.Sprintf("converting osd.%d to bluestore", entry.ID)}
+		if err := oposd.UpdateOrchestrationStatusMap(context.Clientset, a.cluster.Name, a.nodeName, status); err != nil {
+			logger.Warningf("failed to update the orchestration status of node %s. %+v", a.nodeName, err)
+		}
+
+		if err := a.convertOSD(context, entry); err != nil {
+			return fmt.Errorf("failed to convert osd.%d to bluestore: %+v", entry.ID, err)
+		}
+	}
+
+	// the data of the last osd moves back in the background, the next conversion waits for it
+	if err := waitForCleanPGs(context, a.cluster.Name); err != nil {
+		logger.Warningf("the data is still moving back to the osds converted to bluestore. %+v", err)
+	}
+	return nil
+}
+
+// converts a single filestore OSD to bluestore on the same devices
+func (a *OsdAgent) convertOSD(context *clusterd.Context, entry *config.PerfSchemeEntry) error {
+	// the devices of the osd are looked up before the osd is dropped from the scheme, the osd is only taken out if it
+	// can be recreated on them
+	devices := getConversionMapping(context, entry)
+	if err := a.validateConversion(context, entry, devices); err != nil {
+		return err
+	}
+
+	// the data of the previous osd must be back before another osd is taken out
+	if err := waitForCleanPGs(context, a.cluster.Name); err != nil {
+		return fmt.Errorf("the cluster is not clean, the conversion continues at the next orchestration: %+v", err)
+	}
+
+	cfg := &osdConfig{id: entry.ID, uuid: entry.OsdUUID, configRoot: context.ConfigDir, partitionScheme: entry,
+		rootPath: getOSDRootDir(context.ConfigDir, entry.ID), storeConfig: a.storeConfig, kv: a.kv,
+		storeName: config.GetConfigStoreName(a.nodeName)}
+
+	logger.Infof("marking osd.%d out to move its data before converting it", entry.ID)
+	if err := markOSDOut(context, a.cluster.Name, entry.ID); err != nil {
+		return fmt.Errorf("failed to mark osd.%d out: %+v", entry.ID, err)
+	}
+	if err := waitForConversionDrain(context, a.cluster.Name, entry.ID); err != nil {
+		return fmt.Errorf("osd.%d stays out, its conversion continues at the next orchestration: %+v", entry.ID, err)
+	}
+
+	if proc, ok := a.osdProc[entry.ID]; ok {
+		if err := proc.Stop(false); err != nil {
+			return fmt.Errorf("failed to stop proc for osd.%d: %+v", entry.ID, err)
+		}
+		delete(a.osdProc, entry.ID)
+	}
+
+	if err := a.destroyConvertedOSD(context, cfg); err != nil {
+		return err
+	}
+
+	// the device is partitioned again and the osd is recreated with its id, then it is marked back in
+	logger.Infof("recreating osd.%d as bluestore on %s", entry.ID, devices)
+	if err := a.configureDevices(context, devices); err != nil {
+		return fmt.Errorf("failed to recreate osd.%d: %+v", entry.ID, err)
+	}
+	return nil
+}
+
+// checks that the given OSD can be recreated as bluestore on its devices, before it is taken out of the cluster. The
+// devices must be found on the node and the metadata device of the journal must have room for the bluestore metadata,
+// since the journal partition stays reserved.
+func (a *OsdAgent) validateConversion(context *clusterd.Context, entry *config.PerfSchemeEntry, devices *DeviceOsdMapping) error {
+	scheme, err := config.LoadScheme(a.kv, config.GetConfigStoreName(a.nodeName))
+	if err != nil {
+		return fmt.Errorf("failed to load partition scheme: %+v", err)
+	}
+
+	var dataDevices, metadataNames []string
+	metadataDevices := map[string]*config.MetadataDeviceInfo{}
+	for name, mapping := range devices.Entries {
+		if !isDeviceFound(context, name) {
+			return fmt.Errorf("device %s of osd.%d is not found on the node", name, entry.ID)
+		}
+		if !isDeviceDesiredForMetadata(mapping, scheme) {
+			dataDevices = append(dataDevices, name)
+			continue
+		}
+
+		journal := entry.Partitions[config.FilestoreJournalPartitionType]
+		metadata := scheme.GetMetadataDevice(journal.DiskUUID)
+		if metadata == nil {
+			return fmt.Errorf("metadata device %s of osd.%d is not in the partition scheme", name, entry.ID)
+		}
+		metadataDevices[name] = metadata
+		metadataNames = append(metadataNames, name)
+	}
+
+	// the metadata of the bluestore osd is placed like that of a new osd
+	assignments, err := a.assignMetadataDevices(dataDevices, metadataNames, metadataDevices)
+	if err != nil {
+		return fmt.Errorf("cannot convert osd.%d to bluestore: %+v", entry.ID, err)
+	}
+	if _, _, err := a.getMetadataStoreConfigs(context, assignments, metadataDevices); err != nil {
+		return fmt.Errorf("cannot convert osd.%d to bluestore: %+v", entry.ID, err)
+	}
+	return nil
+}
+
+// destroys the given OSD while keeping its ID and releases its devices. The OSD is dropped from the partition scheme and
+// its ID is kept for the device it is recreated on.
+func (a *OsdAgent) destroyConvertedOSD(context *clusterd.Context, cfg *osdConfig) error {
+	if o, err := client.OSDDestroy(context, a.cluster.Name, cfg.id); err != nil {
+		return fmt.Errorf("failed to destroy osd.%d: %+v. %s", cfg.id, err, o)
+	}
+	delete(a.configuredOSDs, cfg.id)
+
+	// the filestore data partition is mounted at the root of the osd
+	if err := sys.UnmountDevice(cfg.rootPath, context.Executor); err != nil {
+		return fmt.Errorf("failed to unmount osd.%d: %+v", cfg.id, err)
+	}
+
+	if err := releaseOSDStorage(context, a.cluster.Name, cfg); err != nil {
+		return err
+	}
+
+	storeName := config.GetConfigStoreName(a.nodeName)
+	scheme, err := config.LoadScheme(a.kv, storeName)
+	if err != nil {
+		return fmt.Errorf("failed to load partition scheme: %+v", err)
+	}
+
+	// the journal partition of the osd on a metadata device stays reserved since the partitions of a metadata device
+	// are numbered by their position
+	if err := scheme.DeleteSchemeEntry(cfg.partitionScheme); err != nil {
+		return fmt.Errorf("failed to delete osd.%d from the partition scheme: %+v", cfg.id, err)
+	}
+	scheme.ReplacedOSDs = append(scheme.ReplacedOSDs, cfg.id)
+	if err := scheme.SaveScheme(a.kv, storeName); err != nil {
+		return fmt.Errorf("failed to save partition scheme: %+v", err)
+	}
+	return nil
+}
+
+// gets the mapping of the devices to recreate the given OSD on. An OSD with its journal on a metadata device gets its
+// bluestore metadata on the same metadata device.
+func getConversionMapping(context *clusterd.Context, entry *config.PerfSchemeEntry) *DeviceOsdMapping {
+	devices := &DeviceOsdMapping{Entries: map[string]*DeviceOsdIDEntry{}}
+
+	data := entry.Partitions[config.FilestoreDataPartitionType]
+	devices.Entries[getDeviceName(context, data)] = &DeviceOsdIDEntry{Data: unassignedOSDID}
+	if journal, ok := entry.Partitions[config.FilestoreJournalPartitionType]; ok {
+		devices.Entries[getDeviceName(context, journal)] = &DeviceOsdIDEntry{Data: unassignedOSDID, Metadata: []int{}}
+	}
+	return devices
+}
+
+// gets the current name of the device of the given partition, which may have changed since it was partitioned
+func getDeviceName(context *clusterd.Context, details *config.PerfSchemePartitionDetails) string {
+	for _, disk := range context.Devices {
+		if disk.UUID != "" && disk.UUID == details.DiskUUID {
+			return disk.Name
+		}
+	}
+	return details.Device
+}
+
+// determines if the device with the given name is on the node
+func isDeviceFound(context *clusterd.Context, name string) bool {
+	for _, disk := range context.Devices {
+		if disk.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func waitForCleanPGs(context *clusterd.Context, clusterName string) error {
+	return util.Retry(conversionRetries, conversionRetryDelay, func() error {
+		return oposd.CheckPGsClean(context, clusterName)
+	})
+}
+
+// waits for the data of the given OSD that was marked out to move to the other OSDs, until the OSD is in no PG and the
+// cluster is clean. The wait goes on as long as PGs keep moving off the OSD, it is given up when they stopped moving.
+func waitForConversionDrain(context *clusterd.Context, clusterName string, osdID int) error {
+	remaining := -1
+	stalled := 0
+	for {
+		count, err := countOSDPGs(context, clusterName, osdID)
+		if err == nil && count == 0 {
+			err = oposd.CheckPGsClean(context, clusterName)
+			if err == nil {
+				return nil
+			}
+		}
+
+		if err == nil && (remaining < 0 || count < remaining) {
+			remaining = count
+			stalled = 0
+		} else {
+			stalled++
+			if stalled > conversionRetries && err != nil {
+				return fmt.Errorf("the data of osd.%d stopped moving with %d pgs left: %+v", osdID, remaining, err)
+			}
+			if stalled > conversionRetries {
+				return fmt.Errorf("the data of osd.%d stopped moving with %d pgs left", osdID, remaining)
+			}
+		}
+		<-time.After(conversionRetryDelay)
+	}
+}
+
+// counts the PGs the given OSD is up or acting for
+func countOSDPGs(context *clusterd.Context, clusterName string, osdID int) (int, error) {
+	pgDump, err := client.GetPGDumpBrief(context, clusterName)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, pg := range pgDump {
+		ids := append(append([]int{pg.UpPrimaryID, pg.ActingPrimaryID}, pg.UpOsdIDs...), pg.ActingOsdIDs...)
+		for _, id := range ids {
+			if id == osdID {
+				count++
+				break
+			}
+		}
+	}
+	return count, nil
+}
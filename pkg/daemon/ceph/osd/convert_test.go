@@ -0,0 +1,191 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/mon"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/rook/rook/pkg/util/sys"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSchemeEntry(id int, device string, storeType string) *config.PerfSchemeEntry {
+	entry := config.NewPerfSchemeEntry(storeType)
+	entry.ID = id
+	entry.OsdUUID = uuid.Must(uuid.NewRandom())
+	config.PopulateCollocatedPerfSchemeEntry(entry, device, config.StoreConfig{StoreType: storeType})
+	return entry
+}
+
+func TestGetConversionMapping(t *testing.T) {
+	entry := newTestSchemeEntry(3, "sdb", config.Filestore)
+	diskUUID := entry.Partitions[config.FilestoreDataPartitionType].DiskUUID
+
+	// the device is found by its uuid after it was renamed
+	context := &clusterd.Context{Devices: []*sys.LocalDisk{{Name: "sde", UUID: diskUUID}}}
+	devices := getConversionMapping(context, entry)
+	assert.Equal(t, 1, len(devices.Entries))
+	assert.Equal(t, unassignedOSDID, devices.Entries["sde"].Data)
+	assert.True(t, isDeviceDesiredForData(devices.Entries["sde"]))
+
+	// the metadata of the bluestore osd goes to the metadata device of the journal
+	entry.Partitions[config.FilestoreJournalPartitionType] = &config.PerfSchemePartitionDetails{Device: "nvme0n1", DiskUUID: "abc"}
+	devices = getConversionMapping(context, entry)
+	assert.Equal(t, 2, len(devices.Entries))
+	assert.True(t, isDeviceDesiredForMetadata(devices.Entries["nvme0n1"], nil))
+}
+
+func TestDestroyConvertedOSD(t *testing.T) {
+	configDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(configDir)
+
+	var destroyed []string
+	var unmounted []string
+	executor := &exectest.MockExecutor{
+		MockExecuteCommand: func(debug bool, name string, command string, args ...string) error {
+			if command == "umount" {
+				unmounted = append(unmounted, args[0])
+				return nil
+			}
+			return fmt.Errorf("unexpected command %s %v", command, args)
+		},
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+			if args[0] == "osd" && args[1] == "destroy" {
+				destroyed = append(destroyed, args[2])
+				return "", nil
+			}
+			if args[0] == "osd" && args[1] == "new" {
+				return fmt.Sprintf(`{"osdid": %s}`, args[3]), nil
+			}
+			return "", fmt.Errorf("unexpected command %v", args)
+		},
+	}
+	context := &clusterd.Context{Executor: executor, ConfigDir: configDir}
+	agent := &OsdAgent{cluster: &mon.ClusterInfo{Name: "myns"}, kv: mockKVStore(), nodeName: "node1",
+		storeConfig: config.StoreConfig{StoreType: config.Bluestore}, configuredOSDs: map[int]bool{1: true, 2: true}}
+
+	scheme := config.NewPerfScheme()
+	scheme.Entries = append(scheme.Entries,
+		newTestSchemeEntry(1, "sda", config.Filestore),
+		newTestSchemeEntry(2, "sdb", config.Filestore))
+	storeName := config.GetConfigStoreName(agent.nodeName)
+	assert.Nil(t, scheme.SaveScheme(agent.kv, storeName))
+
+	entry := scheme.Entries[0]
+	devices := getConversionMapping(context, entry)
+	cfg := &osdConfig{id: entry.ID, uuid: entry.OsdUUID, configRoot: configDir, partitionScheme: entry,
+		rootPath: getOSDRootDir(configDir, entry.ID), storeConfig: agent.storeConfig, kv: agent.kv, storeName: storeName}
+
+	// the osd is destroyed with its id kept for the device and the filestore partition is unmounted
+	err := agent.destroyConvertedOSD(context, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1"}, destroyed)
+	assert.Equal(t, []string{getOSDRootDir(configDir, 1)}, unmounted)
+	assert.Equal(t, []int{2}, agent.getOSDIDs())
+
+	scheme, err = config.LoadScheme(agent.kv, storeName)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(scheme.Entries))
+	assert.Equal(t, 2, scheme.Entries[0].ID)
+	assert.Equal(t, []int{1}, scheme.ReplacedOSDs)
+
+	// the osd is recreated as bluestore on the same device with its id
+	scheme, err = agent.getPartitionPerfScheme(context, devices)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(scheme.Entries))
+	assert.Equal(t, 1, scheme.Entries[1].ID)
+	assert.Equal(t, config.Bluestore, scheme.Entries[1].StoreType)
+	assert.Equal(t, "sda", scheme.Entries[1].Partitions[config.BlockPartitionType].Device)
+}
+
+func TestValidateConversion(t *testing.T) {
+	agent := &OsdAgent{cluster: &mon.ClusterInfo{Name: "myns"}, kv: mockKVStore(), nodeName: "node1",
+		storeConfig: config.StoreConfig{StoreType: config.Bluestore}}
+
+	// osd 1 has its journal on a metadata device that is nearly full
+	entry := newTestSchemeEntry(1, "sda", config.Filestore)
+	entry.Partitions[config.FilestoreJournalPartitionType] = &config.PerfSchemePartitionDetails{Device: "nvme0n1", DiskUUID: "abc"}
+	metadata := config.NewMetadataDeviceInfo("nvme0n1")
+	metadata.DiskUUID = "abc"
+	metadata.Partitions = append(metadata.Partitions, &config.MetadataDevicePartition{ID: 1, Type: config.FilestoreJournalPartitionType,
+		OffsetMB: 1, SizeMB: 5120})
+	scheme := config.NewPerfScheme()
+	scheme.Entries = append(scheme.Entries, entry)
+	scheme.MetadataDevices = append(scheme.MetadataDevices, metadata)
+	assert.Nil(t, scheme.SaveScheme(agent.kv, config.GetConfigStoreName(agent.nodeName)))
+
+	// the devices of the osd must be on the node
+	dataUUID := entry.Partitions[config.FilestoreDataPartitionType].DiskUUID
+	context := &clusterd.Context{Devices: []*sys.LocalDisk{{Name: "sda", UUID: dataUUID}}}
+	err := agent.validateConversion(context, entry, getConversionMapping(context, entry))
+	assert.NotNil(t, err)
+
+	// the journal stays reserved, the bluestore metadata doesn't fit in the rest of the metadata device
+	context.Devices = append(context.Devices, &sys.LocalDisk{Name: "nvme0n1", UUID: "abc", Size: 6 * 1073741824})
+	err = agent.validateConversion(context, entry, getConversionMapping(context, entry))
+	assert.NotNil(t, err)
+
+	context.Devices[1].Size = 64 * 1073741824
+	err = agent.validateConversion(context, entry, getConversionMapping(context, entry))
+	assert.Nil(t, err)
+}
+
+func TestWaitForConversionDrain(t *testing.T) {
+	conversionRetries = 2
+	conversionRetryDelay = 0
+
+	// the pgs move off osd 1 one at a time
+	pgs := []string{
+		`{"pgid":"1.0","state":"active+remapped+backfilling","up":[2,3],"up_primary":2,"acting":[1,2],"acting_primary":1}`,
+		`{"pgid":"1.1","state":"active+remapped+backfilling","up":[2,3],"up_primary":2,"acting":[1,3],"acting_primary":3}`,
+		`{"pgid":"1.2","state":"active+clean","up":[2,3],"up_primary":2,"acting":[2,3],"acting_primary":2}`,
+	}
+	moving := true
+	dumps := 0
+	executor := &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+			if args[0] == "status" {
+				return `{"pgmap":{"num_pgs":3,"pgs_by_state":[{"state_name":"active+clean","count":3}]}}`, nil
+			}
+			if args[0] == "pg" && args[1] == "dump" {
+				dumps++
+				if moving && len(pgs) > 1 {
+					pgs = pgs[1:]
+				}
+				return "[" + strings.Join(pgs, ",") + "]", nil
+			}
+			return "", fmt.Errorf("unexpected command %v", args)
+		},
+	}
+	context := &clusterd.Context{Executor: executor}
+	assert.Nil(t, waitForConversionDrain(context, "myns", 1))
+
+	// the wait is given up when the pgs stop moving
+	pgs = append([]string{`{"pgid":"1.3","state":"active+remapped+backfilling","up":[2,3],"up_primary":2,"acting":[1,3],"acting_primary":1}`}, pgs...)
+	moving = false
+	dumps = 0
+	assert.NotNil(t, waitForConversionDrain(context, "myns", 1))
+	assert.Equal(t, 4, dumps)
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"path"
 	"regexp"
+	"sort"
 	"time"
 
 	"strings"
@@ -37,13 +38,70 @@ import (
 var logger = capnslog.NewPackageLogger("github.com/rook/rook", "cephosd")
 
 func Run(context *clusterd.Context, agent *OsdAgent, done chan struct{}) error {
+	if err := orchestrate(context, agent); err != nil {
+		return err
+	}
 
-	// set the initial orchestration status
-	status := oposd.OrchestrationStatus{Status: oposd.OrchestrationStatusComputingDiff}
-	if err := oposd.UpdateOrchestrationStatusMap(context.Clientset, agent.cluster.Name, agent.nodeName, status); err != nil {
+	// OSD processes monitoring
+	mon := NewMonitor(context, agent)
+	go mon.Run()
+
+	// FIX
+	logger.Infof("sleeping a while to let the osds run...")
+	select {
+	case <-time.After(1000000 * time.Second):
+		logger.Warning("OSD sleep has expired")
+	case <-done:
+		logger.Infof("done channel signaled")
+	}
+
+	return nil
+}
+
+// PrepareOSDs provisions the OSDs on the storage of the node and removes the OSDs of the storage that is no longer
+// selected, without running the OSDs. The prepared OSDs are reported in the orchestration status of the node so that
+// the operator can run each of them in its own pod.
+func PrepareOSDs(context *clusterd.Context, agent *OsdAgent) error {
+	agent.prepareOnly = true
+	return orchestrate(context, agent)
+}
+
+// RunDedicatedOSD runs the prepared OSD with the given ID in the foreground until it exits
+func RunDedicatedOSD(context *clusterd.Context, agent *OsdAgent, id int) error {
+	if err := initNode(context, agent); err != nil {
+		return err
+	}
+	agent.foreground = true
+
+	cfg, err := agent.getOSDConfig(context, id)
+	if err != nil {
 		return err
 	}
+	if cfg != nil {
+		return agent.startOSD(context, cfg)
+	}
+
+	// the osd was not provisioned by rook, look for it in the osds provisioned by ceph-volume
+	if isUsingCephVolume(agent.storeConfig) {
+		if err := writeCephVolumeConfig(context, agent.cluster); err != nil {
+			return fmt.Errorf("failed to write ceph-volume config: %+v", err)
+		}
+		osds, err := listCephVolumeOSDs(context, agent.cluster)
+		if err != nil {
+			return err
+		}
+		for _, osd := range osds {
+			if osd.ID == id {
+				return agent.startCephVolumeOSD(context, osd)
+			}
+		}
+	}
+
+	return fmt.Errorf("osd.%d not found on node %s", id, agent.nodeName)
+}
 
+// writes the config of the cluster and discovers the devices of the node
+func initNode(context *clusterd.Context, agent *OsdAgent) error {
 	// set the crush location in the osd config file
 	cephConfig := mon.CreateDefaultCephConfig(context, agent.cluster, path.Join(context.ConfigDir, agent.cluster.Name))
 	cephConfig.GlobalConfig.CrushLocation = agent.location
@@ -59,17 +117,46 @@ func Run(context *clusterd.Context, agent *OsdAgent, done chan struct{}) error {
 		return fmt.Errorf("failed initial hardware discovery. %+v", err)
 	}
 	context.Devices = rawDevices
+	agent.resolveDevicePaths(context)
+	return nil
+}
+
+// configures the OSDs on the storage of the node and removes the OSDs of the storage that is no longer selected
+func orchestrate(context *clusterd.Context, agent *OsdAgent) error {
+
+	// the operator asks to keep the osds when the orchestration was only triggered by new devices. the request is kept
+	// in the status until the orchestration completes, so that it still holds if the agent is restarted.
+	previous, err := oposd.GetOrchestrationStatus(context.Clientset, agent.cluster.Name, agent.nodeName)
+	if err != nil {
+		return err
+	}
+	agent.keepOSDs = previous != nil && previous.KeepOSDs
+
+	// set the initial orchestration status
+	status := oposd.OrchestrationStatus{Status: oposd.OrchestrationStatusComputingDiff, KeepOSDs: agent.keepOSDs}
+	if err := oposd.UpdateOrchestrationStatusMap(context.Clientset, agent.cluster.Name, agent.nodeName, status); err != nil {
+		return err
+	}
+
+	if err := initNode(context, agent); err != nil {
+		return err
+	}
+
+	// the failed devices of the osds that are being replaced are dropped so that their ids can be reused
+	if err := agent.dropReplacedOSDs(context); err != nil {
+		return fmt.Errorf("failed to drop replaced osds. %+v", err)
+	}
 
 	logger.Infof("creating and starting the osds")
 
 	// determine the set of devices that can/should be used for OSDs.
-	devices, err := getAvailableDevices(context, agent.devices, agent.metadataDevice, agent.usingDeviceFilter)
+	devices, err := getAvailableDevices(context, agent.devices, strings.Join(agent.getMetadataDevices(), ","), agent.usingDeviceFilter)
 	if err != nil {
 		return fmt.Errorf("failed to get available devices. %+v", err)
 	}
 
 	// determine the set of removed OSDs and the node's crush name (if needed)
-	removedDevicesScheme, removedDevicesMapping, err := getRemovedDevices(agent)
+	removedDevicesScheme, removedDevicesMapping, err := getRemovedDevices(context, agent)
 	if err != nil {
 		return fmt.Errorf("failed to get removed devices: %+v", err)
 	}
@@ -90,17 +177,52 @@ func Run(context *clusterd.Context, agent *OsdAgent, done chan struct{}) error {
 	}
 
 	// orchestration is about to start, update the status
-	status = oposd.OrchestrationStatus{Status: oposd.OrchestrationStatusOrchestrating}
+	status = oposd.OrchestrationStatus{Status: oposd.OrchestrationStatusOrchestrating, KeepOSDs: agent.keepOSDs}
 	if err := oposd.UpdateOrchestrationStatusMap(context.Clientset, agent.cluster.Name, agent.nodeName, status); err != nil {
 		return err
 	}
 
+	// with ceph-volume, only the devices that already have OSDs from the partition scheme are configured by rook
+	var cephVolumeDevices *DeviceOsdMapping
+	cephVolumeOSDCount := 0
+	if isUsingCephVolume(agent.storeConfig) {
+		devices, cephVolumeDevices, err = agent.splitPartitionSchemeDevices(context, devices)
+		if err != nil {
+			return fmt.Errorf("failed to split devices between provisioners. %+v", err)
+		}
+		if err := writeCephVolumeConfig(context, agent.cluster); err != nil {
+			return fmt.Errorf("failed to write ceph-volume config: %+v", err)
+		}
+		osds, err := listCephVolumeOSDs(context, agent.cluster)
+		if err != nil {
+			return err
+		}
+		cephVolumeOSDCount = agent.countCephVolumeOSDs(osds, cephVolumeDevices)
+	}
+
+	// the memory limit of the pod is divided between all the osds of the node
+	agent.osdCount = agent.countDataOSDs(devices) + cephVolumeOSDCount + len(removedDevicesScheme.Entries) + len(dirs) + len(removedDirs)
+
 	// start the desired OSDs on devices
 	logger.Infof("configuring osd devices: %+v", devices)
 	if err := agent.configureDevices(context, devices); err != nil {
 		return fmt.Errorf("failed to configure devices. %+v", err)
 	}
 
+	// prepare the new devices and start all the OSDs provisioned by ceph-volume
+	var cephVolumeOSDs []*cephVolumeOSD
+	if isUsingCephVolume(agent.storeConfig) {
+		logger.Infof("configuring ceph-volume osd devices: %+v", cephVolumeDevices)
+		cephVolumeOSDs, err = agent.configureCephVolumeDevices(context, cephVolumeDevices)
+		if err != nil {
+			if !oposd.IsRemovingNode(agent.devices) {
+				return fmt.Errorf("failed to configure ceph-volume devices. %+v", err)
+			}
+			// the osds will be removed, try to remove them even if some of them can't start up
+			logger.Warningf("failed to configure ceph-volume devices, but proceeding with removal attempts. %+v", err)
+		}
+	}
+
 	// also start OSDs for the devices that will be removed.  In order to remove devices, we need the
 	// OSDs to first be running so they can participate in the rebalancing
 	logger.Infof("configuring removed osd devices: %+v", removedDevicesMapping)
@@ -128,6 +250,21 @@ func Run(context *clusterd.Context, agent *OsdAgent, done chan struct{}) error {
 		return fmt.Errorf("failed to remove devices. %+v", err)
 	}
 
+	if removedCephVolumeOSDs := agent.getRemovedCephVolumeOSDs(cephVolumeOSDs); len(removedCephVolumeOSDs) > 0 {
+		if oposd.IsRemovingNode(agent.devices) && nodeCrushName == "" {
+			id := removedCephVolumeOSDs[0].ID
+			nodeCrushName, err = client.GetCrushHostName(context, agent.cluster.Name, id)
+			if err != nil {
+				return fmt.Errorf("failed to get crush host name for osd.%d: %+v", id, err)
+			}
+		}
+
+		logger.Infof("removing ceph-volume osds: %+v", removedCephVolumeOSDs)
+		if err := agent.removeCephVolumeOSDs(context, removedCephVolumeOSDs); err != nil {
+			return fmt.Errorf("failed to remove ceph-volume osds. %+v", err)
+		}
+	}
+
 	logger.Infof("removing osd dirs: %+v", removedDirs)
 	if err := agent.removeDirs(context, removedDirs); err != nil {
 		return fmt.Errorf("failed to remove dirs. %+v", err)
@@ -138,6 +275,11 @@ func Run(context *clusterd.Context, agent *OsdAgent, done chan struct{}) error {
 		return fmt.Errorf("failed to save osd dir map. %+v", err)
 	}
 
+	// the filestore osds are converted one at a time once the store type of the node is changed to bluestore
+	if err := agent.convertFilestoreOSDs(context); err != nil {
+		return fmt.Errorf("failed to convert filestore osds. %+v", err)
+	}
+
 	if oposd.IsRemovingNode(agent.devices) {
 		if err := cleanUpNodeResources(context, agent, nodeCrushName); err != nil {
 			logger.Warningf("failed to clean up node resources, they may need to be cleaned up manually: %+v", err)
@@ -145,34 +287,56 @@ func Run(context *clusterd.Context, agent *OsdAgent, done chan struct{}) error {
 	}
 
 	// orchestration is completed, update the status
-	status = oposd.OrchestrationStatus{Status: oposd.OrchestrationStatusCompleted}
+	status = oposd.OrchestrationStatus{Status: oposd.OrchestrationStatusCompleted, OSDs: agent.getPreparedOSDs(),
+		OSDIDs: agent.getOSDIDs()}
 	if err := oposd.UpdateOrchestrationStatusMap(context.Clientset, agent.cluster.Name, agent.nodeName, status); err != nil {
 		return err
 	}
 
-	// OSD processes monitoring
-	mon := NewMonitor(context, agent)
-	go mon.Run()
+	return nil
+}
 
-	// FIX
-	logger.Infof("sleeping a while to let the osds run...")
-	select {
-	case <-time.After(1000000 * time.Second):
-		logger.Warning("OSD sleep has expired")
-	case <-done:
-		logger.Infof("done channel signaled")
+// gets the metadata devices of the node and the metadata devices in the config of its data devices
+func (a *OsdAgent) getMetadataDevices() []string {
+	found := map[string]bool{}
+	var metadataDevices []string
+	add := func(name string) {
+		if name != "" && !found[name] {
+			found[name] = true
+			metadataDevices = append(metadataDevices, name)
+		}
 	}
 
-	return nil
+	for _, name := range strings.Split(a.metadataDevice, ",") {
+		add(strings.TrimSpace(name))
+	}
+
+	var names []string
+	for name := range a.deviceConfig {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(config.MetadataDevice(a.deviceConfig[name]))
+	}
+
+	return metadataDevices
 }
 
-func getAvailableDevices(context *clusterd.Context, desiredDevices string, metadataDevice string, usingDeviceFilter bool) (*DeviceOsdMapping, error) {
+func getAvailableDevices(context *clusterd.Context, desiredDevices string, metadataDevices string, usingDeviceFilter bool) (*DeviceOsdMapping, error) {
 
 	var deviceList []string
 	if !usingDeviceFilter {
 		deviceList = strings.Split(desiredDevices, ",")
 	}
 
+	metadataDeviceList := map[string]bool{}
+	for _, name := range strings.Split(metadataDevices, ",") {
+		if name != "" {
+			metadataDeviceList[name] = true
+		}
+	}
+
 	available := &DeviceOsdMapping{Entries: map[string]*DeviceOsdIDEntry{}}
 
 	if oposd.IsRemovingNode(desiredDevices) {
@@ -195,8 +359,8 @@ func getAvailableDevices(context *clusterd.Context, desiredDevices string, metad
 			continue
 		}
 
-		if metadataDevice != "" && metadataDevice == device.Name {
-			// current device is desired as the metadata device
+		if metadataDeviceList[device.Name] {
+			// current device is desired as a metadata device
 			available.Entries[device.Name] = &DeviceOsdIDEntry{Data: unassignedOSDID, Metadata: []int{}}
 		} else if desiredDevices == "all" {
 			// user has specified all devices, use the current one for data
@@ -282,20 +446,24 @@ func addDirsToDirMap(dirList []string, dirMap *map[string]int) {
 	}
 }
 
-func getRemovedDevices(agent *OsdAgent) (*config.PerfScheme, *DeviceOsdMapping, error) {
+// gets the OSDs on devices that are no longer selected on the node, which is all of them if the node is being removed.
+// The OSDs on the devices that are still selected are not returned so that they are left untouched.
+func getRemovedDevices(context *clusterd.Context, agent *OsdAgent) (*config.PerfScheme, *DeviceOsdMapping, error) {
 	removedDevicesScheme := config.NewPerfScheme()
 	removedDevicesMapping := &DeviceOsdMapping{Entries: map[string]*DeviceOsdIDEntry{}}
 
-	if !oposd.IsRemovingNode(agent.devices) {
-		// TODO: support more removed device scenarios beyond just entire node removal
-		return removedDevicesScheme, removedDevicesMapping, nil
-	}
-
 	scheme, err := config.LoadScheme(agent.kv, config.GetConfigStoreName(agent.nodeName))
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to load agent's partition scheme: %+v", err)
 	}
 
+	uuidToName := map[string]string{}
+	for _, disk := range context.Devices {
+		if disk.UUID != "" {
+			uuidToName[disk.UUID] = disk.Name
+		}
+	}
+
 	for _, entry := range scheme.Entries {
 		// determine which partition the data lives on for this entry
 		dataDetails, ok := entry.Partitions[entry.GetDataPartitionType()]
@@ -303,15 +471,108 @@ func getRemovedDevices(agent *OsdAgent) (*config.PerfScheme, *DeviceOsdMapping,
 			return nil, nil, fmt.Errorf("failed to find data partition for entry %+v", entry)
 		}
 
+		if !oposd.IsRemovingNode(agent.devices) {
+			// the device name may have changed since it was saved, the OSD is kept if either name or the persistent path
+			// of the device is still selected. a device that is not found on the node anymore is only known by its saved
+			// name and path.
+			name := dataDetails.Device
+			found := true
+			if currentName, ok := uuidToName[dataDetails.DiskUUID]; ok {
+				name = currentName
+			} else if disk := findDiskByPath(context, dataDetails.DevicePath); disk != nil {
+				name = disk.Name
+			} else {
+				found = false
+			}
+			if !agent.isDeviceDeselected(name, found) || !agent.isDeviceDeselected(dataDetails.Device, found) ||
+				(dataDetails.DevicePath != "" && !agent.isDeviceDeselected(dataDetails.DevicePath, found)) {
+				continue
+			}
+			logger.Infof("device %s of osd.%d was removed from the device selection, the osd will be removed", name, entry.ID)
+		}
+
 		// add the current scheme entry to the removed devices scheme and its device to the removed
-		// devices mapping
+		// devices mapping. the osds sharing a device are mapped like they were provisioned, with the data of the first
+		// osd and the collocated metadata of all of them.
 		removedDevicesScheme.Entries = append(removedDevicesScheme.Entries, entry)
-		removedDevicesMapping.Entries[dataDetails.Device] = &DeviceOsdIDEntry{Data: entry.ID}
+		mapping, ok := removedDevicesMapping.Entries[dataDetails.Device]
+		if !ok {
+			mapping = &DeviceOsdIDEntry{Data: entry.ID}
+			removedDevicesMapping.Entries[dataDetails.Device] = mapping
+		}
+		if entry.IsCollocated() {
+			mapping.Metadata = append(mapping.Metadata, entry.ID)
+		}
 	}
 
 	return removedDevicesScheme, removedDevicesMapping, nil
 }
 
+// determines whether the given device is not selected by the devices declared for the node, or by the device list or
+// filter of the node if they were not passed to the agent. A device that is not found on the node is only deselected if
+// it was removed from the declared devices, its OSD is kept if it only dropped out of the discovered devices.
+func (a *OsdAgent) isDeviceDeselected(name string, found bool) bool {
+	if oposd.IsRemovingNode(a.devices) {
+		return true
+	}
+	if a.keepOSDs {
+		// the orchestration was triggered by new devices, the osds are only removed by the orchestration of the cluster
+		return false
+	}
+	if a.deviceSelection != nil {
+		return isDeviceDeselected(a.deviceSelection, name, found)
+	}
+	if a.devices == "all" {
+		return false
+	}
+	if a.usingDeviceFilter {
+		matched, err := regexp.Match(a.devices, []byte(name))
+		if err != nil {
+			// keep the OSDs if the filter is not valid
+			logger.Warningf("failed to match device %s with filter %s. %+v", name, a.devices, err)
+			return false
+		}
+		return !matched
+	}
+
+	for _, desired := range strings.Split(a.devices, ",") {
+		if desired == name {
+			return false
+		}
+	}
+	return true
+}
+
+func isDeviceDeselected(selection *oposd.DeviceSelection, name string, found bool) bool {
+	for _, drained := range selection.Drained {
+		if drained == name {
+			return true
+		}
+	}
+	if selection.Filter == "all" {
+		return false
+	}
+	if selection.Filter != "" {
+		matched, err := regexp.Match(selection.Filter, []byte(name))
+		if err != nil {
+			logger.Warningf("failed to match device %s with filter %s. %+v", name, selection.Filter, err)
+			return false
+		}
+		return !matched
+	}
+	if selection.Discovered && !found {
+		// the devices matching the device selector are only known if they are found on the node
+		return false
+	}
+
+	for _, desired := range selection.Devices {
+		if desired == name {
+			return false
+		}
+	}
+	return true
+}
+
 func getActiveAndRemovedDirs(currentDirList []string, savedDirMap map[string]int) (activeDirs, removedDirs map[string]int) {
 	activeDirs = map[string]int{}
 	removedDirs = map[string]int{}
@@ -22,7 +22,9 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/google/uuid"
 	"github.com/rook/rook/pkg/clusterd"
+	oposd "github.com/rook/rook/pkg/operator/ceph/cluster/osd"
 	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
 	exectest "github.com/rook/rook/pkg/util/exec/test"
 	"github.com/rook/rook/pkg/util/sys"
@@ -267,14 +269,14 @@ func testGetRemovedDevicesHelper(t *testing.T, storeConfig *config.StoreConfig)
 	defer os.RemoveAll(configDir)
 	os.MkdirAll(configDir, 0755)
 	nodeName := "node3391"
-	agent, _, _ := createTestAgent(t, "none", configDir, nodeName, storeConfig)
+	agent, _, context := createTestAgent(t, "none", configDir, nodeName, storeConfig)
 
 	// mock the pre-existence of osd 1 on device sdx
 	_, _, _ = mockPartitionSchemeEntry(t, 1, "sdx", &agent.storeConfig, agent.kv, nodeName)
 
 	// get the removed devices for this configuration (note we said to use devices "none" above),
 	// it should be osd 1 on device sdx
-	scheme, mapping, err := getRemovedDevices(agent)
+	scheme, mapping, err := getRemovedDevices(context, agent)
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(mapping.Entries))
 	assert.Equal(t, 1, len(scheme.Entries))
@@ -290,3 +292,198 @@ func testGetRemovedDevicesHelper(t *testing.T, storeConfig *config.StoreConfig)
 	assert.NotNil(t, mappingEntry)
 	assert.Equal(t, 1, mappingEntry.Data)
 }
+
+func TestGetRemovedSharedDevice(t *testing.T) {
+	configDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(configDir)
+	os.MkdirAll(configDir, 0755)
+	nodeName := "node2274"
+	agent, _, context := createTestAgent(t, "none", configDir, nodeName, nil)
+
+	// mock the pre-existence of osd 1 and osd 2 that share device sdx
+	scheme := config.NewPerfScheme()
+	diskUUID := ""
+	for i := 0; i < 2; i++ {
+		entry := config.NewPerfSchemeEntry(config.Bluestore)
+		entry.ID = i + 1
+		entry.OsdUUID = uuid.Must(uuid.NewRandom())
+		assert.Nil(t, config.PopulateCollocatedPerfSchemeEntry(entry, "sdx", agent.storeConfig))
+		if i == 0 {
+			diskUUID = entry.Partitions[entry.GetDataPartitionType()].DiskUUID
+		}
+		assert.Nil(t, config.ShareDataDevice(entry, diskUUID, i, 2, 20000))
+		scheme.Entries = append(scheme.Entries, entry)
+	}
+	err := scheme.SaveScheme(agent.kv, config.GetConfigStoreName(nodeName))
+	assert.Nil(t, err)
+
+	// both osds are removed, the mapping of their device keeps both of them
+	removedScheme, mapping, err := getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(removedScheme.Entries))
+	assert.Equal(t, 1, len(mapping.Entries))
+	assert.Equal(t, &DeviceOsdIDEntry{Data: 1, Metadata: []int{1, 2}}, mapping.Entries["sdx"])
+}
+
+func TestGetRemovedDevicesFromDeclaredSelection(t *testing.T) {
+	configDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(configDir)
+	os.MkdirAll(configDir, 0755)
+	nodeName := "node5310"
+
+	// the operator only passes the discovered devices sdx and sdz, sdy was not discovered
+	agent, _, context := createTestAgent(t, "sdx,sdz", configDir, nodeName, nil)
+	agent.deviceSelection = &oposd.DeviceSelection{Devices: []string{"sdx", "sdy", "sdz"}}
+
+	// mock the pre-existence of osd 1 on device sdx, osd 2 on device sdy and osd 3 on device sdz
+	scheme := config.NewPerfScheme()
+	for i, device := range []string{"sdx", "sdy", "sdz"} {
+		entry := config.NewPerfSchemeEntry(config.Bluestore)
+		entry.ID = i + 1
+		entry.OsdUUID = uuid.Must(uuid.NewRandom())
+		config.PopulateCollocatedPerfSchemeEntry(entry, device, agent.storeConfig)
+		scheme.Entries = append(scheme.Entries, entry)
+	}
+	err := scheme.SaveScheme(agent.kv, config.GetConfigStoreName(nodeName))
+	assert.Nil(t, err)
+	diskUUID := func(id int) string {
+		entry := scheme.Entries[id-1]
+		return entry.Partitions[entry.GetDataPartitionType()].DiskUUID
+	}
+	context.Devices = []*sys.LocalDisk{
+		{Name: "sdx", UUID: diskUUID(1)},
+		{Name: "sdz", UUID: diskUUID(3)},
+	}
+
+	// sdy is still declared for the node, its osd is kept even though the device is missing
+	removedScheme, mapping, err := getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(removedScheme.Entries))
+	assert.Equal(t, 0, len(mapping.Entries))
+
+	// sdy was removed from the declared devices, its osd is removed while the device is missing
+	agent.deviceSelection.Devices = []string{"sdx", "sdz"}
+	removedScheme, _, err = getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(removedScheme.Entries))
+	assert.Equal(t, 2, removedScheme.Entries[0].ID)
+
+	// the devices were matched by a selector, a missing device is not known to be deselected
+	agent.deviceSelection = &oposd.DeviceSelection{Devices: []string{"sdx"}, Discovered: true}
+	removedScheme, _, err = getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(removedScheme.Entries))
+	assert.Equal(t, 3, removedScheme.Entries[0].ID)
+
+	// a filter keeps the osds on the missing devices that match it, a drained device is removed
+	agent.deviceSelection = &oposd.DeviceSelection{Filter: "^sd", Drained: []string{"sdz"}}
+	removedScheme, _, err = getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(removedScheme.Entries))
+	assert.Equal(t, 3, removedScheme.Entries[0].ID)
+
+	// all the devices are used, nothing is removed
+	agent.deviceSelection = &oposd.DeviceSelection{Filter: "all"}
+	removedScheme, _, err = getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(removedScheme.Entries))
+
+	// the orchestration for new devices keeps the osds of the deselected and drained devices
+	agent.deviceSelection = &oposd.DeviceSelection{Devices: []string{"sdx"}, Drained: []string{"sdx"}}
+	agent.keepOSDs = true
+	removedScheme, _, err = getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(removedScheme.Entries))
+}
+
+func TestGetRemovedDevicesFromSelection(t *testing.T) {
+	configDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(configDir)
+	os.MkdirAll(configDir, 0755)
+	nodeName := "node4827"
+	agent, _, context := createTestAgent(t, "sdx,sdz", configDir, nodeName, nil)
+
+	// mock the pre-existence of osd 1 on device sdx, osd 2 on device sdy and osd 3 on device sdz
+	scheme := config.NewPerfScheme()
+	for i, device := range []string{"sdx", "sdy", "sdz"} {
+		entry := config.NewPerfSchemeEntry(config.Bluestore)
+		entry.ID = i + 1
+		entry.OsdUUID = uuid.Must(uuid.NewRandom())
+		config.PopulateCollocatedPerfSchemeEntry(entry, device, agent.storeConfig)
+		scheme.Entries = append(scheme.Entries, entry)
+	}
+	err := scheme.SaveScheme(agent.kv, config.GetConfigStoreName(nodeName))
+	assert.Nil(t, err)
+	diskUUID := func(id int) string {
+		entry := scheme.Entries[id-1]
+		return entry.Partitions[entry.GetDataPartitionType()].DiskUUID
+	}
+
+	// sdy is not in the device list anymore, only osd 2 is removed
+	context.Devices = []*sys.LocalDisk{
+		{Name: "sdx", UUID: diskUUID(1)},
+		{Name: "sdy", UUID: diskUUID(2)},
+		{Name: "sdz", UUID: diskUUID(3)},
+	}
+	removedScheme, mapping, err := getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(removedScheme.Entries))
+	assert.Equal(t, 2, removedScheme.Entries[0].ID)
+	assert.Equal(t, 1, len(mapping.Entries))
+	assert.Equal(t, 2, mapping.Entries["sdy"].Data)
+
+	// sdz was renamed to sdw by the kernel, the osd is kept since its saved name is still in the device list
+	context.Devices[2].Name = "sdw"
+	removedScheme, _, err = getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(removedScheme.Entries))
+	assert.Equal(t, 2, removedScheme.Entries[0].ID)
+
+	// the device filter only selects sdx, the osds on sdy and sdz are removed
+	agent.devices = "^sdx$"
+	agent.usingDeviceFilter = true
+	context.Devices[2].Name = "sdz"
+	removedScheme, mapping, err = getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(removedScheme.Entries))
+	assert.Equal(t, 2, len(mapping.Entries))
+	assert.Nil(t, mapping.Entries["sdx"])
+
+	// all devices are selected, nothing is removed
+	agent.devices = "all"
+	removedScheme, mapping, err = getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(removedScheme.Entries))
+	assert.Equal(t, 0, len(mapping.Entries))
+
+	// the device of osd 1 is selected by its persistent path, which was recorded in the scheme
+	entry := scheme.Entries[0]
+	entry.Partitions[entry.GetDataPartitionType()].DevicePath = "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4"
+	err = scheme.SaveScheme(agent.kv, config.GetConfigStoreName(nodeName))
+	assert.Nil(t, err)
+	agent.devices = "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4"
+	agent.usingDeviceFilter = false
+
+	// the device is not found on the node, the osd is kept since its path is still selected
+	context.Devices = []*sys.LocalDisk{
+		{Name: "sdy", UUID: diskUUID(2)},
+		{Name: "sdz", UUID: diskUUID(3)},
+	}
+	agent.resolveDevicePaths(context)
+	assert.Equal(t, "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4", agent.devices)
+	removedScheme, _, err = getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(removedScheme.Entries))
+	assert.Equal(t, 2, removedScheme.Entries[0].ID)
+	assert.Equal(t, 3, removedScheme.Entries[1].ID)
+
+	// the device is found with another name, the osd is matched to it by its path
+	context.Devices = append(context.Devices, &sys.LocalDisk{Name: "sdq", DevLinks: "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4"})
+	agent.resolveDevicePaths(context)
+	assert.Equal(t, "sdq", agent.devices)
+	removedScheme, _, err = getRemovedDevices(context, agent)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(removedScheme.Entries))
+	assert.Equal(t, 2, removedScheme.Entries[0].ID)
+	assert.Equal(t, 3, removedScheme.Entries[1].ID)
+}
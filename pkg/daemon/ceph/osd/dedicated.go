@@ -0,0 +1,94 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rook/rook/pkg/clusterd"
+	oposd "github.com/rook/rook/pkg/operator/ceph/cluster/osd"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// records an OSD that is ready to be run by its own pod
+func (a *OsdAgent) addPreparedOSD(cfg *osdConfig) {
+	if a.preparedOSDs == nil {
+		a.preparedOSDs = map[int]oposd.OSDInfo{}
+	}
+
+	info := oposd.OSDInfo{ID: cfg.id, UUID: cfg.uuid.String(), DataPath: cfg.rootPath}
+	if cfg.dir {
+		info.Directory = cfg.configRoot
+	}
+	a.preparedOSDs[cfg.id] = info
+}
+
+// gets the prepared OSDs of the node sorted by their IDs
+func (a *OsdAgent) getPreparedOSDs() []oposd.OSDInfo {
+	var ids []int
+	for id := range a.preparedOSDs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var osds []oposd.OSDInfo
+	for _, id := range ids {
+		osds = append(osds, a.preparedOSDs[id])
+	}
+	return osds
+}
+
+// gets the IDs of the OSDs configured on the node, sorted. The list is not nil so that the status reports the node has
+// no OSDs.
+func (a *OsdAgent) getOSDIDs() []int {
+	ids := []int{}
+	for id := range a.configuredOSDs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// gets the config of the OSD with the given ID that was provisioned by rook on a device or in a directory of the node.
+// nil is returned if the OSD is not found.
+func (a *OsdAgent) getOSDConfig(context *clusterd.Context, id int) (*osdConfig, error) {
+	storeName := config.GetConfigStoreName(a.nodeName)
+
+	scheme, err := config.LoadScheme(a.kv, storeName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load partition scheme: %+v", err)
+	}
+	for _, entry := range scheme.Entries {
+		if entry.ID == id {
+			return &osdConfig{id: entry.ID, uuid: entry.OsdUUID, configRoot: context.ConfigDir, partitionScheme: entry,
+				storeConfig: a.storeConfig, kv: a.kv, storeName: storeName}, nil
+		}
+	}
+
+	dirMap, err := config.LoadOSDDirMap(a.kv, a.nodeName)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to load osd dir map: %+v", err)
+	}
+	for dir, osdID := range dirMap {
+		if osdID == id {
+			return &osdConfig{id: osdID, configRoot: dir, dir: true, storeConfig: a.storeConfig, kv: a.kv, storeName: storeName}, nil
+		}
+	}
+
+	return nil, nil
+}
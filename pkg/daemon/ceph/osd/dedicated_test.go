@@ -0,0 +1,86 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/mon"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepareOnlyRecordsOSDs(t *testing.T) {
+	executor := &exectest.MockExecutor{}
+	context := &clusterd.Context{Executor: executor}
+	agent := NewAgent(context, "", false, nil, nil, "", "", false, "", config.StoreConfig{}, nil, 0,
+		&mon.ClusterInfo{Name: "myns"}, "node1", mockKVStore())
+	agent.prepareOnly = true
+
+	// the osds are recorded instead of being started
+	dirUUID := uuid.Must(uuid.NewRandom())
+	err := agent.runOSD(context, "myns", &osdConfig{id: 5, uuid: dirUUID, configRoot: "/mnt/data", rootPath: "/mnt/data/osd5", dir: true})
+	assert.Nil(t, err)
+	deviceUUID := uuid.Must(uuid.NewRandom())
+	err = agent.runOSD(context, "myns", &osdConfig{id: 2, uuid: deviceUUID, configRoot: "/var/lib/rook", rootPath: "/var/lib/rook/osd2"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(agent.osdProc))
+
+	osds := agent.getPreparedOSDs()
+	assert.Equal(t, 2, len(osds))
+	assert.Equal(t, 2, osds[0].ID)
+	assert.Equal(t, deviceUUID.String(), osds[0].UUID)
+	assert.Equal(t, "/var/lib/rook/osd2", osds[0].DataPath)
+	assert.Equal(t, "", osds[0].Directory)
+	assert.Equal(t, 5, osds[1].ID)
+	assert.Equal(t, "/mnt/data", osds[1].Directory)
+}
+
+func TestGetOSDConfig(t *testing.T) {
+	context := &clusterd.Context{Executor: &exectest.MockExecutor{}, ConfigDir: "/var/lib/rook"}
+	agent := &OsdAgent{cluster: &mon.ClusterInfo{Name: "myns"}, kv: mockKVStore(), nodeName: "node1",
+		storeConfig: config.StoreConfig{StoreType: config.Bluestore}}
+
+	// osd.1 is on a device and osd.3 is in a directory
+	scheme := config.NewPerfScheme()
+	entry := config.NewPerfSchemeEntry(config.Bluestore)
+	entry.ID = 1
+	entry.OsdUUID = uuid.Must(uuid.NewRandom())
+	config.PopulateCollocatedPerfSchemeEntry(entry, "sda", agent.storeConfig)
+	scheme.Entries = append(scheme.Entries, entry)
+	assert.Nil(t, scheme.SaveScheme(agent.kv, config.GetConfigStoreName(agent.nodeName)))
+	assert.Nil(t, config.SaveOSDDirMap(agent.kv, agent.nodeName, map[string]int{"/mnt/data": 3}))
+
+	cfg, err := agent.getOSDConfig(context, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, entry.OsdUUID, cfg.uuid)
+	assert.Equal(t, "/var/lib/rook", cfg.configRoot)
+	assert.False(t, cfg.dir)
+	assert.NotNil(t, cfg.partitionScheme)
+
+	cfg, err = agent.getOSDConfig(context, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, "/mnt/data", cfg.configRoot)
+	assert.True(t, cfg.dir)
+
+	// the osd is not on the node
+	cfg, err = agent.getOSDConfig(context, 4)
+	assert.Nil(t, err)
+	assert.Nil(t, cfg)
+}
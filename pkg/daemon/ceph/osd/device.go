@@ -29,11 +29,13 @@ import (
 	"github.com/rook/rook/pkg/clusterd"
 	"github.com/rook/rook/pkg/daemon/ceph/client"
 	"github.com/rook/rook/pkg/daemon/ceph/mon"
+	oposd "github.com/rook/rook/pkg/operator/ceph/cluster/osd"
 	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
 	"github.com/rook/rook/pkg/operator/k8sutil"
 	"github.com/rook/rook/pkg/util/display"
 	"github.com/rook/rook/pkg/util/exec"
 	"github.com/rook/rook/pkg/util/sys"
+	"k8s.io/apimachinery/pkg/api/errors"
 )
 
 const (
@@ -60,6 +62,10 @@ type osdConfig struct {
 	partitionScheme *config.PerfSchemeEntry
 	kv              *k8sutil.ConfigMapKVStore
 	storeName       string
+	// the key of the dm-crypt partitions of an encrypted OSD
+	encryptionKey string
+	// the memory limit (bytes) of the OSD, 0 if the memory is not limited
+	memoryLimit int64
 }
 
 type Device struct {
@@ -137,39 +143,43 @@ func partitionMetadata(context *clusterd.Context, info *config.MetadataDeviceInf
 		return fmt.Errorf("failed to load the saved partition scheme: %+v", err)
 	}
 
-	if savedScheme.Metadata != nil && len(savedScheme.Metadata.Partitions) > 0 {
-		// TODO: there is already an existing metadata partition scheme that has been applied, we should be able to add to it
-		// https://github.com/rook/rook/issues/341
-		if info.DiskUUID == savedScheme.Metadata.DiskUUID {
-			// the existing metadata partition scheme is the same disk as the desired metadata device.  no work to perform.
+	if saved := savedScheme.GetMetadataDevice(info.DiskUUID); saved != nil && len(saved.Partitions) > 0 {
+		// there is already an existing metadata partition scheme that has been applied to the device
+		if len(info.Partitions) <= len(saved.Partitions) {
+			// all the desired metadata partitions already exist.  no work to perform.
 			return nil
 		}
-		return fmt.Errorf("metadata partition scheme already exists on %s (%s), cannot use desired metadata device %s (%s)",
-			savedScheme.Metadata.Device, savedScheme.Metadata.DiskUUID, info.Device, info.DiskUUID)
-	}
 
-	// check one last time to make sure it's OK for us to format this metadata device
-	ownPartitions, fs, err := sys.CheckIfDeviceAvailable(context.Executor, info.Device)
-	if err != nil {
-		return fmt.Errorf("failed to get metadata device %s info: %+v", info.Device, err)
-	} else if fs != "" || !ownPartitions {
-		return fmt.Errorf("metadata device %s is already in use (not by rook). fs: %s, ownPartitions: %t", info.Device, fs, ownPartitions)
-	}
+		// add the partitions of the new OSDs after the existing ones
+		logger.Infof("adding %d partitions to metadata device %s", len(info.Partitions)-len(saved.Partitions), info.Device)
+		err = sys.CreatePartitions(info.Device, info.GetAppendPartitionArgs(len(saved.Partitions)), context.Executor)
+		if err != nil {
+			return fmt.Errorf("failed to add partitions to metadata device /dev/%s. %+v", info.Device, err)
+		}
+	} else {
+		// check one last time to make sure it's OK for us to format this metadata device
+		ownPartitions, fs, err := sys.CheckIfDeviceAvailable(context.Executor, info.Device)
+		if err != nil {
+			return fmt.Errorf("failed to get metadata device %s info: %+v", info.Device, err)
+		} else if fs != "" || !ownPartitions {
+			return fmt.Errorf("metadata device %s is already in use (not by rook). fs: %s, ownPartitions: %t", info.Device, fs, ownPartitions)
+		}
 
-	// zap/clear all existing partitions
-	err = sys.RemovePartitions(info.Device, context.Executor)
-	if err != nil {
-		return fmt.Errorf("failed to zap partitions on metadata device /dev/%s: %+v", info.Device, err)
-	}
+		// zap/clear all existing partitions
+		err = sys.RemovePartitions(info.Device, context.Executor)
+		if err != nil {
+			return fmt.Errorf("failed to zap partitions on metadata device /dev/%s: %+v", info.Device, err)
+		}
 
-	// create the partitions
-	err = sys.CreatePartitions(info.Device, info.GetPartitionArgs(), context.Executor)
-	if err != nil {
-		return fmt.Errorf("failed to partition metadata device /dev/%s. %+v", info.Device, err)
+		// create the partitions
+		err = sys.CreatePartitions(info.Device, info.GetPartitionArgs(), context.Executor)
+		if err != nil {
+			return fmt.Errorf("failed to partition metadata device /dev/%s. %+v", info.Device, err)
+		}
 	}
 
 	// save the metadata partition info to disk now that it has been committed
-	savedScheme.Metadata = info
+	savedScheme.SetMetadataDevice(info)
 	if err := savedScheme.SaveScheme(kv, storeName); err != nil {
 		return fmt.Errorf("failed to save partition scheme: %+v", err)
 	}
@@ -178,17 +188,21 @@ func partitionMetadata(context *clusterd.Context, info *config.MetadataDeviceInf
 }
 
 // Partitions a device for use by a osd.
-// If there are any partitions or formatting already on the device, it will be wiped.
+// If there are any partitions or formatting already on the device, it will be wiped, unless the osd shares the device
+// with the osds before it.
 func partitionOSD(context *clusterd.Context, cfg *osdConfig) error {
 	dataDetails, err := getDataPartitionDetails(cfg)
 	if err != nil {
 		return err
 	}
 
-	// zap/clear all existing partitions on the device
-	err = sys.RemovePartitions(dataDetails.Device, context.Executor)
-	if err != nil {
-		return fmt.Errorf("failed to zap partitions on metadata device /dev/%s: %+v", dataDetails.Device, err)
+	// zap/clear all existing partitions on the device. the osds that share the device with the first osd add their
+	// partitions after the partitions of the osds before them.
+	if cfg.partitionScheme.DeviceIndex == 0 {
+		err = sys.RemovePartitions(dataDetails.Device, context.Executor)
+		if err != nil {
+			return fmt.Errorf("failed to zap partitions on metadata device /dev/%s: %+v", dataDetails.Device, err)
+		}
 	}
 
 	// create the partitions on the device
@@ -197,6 +211,13 @@ func partitionOSD(context *clusterd.Context, cfg *osdConfig) error {
 		return fmt.Errorf("failed to partition /dev/%s. %+v", dataDetails.Device, err)
 	}
 
+	if cfg.partitionScheme.Encrypted {
+		// the OSD only uses its partitions through their dm-crypt mappings
+		if err := encryptPartitions(context, cfg, cfg.encryptionKey); err != nil {
+			return err
+		}
+	}
+
 	if cfg.partitionScheme.StoreType == config.Filestore {
 		// the OSD is using filestore, create a filesystem for the device (format it) and mount it under config root
 		doFormat := true
@@ -211,6 +232,7 @@ func partitionOSD(context *clusterd.Context, cfg *osdConfig) error {
 		return fmt.Errorf("failed to load the saved partition scheme: %+v", err)
 	}
 	savedScheme.Entries = append(savedScheme.Entries, cfg.partitionScheme)
+	removeReplacedOSD(savedScheme, cfg.id)
 	if err := savedScheme.SaveScheme(cfg.kv, cfg.storeName); err != nil {
 		return fmt.Errorf("failed to save partition scheme: %+v", err)
 	}
@@ -232,15 +254,24 @@ func prepareFilestoreDevice(context *clusterd.Context, cfg *osdConfig, doFormat
 		return fmt.Errorf("osd is not a filestore device: %+v", cfg)
 	}
 
-	// wait for the special /dev/disk/by-partuuid path to show up
+	// wait for the special /dev/disk/by-partuuid path (or the dm-crypt mapping) to show up
 	dataPartDetails := cfg.partitionScheme.Partitions[config.FilestoreDataPartitionType]
-	dataPartPath := filepath.Join(diskByPartUUID, dataPartDetails.PartitionUUID)
+	dataPartPath := getPartitionPath(cfg, dataPartDetails)
 	logger.Infof("waiting for partition path %s", dataPartPath)
 	err := waitForPath(dataPartPath, context.Executor)
 	if err != nil {
 		return fmt.Errorf("failed waiting for %s: %+v", dataPartPath, err)
 	}
 
+	if journalPartition := getFilestoreJournalPartition(cfg); journalPartition != nil {
+		// the journal partition on the metadata device must be available as well
+		journalPath := getFilestoreJournalPath(cfg)
+		logger.Infof("waiting for journal partition path %s", journalPath)
+		if err := waitForPath(journalPath, context.Executor); err != nil {
+			return fmt.Errorf("failed waiting for %s: %+v", journalPath, err)
+		}
+	}
+
 	if doFormat {
 		// perform the format and retry if needed
 		if err = sys.FormatDevice(dataPartPath, context.Executor); err != nil {
@@ -314,8 +345,10 @@ func getMetadataPartitionDetails(cfg *osdConfig) (*config.PerfSchemePartitionDet
 	metadataPartitionType := cfg.partitionScheme.GetMetadataPartitionType()
 
 	if cfg.partitionScheme.StoreType == config.Filestore {
-		// TODO: support separate metadata device for filestore (just use the data partition details for now)
-		return getDataPartitionDetails(cfg)
+		if _, ok := cfg.partitionScheme.Partitions[metadataPartitionType]; !ok {
+			// the journal is collocated in the data partition
+			return getDataPartitionDetails(cfg)
+		}
 	}
 
 	metadataDetails, ok := cfg.partitionScheme.Partitions[metadataPartitionType]
@@ -379,6 +412,11 @@ func getStoreSettings(cfg *osdConfig) (map[string]string, error) {
 		if cfg.storeConfig.JournalSizeMB > 0 {
 			journalSize = cfg.storeConfig.JournalSizeMB
 		}
+		if journalPartition := getFilestoreJournalPartition(cfg); journalPartition != nil {
+			// the journal is on its own partition of a metadata device
+			journalSize = journalPartition.SizeMB
+			settings["osd journal"] = getFilestoreJournalPath(cfg)
+		}
 		settings["osd journal size"] = strconv.Itoa(journalSize)
 		return settings, nil
 	}
@@ -442,9 +480,37 @@ func getStoreSettings(cfg *osdConfig) (map[string]string, error) {
 	settings["bluestore block db path"] = dbPath
 	settings["bluestore block path"] = blockPath
 
+	for name, val := range getMemorySettings(cfg) {
+		settings[name] = val
+	}
+
 	return settings, nil
 }
 
+// returns the scrub hours last applied to the running osds by the scrub schedule of the cluster, so that an osd that
+// starts later scrubs in the same hours
+func getScrubSettings(kv *k8sutil.ConfigMapKVStore) map[string]string {
+	if kv == nil {
+		return nil
+	}
+	hours, err := kv.GetStore(oposd.ScrubHoursMapName)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Warningf("failed to get the scrub hours of the osds. %+v", err)
+		}
+		return nil
+	}
+
+	settings := map[string]string{}
+	if begin, ok := hours[oposd.ScrubBeginHourKey]; ok {
+		settings["osd scrub begin hour"] = begin
+	}
+	if end, ok := hours[oposd.ScrubEndHourKey]; ok {
+		settings["osd scrub end hour"] = end
+	}
+	return settings
+}
+
 func writeConfigFile(cfg *osdConfig, context *clusterd.Context, cluster *mon.ClusterInfo, location string) error {
 	cephConfig := mon.CreateDefaultCephConfig(context, cluster, cfg.rootPath)
 	if isBluestore(cfg) {
@@ -467,6 +533,10 @@ func writeConfigFile(cfg *osdConfig, context *clusterd.Context, cluster *mon.Clu
 		return fmt.Errorf("failed to read store settings. %+v", err)
 	}
 
+	for name, val := range getScrubSettings(cfg.kv) {
+		settings[name] = val
+	}
+
 	// write the OSD config file to disk
 	_, err = mon.GenerateConfigFile(context, cluster, cfg.rootPath, fmt.Sprintf("osd.%d", cfg.id),
 		getOSDKeyringPath(cfg.rootPath), cephConfig, settings)
@@ -570,7 +640,7 @@ func addOSDToCrushMap(context *clusterd.Context, config *osdConfig, clusterName,
 		if err != nil {
 			return fmt.Errorf("failed to get data partition details for osd %d (%s): %+v", osdID, osdDataPath, err)
 		}
-		dataPartPath := filepath.Join(diskByPartUUID, dataPartDetails.PartitionUUID)
+		dataPartPath := getPartitionPath(config, dataPartDetails)
 		devProps, err := sys.GetDevicePropertiesFromPath(dataPartPath, context.Executor)
 		if err != nil {
 			return fmt.Errorf("failed to get device properties for %s: %+v", dataPartPath, err)
@@ -590,16 +660,36 @@ func addOSDToCrushMap(context *clusterd.Context, config *osdConfig, clusterName,
 	weight := float64(totalBytes/1024) / 1073741824.0
 	weight, _ = strconv.ParseFloat(fmt.Sprintf("%.4f", weight), 64)
 
+	// a new osd starts at a fraction of its weight when its weight is raised in steps
+	rampStep := config.storeConfig.WeightRampStep
+	initialWeight := weight
+	if rampStep > 0 {
+		initialWeight = oposd.RoundWeight(weight * rampStep)
+	}
+
 	osdEntity := fmt.Sprintf("osd.%d", osdID)
 	logger.Infof("adding %s (%s), bytes: %d, weight: %.4f, to crush map at '%s'",
-		osdEntity, osdDataPath, totalBytes, weight, location)
-	args := []string{"osd", "crush", "create-or-move", strconv.Itoa(osdID), fmt.Sprintf("%.4f", weight)}
+		osdEntity, osdDataPath, totalBytes, initialWeight, location)
+	args := []string{"osd", "crush", "create-or-move", strconv.Itoa(osdID), fmt.Sprintf("%.4f", initialWeight)}
 	args = append(args, strings.Split(location, " ")...)
 	_, err = client.ExecuteCephCommand(context, clusterName, args)
 	if err != nil {
 		return fmt.Errorf("failed adding %s to crush map: %+v", osdEntity, err)
 	}
 
+	if config.partitionScheme != nil && config.partitionScheme.DeviceClass != "" {
+		logger.Infof("setting device class of %s to %s", osdEntity, config.partitionScheme.DeviceClass)
+		if err := client.SetDeviceClass(context, clusterName, osdID, config.partitionScheme.DeviceClass); err != nil {
+			return err
+		}
+	}
+
+	if rampStep > 0 {
+		if err := startWeightRamp(context, clusterName, osdID, initialWeight, weight, rampStep); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -647,13 +737,32 @@ func getBluestorePartitionPaths(cfg *osdConfig) (string, string, string, error)
 		return "", "", "", fmt.Errorf("failed to find block partition for osd %d", cfg.id)
 	}
 
-	return filepath.Join(diskByPartUUID, walPartition.PartitionUUID),
-		filepath.Join(diskByPartUUID, dbPartition.PartitionUUID),
-		filepath.Join(diskByPartUUID, blockPartition.PartitionUUID),
+	return getPartitionPath(cfg, walPartition),
+		getPartitionPath(cfg, dbPartition),
+		getPartitionPath(cfg, blockPartition),
 		nil
 
 }
 
+// gets the journal partition of a filestore OSD, or nil if the journal is collocated with the data
+func getFilestoreJournalPartition(cfg *osdConfig) *config.PerfSchemePartitionDetails {
+	if cfg.dir || cfg.partitionScheme == nil {
+		return nil
+	}
+
+	return cfg.partitionScheme.Partitions[config.FilestoreJournalPartitionType]
+}
+
+// gets the path of the journal of a filestore OSD, which is either a partition of a metadata device or a file in the
+// OSD data dir
+func getFilestoreJournalPath(cfg *osdConfig) string {
+	if journalPartition := getFilestoreJournalPartition(cfg); journalPartition != nil {
+		return getPartitionPath(cfg, journalPartition)
+	}
+
+	return getOSDJournalPath(cfg.rootPath)
+}
+
 func getBluestoreDirPaths(cfg *osdConfig) (string, string, string, error) {
 	if !isBluestoreDir(cfg) {
 		return "", "", "", fmt.Errorf("must be bluestore dir to get bluestore dir paths: %+v", cfg)
@@ -26,6 +26,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/rook/rook/pkg/clusterd"
+	oposd "github.com/rook/rook/pkg/operator/ceph/cluster/osd"
 	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
 	exectest "github.com/rook/rook/pkg/util/exec/test"
 	"github.com/rook/rook/pkg/util/sys"
@@ -196,12 +197,12 @@ func TestPartitionBluestoreMetadata(t *testing.T) {
 	e1 := config.NewPerfSchemeEntry(config.Bluestore)
 	e1.ID = 1
 	e1.OsdUUID = uuid.Must(uuid.NewRandom())
-	config.PopulateDistributedPerfSchemeEntry(e1, "sdb", metadata, storeConfig)
+	config.PopulateDistributedPerfSchemeEntry(e1, "sdb", metadata, storeConfig, config.DeviceSizes{})
 
 	e2 := config.NewPerfSchemeEntry(config.Bluestore)
 	e2.ID = 2
 	e2.OsdUUID = uuid.Must(uuid.NewRandom())
-	config.PopulateDistributedPerfSchemeEntry(e2, "sdc", metadata, storeConfig)
+	config.PopulateDistributedPerfSchemeEntry(e2, "sdc", metadata, storeConfig, config.DeviceSizes{})
 
 	// perform the metadata device partition
 	err = partitionMetadata(context, metadata, mockKVStore(), config.GetConfigStoreName(nodeID))
@@ -212,6 +213,60 @@ func TestPartitionBluestoreMetadata(t *testing.T) {
 	// e.g. OSDs 1 and 2
 }
 
+func TestPartitionBluestoreMetadataAppend(t *testing.T) {
+	nodeID := "node123"
+	kv := mockKVStore()
+
+	execCount := 0
+	executor := &exectest.MockExecutor{}
+	executor.MockExecuteCommand = func(debug bool, name string, command string, args ...string) error {
+		logger.Infof("RUN %d for '%s'. %s %+v", execCount, name, command, args)
+		assert.Equal(t, "sgdisk", command)
+
+		// the device is not zapped, only the partitions of the new OSD are added
+		assert.Equal(t, 7, len(args))
+		assert.Equal(t, "--change-name=5:ROOK-OSD3-WAL", args[1])
+		assert.Equal(t, "--change-name=6:ROOK-OSD3-DB", args[4])
+		assert.Equal(t, "/dev/sda", args[6])
+		execCount++
+		return nil
+	}
+	context := &clusterd.Context{Executor: executor}
+
+	// the metadata device sda already has the partitions for 2 OSDs (sdb, sdc)
+	storeConfig := config.StoreConfig{StoreType: config.Bluestore, WalSizeMB: 1, DatabaseSizeMB: 2}
+	metadata := config.NewMetadataDeviceInfo("sda")
+	for i, device := range []string{"sdb", "sdc"} {
+		e := config.NewPerfSchemeEntry(config.Bluestore)
+		e.ID = i + 1
+		e.OsdUUID = uuid.Must(uuid.NewRandom())
+		config.PopulateDistributedPerfSchemeEntry(e, device, metadata, storeConfig, config.DeviceSizes{})
+	}
+	scheme := config.NewPerfScheme()
+	scheme.SetMetadataDevice(metadata)
+	err := scheme.SaveScheme(kv, config.GetConfigStoreName(nodeID))
+	assert.Nil(t, err)
+
+	// add a third OSD (sdd) that will store its metadata on sda
+	e3 := config.NewPerfSchemeEntry(config.Bluestore)
+	e3.ID = 3
+	e3.OsdUUID = uuid.Must(uuid.NewRandom())
+	config.PopulateDistributedPerfSchemeEntry(e3, "sdd", metadata, storeConfig, config.DeviceSizes{})
+
+	err = partitionMetadata(context, metadata, kv, config.GetConfigStoreName(nodeID))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, execCount)
+
+	// the saved metadata device has all the partitions now, partitioning again has no work to perform
+	savedScheme, err := config.LoadScheme(kv, config.GetConfigStoreName(nodeID))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(savedScheme.MetadataDevices))
+	assert.Equal(t, 6, len(savedScheme.MetadataDevices[0].Partitions))
+	err = partitionMetadata(context, metadata, kv, config.GetConfigStoreName(nodeID))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, execCount)
+}
+
 func TestPartitionBluestoreMetadataSafe(t *testing.T) {
 	// set up a temporary config directory that will be cleaned up after test
 	configDir, err := ioutil.TempDir("", "TestPartitionBluestoreMetadataSafe")
@@ -241,7 +296,7 @@ func TestPartitionBluestoreMetadataSafe(t *testing.T) {
 	e1 := config.NewPerfSchemeEntry(config.Bluestore)
 	e1.ID = 1
 	e1.OsdUUID = uuid.Must(uuid.NewRandom())
-	config.PopulateDistributedPerfSchemeEntry(e1, "sda", metadata, storeConfig)
+	config.PopulateDistributedPerfSchemeEntry(e1, "sda", metadata, storeConfig, config.DeviceSizes{})
 
 	// attempt to perform the metadata device partition.  this should fail because we should detect
 	// that the metadata device has a filesystem already (not safe to format)
@@ -333,3 +388,54 @@ func testPartitionOSDHelper(t *testing.T, storeConfig config.StoreConfig) {
 	assert.Nil(t, err)
 	assert.NotEqual(t, "", dataDetails.DiskUUID)
 }
+
+func TestFilestoreJournalOnMetadataDevice(t *testing.T) {
+	storeConfig := config.StoreConfig{StoreType: config.Filestore, JournalSizeMB: 2048}
+	metadata := config.NewMetadataDeviceInfo("nvme01")
+	entry := config.NewPerfSchemeEntry(config.Filestore)
+	entry.ID = 1
+	entry.OsdUUID = uuid.Must(uuid.NewRandom())
+	err := config.PopulateDistributedPerfSchemeEntry(entry, "sda", metadata, storeConfig, config.DeviceSizes{})
+	assert.Nil(t, err)
+
+	// the journal is the partition on the metadata device
+	cfg := &osdConfig{id: 1, rootPath: "/tmp/osd1", partitionScheme: entry, storeConfig: storeConfig}
+	journalPath := filepath.Join(diskByPartUUID, entry.Partitions[config.FilestoreJournalPartitionType].PartitionUUID)
+	assert.Equal(t, journalPath, getFilestoreJournalPath(cfg))
+	details, err := getMetadataPartitionDetails(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, "nvme01", details.Device)
+
+	settings, err := getStoreSettings(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, journalPath, settings["osd journal"])
+	assert.Equal(t, "2048", settings["osd journal size"])
+
+	// a collocated journal is a file in the osd data dir
+	entry = config.NewPerfSchemeEntry(config.Filestore)
+	entry.ID = 2
+	err = config.PopulateCollocatedPerfSchemeEntry(entry, "sdb", storeConfig)
+	assert.Nil(t, err)
+	cfg = &osdConfig{id: 2, rootPath: "/tmp/osd2", partitionScheme: entry, storeConfig: storeConfig}
+	assert.Equal(t, "/tmp/osd2/journal", getFilestoreJournalPath(cfg))
+	details, err = getMetadataPartitionDetails(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, "sdb", details.Device)
+
+	settings, err = getStoreSettings(cfg)
+	assert.Nil(t, err)
+	_, ok := settings["osd journal"]
+	assert.False(t, ok)
+	assert.Equal(t, "2048", settings["osd journal size"])
+}
+
+func TestGetScrubSettings(t *testing.T) {
+	// the osds keep the default scrub hours until the scrub schedule applied its hours
+	kv := mockKVStore()
+	assert.Nil(t, getScrubSettings(nil))
+	assert.Nil(t, getScrubSettings(kv))
+
+	assert.Nil(t, kv.SetValue(oposd.ScrubHoursMapName, oposd.ScrubBeginHourKey, "22"))
+	assert.Nil(t, kv.SetValue(oposd.ScrubHoursMapName, oposd.ScrubEndHourKey, "6"))
+	assert.Equal(t, map[string]string{"osd scrub begin hour": "22", "osd scrub end hour": "6"}, getScrubSettings(kv))
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	cryptsetupCmd              = "cryptsetup"
+	dmcryptMapperDir           = "/dev/mapper"
+	encryptionKeySecretNameFmt = "rook-ceph-osd-encryption-key-%d"
+	encryptionKeyName          = "dmcrypt-key"
+	encryptionKeySize          = 32
+)
+
+// gets the path of a partition of the given OSD. The partitions of an encrypted OSD are used through their dm-crypt
+// mappings, which are named after the partition uuids.
+func getPartitionPath(cfg *osdConfig, details *config.PerfSchemePartitionDetails) string {
+	if cfg.partitionScheme != nil && cfg.partitionScheme.Encrypted {
+		return filepath.Join(dmcryptMapperDir, details.PartitionUUID)
+	}
+
+	return filepath.Join(diskByPartUUID, details.PartitionUUID)
+}
+
+func encryptionKeySecretName(osdID int) string {
+	return fmt.Sprintf(encryptionKeySecretNameFmt, osdID)
+}
+
+// creates a new random encryption key for the given OSD and stores it in a secret. The key of an OSD that was
+// partially created before is reused.
+func createEncryptionKey(context *clusterd.Context, namespace string, osdID int, ownerRef metav1.OwnerReference) (string, error) {
+	key, err := getEncryptionKey(context, namespace, osdID)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.IsNotFound(err) {
+		return "", err
+	}
+
+	b := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate encryption key for osd.%d. %+v", osdID, err)
+	}
+	key = base64.StdEncoding.EncodeToString(b)
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            encryptionKeySecretName(osdID),
+			Namespace:       namespace,
+			OwnerReferences: []metav1.OwnerReference{ownerRef},
+		},
+		Data: map[string][]byte{encryptionKeyName: []byte(key)},
+		Type: k8sutil.RookType,
+	}
+	if _, err := context.Clientset.CoreV1().Secrets(namespace).Create(secret); err != nil {
+		return "", fmt.Errorf("failed to save encryption key of osd.%d. %+v", osdID, err)
+	}
+
+	logger.Infof("created encryption key for osd.%d", osdID)
+	return key, nil
+}
+
+// gets the encryption key of the given OSD from its secret
+func getEncryptionKey(context *clusterd.Context, namespace string, osdID int) (string, error) {
+	secret, err := context.Clientset.CoreV1().Secrets(namespace).Get(encryptionKeySecretName(osdID), metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	key, ok := secret.Data[encryptionKeyName]
+	if !ok {
+		return "", fmt.Errorf("encryption key of osd.%d not found in secret %s", osdID, secret.Name)
+	}
+	return string(key), nil
+}
+
+// deletes the encryption key of the given OSD, after which the data on its devices cannot be decrypted anymore
+func deleteEncryptionKey(context *clusterd.Context, namespace string, osdID int) error {
+	err := context.Clientset.CoreV1().Secrets(namespace).Delete(encryptionKeySecretName(osdID), &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete encryption key of osd.%d. %+v", osdID, err)
+	}
+
+	logger.Infof("deleted encryption key for osd.%d", osdID)
+	return nil
+}
+
+// gets the encryption key of an encrypted OSD and opens its partitions if they were already created. A new key is
+// created for a new OSD, its partitions are encrypted when they are created.
+func (a *OsdAgent) prepareEncryption(context *clusterd.Context, cfg *osdConfig) error {
+	if cfg.partitionScheme == nil || !cfg.partitionScheme.Encrypted {
+		return nil
+	}
+
+	savedScheme, err := config.LoadScheme(a.kv, config.GetConfigStoreName(a.nodeName))
+	if err != nil {
+		return fmt.Errorf("failed to load the saved partition scheme: %+v", err)
+	}
+	partitioned := false
+	for _, savedEntry := range savedScheme.Entries {
+		if savedEntry.ID == cfg.id {
+			partitioned = true
+			break
+		}
+	}
+
+	if !partitioned {
+		cfg.encryptionKey, err = createEncryptionKey(context, a.cluster.Name, cfg.id, a.kv.OwnerRef())
+		return err
+	}
+
+	cfg.encryptionKey, err = getEncryptionKey(context, a.cluster.Name, cfg.id)
+	if err != nil {
+		return fmt.Errorf("failed to get encryption key of osd.%d. %+v", cfg.id, err)
+	}
+	if err := openPartitions(context, cfg, cfg.encryptionKey); err != nil {
+		return fmt.Errorf("failed to open encrypted partitions of osd.%d. %+v", cfg.id, err)
+	}
+	return nil
+}
+
+// sets up dm-crypt on each of the new partitions of the given OSD and opens them
+func encryptPartitions(context *clusterd.Context, cfg *osdConfig, key string) error {
+	return withKeyFile(key, func(keyFile string) error {
+		for _, details := range sortedPartitions(cfg.partitionScheme) {
+			partitionPath := filepath.Join(diskByPartUUID, details.PartitionUUID)
+			if err := waitForPath(partitionPath, context.Executor); err != nil {
+				return fmt.Errorf("failed waiting for %s: %+v", partitionPath, err)
+			}
+
+			logger.Infof("encrypting partition %s on device %s for osd.%d", details.PartitionUUID, details.Device, cfg.id)
+			if err := context.Executor.ExecuteCommand(false, "luks format", cryptsetupCmd,
+				"--batch-mode", "--key-file", keyFile, "luksFormat", partitionPath); err != nil {
+				return fmt.Errorf("failed to encrypt partition %s on device %s. %+v", details.PartitionUUID, details.Device, err)
+			}
+			if err := openPartition(context, details, keyFile); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// opens the encrypted partitions of the given OSD that are not open yet
+func openPartitions(context *clusterd.Context, cfg *osdConfig, key string) error {
+	return withKeyFile(key, func(keyFile string) error {
+		for _, details := range sortedPartitions(cfg.partitionScheme) {
+			if _, err := context.Executor.ExecuteStat(getPartitionPath(cfg, details)); err == nil {
+				// the partition is already open
+				continue
+			}
+
+			partitionPath := filepath.Join(diskByPartUUID, details.PartitionUUID)
+			if err := waitForPath(partitionPath, context.Executor); err != nil {
+				return fmt.Errorf("failed waiting for %s: %+v", partitionPath, err)
+			}
+			if err := openPartition(context, details, keyFile); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func openPartition(context *clusterd.Context, details *config.PerfSchemePartitionDetails, keyFile string) error {
+	partitionPath := filepath.Join(diskByPartUUID, details.PartitionUUID)
+	if err := context.Executor.ExecuteCommand(false, "luks open", cryptsetupCmd,
+		"--key-file", keyFile, "luksOpen", partitionPath, details.PartitionUUID); err != nil {
+		return fmt.Errorf("failed to open encrypted partition %s on device %s. %+v", details.PartitionUUID, details.Device, err)
+	}
+	return nil
+}
+
+// closes the dm-crypt mappings of the partitions of the given OSD
+func closePartitions(context *clusterd.Context, cfg *osdConfig) error {
+	for _, details := range sortedPartitions(cfg.partitionScheme) {
+		if _, err := context.Executor.ExecuteStat(getPartitionPath(cfg, details)); err != nil {
+			// the partition is not open
+			continue
+		}
+		if err := context.Executor.ExecuteCommand(false, "luks close", cryptsetupCmd, "luksClose", details.PartitionUUID); err != nil {
+			return fmt.Errorf("failed to close encrypted partition %s on device %s. %+v", details.PartitionUUID, details.Device, err)
+		}
+	}
+	return nil
+}
+
+// writes the key to a temporary file that is only readable by the owner for cryptsetup to read it, the file is
+// removed as soon as the given func returns
+func withKeyFile(key string, f func(keyFile string) error) error {
+	file, err := ioutil.TempFile("", "osd-key")
+	if err != nil {
+		return fmt.Errorf("failed to create key file. %+v", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(key)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write key file. %+v", err)
+	}
+
+	return f(file.Name())
+}
+
+// gets the partitions of the given OSD in a predictable order
+func sortedPartitions(entry *config.PerfSchemeEntry) []*config.PerfSchemePartitionDetails {
+	var uuids []string
+	byUUID := map[string]*config.PerfSchemePartitionDetails{}
+	for _, details := range entry.Partitions {
+		uuids = append(uuids, details.PartitionUUID)
+		byUUID[details.PartitionUUID] = details
+	}
+	sort.Strings(uuids)
+
+	partitions := make([]*config.PerfSchemePartitionDetails, len(uuids))
+	for i, uuid := range uuids {
+		partitions[i] = byUUID[uuid]
+	}
+	return partitions
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/mon"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	testop "github.com/rook/rook/pkg/operator/test"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEncryptionKey(t *testing.T) {
+	context := &clusterd.Context{Clientset: testop.New(1)}
+
+	// a new key is created and stored in a secret
+	key, err := createEncryptionKey(context, "myns", 3, metav1.OwnerReference{Name: "mycluster"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", key)
+	secret, err := context.Clientset.CoreV1().Secrets("myns").Get("rook-ceph-osd-encryption-key-3", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "mycluster", secret.OwnerReferences[0].Name)
+	stored, err := getEncryptionKey(context, "myns", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, key, stored)
+
+	// the existing key is reused and the keys of other osds are different
+	again, err := createEncryptionKey(context, "myns", 3, metav1.OwnerReference{})
+	assert.Nil(t, err)
+	assert.Equal(t, key, again)
+	other, err := createEncryptionKey(context, "myns", 4, metav1.OwnerReference{})
+	assert.Nil(t, err)
+	assert.NotEqual(t, key, other)
+
+	// the key is destroyed
+	err = deleteEncryptionKey(context, "myns", 3)
+	assert.Nil(t, err)
+	_, err = getEncryptionKey(context, "myns", 3)
+	assert.NotNil(t, err)
+	err = deleteEncryptionKey(context, "myns", 3)
+	assert.Nil(t, err)
+}
+
+func TestEncryptedPartitions(t *testing.T) {
+	configDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(configDir)
+
+	commands := []string{}
+	openMappings := map[string]bool{}
+	executor := &exectest.MockExecutor{
+		MockExecuteCommand: func(debug bool, actionName string, command string, args ...string) error {
+			assert.Equal(t, cryptsetupCmd, command)
+			for _, arg := range args {
+				if strings.HasPrefix(arg, "luks") {
+					commands = append(commands, arg)
+				}
+			}
+			// the mapping is named after the partition uuid, which is the last arg
+			switch commands[len(commands)-1] {
+			case "luksOpen":
+				openMappings["/dev/mapper/"+args[len(args)-1]] = true
+			case "luksClose":
+				delete(openMappings, "/dev/mapper/"+args[len(args)-1])
+			}
+			return nil
+		},
+		MockExecuteStat: func(name string) (os.FileInfo, error) {
+			if strings.HasPrefix(name, dmcryptMapperDir) && !openMappings[name] {
+				return nil, fmt.Errorf("%s not found", name)
+			}
+			return nil, nil
+		},
+	}
+	context := &clusterd.Context{Clientset: testop.New(1), Executor: executor, ConfigDir: configDir}
+	agent := &OsdAgent{cluster: &mon.ClusterInfo{Name: "myns"}, kv: mockKVStore(), nodeName: "node1"}
+
+	entry := config.NewPerfSchemeEntry(config.Bluestore)
+	entry.ID = 1
+	entry.Encrypted = true
+	config.PopulateCollocatedPerfSchemeEntry(entry, "sda", config.StoreConfig{StoreType: config.Bluestore})
+	cfg := &osdConfig{id: 1, partitionScheme: entry}
+
+	// the partitions of an encrypted osd are used through their dm-crypt mappings
+	wal, db, block, err := getBluestorePartitionPaths(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/mapper/"+entry.Partitions[config.WalPartitionType].PartitionUUID, wal)
+	assert.Equal(t, "/dev/mapper/"+entry.Partitions[config.DatabasePartitionType].PartitionUUID, db)
+	assert.Equal(t, "/dev/mapper/"+entry.Partitions[config.BlockPartitionType].PartitionUUID, block)
+
+	// a new osd gets a new key, its partitions are encrypted after they are created
+	err = agent.prepareEncryption(context, cfg)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", cfg.encryptionKey)
+	assert.Equal(t, 0, len(commands))
+	err = encryptPartitions(context, cfg, cfg.encryptionKey)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"luksFormat", "luksOpen", "luksFormat", "luksOpen", "luksFormat", "luksOpen"}, commands)
+	assert.Equal(t, 3, len(openMappings))
+
+	// the partitions of an existing osd are opened with its key if they are not open yet
+	scheme := config.NewPerfScheme()
+	scheme.Entries = append(scheme.Entries, entry)
+	err = scheme.SaveScheme(agent.kv, config.GetConfigStoreName(agent.nodeName))
+	assert.Nil(t, err)
+	delete(openMappings, "/dev/mapper/"+entry.Partitions[config.BlockPartitionType].PartitionUUID)
+	commands = []string{}
+	cfg = &osdConfig{id: 1, partitionScheme: entry}
+	err = agent.prepareEncryption(context, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"luksOpen"}, commands)
+	assert.Equal(t, 3, len(openMappings))
+
+	// the partitions are closed when the osd is removed
+	commands = []string{}
+	err = closePartitions(context, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"luksClose", "luksClose", "luksClose"}, commands)
+	assert.Equal(t, 0, len(openMappings))
+
+	// an osd that is not encrypted uses its partitions directly
+	entry.Encrypted = false
+	commands = []string{}
+	err = agent.prepareEncryption(context, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(commands))
+	_, _, block, err = getBluestorePartitionPaths(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/disk/by-partuuid/"+entry.Partitions[config.BlockPartitionType].PartitionUUID, block)
+}
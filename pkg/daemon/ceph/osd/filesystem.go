@@ -67,7 +67,7 @@ func createOSDFileSystem(context *clusterd.Context, clusterName string, config *
 	}
 
 	if isFilestore(config) {
-		options = append(options, fmt.Sprintf("--osd-journal=%s", getOSDJournalPath(config.rootPath)))
+		options = append(options, fmt.Sprintf("--osd-journal=%s", getFilestoreJournalPath(config)))
 	}
 
 	// create the file system
@@ -0,0 +1,110 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	"github.com/rook/rook/pkg/util/display"
+)
+
+const (
+	// the memory below which an osd is likely to run out of memory during recovery
+	minOSDMemoryBytes = 2 * 1024 * 1024 * 1024
+	// the osd keeps its memory around the target, which is below the limit to leave room for the spikes above the target
+	osdMemoryTargetRatio = 0.8
+	// the part of the memory of an osd given to the bluestore cache by the ceph versions that do not size the cache
+	// from the memory target
+	bluestoreCacheRatio = 0.5
+	// a smaller cache hurts the performance more than it saves memory
+	minBluestoreCacheBytes = 128 * 1024 * 1024
+)
+
+// returns the memory limit of each osd of the pod, or 0 if the memory of the pod is not limited
+func (a *OsdAgent) osdMemoryLimit() int64 {
+	if a.memoryLimit <= 0 {
+		return 0
+	}
+
+	count := a.osdCount
+	if a.foreground || count < 1 {
+		count = 1
+	}
+	limit := a.memoryLimit / int64(count)
+	if limit < minOSDMemoryBytes {
+		logger.Warningf("the memory limit of %s per osd (%s for %d osds) is below the minimum of %s. the osds may run out of memory.",
+			display.BytesToString(uint64(limit)), display.BytesToString(uint64(a.memoryLimit)), count,
+			display.BytesToString(minOSDMemoryBytes))
+	}
+	return limit
+}
+
+// returns the settings that keep a bluestore osd within its memory limit. The memory target is used by newer ceph
+// versions, which size the cache from it, while the cache size is used by the older versions.
+func getMemorySettings(cfg *osdConfig) map[string]string {
+	// the osds provisioned by ceph-volume do not have a partition scheme, their store type is in the store config
+	filestore := isFilestore(cfg) || (cfg.partitionScheme == nil && cfg.storeConfig.StoreType == config.Filestore)
+	if cfg.memoryLimit <= 0 || filestore {
+		return nil
+	}
+
+	cacheSize := int64(float64(cfg.memoryLimit) * bluestoreCacheRatio)
+	if cacheSize < minBluestoreCacheBytes {
+		cacheSize = minBluestoreCacheBytes
+	}
+	return map[string]string{
+		"osd memory target":    strconv.FormatInt(int64(float64(cfg.memoryLimit)*osdMemoryTargetRatio), 10),
+		"bluestore cache size": strconv.FormatInt(cacheSize, 10),
+	}
+}
+
+// counts the osds on the devices of the mapping that have the data of an osd, leaving out the metadata devices
+func (a *OsdAgent) countDataOSDs(mapping *DeviceOsdMapping) int {
+	if mapping == nil {
+		return 0
+	}
+
+	count := 0
+	for name, entry := range mapping.Entries {
+		if entry.Data != unassignedOSDID || entry.Metadata == nil {
+			count += a.osdsPerDevice(name)
+		}
+	}
+	return count
+}
+
+// counts the osds provisioned by ceph-volume on the node: the osds it already found on the logical volumes and the
+// osds it will prepare on the new devices of the mapping
+func (a *OsdAgent) countCephVolumeOSDs(osds []*cephVolumeOSD, mapping *DeviceOsdMapping) int {
+	provisioned := map[string]bool{}
+	for _, osd := range osds {
+		for _, device := range osd.Devices {
+			provisioned[strings.TrimPrefix(device, "/dev/")] = true
+		}
+	}
+
+	count := len(osds)
+	if mapping != nil {
+		for name, entry := range mapping.Entries {
+			if !provisioned[name] && (entry.Data != unassignedOSDID || entry.Metadata == nil) {
+				count += a.osdsPerDevice(name)
+			}
+		}
+	}
+	return count
+}
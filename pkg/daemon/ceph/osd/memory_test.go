@@ -0,0 +1,109 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"testing"
+
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOSDMemoryLimit(t *testing.T) {
+	// the memory is not limited
+	agent := &OsdAgent{osdCount: 4}
+	assert.Equal(t, int64(0), agent.osdMemoryLimit())
+
+	// the limit of the pod is divided between its osds
+	agent.memoryLimit = 8 * 1024 * 1024 * 1024
+	assert.Equal(t, int64(2*1024*1024*1024), agent.osdMemoryLimit())
+
+	// a dedicated pod runs a single osd
+	agent.foreground = true
+	assert.Equal(t, int64(8*1024*1024*1024), agent.osdMemoryLimit())
+}
+
+func TestGetMemorySettings(t *testing.T) {
+	entry := config.NewPerfSchemeEntry(config.Bluestore)
+	cfg := &osdConfig{id: 1, partitionScheme: entry, memoryLimit: 2 * 1024 * 1024 * 1024}
+	settings := getMemorySettings(cfg)
+	assert.Equal(t, "1717986918", settings["osd memory target"])
+	assert.Equal(t, "1073741824", settings["bluestore cache size"])
+
+	// the cache is not made too small
+	cfg.memoryLimit = 128 * 1024 * 1024
+	assert.Equal(t, "134217728", getMemorySettings(cfg)["bluestore cache size"])
+
+	// bluestore osds provisioned by ceph-volume
+	cfg = &osdConfig{id: 2, storeConfig: config.StoreConfig{StoreType: config.Bluestore}, memoryLimit: 1024 * 1024 * 1024}
+	assert.Equal(t, "858993459", getMemorySettings(cfg)["osd memory target"])
+
+	// no settings for filestore or without a limit
+	cfg = &osdConfig{id: 3, partitionScheme: config.NewPerfSchemeEntry(config.Filestore), memoryLimit: 1024 * 1024 * 1024}
+	assert.Nil(t, getMemorySettings(cfg))
+	cfg = &osdConfig{id: 4, dir: true, memoryLimit: 1024 * 1024 * 1024}
+	assert.Nil(t, getMemorySettings(cfg))
+	cfg = &osdConfig{id: 5, partitionScheme: entry}
+	assert.Nil(t, getMemorySettings(cfg))
+}
+
+func TestCountDataOSDs(t *testing.T) {
+	a := &OsdAgent{deviceConfig: map[string]map[string]string{"sdc": {config.OSDsPerDeviceKey: "4"}}}
+	assert.Equal(t, 0, a.countDataOSDs(nil))
+
+	// the new and existing osd devices are counted, but not the metadata devices
+	mapping := &DeviceOsdMapping{Entries: map[string]*DeviceOsdIDEntry{
+		"sda":   {Data: unassignedOSDID},
+		"sdb":   {Data: 3, Metadata: []int{3}},
+		"nvme0": {Data: unassignedOSDID, Metadata: []int{}},
+		"nvme1": {Data: unassignedOSDID, Metadata: []int{4, 5}},
+	}}
+	assert.Equal(t, 2, a.countDataOSDs(mapping))
+
+	// the osds that share a device are counted
+	mapping.Entries["sdc"] = &DeviceOsdIDEntry{Data: unassignedOSDID}
+	assert.Equal(t, 6, a.countDataOSDs(mapping))
+	a.storeConfig.OSDsPerDevice = 2
+	assert.Equal(t, 8, a.countDataOSDs(mapping))
+}
+
+func TestCountCephVolumeOSDs(t *testing.T) {
+	a := &OsdAgent{storeConfig: config.StoreConfig{Provisioner: config.CephVolumeProvisioner}}
+	assert.Equal(t, 0, a.countCephVolumeOSDs(nil, nil))
+
+	// the osds that ceph-volume found on the node are counted, also when their devices are no longer selected
+	osds := []*cephVolumeOSD{
+		{ID: 1, Devices: []string{"/dev/sda", "/dev/sdd"}},
+		{ID: 2, Devices: []string{"/dev/sdb"}},
+		{ID: 3},
+	}
+	assert.Equal(t, 3, a.countCephVolumeOSDs(osds, nil))
+
+	// the new devices are counted once they are prepared, but not the devices that already have an osd
+	mapping := &DeviceOsdMapping{Entries: map[string]*DeviceOsdIDEntry{
+		"sda": {Data: unassignedOSDID},
+		"sdb": {Data: unassignedOSDID},
+		"sdc": {Data: unassignedOSDID},
+	}}
+	assert.Equal(t, 4, a.countCephVolumeOSDs(osds, mapping))
+	a.storeConfig.OSDsPerDevice = 2
+	assert.Equal(t, 5, a.countCephVolumeOSDs(osds, mapping))
+
+	// the memory of the pod is divided between the osds of ceph-volume too
+	a.memoryLimit = 8 * 1024 * 1024 * 1024
+	a.osdCount = a.countDataOSDs(nil) + a.countCephVolumeOSDs(osds, mapping)
+	assert.Equal(t, int64(8*1024*1024*1024/5), a.osdMemoryLimit())
+}
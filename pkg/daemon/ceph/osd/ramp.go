@@ -0,0 +1,109 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/client"
+	oposd "github.com/rook/rook/pkg/operator/ceph/cluster/osd"
+	"github.com/rook/rook/pkg/util"
+)
+
+// records the weight ramp of a new OSD so that the operator raises its weight in steps up to its full weight. An OSD
+// that was already in the CRUSH map keeps its weight.
+func startWeightRamp(context *clusterd.Context, clusterName string, id int, initialWeight, fullWeight, step float64) error {
+	weight := initialWeight
+	usage, err := client.GetOSDUsage(context, clusterName)
+	if err != nil {
+		return fmt.Errorf("failed to get the weight of osd.%d: %+v", id, err)
+	}
+	if u := usage.ByID(id); u != nil {
+		if w, err := u.CrushWeight.Float64(); err == nil {
+			weight = w
+		}
+	}
+
+	ramp := oposd.NewWeightRamp(weight, fullWeight, step)
+	if ramp.State != oposd.WeightRampStateRampingUp {
+		logger.Infof("osd.%d already has weight %.4f, not ramping it up", id, weight)
+		return nil
+	}
+
+	logger.Infof("osd.%d starts at weight %.4f, it will be raised to %.4f in steps of %.4f", id, weight, fullWeight, ramp.StepWeight)
+	return oposd.UpdateWeightRamp(context.Clientset, clusterName, id, ramp)
+}
+
+var (
+	// the time to wait for the data from a drain step to finish moving before the removal of the OSD is given up until
+	// the next orchestration, which continues the drain from the recorded weight
+	drainStepRetries    = 40
+	drainStepRetryDelay = 15 * time.Second
+)
+
+// lowers the weight of the OSD to 0, which moves its data to the other OSDs. With a weight ramp the weight is lowered
+// in steps, each step after the data from the previous step finished moving. The progress is recorded so that a drain
+// that did not finish is continued with the same steps.
+func (a *OsdAgent) drainOSD(context *clusterd.Context, cfg *osdConfig, usage *client.OSDUsage) error {
+	var weight float64
+	if usage != nil {
+		if u := usage.ByID(cfg.id); u != nil {
+			weight, _ = u.CrushWeight.Float64()
+		}
+	}
+
+	step := cfg.storeConfig.WeightRampStep
+	if step <= 0 || weight <= 0 {
+		o, err := client.CrushReweight(context, a.cluster.Name, cfg.id, 0.0)
+		if err != nil {
+			return fmt.Errorf("failed to reweight osd.%d to 0.0: %+v. %s", cfg.id, err, o)
+		}
+		return nil
+	}
+
+	ramp := oposd.NewWeightRamp(weight, 0, step)
+	recorded, err := oposd.GetWeightRamp(context.Clientset, a.cluster.Name, cfg.id)
+	if err != nil {
+		logger.Warningf("failed to get the drain progress of osd.%d. %+v", cfg.id, err)
+	} else if recorded != nil && recorded.State == oposd.WeightRampStateDraining {
+		ramp.StepWeight = recorded.StepWeight
+	}
+	if err := oposd.UpdateWeightRamp(context.Clientset, a.cluster.Name, cfg.id, ramp); err != nil {
+		logger.Warningf("failed to record the drain progress of osd.%d. %+v", cfg.id, err)
+	}
+
+	for !ramp.Done() {
+		err := util.Retry(drainStepRetries, drainStepRetryDelay, func() error {
+			return oposd.CheckPGsClean(context, a.cluster.Name)
+		})
+		if err != nil {
+			return fmt.Errorf("osd.%d is still draining at weight %.4f, its removal continues at the next orchestration: %+v",
+				cfg.id, ramp.Weight, err)
+		}
+
+		ramp, err = ramp.Step(context, a.cluster.Name, cfg.id)
+		if err != nil {
+			return err
+		}
+		if err := oposd.UpdateWeightRamp(context.Clientset, a.cluster.Name, cfg.id, ramp); err != nil {
+			logger.Warningf("failed to record the drain progress of osd.%d. %+v", cfg.id, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/client"
+	"github.com/rook/rook/pkg/daemon/ceph/mon"
+	oposd "github.com/rook/rook/pkg/operator/ceph/cluster/osd"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	testop "github.com/rook/rook/pkg/operator/test"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDrainOSD(t *testing.T) {
+	var reweights []string
+	clean := true
+	executor := &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+			if args[0] == "status" {
+				if !clean {
+					return `{"pgmap":{"num_pgs":100,"pgs_by_state":[{"state_name":"active+clean","count":90},` +
+						`{"state_name":"active+remapped+backfilling","count":10}]}}`, nil
+				}
+				return `{"pgmap":{"num_pgs":100,"pgs_by_state":[{"state_name":"active+clean","count":100}]}}`, nil
+			}
+			if args[0] == "pg" && args[1] == "dump" {
+				return `[{"pgid":"1.ef","state":"active+clean","up":[1,2,3],"up_primary":1,"acting":[1,2,3],"acting_primary":1}]`, nil
+			}
+			if args[0] == "osd" && args[1] == "crush" && args[2] == "reweight" {
+				reweights = append(reweights, strings.Join(args[3:5], " "))
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %v", args)
+		},
+	}
+	context := &clusterd.Context{Clientset: testop.New(1), Executor: executor}
+	agent := &OsdAgent{cluster: &mon.ClusterInfo{Name: "myns"}, kv: mockKVStore(), nodeName: "node1"}
+	usage := &client.OSDUsage{OSDNodes: []client.OSDNodeUsage{{ID: 1, Name: "osd.1", CrushWeight: "1.5"}}}
+
+	// without a ramp the weight is removed at once
+	cfg := &osdConfig{id: 1}
+	err := agent.drainOSD(context, cfg, usage)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"osd.1 0.0000"}, reweights)
+
+	// with a ramp the weight is lowered in steps and the progress is recorded
+	reweights = nil
+	cfg.storeConfig = config.StoreConfig{WeightRampStep: 0.4}
+	err = agent.drainOSD(context, cfg, usage)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"osd.1 0.9000", "osd.1 0.3000", "osd.1 0.0000"}, reweights)
+	cm, err := context.Clientset.CoreV1().ConfigMaps("myns").Get(oposd.WeightRampMapName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Contains(t, cm.Data["osd.1"], `"state":"completed"`)
+
+	// the drain is given up when the data of a step does not finish moving in time
+	drainStepRetries = 1
+	drainStepRetryDelay = 0
+	reweights = nil
+	clean = false
+	assert.Nil(t, oposd.DeleteWeightRamp(context.Clientset, "myns", 1))
+	err = agent.drainOSD(context, cfg, usage)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(reweights))
+	ramp, err := oposd.GetWeightRamp(context.Clientset, "myns", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, oposd.WeightRampStateDraining, ramp.State)
+	assert.Equal(t, 0.6, ramp.StepWeight)
+
+	// the drain continues from the current weight with the recorded steps
+	clean = true
+	usage = &client.OSDUsage{OSDNodes: []client.OSDNodeUsage{{ID: 1, Name: "osd.1", CrushWeight: "0.9"}}}
+	err = agent.drainOSD(context, cfg, usage)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"osd.1 0.3000", "osd.1 0.0000"}, reweights)
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/google/uuid"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/client"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+)
+
+// drops the OSDs of the node that are being replaced and that were destroyed by the operator. The failed device of a
+// destroyed OSD is no longer started, the ID of the OSD is kept in the partition scheme to be reused by the next new
+// device on the node. The ID and the CRUSH position of a destroyed OSD are kept by the cluster.
+func (a *OsdAgent) dropReplacedOSDs(context *clusterd.Context) error {
+	if len(a.replaceOSDs) == 0 {
+		return nil
+	}
+
+	storeName := config.GetConfigStoreName(a.nodeName)
+	scheme, err := config.LoadScheme(a.kv, storeName)
+	if err != nil {
+		return fmt.Errorf("failed to load partition scheme: %+v", err)
+	}
+
+	var replaced []*config.PerfSchemeEntry
+	for _, entry := range scheme.Entries {
+		if a.isReplacingOSD(entry.ID) {
+			replaced = append(replaced, entry)
+		}
+	}
+	if len(replaced) == 0 {
+		return nil
+	}
+
+	dump, err := client.GetOSDDump(context, a.cluster.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range replaced {
+		if !dump.IsDestroyed(entry.ID) {
+			logger.Infof("osd.%d is being replaced but it is not destroyed yet, keeping it", entry.ID)
+			continue
+		}
+
+		cfg := &osdConfig{id: entry.ID, uuid: entry.OsdUUID, configRoot: context.ConfigDir, partitionScheme: entry,
+			storeConfig: a.storeConfig, kv: a.kv, storeName: storeName}
+		logger.Infof("dropping the failed device of destroyed osd.%d, its id will be used by the next new device", entry.ID)
+
+		if err := releaseOSDStorage(context, a.cluster.Name, cfg); err != nil {
+			return err
+		}
+
+		if err := scheme.DeleteSchemeEntry(entry); err != nil {
+			return fmt.Errorf("failed to delete osd.%d from the partition scheme: %+v", entry.ID, err)
+		}
+		scheme.ReplacedOSDs = append(scheme.ReplacedOSDs, entry.ID)
+	}
+
+	if err := scheme.SaveScheme(a.kv, storeName); err != nil {
+		return fmt.Errorf("failed to save partition scheme: %+v", err)
+	}
+	return nil
+}
+
+// releases the storage of a destroyed OSD so that its devices can be partitioned for a new OSD. The key of encrypted
+// partitions is not given to the new OSD and the backup of the old filesystem must not be restored on the new device.
+func releaseOSDStorage(context *clusterd.Context, clusterName string, cfg *osdConfig) error {
+	if cfg.partitionScheme != nil && cfg.partitionScheme.Encrypted {
+		if err := closePartitions(context, cfg); err != nil {
+			logger.Warningf("failed to close the encrypted partitions of osd.%d. %+v", cfg.id, err)
+		}
+		if err := deleteEncryptionKey(context, clusterName, cfg.id); err != nil {
+			return err
+		}
+	}
+
+	if err := deleteOSDFileSystem(cfg); err != nil {
+		logger.Warningf("failed to delete osd.%d filesystem, it may need to be cleaned up manually: %+v", cfg.id, err)
+	}
+	osdRootDir := getOSDRootDir(cfg.configRoot, cfg.id)
+	if err := os.RemoveAll(osdRootDir); err != nil {
+		logger.Warningf("failed to delete osd.%d root dir from %s, it may need to be cleaned up manually: %+v",
+			cfg.id, osdRootDir, err)
+	}
+	return nil
+}
+
+func (a *OsdAgent) isReplacingOSD(id int) bool {
+	for _, replaceID := range a.replaceOSDs {
+		if replaceID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// removes the given OSD from the OSDs that are waiting for a new device in the saved scheme
+func removeReplacedOSD(scheme *config.PerfScheme, id int) {
+	for i, replacedID := range scheme.ReplacedOSDs {
+		if replacedID == id {
+			scheme.ReplacedOSDs = append(scheme.ReplacedOSDs[:i], scheme.ReplacedOSDs[i+1:]...)
+			return
+		}
+	}
+}
+
+func isReplacedOSD(scheme *config.PerfScheme, id int) bool {
+	for _, replacedID := range scheme.ReplacedOSDs {
+		if replacedID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// registers a new OSD with the ID of the given destroyed OSD, which keeps the CRUSH position and weight of the destroyed
+// OSD
+func replaceOSD(context *clusterd.Context, clusterName string, id int) (*int, *uuid.UUID, error) {
+	osdUUID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate UUID for osd: %+v", err)
+	}
+
+	args := []string{"osd", "new", osdUUID.String(), strconv.Itoa(id)}
+	buf, err := client.ExecuteCephCommand(context, clusterName, args)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to recreate destroyed osd.%d: %+v", id, err)
+	}
+
+	var resp map[string]interface{}
+	if err := json.Unmarshal(buf, &resp); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal response: %+v.  raw response: '%s'", err, string(buf[:]))
+	}
+	if osdID, ok := resp["osdid"].(float64); !ok || int(osdID) != id {
+		return nil, nil, fmt.Errorf("unexpected osd id in response to recreating osd.%d: '%s'", id, string(buf[:]))
+	}
+
+	logger.Infof("successfully recreated destroyed OSD %s with ID %d", osdUUID.String(), id)
+	return &id, &osdUUID, nil
+}
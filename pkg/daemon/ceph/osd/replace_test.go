@@ -0,0 +1,131 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/mon"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDropReplacedOSDs(t *testing.T) {
+	configDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(configDir)
+
+	// osd.1 was destroyed by the operator, osd.2 is being replaced but it is not destroyed yet
+	executor := &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+			if args[0] == "osd" && args[1] == "dump" {
+				return `{"osds":[{"osd":1,"up":0,"in":0,"state":["destroyed","exists"]},{"osd":2,"up":0,"in":1,"state":["exists"]},` +
+					`{"osd":3,"up":1,"in":1,"state":["exists","up"]}]}`, nil
+			}
+			return "", fmt.Errorf("unexpected command %v", args)
+		},
+	}
+	context := &clusterd.Context{Executor: executor, ConfigDir: configDir}
+	agent := &OsdAgent{cluster: &mon.ClusterInfo{Name: "myns"}, kv: mockKVStore(), nodeName: "node1",
+		storeConfig: config.StoreConfig{StoreType: config.Bluestore}}
+
+	scheme := config.NewPerfScheme()
+	for i, device := range []string{"sda", "sdb", "sdc"} {
+		entry := config.NewPerfSchemeEntry(config.Bluestore)
+		entry.ID = i + 1
+		entry.OsdUUID = uuid.Must(uuid.NewRandom())
+		config.PopulateCollocatedPerfSchemeEntry(entry, device, agent.storeConfig)
+		scheme.Entries = append(scheme.Entries, entry)
+	}
+	storeName := config.GetConfigStoreName(agent.nodeName)
+	assert.Nil(t, scheme.SaveScheme(agent.kv, storeName))
+
+	// nothing is dropped while no osds are being replaced
+	err := agent.dropReplacedOSDs(context)
+	assert.Nil(t, err)
+	scheme, err = config.LoadScheme(agent.kv, storeName)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(scheme.Entries))
+
+	// only the destroyed osd is dropped and its id is kept for the next new device
+	agent.replaceOSDs = []int{1, 2}
+	err = agent.dropReplacedOSDs(context)
+	assert.Nil(t, err)
+	scheme, err = config.LoadScheme(agent.kv, storeName)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(scheme.Entries))
+	assert.Equal(t, 2, scheme.Entries[0].ID)
+	assert.Equal(t, 3, scheme.Entries[1].ID)
+	assert.Equal(t, []int{1}, scheme.ReplacedOSDs)
+	assert.True(t, isReplacedOSD(scheme, 1))
+	assert.False(t, isReplacedOSD(scheme, 2))
+
+	// the id is no longer pending after it was given to a new device
+	removeReplacedOSD(scheme, 1)
+	assert.Equal(t, 0, len(scheme.ReplacedOSDs))
+}
+
+func TestReplacedOSDReusedByNewDevice(t *testing.T) {
+	registered := 0
+	executor := &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+			if args[0] == "osd" && args[1] == "new" {
+				// the destroyed osd is recreated with its id
+				return fmt.Sprintf(`{"osdid": %s}`, args[3]), nil
+			}
+			if args[0] == "osd" && args[1] == "create" {
+				registered++
+				return `{"osdid": 10}`, nil
+			}
+			return "", fmt.Errorf("unexpected command %v", args)
+		},
+	}
+	context := &clusterd.Context{Executor: executor}
+	agent := &OsdAgent{cluster: &mon.ClusterInfo{Name: "myns"}, kv: mockKVStore(), nodeName: "node1",
+		storeConfig: config.StoreConfig{StoreType: config.Bluestore}}
+
+	scheme := config.NewPerfScheme()
+	scheme.ReplacedOSDs = []int{4}
+	assert.Nil(t, scheme.SaveScheme(agent.kv, config.GetConfigStoreName(agent.nodeName)))
+
+	// the first new device takes the id of the destroyed osd, the next one gets a new id
+	devices := &DeviceOsdMapping{Entries: map[string]*DeviceOsdIDEntry{
+		"sda": {Data: unassignedOSDID},
+		"sdb": {Data: unassignedOSDID},
+	}}
+	scheme, err := agent.getPartitionPerfScheme(context, devices)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(scheme.Entries))
+	assert.Equal(t, 4, scheme.Entries[0].ID)
+	assert.Equal(t, "sda", scheme.Entries[0].Partitions[config.BlockPartitionType].Device)
+	assert.Equal(t, 10, scheme.Entries[1].ID)
+	assert.Equal(t, 1, registered)
+
+	// the id stays pending until the new device is partitioned
+	assert.Equal(t, []int{4}, scheme.ReplacedOSDs)
+
+	// a destroyed osd cannot be recreated with a different id
+	executor.MockExecuteCommandWithOutputFile = func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+		return `{"osdid": 11}`, nil
+	}
+	_, _, err = replaceOSD(context, "myns", 4)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,404 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/client"
+	"github.com/rook/rook/pkg/daemon/ceph/mon"
+	oposd "github.com/rook/rook/pkg/operator/ceph/cluster/osd"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+)
+
+const (
+	cephVolumeCmd = "ceph-volume"
+
+	// the well known locations that ceph-volume expects the config, the bootstrap keyring and the OSD data dirs in
+	cephVolumeConfigDir           = "/etc/ceph"
+	cephVolumeBootstrapKeyringDir = "/var/lib/ceph/bootstrap-osd"
+	cephVolumeOSDDataDir          = "/var/lib/ceph/osd"
+
+	cephVolumeOSDFSIDTag     = "ceph.osd_fsid"
+	cephVolumeClusterFSIDTag = "ceph.cluster_fsid"
+	cephVolumeTypeTag        = "ceph.type"
+)
+
+// an OSD that was prepared by ceph-volume on one or more logical volumes
+type cephVolumeOSD struct {
+	ID        int
+	UUID      uuid.UUID
+	StoreType string
+	Devices   []string
+}
+
+// a logical volume as reported by `ceph-volume lvm list`
+type cephVolumeLV struct {
+	Type    string            `json:"type"`
+	Path    string            `json:"path"`
+	Devices []string          `json:"devices"`
+	Tags    map[string]string `json:"tags"`
+}
+
+func isUsingCephVolume(storeConfig config.StoreConfig) bool {
+	return storeConfig.Provisioner == config.CephVolumeProvisioner
+}
+
+// splits the given devices into the devices that already have OSDs from the partition scheme, which keep running the way
+// they were provisioned, and the devices that are new and will be provisioned by ceph-volume
+func (a *OsdAgent) splitPartitionSchemeDevices(context *clusterd.Context, devices *DeviceOsdMapping) (partitioned, fresh *DeviceOsdMapping, err error) {
+	partitioned = &DeviceOsdMapping{Entries: map[string]*DeviceOsdIDEntry{}}
+	fresh = &DeviceOsdMapping{Entries: map[string]*DeviceOsdIDEntry{}}
+	if devices == nil {
+		return partitioned, fresh, nil
+	}
+
+	scheme, err := config.LoadScheme(a.kv, config.GetConfigStoreName(a.nodeName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load partition scheme: %+v", err)
+	}
+
+	nameToUUID := map[string]string{}
+	for _, disk := range context.Devices {
+		if disk.UUID != "" {
+			nameToUUID[disk.Name] = disk.UUID
+		}
+	}
+
+	for name, mapping := range devices.Entries {
+		if isDeviceInUse(name, nameToUUID, scheme) {
+			partitioned.Entries[name] = mapping
+		} else {
+			fresh.Entries[name] = mapping
+		}
+	}
+
+	return partitioned, fresh, nil
+}
+
+// prepares each of the given new devices with ceph-volume, then activates and runs all the ceph-volume OSDs of this cluster
+// that are found on the node.  The OSDs that were found are returned.
+func (a *OsdAgent) configureCephVolumeDevices(context *clusterd.Context, devices *DeviceOsdMapping) ([]*cephVolumeOSD, error) {
+	if err := writeCephVolumeConfig(context, a.cluster); err != nil {
+		return nil, fmt.Errorf("failed to write ceph-volume config: %+v", err)
+	}
+
+	// the new devices replace the failed devices of the destroyed osds first
+	replaced := map[int]bool{}
+	if devices != nil {
+		storeName := config.GetConfigStoreName(a.nodeName)
+		scheme, err := config.LoadScheme(a.kv, storeName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load partition scheme: %+v", err)
+		}
+
+		// sort the devices so they are prepared in a predictable order
+		var names []string
+		for name := range devices.Entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if !isDeviceDesiredForData(devices.Entries[name]) {
+				logger.Warningf("skipping device %s, a metadata device is not supported by the ceph-volume provisioner", name)
+				continue
+			}
+
+			// the osds that share a device are created together, which cannot reuse the id of a destroyed osd
+			osdID := unassignedOSDID
+			count := a.osdsPerDevice(name)
+			if len(scheme.ReplacedOSDs) > 0 && count == 1 {
+				osdID = scheme.ReplacedOSDs[0]
+			}
+			if err := prepareCephVolumeDevice(context, a.cluster.Name, name, a.getDeviceClass(context, name), osdID, count, a.storeConfig); err != nil {
+				return nil, err
+			}
+
+			if osdID != unassignedOSDID {
+				replaced[osdID] = true
+				removeReplacedOSD(scheme, osdID)
+				if err := scheme.SaveScheme(a.kv, storeName); err != nil {
+					return nil, fmt.Errorf("failed to save partition scheme: %+v", err)
+				}
+			}
+		}
+	}
+
+	osds, err := listCephVolumeOSDs(context, a.cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	succeeded := 0
+	var lastErr error
+	for _, osd := range osds {
+		if err := a.startCephVolumeOSD(context, osd); err != nil {
+			logger.Errorf("failed to start ceph-volume osd.%d. %+v", osd.ID, err)
+			lastErr = err
+		} else {
+			succeeded++
+		}
+
+		if replaced[osd.ID] {
+			// the destroyed osd was marked out by the operator, it takes its place in the cluster again on the new device
+			if o, err := client.OSDIn(context, a.cluster.Name, osd.ID); err != nil {
+				logger.Errorf("failed to mark replaced osd.%d in. %+v. %s", osd.ID, err, o)
+				lastErr = err
+			}
+		}
+	}
+
+	logger.Infof("%d/%d ceph-volume osds succeeded on this node", succeeded, len(osds))
+	return osds, lastErr
+}
+
+// ceph-volume looks for the cluster config and the bootstrap-osd keyring in the default locations, write them there
+func writeCephVolumeConfig(context *clusterd.Context, cluster *mon.ClusterInfo) error {
+	if err := createOSDBootstrapKeyring(context, cluster.Name); err != nil {
+		return fmt.Errorf("failed to create bootstrap osd keyring: %+v", err)
+	}
+
+	copies := map[string]string{
+		mon.GetConfFilePath(path.Join(context.ConfigDir, cluster.Name), cluster.Name): path.Join(cephVolumeConfigDir, fmt.Sprintf("%s.conf", cluster.Name)),
+		getBootstrapOSDKeyringPath(context.ConfigDir, cluster.Name):                   path.Join(cephVolumeBootstrapKeyringDir, fmt.Sprintf("%s.keyring", cluster.Name)),
+	}
+	for src, dest := range copies {
+		contents, err := ioutil.ReadFile(src)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %+v", src, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0744); err != nil {
+			return fmt.Errorf("failed to create dir for %s: %+v", dest, err)
+		}
+		if err := ioutil.WriteFile(dest, contents, 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %+v", dest, err)
+		}
+	}
+
+	return nil
+}
+
+// creates the logical volumes and the OSD on the given device.  ceph-volume registers the OSD with the cluster, with the
+// given ID of a destroyed OSD if it is replacing one. A device shared by several OSDs is split into a logical volume for
+// each of them.
+func prepareCephVolumeDevice(context *clusterd.Context, clusterName, device, deviceClass string, osdID, osdsPerDevice int,
+	storeConfig config.StoreConfig) error {
+	if storeConfig.StoreType == config.Filestore {
+		// filestore needs a separate journal volume, which is not provisioned yet
+		return fmt.Errorf("cannot prepare device %s, filestore is not supported by the ceph-volume provisioner", device)
+	}
+
+	logger.Infof("preparing device %s with ceph-volume", device)
+	args := []string{"--cluster", clusterName, "lvm", "prepare", "--bluestore", "--data", path.Join("/dev", device)}
+	if osdsPerDevice > 1 {
+		logger.Infof("splitting device %s between %d osds", device, osdsPerDevice)
+		args = []string{"--cluster", clusterName, "lvm", "batch", "--prepare", "--bluestore", "--yes",
+			"--osds-per-device", strconv.Itoa(osdsPerDevice), path.Join("/dev", device)}
+	}
+	if deviceClass != "" {
+		args = append(args, "--crush-device-class", deviceClass)
+	}
+	if osdID != unassignedOSDID {
+		args = append(args, "--osd-id", strconv.Itoa(osdID))
+	}
+	if storeConfig.EncryptedDevice {
+		// ceph-volume stores the keys of the encrypted volumes in the monitors
+		args = append(args, "--dmcrypt")
+	}
+	if _, err := context.Executor.ExecuteCommandWithCombinedOutput(false, "ceph-volume prepare", cephVolumeCmd, args...); err != nil {
+		return fmt.Errorf("failed to prepare device %s with ceph-volume: %+v", device, err)
+	}
+
+	return nil
+}
+
+// lists the OSDs of the given cluster that ceph-volume finds on the logical volumes of the node
+func listCephVolumeOSDs(context *clusterd.Context, cluster *mon.ClusterInfo) ([]*cephVolumeOSD, error) {
+	args := []string{"--cluster", cluster.Name, "lvm", "list", "--format", "json"}
+	output, err := context.Executor.ExecuteCommandWithOutput(false, "ceph-volume list", cephVolumeCmd, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ceph-volume osds: %+v", err)
+	}
+
+	return parseCephVolumeOSDs(output, cluster.FSID)
+}
+
+func parseCephVolumeOSDs(output, clusterFSID string) ([]*cephVolumeOSD, error) {
+	var lvsByID map[string][]cephVolumeLV
+	if err := json.Unmarshal([]byte(output), &lvsByID); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ceph-volume list output: %+v. %s", err, output)
+	}
+
+	// walk through the OSDs in order of their IDs
+	var ids []int
+	for rawID := range lvsByID {
+		id, err := strconv.Atoi(rawID)
+		if err != nil {
+			logger.Warningf("skipping ceph-volume osd with invalid id %s", rawID)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var osds []*cephVolumeOSD
+	for _, id := range ids {
+		lvs := lvsByID[strconv.Itoa(id)]
+		osd := &cephVolumeOSD{ID: id, StoreType: config.Bluestore}
+		belongsToCluster := true
+		for _, lv := range lvs {
+			if clusterFSID != "" && lv.Tags[cephVolumeClusterFSIDTag] != clusterFSID {
+				belongsToCluster = false
+				break
+			}
+
+			osdUUID, err := uuid.Parse(lv.Tags[cephVolumeOSDFSIDTag])
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse fsid of ceph-volume osd.%d: %+v", id, err)
+			}
+			osd.UUID = osdUUID
+
+			lvType := lv.Type
+			if lvType == "" {
+				lvType = lv.Tags[cephVolumeTypeTag]
+			}
+			if lvType == "data" || lvType == "journal" {
+				osd.StoreType = config.Filestore
+			}
+			osd.Devices = append(osd.Devices, lv.Devices...)
+		}
+
+		if !belongsToCluster {
+			logger.Infof("skipping ceph-volume osd.%d that belongs to another cluster", id)
+			continue
+		}
+		osds = append(osds, osd)
+	}
+
+	return osds, nil
+}
+
+// activates the given ceph-volume OSD, which mounts its data dir, and then runs it
+func (a *OsdAgent) startCephVolumeOSD(context *clusterd.Context, osd *cephVolumeOSD) error {
+	if a.prepareOnly {
+		// the osd is activated by its own pod
+		a.addPreparedOSD(&osdConfig{id: osd.ID, uuid: osd.UUID, rootPath: getCephVolumeOSDDataDir(a.cluster.Name, osd.ID)})
+		return nil
+	}
+
+	storeFlag := "--bluestore"
+	if osd.StoreType == config.Filestore {
+		storeFlag = "--filestore"
+	}
+
+	args := []string{"--cluster", a.cluster.Name, "lvm", "activate", "--no-systemd", storeFlag, strconv.Itoa(osd.ID), osd.UUID.String()}
+	if _, err := context.Executor.ExecuteCommandWithCombinedOutput(false, "ceph-volume activate", cephVolumeCmd, args...); err != nil {
+		return fmt.Errorf("failed to activate osd.%d: %+v", osd.ID, err)
+	}
+
+	cfg := &osdConfig{id: osd.ID, uuid: osd.UUID, rootPath: getCephVolumeOSDDataDir(a.cluster.Name, osd.ID),
+		storeConfig: config.StoreConfig{StoreType: osd.StoreType}, memoryLimit: a.osdMemoryLimit(), kv: a.kv}
+	if err := writeCephVolumeOSDConfigFile(context, a.cluster, cfg, osd.StoreType, a.location); err != nil {
+		return err
+	}
+
+	return a.runOSD(context, a.cluster.Name, cfg)
+}
+
+func writeCephVolumeOSDConfigFile(context *clusterd.Context, cluster *mon.ClusterInfo, cfg *osdConfig, storeType, location string) error {
+	cephConfig := mon.CreateDefaultCephConfig(context, cluster, cfg.rootPath)
+	cephConfig.GlobalConfig.OsdObjectStore = storeType
+	cephConfig.CrushLocation = location
+
+	// ceph-volume has set up the data dir with links to the block devices, only the memory and scrub settings are needed
+	settings := getMemorySettings(cfg)
+	if settings == nil {
+		settings = map[string]string{}
+	}
+	for name, val := range getScrubSettings(cfg.kv) {
+		settings[name] = val
+	}
+	_, err := mon.GenerateConfigFile(context, cluster, cfg.rootPath, fmt.Sprintf("osd.%d", cfg.id),
+		getOSDKeyringPath(cfg.rootPath), cephConfig, settings)
+	if err != nil {
+		return fmt.Errorf("failed to write osd.%d config file: %+v", cfg.id, err)
+	}
+
+	return nil
+}
+
+// removes the given ceph-volume OSDs from the cluster.  The logical volumes are left on the devices.
+func (a *OsdAgent) removeCephVolumeOSDs(context *clusterd.Context, osds []*cephVolumeOSD) error {
+	var errorMessages []string
+	for _, osd := range osds {
+		cfg := &osdConfig{id: osd.ID, uuid: osd.UUID, configRoot: cephVolumeOSDDataDir, storeConfig: a.storeConfig,
+			rootPath: getCephVolumeOSDDataDir(a.cluster.Name, osd.ID), kv: a.kv, storeName: config.GetConfigStoreName(a.nodeName)}
+		if err := a.removeOSD(context, cfg); err != nil {
+			errMsg := fmt.Sprintf("failed to remove ceph-volume osd.%d. %+v", osd.ID, err)
+			logger.Error(errMsg)
+			errorMessages = append(errorMessages, errMsg)
+			continue
+		}
+		logger.Infof("removed ceph-volume osd.%d, devices %v need to be wiped before they can be used again", osd.ID, osd.Devices)
+	}
+
+	if len(errorMessages) > 0 {
+		return fmt.Errorf(strings.Join(errorMessages, "\n"))
+	}
+
+	return nil
+}
+
+// gets the ceph-volume OSDs whose devices are all no longer selected on the node
+func (a *OsdAgent) getRemovedCephVolumeOSDs(osds []*cephVolumeOSD) []*cephVolumeOSD {
+	var removed []*cephVolumeOSD
+	for _, osd := range osds {
+		if len(osd.Devices) == 0 && !oposd.IsRemovingNode(a.devices) {
+			// the devices of the osd are unknown, keep it
+			continue
+		}
+
+		deselected := true
+		for _, device := range osd.Devices {
+			// the devices of a ceph-volume osd are found on the node since ceph-volume lists the osd
+			if !a.isDeviceDeselected(strings.TrimPrefix(device, "/dev/"), true) {
+				deselected = false
+				break
+			}
+		}
+		if deselected {
+			removed = append(removed, osd)
+		}
+	}
+
+	return removed
+}
+
+func getCephVolumeOSDDataDir(clusterName string, id int) string {
+	return path.Join(cephVolumeOSDDataDir, fmt.Sprintf("%s-%d", clusterName, id))
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package osd
+
+import (
+	"testing"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	"github.com/rook/rook/pkg/util/sys"
+	"github.com/stretchr/testify/assert"
+)
+
+const cephVolumeListOutput = `{
+    "3": [
+        {
+            "devices": ["/dev/sdc"],
+            "path": "/dev/ceph-c/osd-block-c",
+            "tags": {
+                "ceph.cluster_fsid": "4a4ad3fa-6b4c-4c8b-8f4e-4b3a0d3b2e51",
+                "ceph.osd_fsid": "a3b3e2b7-0c3b-4d1e-9a6f-2e8bb5b0b0c3",
+                "ceph.type": "block"
+            },
+            "type": "block"
+        }
+    ],
+    "1": [
+        {
+            "devices": ["/dev/sda"],
+            "path": "/dev/ceph-a/osd-data-a",
+            "tags": {
+                "ceph.cluster_fsid": "4a4ad3fa-6b4c-4c8b-8f4e-4b3a0d3b2e51",
+                "ceph.osd_fsid": "e9b9b7b1-5a07-4d6e-a5c5-8c4d1b2f1a01",
+                "ceph.type": "data"
+            },
+            "type": "data"
+        },
+        {
+            "devices": ["/dev/sdd"],
+            "path": "/dev/ceph-d/osd-journal-a",
+            "tags": {
+                "ceph.cluster_fsid": "4a4ad3fa-6b4c-4c8b-8f4e-4b3a0d3b2e51",
+                "ceph.osd_fsid": "e9b9b7b1-5a07-4d6e-a5c5-8c4d1b2f1a01",
+                "ceph.type": "journal"
+            },
+            "type": "journal"
+        }
+    ],
+    "2": [
+        {
+            "devices": ["/dev/sdb"],
+            "path": "/dev/ceph-b/osd-block-b",
+            "tags": {
+                "ceph.cluster_fsid": "00000000-0000-0000-0000-000000000000",
+                "ceph.osd_fsid": "5d3c2f11-1f4e-4b7e-8f9a-0c6f2b3a4d02",
+                "ceph.type": "block"
+            },
+            "type": "block"
+        }
+    ]
+}`
+
+func TestParseCephVolumeOSDs(t *testing.T) {
+	osds, err := parseCephVolumeOSDs(cephVolumeListOutput, "4a4ad3fa-6b4c-4c8b-8f4e-4b3a0d3b2e51")
+	assert.Nil(t, err)
+
+	// osd.2 belongs to another cluster and the others are ordered by their IDs
+	assert.Equal(t, 2, len(osds))
+	assert.Equal(t, 1, osds[0].ID)
+	assert.Equal(t, "e9b9b7b1-5a07-4d6e-a5c5-8c4d1b2f1a01", osds[0].UUID.String())
+	assert.Equal(t, config.Filestore, osds[0].StoreType)
+	assert.Equal(t, []string{"/dev/sda", "/dev/sdd"}, osds[0].Devices)
+	assert.Equal(t, 3, osds[1].ID)
+	assert.Equal(t, "a3b3e2b7-0c3b-4d1e-9a6f-2e8bb5b0b0c3", osds[1].UUID.String())
+	assert.Equal(t, config.Bluestore, osds[1].StoreType)
+	assert.Equal(t, []string{"/dev/sdc"}, osds[1].Devices)
+
+	// without a cluster fsid all the osds are returned
+	osds, err = parseCephVolumeOSDs(cephVolumeListOutput, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(osds))
+
+	// nothing has been prepared on the node
+	osds, err = parseCephVolumeOSDs("{}", "4a4ad3fa-6b4c-4c8b-8f4e-4b3a0d3b2e51")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(osds))
+
+	_, err = parseCephVolumeOSDs("not json", "")
+	assert.NotNil(t, err)
+}
+
+func TestSplitPartitionSchemeDevices(t *testing.T) {
+	a := &OsdAgent{devices: "sda,sdb", kv: mockKVStore(), nodeName: "node1",
+		storeConfig: config.StoreConfig{Provisioner: config.CephVolumeProvisioner}}
+	assert.True(t, isUsingCephVolume(a.storeConfig))
+
+	// sda already has an osd from the partition scheme
+	_, _, sdaUUID := mockPartitionSchemeEntry(t, 1, "sda", nil, a.kv, a.nodeName)
+	context := &clusterd.Context{Devices: []*sys.LocalDisk{
+		{Name: "sda", UUID: sdaUUID},
+		{Name: "sdb", UUID: "5b3a8f2e-43d4-4f5c-9f3e-2d8c1a7b6e90"},
+	}}
+
+	devices := &DeviceOsdMapping{Entries: map[string]*DeviceOsdIDEntry{
+		"sda": {Data: 1, Metadata: []int{1}},
+		"sdb": {Data: unassignedOSDID},
+	}}
+	partitioned, fresh, err := a.splitPartitionSchemeDevices(context, devices)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(partitioned.Entries))
+	assert.NotNil(t, partitioned.Entries["sda"])
+	assert.Equal(t, 1, len(fresh.Entries))
+	assert.NotNil(t, fresh.Entries["sdb"])
+
+	// the partition scheme provisioner is the default
+	a.storeConfig.Provisioner = ""
+	assert.False(t, isUsingCephVolume(a.storeConfig))
+}
+
+func TestGetRemovedCephVolumeOSDs(t *testing.T) {
+	a := &OsdAgent{devices: "sda,sdb"}
+	osds := []*cephVolumeOSD{
+		{ID: 1, Devices: []string{"/dev/sda"}},
+		{ID: 2, Devices: []string{"/dev/sdc"}},
+		{ID: 3},
+	}
+
+	// only the osd on the deselected device is removed
+	removed := a.getRemovedCephVolumeOSDs(osds)
+	assert.Equal(t, 1, len(removed))
+	assert.Equal(t, 2, removed[0].ID)
+
+	// all the osds are removed with the node
+	a.devices = "none"
+	removed = a.getRemovedCephVolumeOSDs(osds)
+	assert.Equal(t, 3, len(removed))
+}
@@ -44,6 +44,27 @@ var (
 	probeInterval                           = 30 * time.Second
 	nodeName, namespace, lastDevice, cmName string
 	cm                                      *v1.ConfigMap
+
+	// the devices are updated from the uevents of the kernel as they are added, removed or changed. They are all probed
+	// again at this slower interval in case an event was missed.
+	rescanInterval = 10 * time.Minute
+	// the devices of the last probe, which are updated from the uevents
+	probedDevices []sys.LocalDisk
+	// the delay before the uevents are read again after a failure, which doubles with each failure in a row up to the
+	// max delay. The uevents are no longer read after too many failures in a row.
+	ueventRetryDelay    = time.Second
+	ueventMaxRetryDelay = time.Minute
+	ueventMaxFailures   = 10
+
+	// DeviceHealthEnvVar enables probing the health of the devices, which needs the discover pod to be privileged
+	DeviceHealthEnvVar = "ROOK_DISCOVER_DEVICE_HEALTH"
+	// whether the health of the devices is probed
+	deviceHealthEnabled bool
+
+	// the health of the devices changes slowly and reading it can be slow, it is probed less often than the devices
+	healthProbeInterval = 10 * time.Minute
+	lastHealthProbe     time.Time
+	deviceHealth        = map[string]*sys.DeviceHealth{}
 )
 
 func Run(context *clusterd.Context) error {
@@ -53,22 +74,141 @@ func Run(context *clusterd.Context) error {
 	nodeName = os.Getenv(k8sutil.NodeNameEnvVar)
 	namespace = os.Getenv(k8sutil.PodNamespaceEnvVar)
 	cmName = LocalDiskCMName + nodeName
-	tick := time.NewTicker(probeInterval).C
+	deviceHealthEnabled = os.Getenv(DeviceHealthEnvVar) == "true"
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGTERM)
+
+	// without the uevents the devices are probed at the faster interval to notice the changes
+	interval := probeInterval
+	events := make(chan *sys.UEvent)
+	listener, err := sys.NewUEventListener()
+	if err != nil {
+		logger.Warningf("failed to listen to device events, probing the devices every %s. %+v", probeInterval, err)
+	} else {
+		defer func() {
+			if listener != nil {
+				listener.Close()
+			}
+		}()
+		interval = rescanInterval
+		go listenUEvents(listener, events)
+	}
+
+	if err := updateDeviceCM(context); err != nil {
+		logger.Infof("failed to update device configmap: %v", err)
+	}
+	ticker := time.NewTicker(interval)
 	for {
 		select {
 		case <-sigc:
 			logger.Infof("shutdown signal received, exiting...")
 			return nil
-		case <-tick:
+		case <-ticker.C:
 			err := updateDeviceCM(context)
 			if err != nil {
 				logger.Infof("failed to update device configmap: %v", err)
 			}
+		case event, ok := <-events:
+			if !ok {
+				// the events could not be read anymore, the devices are probed at the faster interval again
+				logger.Warningf("stopped listening to device events, probing the devices every %s", probeInterval)
+				listener.Close()
+				listener = nil
+				events = nil
+				ticker.Stop()
+				ticker = time.NewTicker(probeInterval)
+				continue
+			}
+			if err := handleUEvent(context, event); err != nil {
+				logger.Infof("failed to update device configmap after a device event: %v", err)
+			}
+		}
+	}
+}
+
+// reads the uevents of the kernel
+type ueventReader interface {
+	Read() (*sys.UEvent, error)
+}
+
+// listenUEvents sends the uevents of the block devices to the channel. A nil event is sent when the events could not be
+// read, for example when the socket buffer overflowed, since some of the events may have been missed. The events are
+// read again after a delay that grows with the failures in a row, and the channel is closed when they keep failing.
+func listenUEvents(listener ueventReader, events chan<- *sys.UEvent) {
+	delay := ueventRetryDelay
+	failures := 0
+	for {
+		event, err := listener.Read()
+		if err != nil {
+			failures++
+			if failures >= ueventMaxFailures {
+				logger.Errorf("failed to read device events %d times in a row, giving up. %+v", failures, err)
+				close(events)
+				return
+			}
+			logger.Warningf("failed to read device events, trying again in %s. %+v", delay, err)
+			events <- nil
+			<-time.After(delay)
+			delay *= 2
+			if delay > ueventMaxRetryDelay {
+				delay = ueventMaxRetryDelay
+			}
+			continue
+		}
+
+		failures = 0
+		delay = ueventRetryDelay
+		if event != nil && event.Subsystem == sys.BlockSubsystem {
+			events <- event
+		}
+	}
+}
+
+// handleUEvent probes the device of the event again, or removes it if it was removed, and updates the configmap. The
+// events of the partitions update the disk of the partitions. All the devices are probed again for a nil event.
+func handleUEvent(context *clusterd.Context, event *sys.UEvent) error {
+	if event == nil {
+		return updateDeviceCM(context)
+	}
+	if event.DevName == "" || (event.Action != sys.UEventAdd && event.Action != sys.UEventRemove && event.Action != sys.UEventChange) {
+		return nil
+	}
+	logger.Infof("device %s event for %s", event.Action, event.DevName)
+
+	name := event.DevName
+	removed := event.Action == sys.UEventRemove
+	if parent := event.Parent(); parent != "" {
+		name = parent
+		removed = false
+	}
+
+	devices := make([]sys.LocalDisk, 0, len(probedDevices)+1)
+	for _, device := range probedDevices {
+		if device.Name != name {
+			devices = append(devices, device)
+		}
+	}
+	if removed {
+		delete(deviceHealth, name)
+	} else {
+		// wait for udev to process the event so that the properties and links of the device are up to date
+		if err := context.Executor.ExecuteCommand(false, "wait for udev", "udevadm", "settle", "--timeout=10"); err != nil {
+			logger.Warningf("failed to wait for udev to process the events. %+v", err)
+		}
+
+		device, err := probeDevice(context, name)
+		if err != nil {
+			return err
+		}
+		if device != nil {
+			devices = append(devices, *device)
 		}
 	}
+
+	probedDevices = devices
+	return publishDevices(context, devices)
 }
+
 func updateDeviceCM(context *clusterd.Context) error {
 	logger.Infof("updating device configmap")
 	devices, err := probeDevices(context)
@@ -76,6 +216,12 @@ func updateDeviceCM(context *clusterd.Context) error {
 		logger.Infof("failed to probe devices: %v", err)
 		return err
 	}
+	probedDevices = devices
+	return publishDevices(context, devices)
+}
+
+// publishDevices writes the devices to the configmap of the node if they changed
+func publishDevices(context *clusterd.Context, devices []sys.LocalDisk) error {
 	deviceJson, err := json.Marshal(devices)
 	if err != nil {
 		logger.Infof("failed to marshal: %v", err)
@@ -134,6 +280,11 @@ func probeDevices(context *clusterd.Context) ([]sys.LocalDisk, error) {
 	if err != nil {
 		return devices, fmt.Errorf("failed initial hardware discovery. %+v", err)
 	}
+
+	probeHealth := deviceHealthEnabled && time.Since(lastHealthProbe) >= healthProbeInterval
+	if probeHealth {
+		lastHealthProbe = time.Now()
+	}
 	for _, device := range localDevices {
 		if device == nil {
 			continue
@@ -142,23 +293,80 @@ func probeDevices(context *clusterd.Context) ([]sys.LocalDisk, error) {
 			continue
 		}
 
-		partitions, _, err := sys.GetDevicePartitions(device.Name, context.Executor)
-		if err != nil {
-			logger.Infof("failed to check device partitions %s: %v", device.Name, err)
-			continue
-		}
-
-		// check if there is a file system on the device
-		fs, err := sys.GetDeviceFilesystems(device.Name, context.Executor)
-		if err != nil {
-			logger.Infof("failed to check device filesystem %s: %v", device.Name, err)
+		if err := populateDevice(context, device, probeHealth); err != nil {
+			logger.Infof("%v", err)
 			continue
 		}
-		device.Partitions = partitions
-		device.Filesystem = fs
 		devices = append(devices, *device)
 	}
 
 	logger.Infof("available devices: %+v", devices)
 	return devices, nil
 }
+
+// probeDevice probes a single device, which is nil if the device is a partition or is not supported
+func probeDevice(context *clusterd.Context, name string) (*sys.LocalDisk, error) {
+	device, err := clusterd.PopulateDeviceInfo(name, context.Executor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe device %s. %+v", name, err)
+	}
+	if device == nil || device.Type == sys.PartType {
+		return nil, nil
+	}
+
+	// the health of a new or changed device is probed right away
+	if err := populateDevice(context, device, deviceHealthEnabled); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// populateDevice sets the partitions, the filesystem, the logical volumes, the availability and the health of the device
+func populateDevice(context *clusterd.Context, device *sys.LocalDisk, probeHealth bool) error {
+	partitions, _, err := sys.GetDevicePartitions(device.Name, context.Executor)
+	if err != nil {
+		return fmt.Errorf("failed to check device partitions %s: %v", device.Name, err)
+	}
+
+	// check if there is a file system on the device
+	fs, err := sys.GetDeviceFilesystems(device.Name, context.Executor)
+	if err != nil {
+		return fmt.Errorf("failed to check device filesystem %s: %v", device.Name, err)
+	}
+	device.Partitions = partitions
+	device.Filesystem = fs
+
+	// the logical volumes of an osd provisioned by ceph-volume show the physical volume is in use by the osd
+	device.LogicalVolumes = nil
+	if fs == sys.LVMPhysicalVolumeFS {
+		volumes, err := sys.GetDeviceLogicalVolumes(device.Name, context.Executor)
+		if err != nil {
+			logger.Warningf("%+v", err)
+		}
+		device.LogicalVolumes = volumes
+	}
+	device.Available, device.RejectedReason = clusterd.GetDeviceAvailability(device)
+	if !device.Available {
+		logger.Infof("device %s cannot be used by an osd: %s", device.Name, device.RejectedReason)
+	}
+	if probeHealth {
+		updateDeviceHealth(context, device.Name)
+	}
+	device.Health = deviceHealth[device.Name]
+	return nil
+}
+
+// updateDeviceHealth gets the SMART health of the device. The last known health is kept when the device does not
+// report its health this time, for example when it is in standby.
+func updateDeviceHealth(context *clusterd.Context, device string) {
+	health, err := sys.GetDeviceHealth(device, context.Executor)
+	if err != nil {
+		logger.Debugf("failed to get the health of device %s. %+v", device, err)
+		return
+	}
+
+	if health.FailurePredicted {
+		logger.Warningf("device %s is predicted to fail. health: %+v", device, *health)
+	}
+	deviceHealth[device] = health
+}
@@ -18,12 +18,18 @@ limitations under the License.
 package discover
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/rook/rook/pkg/clusterd"
 	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/rook/rook/pkg/util/sys"
 
 	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 const udevOutput = `DEVLINKS=/dev/disk/by-id/scsi-36001405d27e5d898829468b90ce4ef8c /dev/disk/by-id/wwn-0x6001405d27e5d898829468b90ce4ef8c /dev/disk/by-path/ip-127.0.0.1:3260-iscsi-iqn.2016-06.world.srv:storage.target01-lun-0 /dev/disk/by-uuid/f2d38cba-37da-411d-b7ba-9a6696c58174
@@ -85,6 +91,9 @@ testa2   centos_host13-home
 
 		case "get disk testa fs serial":
 			output = udevOutput
+
+		case "get health of device testa":
+			output = "SMART overall-health self-assessment test result: PASSED"
 		}
 
 		return output, nil
@@ -92,9 +101,139 @@ testa2   centos_host13-home
 
 	context := &clusterd.Context{Executor: executor}
 
+	// the health is not probed unless enabled
 	devices, err := probeDevices(context)
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(devices))
 	assert.Equal(t, "ext2", devices[0].Filesystem)
+	assert.False(t, devices[0].Available)
+	assert.Equal(t, "has a filesystem: ext2", devices[0].RejectedReason)
+	assert.Nil(t, devices[0].Health)
+
+	deviceHealthEnabled = true
+	defer func() { deviceHealthEnabled = false }()
+	devices, err = probeDevices(context)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(devices))
+	assert.NotNil(t, devices[0].Health)
+	assert.True(t, devices[0].Health.Passed)
+	assert.False(t, devices[0].Health.FailurePredicted)
+
+}
+
+func TestHandleUEvent(t *testing.T) {
+	settled := 0
+	executor := &exectest.MockExecutor{
+		MockExecuteCommand: func(debug bool, actionName string, command string, args ...string) error {
+			assert.Equal(t, "udevadm", command)
+			settled++
+			return nil
+		},
+		MockExecuteCommandWithOutput: func(debug bool, name string, command string, args ...string) (string, error) {
+			switch name {
+			case "lsblk /dev/testa":
+				return `SIZE="249510756352" ROTA="1" RO="0" TYPE="disk" PKNAME=""`, nil
+			case "get filesystem type for testa", "get disk testa fs uuid", "get disk testa fs serial":
+				return udevOutput, nil
+			}
+			return "", nil
+		},
+	}
+	context := &clusterd.Context{Executor: executor, Clientset: fake.NewSimpleClientset()}
+	namespace = "rook-system"
+	nodeName = "node1"
+	cmName = LocalDiskCMName + nodeName
+	cm = nil
+	probedDevices = []sys.LocalDisk{{Name: "testb", Size: 1024}}
+	publishedDevices := func() []string {
+		configMap, err := context.Clientset.CoreV1().ConfigMaps(namespace).Get(cmName, metav1.GetOptions{})
+		assert.Nil(t, err)
+		var devices []sys.LocalDisk
+		assert.Nil(t, json.Unmarshal([]byte(configMap.Data[LocalDiskCMData]), &devices))
+		names := []string{}
+		for _, d := range devices {
+			names = append(names, d.Name)
+		}
+		return names
+	}
+
+	// the added device is probed after udev processed the event
+	err := handleUEvent(context, &sys.UEvent{Action: sys.UEventAdd, Subsystem: sys.BlockSubsystem, DevName: "testa", DevType: "disk",
+		DevPath: "/devices/virtual/block/testa"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, settled)
+	assert.Equal(t, []string{"testb", "testa"}, publishedDevices())
+	assert.Equal(t, "ext2", probedDevices[1].Filesystem)
+
+	// the events of a partition probe its disk again
+	err = handleUEvent(context, &sys.UEvent{Action: sys.UEventRemove, Subsystem: sys.BlockSubsystem, DevName: "testa1",
+		DevType: sys.PartitionType, DevPath: "/devices/virtual/block/testa/testa1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, settled)
+	assert.Equal(t, []string{"testb", "testa"}, publishedDevices())
+
+	// the removed device is not probed
+	err = handleUEvent(context, &sys.UEvent{Action: sys.UEventRemove, Subsystem: sys.BlockSubsystem, DevName: "testb", DevType: "disk",
+		DevPath: "/devices/virtual/block/testb"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, settled)
+	assert.Equal(t, []string{"testa"}, publishedDevices())
+
+	// other actions are ignored
+	err = handleUEvent(context, &sys.UEvent{Action: "bind", Subsystem: sys.BlockSubsystem, DevName: "testa", DevType: "disk"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, settled)
+	assert.Equal(t, 1, len(probedDevices))
+}
 
+type fakeUEventReader struct {
+	results []*sys.UEvent
+	reads   []time.Time
+}
+
+// returns the scripted events, where a nil event is a failure, and then fails forever
+func (r *fakeUEventReader) Read() (*sys.UEvent, error) {
+	r.reads = append(r.reads, time.Now())
+	if len(r.results) == 0 || r.results[0] == nil {
+		if len(r.results) > 0 {
+			r.results = r.results[1:]
+		}
+		return nil, fmt.Errorf("no buffer space available")
+	}
+	event := r.results[0]
+	r.results = r.results[1:]
+	return event, nil
+}
+
+func TestListenUEvents(t *testing.T) {
+	ueventRetryDelay = time.Millisecond
+	ueventMaxRetryDelay = 4 * time.Millisecond
+	ueventMaxFailures = 5
+	defer func() {
+		ueventRetryDelay = time.Second
+		ueventMaxRetryDelay = time.Minute
+		ueventMaxFailures = 10
+	}()
+
+	added := &sys.UEvent{Action: sys.UEventAdd, Subsystem: sys.BlockSubsystem, DevName: "sda"}
+	reader := &fakeUEventReader{results: []*sys.UEvent{
+		nil, nil, nil,
+		{Action: sys.UEventAdd, Subsystem: "net", DevName: "eth0"},
+		added,
+	}}
+	events := make(chan *sys.UEvent)
+	go listenUEvents(reader, events)
+
+	// a failure is sent as a nil event, the events of other subsystems are not sent
+	var received []*sys.UEvent
+	for event := range events {
+		received = append(received, event)
+	}
+	assert.Equal(t, []*sys.UEvent{nil, nil, nil, added, nil, nil, nil, nil}, received)
+
+	// the delay doubles with the failures in a row up to the max, and starts over after an event was read
+	assert.Equal(t, 10, len(reader.reads))
+	for i, delay := range []time.Duration{1, 2, 4, 0, 0, 1, 2, 4, 4} {
+		assert.True(t, reader.reads[i+1].Sub(reader.reads[i]) >= delay*time.Millisecond)
+	}
 }
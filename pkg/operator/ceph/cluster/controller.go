@@ -103,14 +103,15 @@ type ClusterController struct {
 }
 
 type cluster struct {
-	context   *clusterd.Context
-	Namespace string
-	Spec      cephv1alpha1.ClusterSpec
-	mons      *mon.Cluster
-	mgrs      *mgr.Cluster
-	osds      *osd.Cluster
-	stopCh    chan struct{}
-	ownerRef  metav1.OwnerReference
+	context     *clusterd.Context
+	Namespace   string
+	Spec        cephv1alpha1.ClusterSpec
+	annotations map[string]string
+	mons        *mon.Cluster
+	mgrs        *mgr.Cluster
+	osds        *osd.Cluster
+	stopCh      chan struct{}
+	ownerRef    metav1.OwnerReference
 }
 
 // NewClusterController create controller for watching cluster custom resources created
@@ -208,6 +209,7 @@ func (c *ClusterController) onAdd(obj interface{}) {
 			logger.Errorf("failed to create cluster in namespace %s. %+v", cluster.Namespace, err)
 			return false, nil
 		}
+		c.updateRejectedDevices(clusterObj.Namespace, clusterObj.Name, cluster.osds.RejectedDevices())
 
 		// cluster is created, update the cluster CRD status now
 		if err := c.updateClusterStatus(clusterObj.Namespace, clusterObj.Name, cephv1alpha1.ClusterStateCreated, ""); err != nil {
@@ -246,6 +248,32 @@ func (c *ClusterController) onAdd(obj interface{}) {
 	healthChecker := mon.NewHealthChecker(cluster.mons)
 	go healthChecker.Check(cluster.stopCh)
 
+	// Start raising the weight of new osds in steps and reporting the progress of the weight ramps
+	weightRamper := osd.NewWeightRamper(c.context, cluster.Namespace, clusterObj.Name)
+	go weightRamper.Run(cluster.stopCh)
+
+	// Start reweighting the osds by their utilization when enabled in the cluster spec
+	reweighter := osd.NewReweighter(c.context, cluster.Namespace, clusterObj.Name)
+	go reweighter.Run(cluster.stopCh)
+
+	// Start allowing the osds to scrub only in the windows of the scrub schedule
+	scrubScheduler := osd.NewScrubScheduler(c.context, cluster.Namespace, clusterObj.Name)
+	go scrubScheduler.Run(cluster.stopCh)
+
+	// Start provisioning osds on the new devices discovered on the storage nodes, with the latest cluster spec
+	deviceWatcher := osd.NewDeviceWatcher(c.context, cluster.Namespace, func() (*osd.Cluster, error) {
+		latest, err := c.context.RookClientset.CephV1alpha1().Clusters(clusterObj.Namespace).Get(clusterObj.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get cluster %s. %+v", clusterObj.Name, err)
+		}
+		return newCluster(latest, c.context).newOSDCluster(c.rookImage), nil
+	})
+	go deviceWatcher.Run(cluster.stopCh)
+
+	// Start mirroring the orchestration status of the osds of each node into the cluster status
+	statusMirror := osd.NewStatusMirror(c.context, cluster.Namespace, clusterObj.Name)
+	go statusMirror.Run(cluster.stopCh)
+
 	// add the finalizer to the crd
 	err = c.addFinalizer(clusterObj)
 	if err != nil {
@@ -304,7 +332,9 @@ func (c *ClusterController) onUpdate(oldObj, newObj interface{}) {
 		return
 	}
 
-	if !clusterChanged(oldClust.Spec, newClust.Spec) {
+	// the osds to replace are requested with an annotation on the cluster
+	replaceOSDsChanged := oldClust.Annotations[osd.ReplaceOSDsAnnotation] != newClust.Annotations[osd.ReplaceOSDsAnnotation]
+	if !clusterChanged(oldClust.Spec, newClust.Spec) && !replaceOSDsChanged {
 		logger.Infof("update event for cluster %s is not supported", newClust.Namespace)
 		return
 	}
@@ -345,6 +375,7 @@ func (c *ClusterController) handleUpdate(newClust *cephv1alpha1.Cluster, cluster
 		logger.Errorf("failed to update cluster in namespace %s. %+v", newClust.Namespace, err)
 		return false, nil
 	}
+	c.updateRejectedDevices(newClust.Namespace, newClust.Name, cluster.osds.RejectedDevices())
 
 	if err := c.updateClusterStatus(newClust.Namespace, newClust.Name, cephv1alpha1.ClusterStateCreated, ""); err != nil {
 		logger.Errorf("failed to update cluster status in namespace %s: %+v", newClust.Namespace, err)
@@ -543,23 +574,32 @@ func (c *ClusterController) removeLegacyFinalizer(obj interface{}) {
 }
 
 func (c *ClusterController) updateClusterStatus(namespace, name string, state cephv1alpha1.ClusterState, message string) error {
-	// get the most recent cluster CRD object
-	cluster, err := c.context.RookClientset.CephV1alpha1().Clusters(namespace).Get(name, metav1.GetOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to get cluster from namespace %s prior to updating its status: %+v", namespace, err)
-	}
+	// update the status on the most recent cluster CRD object, keeping the scrub status and rejected devices that are
+	// updated separately
+	return osd.UpdateClusterStatus(c.context, namespace, name, func(status *cephv1alpha1.ClusterStatus) bool {
+		status.State = state
+		status.Message = message
+		return true
+	})
+}
 
-	// update the status on the retrieved cluster object
-	cluster.Status = cephv1alpha1.ClusterStatus{State: state, Message: message}
-	if _, err := c.context.RookClientset.CephV1alpha1().Clusters(cluster.Namespace).Update(cluster); err != nil {
-		return fmt.Errorf("failed to update cluster %s status: %+v", cluster.Namespace, err)
+// updateRejectedDevices records in the cluster status the devices that cannot be used by the osds
+func (c *ClusterController) updateRejectedDevices(namespace, name string, rejected []cephv1alpha1.RejectedDevice) {
+	err := osd.UpdateClusterStatus(c.context, namespace, name, func(status *cephv1alpha1.ClusterStatus) bool {
+		if reflect.DeepEqual(status.RejectedDevices, rejected) {
+			return false
+		}
+		status.RejectedDevices = rejected
+		return true
+	})
+	if err != nil {
+		logger.Errorf("failed to update the rejected devices of cluster %s: %+v", namespace, err)
 	}
-
-	return nil
 }
 
 func newCluster(c *cephv1alpha1.Cluster, context *clusterd.Context) *cluster {
-	return &cluster{Namespace: c.Namespace, Spec: c.Spec, context: context, ownerRef: ClusterOwnerRef(c.Namespace, string(c.UID))}
+	return &cluster{Namespace: c.Namespace, Spec: c.Spec, annotations: c.Annotations, context: context,
+		ownerRef: ClusterOwnerRef(c.Namespace, string(c.UID))}
 }
 
 func ClusterOwnerRef(namespace, clusterID string) metav1.OwnerReference {
@@ -614,8 +654,7 @@ func (c *cluster) createInstance(rookImage string) error {
 	}
 
 	// Start the OSDs
-	c.osds = osd.New(c.context, c.Namespace, rookImage, c.Spec.Storage, c.Spec.DataDirHostPath,
-		cephv1alpha1.GetOSDPlacement(c.Spec.Placement), c.Spec.Network.HostNetwork, cephv1alpha1.GetOSDResources(c.Spec.Resources), c.ownerRef)
+	c.osds = c.newOSDCluster(rookImage)
 	err = c.osds.Start()
 	if err != nil {
 		return fmt.Errorf("failed to start the osds. %+v", err)
@@ -625,6 +664,16 @@ func (c *cluster) createInstance(rookImage string) error {
 	return nil
 }
 
+// newOSDCluster creates the OSD manager from the settings of the cluster
+func (c *cluster) newOSDCluster(rookImage string) *osd.Cluster {
+	osds := osd.New(c.context, c.Namespace, rookImage, c.Spec.Storage, c.Spec.DataDirHostPath,
+		cephv1alpha1.GetOSDPlacement(c.Spec.Placement), c.Spec.Network.HostNetwork, cephv1alpha1.GetOSDResources(c.Spec.Resources), c.ownerRef)
+	osds.ReplaceOSDs = osd.ParseReplaceOSDs(c.annotations[osd.ReplaceOSDsAnnotation])
+	osds.ScrubSchedule = c.Spec.ScrubSchedule
+	osds.NodeConcurrency = c.Spec.OSDNodeConcurrency
+	return osds
+}
+
 func (c *cluster) createInitialCrushMap() error {
 	configMapExists := false
 	createCrushMap := false
@@ -686,17 +735,24 @@ func (c *cluster) createInitialCrushMap() error {
 
 func clusterChanged(oldCluster, newCluster cephv1alpha1.ClusterSpec) bool {
 
-	oldStorage := oldCluster.Storage
-	newStorage := newCluster.Storage
+	// the nodes, the device sets, or the settings of the cluster such as its device filter, location or config that
+	// apply to all the nodes have changed. the order of the nodes is not a change.
+	if !reflect.DeepEqual(sortedStorage(oldCluster.Storage), sortedStorage(newCluster.Storage)) {
+		return true
+	}
 
-	// sort the nodes by name then compare to see if there are changes
-	sort.Sort(rookv1alpha2.NodesByName(oldStorage.Nodes))
-	sort.Sort(rookv1alpha2.NodesByName(newStorage.Nodes))
-	if !reflect.DeepEqual(oldStorage.Nodes, newStorage.Nodes) {
-		// the nodes list has changed
+	// the osd pods are updated with their new resources
+	if !reflect.DeepEqual(oldCluster.Resources[cephv1alpha1.ResourcesKeyOSD], newCluster.Resources[cephv1alpha1.ResourcesKeyOSD]) {
 		return true
 	}
 
 	// none of the supported cluster updates were detected
 	return false
 }
+
+// returns a copy of the storage spec with its nodes sorted by name
+func sortedStorage(storage rookv1alpha2.StorageScopeSpec) rookv1alpha2.StorageScopeSpec {
+	storage.Nodes = append([]rookv1alpha2.Node{}, storage.Nodes...)
+	sort.Sort(rookv1alpha2.NodesByName(storage.Nodes))
+	return storage
+}
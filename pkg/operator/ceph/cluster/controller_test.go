@@ -25,10 +25,13 @@ import (
 	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
 	"github.com/rook/rook/pkg/clusterd"
 	"github.com/rook/rook/pkg/daemon/ceph/agent/flexvolume/attachment"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
 	"github.com/rook/rook/pkg/operator/k8sutil"
 	testop "github.com/rook/rook/pkg/operator/test"
 	exectest "github.com/rook/rook/pkg/util/exec/test"
 	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -149,4 +152,32 @@ func TestClusterChanged(t *testing.T) {
 		{Name: "node1", Selection: rookalpha.Selection{Devices: []rookalpha.Device{{Name: "sda"}}}},
 	}
 	assert.False(t, clusterChanged(old, new))
+
+	// the count of a device set changed
+	old.Storage.StorageClassDeviceSets = []rookalpha.StorageClassDeviceSet{{Name: "set1", Count: 3}}
+	new.Storage.StorageClassDeviceSets = []rookalpha.StorageClassDeviceSet{{Name: "set1", Count: 3}}
+	assert.False(t, clusterChanged(old, new))
+	new.Storage.StorageClassDeviceSets[0].Count = 4
+	assert.True(t, clusterChanged(old, new))
+	new.Storage.StorageClassDeviceSets[0].Count = 3
+
+	// the device filter of the cluster changed, which applies to the nodes that don't override it
+	new.Storage.DeviceFilter = "^sd[b-d]"
+	assert.True(t, clusterChanged(old, new))
+	new.Storage.DeviceFilter = ""
+
+	// the store type of the cluster changed to bluestore, which converts the filestore osds of the nodes
+	old.Storage.Config = map[string]string{config.StoreTypeKey: config.Filestore}
+	new.Storage.Config = map[string]string{config.StoreTypeKey: config.Filestore}
+	assert.False(t, clusterChanged(old, new))
+	new.Storage.Config[config.StoreTypeKey] = config.Bluestore
+	assert.True(t, clusterChanged(old, new))
+	new.Storage.Config[config.StoreTypeKey] = config.Filestore
+
+	// the resources of the osds changed
+	new.Resources = rookalpha.ResourceSpec{cephv1alpha1.ResourcesKeyOSD: v1.ResourceRequirements{
+		Limits: v1.ResourceList{v1.ResourceMemory: resource.MustParse("4Gi")}}}
+	assert.True(t, clusterChanged(old, new))
+	new.Resources = nil
+	assert.False(t, clusterChanged(old, new))
 }
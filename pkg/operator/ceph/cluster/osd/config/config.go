@@ -36,11 +36,47 @@ func GetConfigStoreName(nodeName string) string {
 }
 
 const (
-	StoreTypeKey      = "storeType"
-	WalSizeMBKey      = "walSizeMB"
-	DatabaseSizeMBKey = "databaseSizeMB"
-	JournalSizeMBKey  = "journalSizeMB"
-	MetadataDeviceKey = "metadataDevice"
+	StoreTypeKey       = "storeType"
+	WalSizeMBKey       = "walSizeMB"
+	DatabaseSizeMBKey  = "databaseSizeMB"
+	JournalSizeMBKey   = "journalSizeMB"
+	MetadataDeviceKey  = "metadataDevice"
+	ProvisionerKey     = "provisioner"
+	DeviceClassKey     = "deviceClass"
+	EncryptedDeviceKey = "encryptedDevice"
+	DedicatedPodsKey   = "dedicatedPods"
+	WeightRampStepKey  = "weightRampStep"
+	FailingDevicesKey  = "failingDevices"
+	OSDsPerDeviceKey   = "osdsPerDevice"
+	// the sizes of the bluestore metadata on a metadata device derived from the capacity of the devices
+	DatabaseSizePercentKey = "databaseSizePercent"
+	WalSizePercentKey      = "walSizePercent"
+	AutoMetadataSizeKey    = "autoMetadataSize"
+)
+
+const (
+	// FailingDevicesSkip keeps new OSDs off of the devices predicted to fail, the OSDs already on them keep running
+	FailingDevicesSkip = "skip"
+	// FailingDevicesDrain also drains and removes the OSDs on the devices predicted to fail
+	FailingDevicesDrain = "drain"
+	// FailingDevicesUse ignores the health of the devices
+	FailingDevicesUse = "use"
+)
+
+const (
+	// HddDeviceClass is the crush device class of rotational devices
+	HddDeviceClass = "hdd"
+	// SsdDeviceClass is the crush device class of non-rotational devices
+	SsdDeviceClass = "ssd"
+	// NvmeDeviceClass is the crush device class of nvme devices
+	NvmeDeviceClass = "nvme"
+)
+
+const (
+	// PartitionProvisioner provisions OSDs on devices with the rook partition scheme
+	PartitionProvisioner = "partition"
+	// CephVolumeProvisioner provisions OSDs on devices with `ceph-volume lvm`
+	CephVolumeProvisioner = "ceph-volume"
 )
 
 type StoreConfig struct {
@@ -48,6 +84,20 @@ type StoreConfig struct {
 	WalSizeMB      int    `json:"walSizeMB,omitempty"`
 	DatabaseSizeMB int    `json:"databaseSizeMB,omitempty"`
 	JournalSizeMB  int    `json:"journalSizeMB,omitempty"`
+	Provisioner    string `json:"provisioner,omitempty"`
+	// whether the OSDs on devices are encrypted with dm-crypt
+	EncryptedDevice bool `json:"encryptedDevice,omitempty"`
+	// the fraction of the full CRUSH weight by which new OSDs are raised and removed OSDs are drained at each step, or
+	// 0 to change the weight at once
+	WeightRampStep float64 `json:"weightRampStep,omitempty"`
+	// the number of OSDs that share each new device, or 0 for a single OSD on each device
+	OSDsPerDevice int `json:"osdsPerDevice,omitempty"`
+	// the size of the DB and the WAL of a bluestore OSD with a metadata device as a percentage of its data device, or 0
+	// for the fixed sizes
+	DatabaseSizePercent float64 `json:"databaseSizePercent,omitempty"`
+	WalSizePercent      float64 `json:"walSizePercent,omitempty"`
+	// whether the free space of a metadata device is split between the DBs of its new bluestore OSDs
+	AutoMetadataSize bool `json:"autoMetadataSize,omitempty"`
 }
 
 func ToStoreConfig(config map[string]string) StoreConfig {
@@ -62,6 +112,20 @@ func ToStoreConfig(config map[string]string) StoreConfig {
 			storeConfig.DatabaseSizeMB = convertToIntIgnoreErr(v)
 		case JournalSizeMBKey:
 			storeConfig.JournalSizeMB = convertToIntIgnoreErr(v)
+		case ProvisionerKey:
+			storeConfig.Provisioner = v
+		case EncryptedDeviceKey:
+			storeConfig.EncryptedDevice = v == "true"
+		case WeightRampStepKey:
+			storeConfig.WeightRampStep = toWeightRampStep(v)
+		case OSDsPerDeviceKey:
+			storeConfig.OSDsPerDevice = toOSDsPerDevice(v)
+		case DatabaseSizePercentKey:
+			storeConfig.DatabaseSizePercent = toSizePercent(k, v)
+		case WalSizePercentKey:
+			storeConfig.WalSizePercent = toSizePercent(k, v)
+		case AutoMetadataSizeKey:
+			storeConfig.AutoMetadataSize = v == "true"
 		}
 	}
 
@@ -79,6 +143,70 @@ func MetadataDevice(config map[string]string) string {
 	return ""
 }
 
+func DeviceClass(config map[string]string) string {
+	return config[DeviceClassKey]
+}
+
+// DedicatedPods returns whether each OSD of a node runs in its own pod instead of all the OSDs of the node running in a
+// single pod
+func DedicatedPods(config map[string]string) bool {
+	return config[DedicatedPodsKey] == "true"
+}
+
+// FailingDevices returns how the devices predicted to fail by their health are handled, which is to skip them by default
+func FailingDevices(config map[string]string) string {
+	switch v := config[FailingDevicesKey]; v {
+	case FailingDevicesSkip, FailingDevicesDrain, FailingDevicesUse:
+		return v
+	case "":
+	default:
+		logger.Warningf("ignoring invalid %s %q, it must be %s, %s or %s", FailingDevicesKey, v,
+			FailingDevicesSkip, FailingDevicesDrain, FailingDevicesUse)
+	}
+	return FailingDevicesSkip
+}
+
+// OSDsPerDevice returns the number of OSDs in the config of a device, or 0 if the config of the device does not set it
+func OSDsPerDevice(config map[string]string) int {
+	if v, ok := config[OSDsPerDeviceKey]; ok {
+		return toOSDsPerDevice(v)
+	}
+	return 0
+}
+
+// the ramp step must be a fraction of the full weight, the weight is changed at once for any other value
+func toWeightRampStep(raw string) float64 {
+	val, err := strconv.ParseFloat(raw, 64)
+	if err != nil || val <= 0 || val > 1 {
+		logger.Warningf("ignoring invalid %s %q, it must be greater than 0 and at most 1", WeightRampStepKey, raw)
+		return 0
+	}
+
+	return val
+}
+
+// a device has at least one osd, the default of a single osd is used for any other value
+func toOSDsPerDevice(raw string) int {
+	val, err := strconv.Atoi(raw)
+	if err != nil || val < 1 {
+		logger.Warningf("ignoring invalid %s %q, it must be at least 1", OSDsPerDeviceKey, raw)
+		return 0
+	}
+
+	return val
+}
+
+// a size percentage must be a part of the data device, the fixed size is used for any other value
+func toSizePercent(key, raw string) float64 {
+	val, err := strconv.ParseFloat(raw, 64)
+	if err != nil || val <= 0 || val > 100 {
+		logger.Warningf("ignoring invalid %s %q, it must be greater than 0 and at most 100", key, raw)
+		return 0
+	}
+
+	return val
+}
+
 func convertToIntIgnoreErr(raw string) int {
 	val, err := strconv.Atoi(raw)
 	if err != nil {
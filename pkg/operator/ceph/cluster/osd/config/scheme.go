@@ -18,6 +18,7 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 
 	"github.com/google/uuid"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -36,6 +37,12 @@ const (
 	BluestoreDirBlockName = "bluestore-block"
 	BluestoreDirWalName   = "bluestore-wal"
 	BluestoreDirDBName    = "bluestore-db"
+
+	// the bounds of the WAL and DB sizes that are derived from the capacity of the devices
+	WalMinSizeMB = WalDefaultSizeMB
+	WalMaxSizeMB = 10240
+	DBMinSizeMB  = 1024
+	DBMaxSizeMB  = 307200
 )
 
 type PartitionType int
@@ -48,25 +55,48 @@ const (
 	FilestoreJournalPartitionType
 )
 
-// top level representation of an overall performance oriented partition scheme, with a dedicated metadata device
+// top level representation of an overall performance oriented partition scheme, with the dedicated metadata devices
 // and entries for all OSDs that define where their partitions live
 type PerfScheme struct {
+	MetadataDevices []*MetadataDeviceInfo `json:"metadataDevices,omitempty"`
+	Entries         []*PerfSchemeEntry    `json:"entries"`
+	// the IDs of destroyed OSDs whose failed devices were dropped, which are reused by the next new devices
+	ReplacedOSDs []int `json:"replacedOsds,omitempty"`
+}
+
+// the partition scheme as it was saved when only a single metadata device was supported
+type legacyPerfScheme struct {
 	Metadata *MetadataDeviceInfo `json:"metadata"`
-	Entries  []*PerfSchemeEntry  `json:"entries"`
 }
 
 // represents an OSD and details about all of its partitions
 type PerfSchemeEntry struct {
-	ID         int                                           `json:"id"`
-	OsdUUID    uuid.UUID                                     `json:"osdUuid"`
-	Partitions map[PartitionType]*PerfSchemePartitionDetails `json:"partitions"` // mapping of partition name to its details
-	StoreType  string                                        `json:"storeType,omitempty"`
-	FSCreated  bool                                          `json:"fsCreated"`
+	ID          int                                           `json:"id"`
+	OsdUUID     uuid.UUID                                     `json:"osdUuid"`
+	Partitions  map[PartitionType]*PerfSchemePartitionDetails `json:"partitions"` // mapping of partition name to its details
+	StoreType   string                                        `json:"storeType,omitempty"`
+	DeviceClass string                                        `json:"deviceClass,omitempty"`
+	Encrypted   bool                                          `json:"encrypted,omitempty"` // whether the partitions are encrypted with dm-crypt
+	FSCreated   bool                                          `json:"fsCreated"`
+	// the position of the OSD among the OSDs that share its data device, the first OSD partitions the device
+	DeviceIndex int `json:"deviceIndex,omitempty"`
+	// the sizes chosen for the WAL and the DB of a bluestore OSD on a metadata device
+	WalSizeMB      int `json:"walSizeMB,omitempty"`
+	DatabaseSizeMB int `json:"databaseSizeMB,omitempty"`
+}
+
+// DeviceSizes are the sizes (MB) of the devices of a new OSD that its metadata sizes can be derived from, 0 if unknown
+type DeviceSizes struct {
+	// the part of the data device used by the OSD
+	DataMB int
+	// the part of the free space of the metadata device for each of its new OSDs
+	MetadataShareMB int
 }
 
 // details for 1 OSD partition
 type PerfSchemePartitionDetails struct {
 	Device        string `json:"device"`
+	DevicePath    string `json:"devicePath,omitempty"` // persistent path of the device that does not change if it is renamed
 	DiskUUID      string `json:"diskUuid"`
 	PartitionUUID string `json:"partitionUuid"`
 	SizeMB        int    `json:"sizeMB"`
@@ -125,6 +155,15 @@ func LoadScheme(kv *k8sutil.ConfigMapKVStore, storeName string) (*PerfScheme, er
 		return nil, err
 	}
 
+	// a scheme saved with a single metadata device becomes the first of the metadata devices
+	var legacyScheme legacyPerfScheme
+	if err := json.Unmarshal([]byte(schemeRaw), &legacyScheme); err != nil {
+		return nil, err
+	}
+	if legacyScheme.Metadata != nil && len(scheme.MetadataDevices) == 0 {
+		scheme.MetadataDevices = []*MetadataDeviceInfo{legacyScheme.Metadata}
+	}
+
 	return &scheme, nil
 }
 
@@ -163,6 +202,33 @@ func (s *PerfScheme) String() string {
 	return string(b)
 }
 
+// gets the metadata device with the given disk UUID, or nil if it is not a metadata device of the scheme
+func (s *PerfScheme) GetMetadataDevice(diskUUID string) *MetadataDeviceInfo {
+	if diskUUID == "" {
+		return nil
+	}
+
+	for _, m := range s.MetadataDevices {
+		if m.DiskUUID == diskUUID {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// adds the given metadata device to the scheme, replacing the device with the same disk UUID if there is one
+func (s *PerfScheme) SetMetadataDevice(info *MetadataDeviceInfo) {
+	for i, m := range s.MetadataDevices {
+		if m.DiskUUID == info.DiskUUID {
+			s.MetadataDevices[i] = info
+			return
+		}
+	}
+
+	s.MetadataDevices = append(s.MetadataDevices, info)
+}
+
 func (s *PerfScheme) UpdateSchemeEntry(e *PerfSchemeEntry) error {
 	return s.doSchemeEntryAction(e, func(scheme *PerfScheme, index int, entry *PerfSchemeEntry) {
 		// the action to perform if the entry is found is to update the entry
@@ -266,13 +332,13 @@ func PopulateCollocatedPerfSchemeEntry(entry *PerfSchemeEntry, device string, st
 }
 
 // populates a partition scheme entry for an OSD that will have distributed partitions: its metadata will live on a
-// dedicated metadata device and its block data will live on a dedicated device
+// dedicated metadata device and its block data will live on a dedicated device.  For filestore, the metadata is the
+// journal of the OSD. For bluestore, the sizes of the WAL and DB can be derived from the given sizes of the devices.
 func PopulateDistributedPerfSchemeEntry(entry *PerfSchemeEntry, device string, metadataInfo *MetadataDeviceInfo,
-	storeConfig StoreConfig) error {
+	storeConfig StoreConfig, sizes DeviceSizes) error {
 
 	if storeConfig.StoreType == Filestore {
-		// TODO: support separate metadata device for filestore
-		return fmt.Errorf("filestore not yet supported for distributed partition scheme")
+		return populateDistributedFilestoreEntry(entry, device, metadataInfo, storeConfig)
 	}
 
 	diskUUID, walUUID, dbUUID, blockUUID, err := createBluestoreUUIDs()
@@ -289,21 +355,25 @@ func PopulateDistributedPerfSchemeEntry(entry *PerfSchemeEntry, device string, m
 		OffsetMB:      1,
 	}
 
+	walSize, dbSize, err := getMetadataSizes(storeConfig, sizes)
+	if err != nil {
+		return fmt.Errorf("failed to size the metadata of osd.%d: %+v", entry.ID, err)
+	}
+	entry.WalSizeMB = walSize
+	entry.DatabaseSizeMB = dbSize
+
 	// the WAL and DB will be on a separate metadata device
-	offset := 1
-	numMetadataParts := len(metadataInfo.Partitions)
-	if numMetadataParts == 0 {
-		// the metadata device hasn't been used yet, create a disk UUID for it
-		u, err := uuid.NewRandom()
-		if err != nil {
-			return fmt.Errorf("failed to get metadata disk uuid. %+v", err)
-		}
-		metadataInfo.DiskUUID = u.String()
-	} else {
-		lastEntry := metadataInfo.Partitions[numMetadataParts-1]
-		offset = lastEntry.OffsetMB + lastEntry.SizeMB
+	if err := addMetadataPartition(entry, metadataInfo, WalPartitionType, walUUID.String(), walSize); err != nil {
+		return err
 	}
+	return addMetadataPartition(entry, metadataInfo, DatabasePartitionType, dbUUID.String(), dbSize)
+}
 
+// gets the sizes (MB) of the WAL and the DB of a bluestore OSD on a metadata device. The sizes are a percentage of the
+// data device, or the DB takes the share of the free space of the metadata device, within their bounds. The fixed sizes
+// are used when the size of the device they are derived from is unknown. The metadata never exceeds the share of the
+// metadata device.
+func getMetadataSizes(storeConfig StoreConfig, sizes DeviceSizes) (int, int, error) {
 	walSize := WalDefaultSizeMB
 	if storeConfig.WalSizeMB > 0 {
 		walSize = storeConfig.WalSizeMB
@@ -312,61 +382,230 @@ func PopulateDistributedPerfSchemeEntry(entry *PerfSchemeEntry, device string, m
 	if storeConfig.DatabaseSizeMB > 0 {
 		dbSize = storeConfig.DatabaseSizeMB
 	}
+	derived := false
 
-	// record information about the WAL partition
-	entry.Partitions[WalPartitionType] = &PerfSchemePartitionDetails{
-		Device:        metadataInfo.Device,
-		DiskUUID:      metadataInfo.DiskUUID,
-		PartitionUUID: walUUID.String(),
-		SizeMB:        walSize,
-		OffsetMB:      offset,
+	if storeConfig.WalSizePercent > 0 && sizes.DataMB > 0 {
+		walSize = boundSize(int(float64(sizes.DataMB)*storeConfig.WalSizePercent/100), WalMinSizeMB, WalMaxSizeMB)
+		derived = true
 	}
-	walPartitionInfo := &MetadataDevicePartition{
-		ID:            entry.ID,
-		OsdUUID:       entry.OsdUUID,
-		Type:          WalPartitionType,
-		PartitionUUID: walUUID.String(),
-		SizeMB:        walSize,
-		OffsetMB:      offset,
+	if storeConfig.DatabaseSizePercent > 0 && sizes.DataMB > 0 {
+		dbSize = boundSize(int(float64(sizes.DataMB)*storeConfig.DatabaseSizePercent/100), DBMinSizeMB, DBMaxSizeMB)
+		derived = true
+	} else if storeConfig.AutoMetadataSize && sizes.MetadataShareMB > 0 {
+		dbSize = boundSize(sizes.MetadataShareMB-walSize, DBMinSizeMB, DBMaxSizeMB)
+		derived = true
+	}
+
+	if derived && sizes.MetadataShareMB > 0 && walSize+dbSize > sizes.MetadataShareMB {
+		// the db shrinks to what is left of the share of the metadata device
+		dbSize = sizes.MetadataShareMB - walSize
+		if dbSize < DBMinSizeMB {
+			return 0, 0, fmt.Errorf("share of %d MB of the metadata device is too small for a %d MB wal and a db of at least %d MB",
+				sizes.MetadataShareMB, walSize, DBMinSizeMB)
+		}
+	}
+	if derived {
+		logger.Infof("derived a %d MB wal and a %d MB db from a %d MB data device and a %d MB share of the metadata device",
+			walSize, dbSize, sizes.DataMB, sizes.MetadataShareMB)
 	}
-	metadataInfo.Partitions = append(metadataInfo.Partitions, walPartitionInfo)
-	offset += entry.Partitions[WalPartitionType].SizeMB
 
-	// record information about the DB partition
-	entry.Partitions[DatabasePartitionType] = &PerfSchemePartitionDetails{
+	return walSize, dbSize, nil
+}
+
+// keeps the size within the given bounds
+func boundSize(size, min, max int) int {
+	if size < min {
+		return min
+	}
+	if size > max {
+		return max
+	}
+	return size
+}
+
+func populateDistributedFilestoreEntry(entry *PerfSchemeEntry, device string, metadataInfo *MetadataDeviceInfo,
+	storeConfig StoreConfig) error {
+
+	diskUUID, dataUUID, journalUUID, err := createFilestoreUUIDs()
+	if err != nil {
+		return err
+	}
+
+	// the filestore data partition will take up the entire given device
+	entry.Partitions[FilestoreDataPartitionType] = &PerfSchemePartitionDetails{
+		Device:        device,
+		DiskUUID:      diskUUID.String(),
+		PartitionUUID: dataUUID.String(),
+		SizeMB:        UseRemainingSpace,
+		OffsetMB:      1,
+	}
+
+	// the journal will be on a separate metadata device
+	journalSize := JournalDefaultSizeMB
+	if storeConfig.JournalSizeMB > 0 {
+		journalSize = storeConfig.JournalSizeMB
+	}
+	return addMetadataPartition(entry, metadataInfo, FilestoreJournalPartitionType, journalUUID.String(), journalSize)
+}
+
+// FilestoreConversions gets the filestore OSDs on devices that can be converted to bluestore, sorted by their IDs. The
+// OSDs that share their data device with other OSDs are not converted since the device can't be partitioned again for a
+// single OSD.
+func FilestoreConversions(scheme *PerfScheme) []*PerfSchemeEntry {
+	osdsOnDisk := map[string]int{}
+	for _, entry := range scheme.Entries {
+		if data, ok := entry.Partitions[entry.GetDataPartitionType()]; ok {
+			osdsOnDisk[data.DiskUUID]++
+		}
+	}
+
+	byID := map[int]*PerfSchemeEntry{}
+	var ids []int
+	for _, entry := range scheme.Entries {
+		if entry.StoreType != Filestore {
+			continue
+		}
+		data, ok := entry.Partitions[FilestoreDataPartitionType]
+		if !ok {
+			continue
+		}
+		if osdsOnDisk[data.DiskUUID] > 1 {
+			logger.Warningf("not converting osd.%d to bluestore, it shares its device %s with other osds", entry.ID, data.Device)
+			continue
+		}
+		byID[entry.ID] = entry
+		ids = append(ids, entry.ID)
+	}
+	sort.Ints(ids)
+
+	var entries []*PerfSchemeEntry
+	for _, id := range ids {
+		entries = append(entries, byID[id])
+	}
+	return entries
+}
+
+// ShareDataDevice places the partitions of the OSD on its data device in the part of the device at the given index when
+// the device is split into count equal parts, so that several OSDs share the device. The partitions get the given disk
+// UUID so that all the OSDs on the device agree on it. The last part takes the remaining space of the device.
+func ShareDataDevice(entry *PerfSchemeEntry, diskUUID string, index, count, deviceSizeMB int) error {
+	dataDetails, ok := entry.Partitions[entry.GetDataPartitionType()]
+	if !ok || dataDetails == nil {
+		return fmt.Errorf("data partition missing from %+v", entry)
+	}
+
+	// the partitions of the entry are laid out from the start of the device
+	var parts []*PerfSchemePartitionDetails
+	fixedSizeMB := 0
+	for _, details := range entry.Partitions {
+		if details.DiskUUID != dataDetails.DiskUUID {
+			continue
+		}
+		parts = append(parts, details)
+		if details.SizeMB != UseRemainingSpace {
+			fixedSizeMB += details.SizeMB
+		}
+	}
+
+	partSizeMB := (deviceSizeMB - 1) / count
+	if partSizeMB <= fixedSizeMB {
+		return fmt.Errorf("device %s of %d MB is too small to be shared by %d osds", dataDetails.Device, deviceSizeMB, count)
+	}
+
+	start := 1 + index*partSizeMB
+	for _, details := range parts {
+		details.DiskUUID = diskUUID
+		details.OffsetMB += start - 1
+		if details.SizeMB == UseRemainingSpace && index < count-1 {
+			details.SizeMB = start + partSizeMB - details.OffsetMB
+		}
+	}
+	entry.DeviceIndex = index
+
+	return nil
+}
+
+// records a partition of the given OSD on the metadata device, after the existing partitions of the device
+func addMetadataPartition(entry *PerfSchemeEntry, metadataInfo *MetadataDeviceInfo, partType PartitionType,
+	partUUID string, sizeMB int) error {
+
+	if len(metadataInfo.Partitions) == 0 && metadataInfo.DiskUUID == "" {
+		// the metadata device hasn't been used yet, create a disk UUID for it
+		u, err := uuid.NewRandom()
+		if err != nil {
+			return fmt.Errorf("failed to get metadata disk uuid. %+v", err)
+		}
+		metadataInfo.DiskUUID = u.String()
+	}
+	offset := metadataInfo.NextOffsetMB()
+
+	entry.Partitions[partType] = &PerfSchemePartitionDetails{
 		Device:        metadataInfo.Device,
 		DiskUUID:      metadataInfo.DiskUUID,
-		PartitionUUID: dbUUID.String(),
-		SizeMB:        dbSize,
+		PartitionUUID: partUUID,
+		SizeMB:        sizeMB,
 		OffsetMB:      offset,
 	}
-	dbPartitionInfo := &MetadataDevicePartition{
+	metadataInfo.Partitions = append(metadataInfo.Partitions, &MetadataDevicePartition{
 		ID:            entry.ID,
 		OsdUUID:       entry.OsdUUID,
-		Type:          DatabasePartitionType,
-		PartitionUUID: dbUUID.String(),
-		SizeMB:        dbSize,
+		Type:          partType,
+		PartitionUUID: partUUID,
+		SizeMB:        sizeMB,
 		OffsetMB:      offset,
-	}
-	metadataInfo.Partitions = append(metadataInfo.Partitions, dbPartitionInfo)
+	})
 
 	return nil
 }
 
 func (m *MetadataDeviceInfo) GetPartitionArgs() []string {
+	args := m.getPartitionArgs(0)
+
+	// append args for the whole device
+	args = append(args, []string{fmt.Sprintf("--disk-guid=%s", m.DiskUUID), "/dev/" + m.Device}...)
+
+	return args
+}
+
+// Get the args to add the partitions from the given index on to a metadata device that already has the partitions
+// before that index.
+func (m *MetadataDeviceInfo) GetAppendPartitionArgs(start int) []string {
+	args := m.getPartitionArgs(start)
+	return append(args, "/dev/"+m.Device)
+}
+
+func (m *MetadataDeviceInfo) getPartitionArgs(start int) []string {
 	args := []string{}
 
-	for partNum, part := range m.Partitions {
-		partArgs := getPartitionArgs(partNum+1, part.PartitionUUID, part.OffsetMB, part.SizeMB, getPartitionLabel(part.ID, part.Type))
+	for i := start; i < len(m.Partitions); i++ {
+		part := m.Partitions[i]
+		partArgs := getPartitionArgs(i+1, part.PartitionUUID, part.OffsetMB, part.SizeMB, getPartitionLabel(part.ID, part.Type))
 		args = append(args, partArgs...)
 	}
 
-	// append args for the whole device
-	args = append(args, []string{fmt.Sprintf("--disk-guid=%s", m.DiskUUID), "/dev/" + m.Device}...)
-
 	return args
 }
 
+// gets the offset in MB of the next partition that will be added to the metadata device
+func (m *MetadataDeviceInfo) NextOffsetMB() int {
+	if len(m.Partitions) == 0 {
+		return 1
+	}
+
+	last := m.Partitions[len(m.Partitions)-1]
+	return last.OffsetMB + last.SizeMB
+}
+
+// gets the number of OSDs that have metadata partitions on the metadata device
+func (m *MetadataDeviceInfo) OSDCount() int {
+	ids := map[int]bool{}
+	for _, part := range m.Partitions {
+		ids[part.ID] = true
+	}
+
+	return len(ids)
+}
+
 func (e *PerfSchemeEntry) String() string {
 	b, _ := json.Marshal(e)
 	return string(b)
@@ -377,7 +616,13 @@ func (e *PerfSchemeEntry) GetPartitionArgs() []string {
 	collocated := e.IsCollocated()
 
 	args := []string{}
-	partNum := 1
+
+	// the partitions of the OSDs that share the device are numbered after the partitions of the OSDs before them
+	partsPerOSD := 1
+	if collocated && e.StoreType == Bluestore {
+		partsPerOSD = 3
+	}
+	partNum := 1 + e.DeviceIndex*partsPerOSD
 
 	if collocated && e.StoreType == Bluestore {
 		// partitions are collocated, create the metadata partitions on the same device
@@ -17,6 +17,7 @@ package config
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/google/uuid"
@@ -35,16 +36,17 @@ func TestSchemeSaveLoad(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, scheme)
 	assert.Equal(t, 0, len(scheme.Entries))
-	assert.Nil(t, scheme.Metadata)
+	assert.Equal(t, 0, len(scheme.MetadataDevices))
 
 	// add some entries to the scheme
-	scheme.Metadata = NewMetadataDeviceInfo("sda")
-	scheme.Metadata.DiskUUID = uuid.Must(uuid.NewRandom()).String()
+	metadata := NewMetadataDeviceInfo("sda")
+	metadata.DiskUUID = uuid.Must(uuid.NewRandom()).String()
+	scheme.MetadataDevices = append(scheme.MetadataDevices, metadata)
 	m1 := &MetadataDevicePartition{ID: 1, OsdUUID: uuid.Must(uuid.NewRandom()), Type: WalPartitionType,
 		PartitionUUID: uuid.Must(uuid.NewRandom()).String(), SizeMB: 100, OffsetMB: 1}
 	m2 := &MetadataDevicePartition{ID: 1, OsdUUID: m1.OsdUUID, Type: DatabasePartitionType,
 		PartitionUUID: uuid.Must(uuid.NewRandom()).String(), SizeMB: 200, OffsetMB: 101}
-	scheme.Metadata.Partitions = append(scheme.Metadata.Partitions, []*MetadataDevicePartition{m1, m2}...)
+	metadata.Partitions = append(metadata.Partitions, []*MetadataDevicePartition{m1, m2}...)
 
 	e1 := &PerfSchemeEntry{ID: 1, OsdUUID: m1.OsdUUID}
 	e1.Partitions = map[PartitionType]*PerfSchemePartitionDetails{
@@ -90,7 +92,7 @@ func TestPopulateDistributedPerfSchemeEntry(t *testing.T) {
 	entry.ID = 20
 	entry.OsdUUID = uuid.Must(uuid.NewRandom())
 
-	err := PopulateDistributedPerfSchemeEntry(entry, "sdb", metadata, StoreConfig{WalSizeMB: 1, DatabaseSizeMB: 2})
+	err := PopulateDistributedPerfSchemeEntry(entry, "sdb", metadata, StoreConfig{WalSizeMB: 1, DatabaseSizeMB: 2}, DeviceSizes{})
 	assert.Nil(t, err)
 
 	// verify the populated distributed partition entries (metadata partitions should be on metadata device, block
@@ -106,6 +108,147 @@ func TestPopulateDistributedPerfSchemeEntry(t *testing.T) {
 	verifyMetadataDevicePartition(t, metadata, 1, entry.ID, entry.OsdUUID, DatabasePartitionType, 2, 2)
 }
 
+func TestPopulateDistributedPerfSchemeEntryDerivedSizes(t *testing.T) {
+	metadata := NewMetadataDeviceInfo("nvme0n1")
+
+	// the db is a percentage of the 1 TB data device and the sizes are reported in the entry
+	entry := NewPerfSchemeEntry(Bluestore)
+	entry.ID = 21
+	sizes := DeviceSizes{DataMB: 1048576, MetadataShareMB: 51200}
+	err := PopulateDistributedPerfSchemeEntry(entry, "sdb", metadata, StoreConfig{DatabaseSizePercent: 2}, sizes)
+	assert.Nil(t, err)
+	assert.Equal(t, WalDefaultSizeMB, entry.WalSizeMB)
+	assert.Equal(t, 20971, entry.DatabaseSizeMB)
+	verifyPartitionDetails(t, entry, WalPartitionType, "nvme0n1", 1, WalDefaultSizeMB)
+	verifyPartitionDetails(t, entry, DatabasePartitionType, "nvme0n1", 577, 20971)
+}
+
+func TestGetMetadataSizes(t *testing.T) {
+	tests := []struct {
+		name        string
+		storeConfig StoreConfig
+		sizes       DeviceSizes
+		wal         int
+		db          int
+		err         bool
+	}{
+		{"fixed", StoreConfig{WalSizeMB: 1000, DatabaseSizeMB: 2000}, DeviceSizes{DataMB: 1048576, MetadataShareMB: 1}, 1000, 2000, false},
+		{"defaults", StoreConfig{}, DeviceSizes{}, WalDefaultSizeMB, DBDefaultSizeMB, false},
+		{"percent", StoreConfig{DatabaseSizePercent: 4, WalSizePercent: 0.1}, DeviceSizes{DataMB: 1048576}, 1048, 41943, false},
+		{"percent min", StoreConfig{DatabaseSizePercent: 1, WalSizePercent: 0.01}, DeviceSizes{DataMB: 10240}, WalMinSizeMB, DBMinSizeMB, false},
+		{"percent max", StoreConfig{DatabaseSizePercent: 10, WalSizePercent: 1}, DeviceSizes{DataMB: 8388608}, WalMaxSizeMB, DBMaxSizeMB, false},
+		{"percent unknown size", StoreConfig{DatabaseSizePercent: 4}, DeviceSizes{}, WalDefaultSizeMB, DBDefaultSizeMB, false},
+		{"percent over share", StoreConfig{DatabaseSizePercent: 4}, DeviceSizes{DataMB: 1048576, MetadataShareMB: 10000}, WalDefaultSizeMB, 9424, false},
+		{"percent share too small", StoreConfig{DatabaseSizePercent: 4}, DeviceSizes{DataMB: 1048576, MetadataShareMB: 1500}, 0, 0, true},
+		{"auto", StoreConfig{AutoMetadataSize: true}, DeviceSizes{DataMB: 1048576, MetadataShareMB: 51200}, WalDefaultSizeMB, 50624, false},
+		{"auto max", StoreConfig{AutoMetadataSize: true}, DeviceSizes{MetadataShareMB: 1048576}, WalDefaultSizeMB, DBMaxSizeMB, false},
+		{"auto unknown share", StoreConfig{AutoMetadataSize: true, DatabaseSizeMB: 3000}, DeviceSizes{DataMB: 1048576}, WalDefaultSizeMB, 3000, false},
+		{"percent before auto", StoreConfig{DatabaseSizePercent: 1, AutoMetadataSize: true}, DeviceSizes{DataMB: 1048576, MetadataShareMB: 51200}, WalDefaultSizeMB, 10485, false},
+	}
+
+	for _, test := range tests {
+		wal, db, err := getMetadataSizes(test.storeConfig, test.sizes)
+		if test.err {
+			assert.NotNil(t, err, test.name)
+			continue
+		}
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, test.wal, wal, test.name)
+		assert.Equal(t, test.db, db, test.name)
+	}
+}
+
+func TestPopulateDistributedFilestorePerfSchemeEntry(t *testing.T) {
+	metadata := NewMetadataDeviceInfo("sda")
+
+	e1 := NewPerfSchemeEntry(Filestore)
+	e1.ID = 30
+	e1.OsdUUID = uuid.Must(uuid.NewRandom())
+	err := PopulateDistributedPerfSchemeEntry(e1, "sdb", metadata, StoreConfig{StoreType: Filestore, JournalSizeMB: 3}, DeviceSizes{})
+	assert.Nil(t, err)
+
+	// the data partition takes the whole data device and the journal is on the metadata device
+	assert.Equal(t, 2, len(e1.Partitions))
+	assert.False(t, e1.IsCollocated())
+	verifyPartitionDetails(t, e1, FilestoreDataPartitionType, "sdb", 1, -1)
+	verifyPartitionDetails(t, e1, FilestoreJournalPartitionType, "sda", 1, 3)
+
+	// the journal of a second OSD follows the first one, with the default size
+	e2 := NewPerfSchemeEntry(Filestore)
+	e2.ID = 31
+	e2.OsdUUID = uuid.Must(uuid.NewRandom())
+	err = PopulateDistributedPerfSchemeEntry(e2, "sdc", metadata, StoreConfig{StoreType: Filestore}, DeviceSizes{})
+	assert.Nil(t, err)
+	verifyPartitionDetails(t, e2, FilestoreJournalPartitionType, "sda", 4, JournalDefaultSizeMB)
+
+	assert.Equal(t, 2, len(metadata.Partitions))
+	verifyMetadataDevicePartition(t, metadata, 0, e1.ID, e1.OsdUUID, FilestoreJournalPartitionType, 1, 3)
+	verifyMetadataDevicePartition(t, metadata, 1, e2.ID, e2.OsdUUID, FilestoreJournalPartitionType, 4, JournalDefaultSizeMB)
+
+	expectedArgs := []string{
+		"--new=1:2048:+6144", "--change-name=1:ROOK-OSD30-FS-JOURNAL", fmt.Sprintf("--partition-guid=1:%s", metadata.Partitions[0].PartitionUUID),
+		"--new=2:8192:+10485760", "--change-name=2:ROOK-OSD31-FS-JOURNAL", fmt.Sprintf("--partition-guid=2:%s", metadata.Partitions[1].PartitionUUID),
+		fmt.Sprintf("--disk-guid=%s", metadata.DiskUUID), "/dev/sda",
+	}
+	assert.Equal(t, expectedArgs, metadata.GetPartitionArgs())
+
+	// only the data partition is created on the data device
+	expectedArgs = []string{
+		"--largest-new=1", "--change-name=1:ROOK-OSD30-FS-DATA", fmt.Sprintf("--partition-guid=1:%s", e1.Partitions[FilestoreDataPartitionType].PartitionUUID),
+		fmt.Sprintf("--disk-guid=%s", e1.Partitions[FilestoreDataPartitionType].DiskUUID), "/dev/sdb",
+	}
+	assert.Equal(t, expectedArgs, e1.GetPartitionArgs())
+}
+
+func TestShareDataDevice(t *testing.T) {
+	// a device of 1001 MB is split between 2 collocated bluestore osds of 500 MB each
+	e1 := NewPerfSchemeEntry(Bluestore)
+	e1.ID = 40
+	assert.Nil(t, PopulateCollocatedPerfSchemeEntry(e1, "nvme0n1", StoreConfig{WalSizeMB: 10, DatabaseSizeMB: 90}))
+	diskUUID := e1.Partitions[BlockPartitionType].DiskUUID
+	assert.Nil(t, ShareDataDevice(e1, diskUUID, 0, 2, 1001))
+	verifyPartitionDetails(t, e1, WalPartitionType, "nvme0n1", 1, 10)
+	verifyPartitionDetails(t, e1, DatabasePartitionType, "nvme0n1", 11, 90)
+	verifyPartitionDetails(t, e1, BlockPartitionType, "nvme0n1", 101, 400)
+
+	// the last osd takes the rest of the device, with the partitions numbered after those of the first osd
+	e2 := NewPerfSchemeEntry(Bluestore)
+	e2.ID = 41
+	assert.Nil(t, PopulateCollocatedPerfSchemeEntry(e2, "nvme0n1", StoreConfig{WalSizeMB: 10, DatabaseSizeMB: 90}))
+	assert.Nil(t, ShareDataDevice(e2, diskUUID, 1, 2, 1001))
+	assert.True(t, e2.IsCollocated())
+	assert.Equal(t, 1, e2.DeviceIndex)
+	verifyPartitionDetails(t, e2, WalPartitionType, "nvme0n1", 501, 10)
+	verifyPartitionDetails(t, e2, DatabasePartitionType, "nvme0n1", 511, 90)
+	verifyPartitionDetails(t, e2, BlockPartitionType, "nvme0n1", 601, -1)
+	for _, details := range e2.Partitions {
+		assert.Equal(t, diskUUID, details.DiskUUID)
+	}
+
+	expectedArgs := []string{
+		"--new=4:1026048:+20480", "--change-name=4:ROOK-OSD41-WAL", fmt.Sprintf("--partition-guid=4:%s", e2.Partitions[WalPartitionType].PartitionUUID),
+		"--new=5:1046528:+184320", "--change-name=5:ROOK-OSD41-DB", fmt.Sprintf("--partition-guid=5:%s", e2.Partitions[DatabasePartitionType].PartitionUUID),
+		"--largest-new=6", "--change-name=6:ROOK-OSD41-BLOCK", fmt.Sprintf("--partition-guid=6:%s", e2.Partitions[BlockPartitionType].PartitionUUID),
+		fmt.Sprintf("--disk-guid=%s", diskUUID), "/dev/nvme0n1",
+	}
+	assert.Equal(t, expectedArgs, e2.GetPartitionArgs())
+
+	// only the partitions on the data device are moved, the metadata partitions stay on the metadata device
+	metadata := NewMetadataDeviceInfo("sda")
+	e3 := NewPerfSchemeEntry(Filestore)
+	e3.ID = 42
+	assert.Nil(t, PopulateDistributedPerfSchemeEntry(e3, "sdb", metadata, StoreConfig{StoreType: Filestore, JournalSizeMB: 3}, DeviceSizes{}))
+	assert.Nil(t, ShareDataDevice(e3, "disk-uuid", 2, 4, 4001))
+	verifyPartitionDetails(t, e3, FilestoreDataPartitionType, "sdb", 2001, 1000)
+	verifyPartitionDetails(t, e3, FilestoreJournalPartitionType, "sda", 1, 3)
+	assert.Equal(t, metadata.DiskUUID, e3.Partitions[FilestoreJournalPartitionType].DiskUUID)
+
+	// each part of the device must have room for the metadata partitions of its osd
+	e4 := NewPerfSchemeEntry(Bluestore)
+	assert.Nil(t, PopulateCollocatedPerfSchemeEntry(e4, "sdc", StoreConfig{WalSizeMB: 10, DatabaseSizeMB: 90}))
+	assert.NotNil(t, ShareDataDevice(e4, diskUUID, 0, 10, 1001))
+}
+
 func verifyPartitionDetails(t *testing.T, entry *PerfSchemeEntry, partType PartitionType, device string, offset, size int) {
 	part, ok := entry.Partitions[partType]
 	assert.True(t, ok)
@@ -139,9 +282,9 @@ func TestMetadataGetPartitionArgs(t *testing.T) {
 	e2.OsdUUID = uuid.Must(uuid.NewRandom())
 
 	storeConfig := StoreConfig{WalSizeMB: 1, DatabaseSizeMB: 2}
-	err := PopulateDistributedPerfSchemeEntry(e1, "sdb", metadata, storeConfig)
+	err := PopulateDistributedPerfSchemeEntry(e1, "sdb", metadata, storeConfig, DeviceSizes{})
 	assert.Nil(t, err)
-	err = PopulateDistributedPerfSchemeEntry(e2, "sdc", metadata, storeConfig)
+	err = PopulateDistributedPerfSchemeEntry(e2, "sdc", metadata, storeConfig, DeviceSizes{})
 	assert.Nil(t, err)
 
 	expectedArgs := []string{
@@ -155,6 +298,57 @@ func TestMetadataGetPartitionArgs(t *testing.T) {
 	// get the partition args and verify against expected
 	args := metadata.GetPartitionArgs()
 	assert.Equal(t, expectedArgs, args)
+
+	// add a third OSD to the metadata device, only its partitions are added after the existing ones
+	assert.Equal(t, 2, metadata.OSDCount())
+	assert.Equal(t, 7, metadata.NextOffsetMB())
+	e3 := NewPerfSchemeEntry(Bluestore)
+	e3.ID = 3
+	e3.OsdUUID = uuid.Must(uuid.NewRandom())
+	err = PopulateDistributedPerfSchemeEntry(e3, "sdd", metadata, storeConfig, DeviceSizes{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, metadata.OSDCount())
+
+	expectedArgs = []string{
+		"--new=5:14336:+2048", "--change-name=5:ROOK-OSD3-WAL", fmt.Sprintf("--partition-guid=5:%s", metadata.Partitions[4].PartitionUUID),
+		"--new=6:16384:+4096", "--change-name=6:ROOK-OSD3-DB", fmt.Sprintf("--partition-guid=6:%s", metadata.Partitions[5].PartitionUUID),
+		"/dev/sda",
+	}
+	args = metadata.GetAppendPartitionArgs(4)
+	assert.Equal(t, expectedArgs, args)
+}
+
+func TestLoadLegacyScheme(t *testing.T) {
+	kv := mockKVStore()
+	storeName := GetConfigStoreName("node123")
+
+	// a scheme saved with a single metadata device
+	legacy := `{"metadata":{"device":"nvme01","diskUuid":"b3f1f9a8-d1ec-4e0b-a2d5-4b32c6c1f6a4","partitions":[]},"entries":[]}`
+	err := kv.SetValue(storeName, schemeKeyName, legacy)
+	assert.Nil(t, err)
+
+	// the metadata device is loaded as the only metadata device
+	scheme, err := LoadScheme(kv, storeName)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(scheme.MetadataDevices))
+	assert.Equal(t, "nvme01", scheme.MetadataDevices[0].Device)
+	assert.Equal(t, scheme.MetadataDevices[0], scheme.GetMetadataDevice("b3f1f9a8-d1ec-4e0b-a2d5-4b32c6c1f6a4"))
+	assert.Nil(t, scheme.GetMetadataDevice(""))
+
+	// once saved again the scheme has the metadata devices only
+	err = scheme.SaveScheme(kv, storeName)
+	assert.Nil(t, err)
+	raw, err := kv.GetValue(storeName, schemeKeyName)
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(raw, `"metadata":`))
+	assert.True(t, strings.Contains(raw, `"metadataDevices":`))
+
+	// a metadata device with the same disk UUID is replaced, others are added
+	scheme.SetMetadataDevice(&MetadataDeviceInfo{Device: "nvme02", DiskUUID: "b3f1f9a8-d1ec-4e0b-a2d5-4b32c6c1f6a4"})
+	assert.Equal(t, 1, len(scheme.MetadataDevices))
+	assert.Equal(t, "nvme02", scheme.MetadataDevices[0].Device)
+	scheme.SetMetadataDevice(&MetadataDeviceInfo{Device: "nvme03", DiskUUID: "0a2e8d56-46a5-4b8e-b3a6-7e0c2c7d90f1"})
+	assert.Equal(t, 2, len(scheme.MetadataDevices))
 }
 
 func TestSchemeEntryGetPartitionArgs(t *testing.T) {
@@ -243,3 +437,38 @@ func mockKVStore() *k8sutil.ConfigMapKVStore {
 	clientset := testop.New(1)
 	return k8sutil.NewConfigMapKVStore("myns", clientset, metav1.OwnerReference{})
 }
+
+func newConversionEntry(id int, device string, storeType string) *PerfSchemeEntry {
+	entry := NewPerfSchemeEntry(storeType)
+	entry.ID = id
+	entry.OsdUUID = uuid.Must(uuid.NewRandom())
+	PopulateCollocatedPerfSchemeEntry(entry, device, StoreConfig{StoreType: storeType})
+	return entry
+}
+
+func TestFilestoreConversions(t *testing.T) {
+	scheme := NewPerfScheme()
+	scheme.Entries = append(scheme.Entries,
+		newConversionEntry(0, "sda", Bluestore),
+		newConversionEntry(3, "sdb", Filestore),
+		newConversionEntry(1, "sdc", Filestore))
+
+	// the filestore osds are converted in the order of their ids
+	entries := FilestoreConversions(scheme)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, 1, entries[0].ID)
+	assert.Equal(t, 3, entries[1].ID)
+
+	// the osds that share a device are not converted
+	shared := newConversionEntry(5, "sdd", Filestore)
+	second := newConversionEntry(6, "sdd", Filestore)
+	second.DeviceIndex = 1
+	second.Partitions[FilestoreDataPartitionType].DiskUUID = shared.Partitions[FilestoreDataPartitionType].DiskUUID
+	scheme.Entries = append(scheme.Entries, shared, second)
+	entries = FilestoreConversions(scheme)
+	assert.Equal(t, 2, len(entries))
+
+	// nothing to convert on a node with only bluestore osds
+	scheme.Entries = scheme.Entries[:1]
+	assert.Equal(t, 0, len(FilestoreConversions(scheme)))
+}
@@ -0,0 +1,444 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	batch "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+const (
+	prepareAppNameFmt    = "rook-ceph-osd-prepare-%s"
+	osdDeploymentNameFmt = "rook-ceph-osd-id-%d"
+	osdIDAttr            = "ceph-osd-id"
+	osdNodeAttr          = "ceph.rook.io/node"
+	osdIDEnvVarName      = "ROOK_OSD_ID"
+	// the time the OSD has to start up before its liveness is checked
+	livenessProbeInitialDelaySeconds = 60
+)
+
+var (
+	// the interval and timeout of waiting for the OSD pods when the OSDs of a node are moved between pods
+	osdDeploymentsInterval = 5 * time.Second
+	osdDeploymentsTimeout  = 10 * time.Minute
+)
+
+// startDedicatedNode prepares the OSDs of a node with a short-lived job and then runs each of the OSDs in its own
+// deployment. The OSDs on the devices and directories that were removed from the selection are removed by the job, after
+// which their deployments are deleted.
+func (c *Cluster) startDedicatedNode(n rookalpha.Node, devices []rookalpha.Device, selection rookalpha.Selection,
+	storeConfig config.StoreConfig, metadataDevice string, replaceOSDs []int, deviceSelection DeviceSelection, errorMessages *[]string) {
+
+	job := c.makePrepareJob(n.Name, devices, selection, storeConfig, metadataDevice, n.Location)
+	setReplaceOSDsEnvVar(&job.Spec.Template, replaceOSDs)
+	setDeviceSelectionEnvVar(&job.Spec.Template, deviceSelection)
+	if err := k8sutil.RunReplaceableJob(c.context.Clientset, job); err != nil {
+		c.handleOrchestrationFailure(n, fmt.Sprintf("failed to run osd prepare job for node %s. %+v", n.Name, err), errorMessages)
+		return
+	}
+
+	// wait for the job to prepare the OSDs of the node
+	if err := c.waitForCompletion(n.Name); err != nil {
+		*errorMessages = append(*errorMessages, err.Error())
+		return
+	}
+
+	status, err := c.getOrchestrationStatus(n.Name)
+	if err != nil {
+		c.handleOrchestrationFailure(n, err.Error(), errorMessages)
+		return
+	}
+
+	// the OSDs that were run by the single pod of the node are stopped so that their own pods can take them over. the
+	// single pod is only removed after the OSD pods are running, otherwise it runs the OSDs again.
+	legacy, err := c.scaleReplicaSet(fmt.Sprintf(appNameFmt, n.Name), 0)
+	if err != nil {
+		c.handleOrchestrationFailure(n, err.Error(), errorMessages)
+		return
+	}
+
+	err = c.syncOSDDeployments(n, status.OSDs, storeConfig)
+	if err == nil {
+		err = c.waitForOSDDeployments(n.Name, status.OSDs)
+	}
+	if err != nil {
+		if legacy {
+			// the single pod of the node runs the OSDs again
+			c.rollbackDedicatedNode(n.Name)
+		}
+		c.handleOrchestrationFailure(n, err.Error(), errorMessages)
+		return
+	}
+
+	if legacy {
+		if err := k8sutil.DeleteReplicaSet(c.context.Clientset, c.Namespace, fmt.Sprintf(appNameFmt, n.Name)); err != nil {
+			c.handleOrchestrationFailure(n, fmt.Sprintf("failed to remove osd replica set of node %s. %+v", n.Name, err), errorMessages)
+			return
+		}
+	}
+}
+
+// scaleReplicaSet sets the number of replicas of the given replica set and waits for its pods to be stopped when it is
+// scaled down to zero. Returns false if the replica set does not exist.
+func (c *Cluster) scaleReplicaSet(name string, replicas int32) (bool, error) {
+	rs, err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get replica set %s. %+v", name, err)
+	}
+	if rs.Spec.Replicas != nil && *rs.Spec.Replicas == replicas {
+		return true, nil
+	}
+
+	logger.Infof("scaling replica set %s to %d replicas", name, replicas)
+	rs.Spec.Replicas = &replicas
+	if _, err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Update(rs); err != nil {
+		return true, fmt.Errorf("failed to scale replica set %s. %+v", name, err)
+	}
+	if replicas > 0 {
+		return true, nil
+	}
+
+	// the OSDs must be stopped before they are started by other pods
+	err = wait.Poll(osdDeploymentsInterval, osdDeploymentsTimeout, func() (bool, error) {
+		rs, err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return rs.Status.Replicas == replicas, nil
+	})
+	if err != nil {
+		return true, fmt.Errorf("failed to wait for the pods of replica set %s to stop. %+v", name, err)
+	}
+	return true, nil
+}
+
+// waitForOSDDeployments waits for the pods of the deployments of the given OSDs to be available
+func (c *Cluster) waitForOSDDeployments(nodeName string, osds []OSDInfo) error {
+	for _, osd := range osds {
+		name := fmt.Sprintf(osdDeploymentNameFmt, osd.ID)
+		err := wait.Poll(osdDeploymentsInterval, osdDeploymentsTimeout, func() (bool, error) {
+			d, err := c.context.Clientset.Extensions().Deployments(c.Namespace).Get(name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return d.Status.AvailableReplicas > 0, nil
+		})
+		if err != nil {
+			return fmt.Errorf("osd deployment %s on node %s is not running. %+v", name, nodeName, err)
+		}
+	}
+	return nil
+}
+
+// rollbackDedicatedNode removes the OSD deployments of a node whose OSDs were run by a single pod before and runs the
+// OSDs in the single pod again
+func (c *Cluster) rollbackDedicatedNode(nodeName string) {
+	logger.Warningf("osd pods of node %s failed to start, running the osds in the single pod of the node again", nodeName)
+	if err := c.deleteDedicatedPods(nodeName); err != nil {
+		logger.Errorf("failed to remove the osd pods of node %s. %+v", nodeName, err)
+	}
+	if _, err := c.scaleReplicaSet(fmt.Sprintf(appNameFmt, nodeName), 1); err != nil {
+		logger.Errorf("failed to restore the osd replica set of node %s. %+v", nodeName, err)
+	}
+}
+
+// removeDedicatedNode removes all the OSDs of a node whose OSDs run in their own pods. The OSDs keep running while the
+// job migrates their data off of them and removes them from the cluster.
+func (c *Cluster) removeDedicatedNode(n rookalpha.Node, errorMessages *[]string) {
+	storeConfig := config.ToStoreConfig(n.Config)
+	metadataDevice := config.MetadataDevice(n.Config)
+
+	// tell the job not to use any storage at all. the directories are still mounted so their data can be migrated.
+	job := c.makePrepareJob(n.Name, nil, rookalpha.Selection{DeviceFilter: "none", Directories: n.Directories},
+		storeConfig, metadataDevice, n.Location)
+	if err := k8sutil.RunReplaceableJob(c.context.Clientset, job); err != nil {
+		c.handleOrchestrationFailure(n, fmt.Sprintf("failed to run osd prepare job for removed node %s. %+v", n.Name, err), errorMessages)
+		return
+	}
+
+	if err := c.waitForCompletion(n.Name); err != nil {
+		*errorMessages = append(*errorMessages, err.Error())
+		return
+	}
+
+	if err := c.deleteDedicatedPods(n.Name); err != nil {
+		*errorMessages = append(*errorMessages, err.Error())
+	}
+}
+
+// deleteDedicatedPods deletes the OSD deployments and the prepare job of a node, for example when the OSDs of the node
+// are run by a single pod again
+func (c *Cluster) deleteDedicatedPods(nodeName string) error {
+	deployments, err := c.listOSDDeployments(nodeName)
+	if err != nil {
+		return err
+	}
+	for _, d := range deployments {
+		if err := k8sutil.DeleteDeployment(c.context.Clientset, c.Namespace, d.Name); err != nil {
+			return fmt.Errorf("failed to delete osd deployment %s. %+v", d.Name, err)
+		}
+	}
+
+	if len(deployments) > 0 {
+		if err := k8sutil.DeleteJob(c.context.Clientset, c.Namespace, fmt.Sprintf(prepareAppNameFmt, nodeName)); err != nil {
+			return fmt.Errorf("failed to delete osd prepare job of node %s. %+v", nodeName, err)
+		}
+	}
+	return nil
+}
+
+// syncOSDDeployments creates or updates a deployment for each of the prepared OSDs of the node and deletes the
+// deployments of the OSDs that were removed from the node
+func (c *Cluster) syncOSDDeployments(n rookalpha.Node, osds []OSDInfo, storeConfig config.StoreConfig) error {
+	existing, err := c.listOSDDeployments(n.Name)
+	if err != nil {
+		return err
+	}
+
+	prepared := map[string]bool{}
+	for _, osd := range osds {
+		d := c.makeOSDDeployment(n.Name, osd, n.Resources, storeConfig, n.Location)
+		prepared[d.Name] = true
+
+		_, err := c.context.Clientset.Extensions().Deployments(c.Namespace).Create(d)
+		if err == nil {
+			logger.Infof("osd deployment %s started for osd.%d on node %s", d.Name, osd.ID, n.Name)
+			continue
+		}
+		if !errors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create osd deployment %s. %+v", d.Name, err)
+		}
+
+		// the deployment already exists, only update it if its pod would change so that the osd is not restarted
+		current, err := c.context.Clientset.Extensions().Deployments(c.Namespace).Get(d.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get osd deployment %s. %+v", d.Name, err)
+		}
+		changes := podTemplateChanges(current.Spec.Template, d.Spec.Template)
+		if len(changes) == 0 {
+			continue
+		}
+		logger.Infof("updating osd deployment %s: %+v", d.Name, changes)
+		if _, err := c.context.Clientset.Extensions().Deployments(c.Namespace).Update(d); err != nil {
+			return fmt.Errorf("failed to update osd deployment %s. %+v", d.Name, err)
+		}
+	}
+
+	// the OSDs that were not prepared anymore were removed from the cluster by the job
+	for _, d := range existing {
+		if prepared[d.Name] {
+			continue
+		}
+		logger.Infof("removing osd deployment %s that is no longer on node %s", d.Name, n.Name)
+		if err := k8sutil.DeleteDeployment(c.context.Clientset, c.Namespace, d.Name); err != nil {
+			return fmt.Errorf("failed to delete osd deployment %s. %+v", d.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Cluster) listOSDDeployments(nodeName string) ([]extensions.Deployment, error) {
+	selector := fmt.Sprintf("%s=%s,%s=%s", k8sutil.AppAttr, appName, osdNodeAttr, nodeName)
+	deployments, err := c.context.Clientset.Extensions().Deployments(c.Namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list osd deployments of node %s. %+v", nodeName, err)
+	}
+	return deployments.Items, nil
+}
+
+func (c *Cluster) getOrchestrationStatus(nodeName string) (*OrchestrationStatus, error) {
+	status, err := GetOrchestrationStatus(c.context.Clientset, c.Namespace, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	if status == nil {
+		return nil, fmt.Errorf("orchestration status of node %s not found", nodeName)
+	}
+	return status, nil
+}
+
+// makePrepareJob makes the job that prepares the OSDs on the storage of a node. The job exits after the OSDs are
+// prepared instead of running them.
+func (c *Cluster) makePrepareJob(nodeName string, devices []rookalpha.Device, selection rookalpha.Selection,
+	storeConfig config.StoreConfig, metadataDevice, location string) *batch.Job {
+
+	podSpec := c.podTemplateSpec(devices, selection, v1.ResourceRequirements{}, storeConfig, metadataDevice, location)
+	podSpec.Spec.NodeSelector = map[string]string{apis.LabelHostname: nodeName}
+	podSpec.Spec.RestartPolicy = v1.RestartPolicyOnFailure
+	podSpec.Labels[osdNodeAttr] = nodeName
+	podSpec.Spec.Containers[0].Args = []string{"ceph", "osd", "prepare"}
+
+	return &batch.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf(prepareAppNameFmt, nodeName),
+			Namespace:       c.Namespace,
+			OwnerReferences: []metav1.OwnerReference{c.ownerRef},
+			Labels: map[string]string{
+				k8sutil.AppAttr:     appName,
+				k8sutil.ClusterAttr: c.Namespace,
+				osdNodeAttr:         nodeName,
+			},
+		},
+		Spec: batch.JobSpec{Template: podSpec},
+	}
+}
+
+// makeOSDDeployment makes the deployment that runs a single prepared OSD of a node. The resources of the node are
+// applied to each of its OSDs. The pod only mounts the storage of its own OSD so that it is not affected by changes to
+// the rest of the storage of the node.
+func (c *Cluster) makeOSDDeployment(nodeName string, osd OSDInfo, resources v1.ResourceRequirements,
+	storeConfig config.StoreConfig, location string) *extensions.Deployment {
+
+	var selection rookalpha.Selection
+	if osd.Directory != "" && osd.Directory != k8sutil.DataDir {
+		// the osd in the default dir is already in the data dir volume
+		selection.Directories = []rookalpha.Directory{{Path: osd.Directory}}
+	}
+
+	// the store type and the provisioner decide how the osd is run, the other settings only apply to new osds
+	runConfig := config.StoreConfig{StoreType: storeConfig.StoreType, Provisioner: storeConfig.Provisioner}
+	podSpec := c.podTemplateSpec(nil, selection, resources, runConfig, "", location)
+	podSpec.Spec.NodeSelector = map[string]string{apis.LabelHostname: nodeName}
+	podSpec.Labels[osdIDAttr] = strconv.Itoa(osd.ID)
+	podSpec.Labels[osdNodeAttr] = nodeName
+
+	container := &podSpec.Spec.Containers[0]
+	container.Args = []string{"ceph", "osd", "start"}
+	container.Env = append(container.Env, v1.EnvVar{Name: osdIDEnvVarName, Value: strconv.Itoa(osd.ID)})
+	if osd.Directory == "" {
+		// the osd is on a device of the host
+		podSpec.Spec.Volumes = append(podSpec.Spec.Volumes,
+			v1.Volume{Name: devicesVolumeName, VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/dev"}}},
+			v1.Volume{Name: udevVolumeName, VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/run/udev"}}})
+		container.VolumeMounts = append(container.VolumeMounts,
+			v1.VolumeMount{Name: devicesVolumeName, MountPath: "/dev"},
+			v1.VolumeMount{Name: udevVolumeName, MountPath: "/run/udev"})
+		privileged := true
+		container.SecurityContext.Privileged = &privileged
+	}
+
+	// the osd is restarted when it stops responding on its admin socket
+	container.LivenessProbe = &v1.Probe{
+		Handler: v1.Handler{
+			Exec: &v1.ExecAction{
+				Command: []string{"ceph", "--admin-daemon", osdAdminSocketPath(c.Namespace, osd), "status"},
+			},
+		},
+		InitialDelaySeconds: livenessProbeInitialDelaySeconds,
+	}
+
+	replicaCount := int32(1)
+	return &extensions.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf(osdDeploymentNameFmt, osd.ID),
+			Namespace:       c.Namespace,
+			OwnerReferences: []metav1.OwnerReference{c.ownerRef},
+			Labels: map[string]string{
+				k8sutil.AppAttr:     appName,
+				k8sutil.ClusterAttr: c.Namespace,
+				osdIDAttr:           strconv.Itoa(osd.ID),
+				osdNodeAttr:         nodeName,
+			},
+		},
+		Spec: extensions.DeploymentSpec{
+			Template: podSpec,
+			Replicas: &replicaCount,
+			// two instances of the same osd can never run at the same time
+			Strategy: extensions.DeploymentStrategy{Type: extensions.RecreateDeploymentStrategyType},
+		},
+	}
+}
+
+// the admin socket of an OSD is in its run dir, which is the root dir of the OSD
+func osdAdminSocketPath(clusterName string, osd OSDInfo) string {
+	return path.Join(osd.DataPath, fmt.Sprintf("%s-osd.%d.asok", clusterName, osd.ID))
+}
+
+// discoverDedicatedNodes finds the nodes whose OSDs run in their own pods from the OSD deployments
+func (c *Cluster) discoverDedicatedNodes() ([]rookalpha.Node, error) {
+	selector := fmt.Sprintf("%s=%s,%s", k8sutil.AppAttr, appName, osdNodeAttr)
+	deployments, err := c.context.Clientset.Extensions().Deployments(c.Namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list osd deployments: %+v", err)
+	}
+
+	var nodes []rookalpha.Node
+	found := map[string]int{}
+	for _, d := range deployments.Items {
+		nodeName := d.Labels[osdNodeAttr]
+		osdContainer, err := k8sutil.GetMatchingContainer(d.Spec.Template.Spec.Containers, appName)
+		if err != nil {
+			return nil, err
+		}
+
+		i, ok := found[nodeName]
+		if !ok {
+			cfg := getConfigFromContainer(osdContainer)
+			cfg[config.DedicatedPodsKey] = "true"
+			nodes = append(nodes, rookalpha.Node{
+				Name:     nodeName,
+				Location: rookalpha.GetLocationFromContainer(osdContainer),
+				Config:   cfg,
+			})
+			i = len(nodes) - 1
+			found[nodeName] = i
+		}
+
+		// the directories of the node are spread over its osd pods
+		nodes[i].Directories = append(nodes[i].Directories, getDirectoriesFromContainer(osdContainer)...)
+	}
+
+	return nodes, nil
+}
+
+// isDeploymentReplicaSet returns whether the replica set is managed by an OSD deployment rather than running all the
+// OSDs of a node
+func isDeploymentReplicaSet(rs extensions.ReplicaSet) bool {
+	for _, owner := range rs.OwnerReferences {
+		if owner.Kind == "Deployment" {
+			return true
+		}
+	}
+	return false
+}
+
+func containsNode(nodes []rookalpha.Node, name string) bool {
+	for _, n := range nodes {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"testing"
+	"time"
+
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+func TestMakePrepareJob(t *testing.T) {
+	c := New(&clusterd.Context{Clientset: fake.NewSimpleClientset(), Executor: &exectest.MockExecutor{}}, "ns", "rook/rook:myversion",
+		rookalpha.StorageScopeSpec{}, "", rookalpha.Placement{}, false, v1.ResourceRequirements{}, metav1.OwnerReference{})
+
+	job := c.makePrepareJob("node1", []rookalpha.Device{{Name: "sda"}}, rookalpha.Selection{}, config.StoreConfig{}, "", "")
+	assert.Equal(t, "rook-ceph-osd-prepare-node1", job.Name)
+	assert.Equal(t, "node1", job.Labels[osdNodeAttr])
+
+	podSpec := job.Spec.Template.Spec
+	assert.Equal(t, v1.RestartPolicyOnFailure, podSpec.RestartPolicy)
+	assert.Equal(t, "node1", podSpec.NodeSelector[apis.LabelHostname])
+	assert.Equal(t, []string{"ceph", "osd", "prepare"}, podSpec.Containers[0].Args)
+	assert.Equal(t, "sda", envVarValues(podSpec.Containers[0].Env)[dataDevicesEnvVarName])
+}
+
+func TestMakeOSDDeployment(t *testing.T) {
+	c := New(&clusterd.Context{Clientset: fake.NewSimpleClientset(), Executor: &exectest.MockExecutor{}}, "ns", "rook/rook:myversion",
+		rookalpha.StorageScopeSpec{}, "/var/lib/rook", rookalpha.Placement{}, false, v1.ResourceRequirements{}, metav1.OwnerReference{})
+
+	// an osd on a device needs access to the devices of the host
+	osd := OSDInfo{ID: 3, DataPath: "/var/lib/rook/osd3"}
+	d := c.makeOSDDeployment("node1", osd, v1.ResourceRequirements{}, config.StoreConfig{StoreType: config.Bluestore, DatabaseSizeMB: 1024}, "")
+	assert.Equal(t, "rook-ceph-osd-id-3", d.Name)
+	assert.Equal(t, int32(1), *d.Spec.Replicas)
+	assert.Equal(t, extensions.RecreateDeploymentStrategyType, d.Spec.Strategy.Type)
+	assert.Equal(t, "3", d.Spec.Template.Labels[osdIDAttr])
+	assert.Equal(t, "node1", d.Spec.Template.Spec.NodeSelector[apis.LabelHostname])
+
+	container := d.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, []string{"ceph", "osd", "start"}, container.Args)
+	env := envVarValues(container.Env)
+	assert.Equal(t, "3", env[osdIDEnvVarName])
+	assert.Equal(t, config.Bluestore, env[osdStoreEnvVarName])
+	_, ok := env[osdDatabaseSizeEnvVarName]
+	assert.False(t, ok)
+	assert.True(t, *container.SecurityContext.Privileged)
+	assert.Equal(t, []string{"ceph", "--admin-daemon", "/var/lib/rook/osd3/ns-osd.3.asok", "status"}, container.LivenessProbe.Exec.Command)
+	assert.True(t, hasVolumeMount(container, "/dev"))
+
+	// an osd in a directory only mounts its own directory
+	osd = OSDInfo{ID: 4, DataPath: "/mnt/data/osd4", Directory: "/mnt/data"}
+	d = c.makeOSDDeployment("node1", osd, v1.ResourceRequirements{}, config.StoreConfig{}, "")
+	container = d.Spec.Template.Spec.Containers[0]
+	assert.False(t, *container.SecurityContext.Privileged)
+	assert.False(t, hasVolumeMount(container, "/dev"))
+	assert.True(t, hasVolumeMount(container, "/mnt/data"))
+	assert.Equal(t, "/mnt/data", envVarValues(container.Env)[dataDirsEnvVarName])
+
+	// the default dir is in the data dir volume
+	osd = OSDInfo{ID: 5, DataPath: "/var/lib/rook/osd5", Directory: "/var/lib/rook"}
+	d = c.makeOSDDeployment("node1", osd, v1.ResourceRequirements{}, config.StoreConfig{}, "")
+	container = d.Spec.Template.Spec.Containers[0]
+	_, ok = envVarValues(container.Env)[dataDirsEnvVarName]
+	assert.False(t, ok)
+}
+
+func TestSyncOSDDeployments(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	c := New(&clusterd.Context{Clientset: clientset, Executor: &exectest.MockExecutor{}}, "ns", "rook/rook:myversion",
+		rookalpha.StorageScopeSpec{}, "/var/lib/rook", rookalpha.Placement{}, false, v1.ResourceRequirements{}, metav1.OwnerReference{})
+	node := rookalpha.Node{Name: "node1", Location: "rack=a"}
+	storeConfig := config.StoreConfig{StoreType: config.Bluestore}
+
+	osds := []OSDInfo{{ID: 1, DataPath: "/var/lib/rook/osd1"}, {ID: 2, DataPath: "/mnt/data/osd2", Directory: "/mnt/data"}}
+	err := c.syncOSDDeployments(node, osds, storeConfig)
+	assert.Nil(t, err)
+	deployments, err := c.listOSDDeployments("node1")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(deployments))
+
+	// the node is discovered from its osd deployments
+	nodes, err := c.discoverStorageNodes()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(nodes))
+	assert.Equal(t, "node1", nodes[0].Name)
+	assert.Equal(t, "rack=a", nodes[0].Location)
+	assert.True(t, config.DedicatedPods(nodes[0].Config))
+	assert.Equal(t, []rookalpha.Directory{{Path: "/mnt/data"}}, nodes[0].Directories)
+
+	// a removed osd loses its deployment
+	err = c.syncOSDDeployments(node, osds[:1], storeConfig)
+	assert.Nil(t, err)
+	deployments, err = c.listOSDDeployments("node1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deployments))
+	assert.Equal(t, "rook-ceph-osd-id-1", deployments[0].Name)
+
+	// the osd pods are deleted when the node goes back to a single pod
+	err = c.deleteDedicatedPods("node1")
+	assert.Nil(t, err)
+	deployments, err = c.listOSDDeployments("node1")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(deployments))
+}
+
+func TestMoveOSDsToDedicatedPods(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	c := New(&clusterd.Context{Clientset: clientset, Executor: &exectest.MockExecutor{}}, "ns", "rook/rook:myversion",
+		rookalpha.StorageScopeSpec{}, "/var/lib/rook", rookalpha.Placement{}, false, v1.ResourceRequirements{}, metav1.OwnerReference{})
+	osdDeploymentsInterval = time.Millisecond
+	osdDeploymentsTimeout = 10 * time.Millisecond
+	node := rookalpha.Node{Name: "node1"}
+	osds := []OSDInfo{{ID: 1, DataPath: "/var/lib/rook/osd1"}}
+
+	// a node without a single pod has nothing to stop
+	legacy, err := c.scaleReplicaSet("rook-ceph-osd-node1", 0)
+	assert.Nil(t, err)
+	assert.False(t, legacy)
+
+	// the single pod of the node is stopped, but not removed, while the osd pods start
+	replicas := int32(1)
+	rs := &extensions.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "rook-ceph-osd-node1", Namespace: "ns"},
+		Spec: extensions.ReplicaSetSpec{Replicas: &replicas}}
+	_, err = clientset.Extensions().ReplicaSets("ns").Create(rs)
+	assert.Nil(t, err)
+	legacy, err = c.scaleReplicaSet("rook-ceph-osd-node1", 0)
+	assert.Nil(t, err)
+	assert.True(t, legacy)
+	rs, err = clientset.Extensions().ReplicaSets("ns").Get("rook-ceph-osd-node1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(0), *rs.Spec.Replicas)
+
+	// the osd pods are not available
+	err = c.syncOSDDeployments(node, osds, config.StoreConfig{})
+	assert.Nil(t, err)
+	err = c.waitForOSDDeployments("node1", osds)
+	assert.NotNil(t, err)
+
+	// the single pod runs the osds again when their pods fail to start
+	c.rollbackDedicatedNode("node1")
+	deployments, err := c.listOSDDeployments("node1")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(deployments))
+	rs, err = clientset.Extensions().ReplicaSets("ns").Get("rook-ceph-osd-node1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), *rs.Spec.Replicas)
+
+	// the osd pods are available
+	err = c.syncOSDDeployments(node, osds, config.StoreConfig{})
+	assert.Nil(t, err)
+	d, err := clientset.Extensions().Deployments("ns").Get("rook-ceph-osd-id-1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	d.Status.AvailableReplicas = 1
+	_, err = clientset.Extensions().Deployments("ns").Update(d)
+	assert.Nil(t, err)
+	err = c.waitForOSDDeployments("node1", osds)
+	assert.Nil(t, err)
+}
+
+func hasVolumeMount(container v1.Container, mountPath string) bool {
+	for _, m := range container.VolumeMounts {
+		if m.MountPath == mountPath {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"fmt"
+
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	deviceSetAttr       = "ceph.rook.io/DeviceSet"
+	deviceSetVolumeName = "rook-ceph-osd-data"
+	// the path of the claimed block volume in the OSD pod, outside of the /dev of the host that is mounted into the pod
+	deviceSetDevicePath = "/mnt/rook-osd-data"
+)
+
+// startDeviceSets creates the claims for all the storage class device sets and starts an OSD replica set for each claim.
+// Each OSD of a device set is identified by the name of its claim rather than by a node name, so that its orchestration
+// status and config are found again wherever the OSD pod is scheduled.
+func (c *Cluster) startDeviceSets(errorMessages *[]string) {
+	for _, set := range c.Storage.StorageClassDeviceSets {
+		if set.Name == "" || set.Count <= 0 {
+			logger.Warningf("skipping storage class device set %+v without a name or count", set)
+			continue
+		}
+
+		// the config of the set takes precedence over the cluster config
+		setConfig := map[string]string{}
+		for k, v := range c.Storage.Config {
+			setConfig[k] = v
+		}
+		for k, v := range set.Config {
+			setConfig[k] = v
+		}
+		storeConfig := config.ToStoreConfig(setConfig)
+		resources := k8sutil.MergeResourceRequirements(set.Resources, c.resources)
+
+		for i := 0; i < set.Count; i++ {
+			name := deviceSetOSDName(set.Name, i)
+
+			// update the orchestration status of this OSD to the starting state
+			status := OrchestrationStatus{Status: OrchestrationStatusStarting}
+			if err := UpdateOrchestrationStatusMap(c.context.Clientset, c.Namespace, name, status); err != nil {
+				*errorMessages = append(*errorMessages, fmt.Sprintf("failed to set orchestration starting status for %s: %+v", name, err))
+				continue
+			}
+
+			// claim the volume that will back the OSD
+			pvc := c.makeDeviceSetPVC(set, name)
+			if _, err := c.context.Clientset.CoreV1().PersistentVolumeClaims(c.Namespace).Create(pvc); err != nil {
+				if !errors.IsAlreadyExists(err) {
+					message := fmt.Sprintf("failed to create volume claim %s for device set %s. %+v", pvc.Name, set.Name, err)
+					c.handleOrchestrationFailure(rookalpha.Node{Name: name}, message, errorMessages)
+					continue
+				}
+				logger.Infof("volume claim %s already exists", pvc.Name)
+			} else {
+				logger.Infof("volume claim %s created for device set %s", pvc.Name, set.Name)
+			}
+
+			// create the replica set that will run the OSD on the claimed volume
+			rs := c.makeDeviceSetReplicaSet(set, name, pvc.Name, resources, storeConfig)
+			if _, err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Create(rs); err != nil {
+				if !errors.IsAlreadyExists(err) {
+					message := fmt.Sprintf("failed to create osd replica set for %s. %+v", name, err)
+					c.handleOrchestrationFailure(rookalpha.Node{Name: name}, message, errorMessages)
+					continue
+				}
+
+				// the replica set already exists, update it if the settings of the set have changed
+				updated, err := c.updateReplicaSet(name, rs)
+				if err != nil {
+					c.handleOrchestrationFailure(rookalpha.Node{Name: name}, err.Error(), errorMessages)
+					continue
+				}
+				if !updated {
+					message := fmt.Sprintf("osd replica set already exists for %s", name)
+					logger.Info(message)
+					status := OrchestrationStatus{Status: OrchestrationStatusCompleted, Message: message}
+					if err := UpdateOrchestrationStatusMap(c.context.Clientset, c.Namespace, name, status); err != nil {
+						*errorMessages = append(*errorMessages, fmt.Sprintf("failed to set orchestration status for %s, status: %+v: %+v", name, status, err))
+						continue
+					}
+				}
+			} else {
+				logger.Infof("osd replica set started for %s", name)
+			}
+
+			// wait for the OSD's orchestration to be completed
+			if err := c.waitForCompletion(name); err != nil {
+				*errorMessages = append(*errorMessages, err.Error())
+				continue
+			}
+		}
+	}
+}
+
+func (c *Cluster) makeDeviceSetPVC(set rookalpha.StorageClassDeviceSet, name string) *v1.PersistentVolumeClaim {
+	// the OSD is provisioned on the raw block device of the volume rather than on a filesystem
+	volumeMode := v1.PersistentVolumeBlock
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf(appNameFmt, name),
+			Namespace:       c.Namespace,
+			OwnerReferences: []metav1.OwnerReference{c.ownerRef},
+			Labels: map[string]string{
+				k8sutil.AppAttr:     appName,
+				k8sutil.ClusterAttr: c.Namespace,
+				deviceSetAttr:       set.Name,
+			},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			VolumeMode:  &volumeMode,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: set.Size},
+			},
+		},
+	}
+	if set.StorageClassName != "" {
+		storageClassName := set.StorageClassName
+		pvc.Spec.StorageClassName = &storageClassName
+	}
+
+	return pvc
+}
+
+func (c *Cluster) makeDeviceSetReplicaSet(set rookalpha.StorageClassDeviceSet, name, claimName string, resources v1.ResourceRequirements,
+	storeConfig config.StoreConfig) *extensions.ReplicaSet {
+
+	// the OSD is provisioned on the block device of the claimed volume, no other devices or directories of the host are used
+	devices := []rookalpha.Device{{FullPath: deviceSetDevicePath}}
+	podSpec := c.podTemplateSpec(devices, rookalpha.Selection{}, resources, storeConfig, "", "")
+	podSpec.Labels[deviceSetAttr] = set.Name
+	set.Placement.ApplyToPodSpec(&podSpec.Spec)
+
+	for i := range podSpec.Spec.Volumes {
+		if podSpec.Spec.Volumes[i].Name == k8sutil.DataDirVolume {
+			// the config dir must not be shared through the host since the pod is not tied to a node
+			podSpec.Spec.Volumes[i].VolumeSource = v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}
+		}
+	}
+	podSpec.Spec.Volumes = append(podSpec.Spec.Volumes, v1.Volume{
+		Name: deviceSetVolumeName,
+		VolumeSource: v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+		},
+	})
+
+	container := &podSpec.Spec.Containers[0]
+	container.VolumeDevices = append(container.VolumeDevices, v1.VolumeDevice{Name: deviceSetVolumeName, DevicePath: deviceSetDevicePath})
+	for i := range container.Env {
+		if container.Env[i].Name == nodeNameEnvVarName {
+			// identify the OSD by the claim instead of the node it happens to run on
+			container.Env[i] = v1.EnvVar{Name: nodeNameEnvVarName, Value: name}
+		}
+	}
+
+	replicaCount := int32(1)
+	return &extensions.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf(appNameFmt, name),
+			Namespace:       c.Namespace,
+			OwnerReferences: []metav1.OwnerReference{c.ownerRef},
+			Labels: map[string]string{
+				k8sutil.AppAttr:     appName,
+				k8sutil.ClusterAttr: c.Namespace,
+				deviceSetAttr:       set.Name,
+			},
+		},
+		Spec: extensions.ReplicaSetSpec{
+			Template: podSpec,
+			Replicas: &replicaCount,
+		},
+	}
+}
+
+func deviceSetOSDName(setName string, index int) string {
+	return fmt.Sprintf("%s-%d", setName, index)
+}
+
+func isDeviceSetReplicaSet(rs extensions.ReplicaSet) bool {
+	_, ok := rs.Labels[deviceSetAttr]
+	return ok
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"testing"
+
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDeviceSetReplicaSet(t *testing.T) {
+	set := rookalpha.StorageClassDeviceSet{
+		Name:             "set1",
+		Count:            2,
+		StorageClassName: "gp2",
+		Size:             resource.MustParse("100Gi"),
+		Placement: rookalpha.Placement{
+			Tolerations: []v1.Toleration{{Key: "storage", Operator: v1.TolerationOpExists}},
+		},
+	}
+	storageSpec := rookalpha.StorageScopeSpec{StorageClassDeviceSets: []rookalpha.StorageClassDeviceSet{set}}
+
+	clientset := fake.NewSimpleClientset()
+	c := New(&clusterd.Context{Clientset: clientset, ConfigDir: "/var/lib/rook", Executor: &exectest.MockExecutor{}}, "ns", "rook/rook:myversion",
+		storageSpec, "/var/lib/rook", rookalpha.Placement{}, false, v1.ResourceRequirements{}, metav1.OwnerReference{})
+
+	name := deviceSetOSDName(set.Name, 1)
+	assert.Equal(t, "set1-1", name)
+
+	pvc := c.makeDeviceSetPVC(set, name)
+	assert.Equal(t, "rook-ceph-osd-set1-1", pvc.Name)
+	assert.Equal(t, "gp2", *pvc.Spec.StorageClassName)
+	assert.Equal(t, []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}, pvc.Spec.AccessModes)
+	assert.Equal(t, v1.PersistentVolumeBlock, *pvc.Spec.VolumeMode)
+	size := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	assert.Equal(t, "100Gi", size.String())
+
+	rs := c.makeDeviceSetReplicaSet(set, name, pvc.Name, v1.ResourceRequirements{}, config.StoreConfig{StoreType: config.Bluestore})
+	assert.Equal(t, "rook-ceph-osd-set1-1", rs.Name)
+	assert.True(t, isDeviceSetReplicaSet(*rs))
+	assert.Equal(t, "set1", rs.Spec.Template.Labels[deviceSetAttr])
+
+	// the pod is not tied to a node and tolerates according to the set's placement
+	podSpec := rs.Spec.Template.Spec
+	assert.Equal(t, 0, len(podSpec.NodeSelector))
+	assert.Equal(t, set.Placement.Tolerations, podSpec.Tolerations)
+
+	// the config dir is not shared through the host and the claim is attached as a block device
+	assert.Equal(t, 5, len(podSpec.Volumes))
+	assert.NotNil(t, podSpec.Volumes[0].EmptyDir)
+	assert.Nil(t, podSpec.Volumes[0].HostPath)
+	assert.Equal(t, pvc.Name, podSpec.Volumes[4].PersistentVolumeClaim.ClaimName)
+
+	container := podSpec.Containers[0]
+	assert.Equal(t, []v1.VolumeDevice{{Name: deviceSetVolumeName, DevicePath: deviceSetDevicePath}}, container.VolumeDevices)
+	for _, mount := range container.VolumeMounts {
+		assert.NotEqual(t, deviceSetVolumeName, mount.Name)
+	}
+	foundNodeName := false
+	foundDevices := false
+	for _, env := range container.Env {
+		switch env.Name {
+		case nodeNameEnvVarName:
+			foundNodeName = true
+			assert.Equal(t, name, env.Value)
+			assert.Nil(t, env.ValueFrom)
+		case dataDevicesEnvVarName:
+			foundDevices = true
+			assert.Equal(t, deviceSetDevicePath, env.Value)
+		case dataDirsEnvVarName:
+			assert.Fail(t, "unexpected data dirs of a device set osd")
+		}
+	}
+	assert.True(t, foundNodeName)
+	assert.True(t, foundDevices)
+
+	// the replica sets of device sets are not discovered as storage nodes
+	_, err := clientset.Extensions().ReplicaSets(c.Namespace).Create(rs)
+	assert.Nil(t, err)
+	nodes, err := c.discoverStorageNodes()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(nodes))
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"github.com/rook/rook/pkg/clusterd"
+	discoverDaemon "github.com/rook/rook/pkg/daemon/discover"
+	"github.com/rook/rook/pkg/operator/discover"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"github.com/rook/rook/pkg/util/sys"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// the lock of each namespace, the osds of a namespace are orchestrated by a single orchestration at a time
+var orchestrationLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: map[string]*sync.Mutex{}}
+
+// DeviceWatcher orchestrates the OSDs of a node again when a new device that is selected by the storage spec of the
+// node is discovered on it, so that OSDs are provisioned on the disks plugged into the nodes without changing the cluster
+type DeviceWatcher struct {
+	context   *clusterd.Context
+	namespace string
+	// returns the osds of the latest cluster spec
+	getCluster func() (*Cluster, error)
+}
+
+// NewDeviceWatcher creates an instance of the device watcher
+func NewDeviceWatcher(context *clusterd.Context, namespace string, getCluster func() (*Cluster, error)) *DeviceWatcher {
+	return &DeviceWatcher{context: context, namespace: namespace, getCluster: getCluster}
+}
+
+// Run watches the device configmaps of the discover daemons until the stop channel is closed
+func (w *DeviceWatcher) Run(stopCh chan struct{}) {
+	namespace := os.Getenv(k8sutil.PodNamespaceEnvVar)
+	selector := fmt.Sprintf("%s=%s", k8sutil.AppAttr, discoverDaemon.AppName)
+	source := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return w.context.Clientset.CoreV1().ConfigMaps(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return w.context.Clientset.CoreV1().ConfigMaps(namespace).Watch(options)
+		},
+	}
+
+	// the devices already discovered when the watch starts were orchestrated with the cluster, only the devices that
+	// appear in the updates of the configmaps are new
+	_, controller := cache.NewInformer(source, &v1.ConfigMap{}, 0, cache.ResourceEventHandlerFuncs{
+		UpdateFunc: w.onUpdate,
+	})
+	logger.Infof("watching the discovered devices for new osds in namespace %s", w.namespace)
+	controller.Run(stopCh)
+	logger.Infof("stopping the watch of the discovered devices in namespace %s", w.namespace)
+}
+
+func (w *DeviceWatcher) onUpdate(oldObj, newObj interface{}) {
+	oldCM, ok := oldObj.(*v1.ConfigMap)
+	if !ok {
+		return
+	}
+	newCM, ok := newObj.(*v1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	nodeName := newCM.Labels[discoverDaemon.NodeAttr]
+	added := addedDevices(oldCM, newCM)
+	if nodeName == "" || len(added) == 0 {
+		return
+	}
+
+	// the orchestration waits for the osds of the node, the other configmaps are still watched in the meantime
+	go w.orchestrateNode(nodeName, added)
+}
+
+// orchestrateNode orchestrates the osds of the node if one of its new devices is selected for an osd
+func (w *DeviceWatcher) orchestrateNode(nodeName string, added []sys.LocalDisk) {
+	c, err := w.getCluster()
+	if err != nil {
+		logger.Warningf("failed to get the osds of namespace %s to provision the new devices of node %s. %+v", w.namespace, nodeName, err)
+		return
+	}
+	if !c.newDevicesSelected(nodeName, added) {
+		return
+	}
+
+	if err := c.startSingleNode(nodeName); err != nil {
+		logger.Errorf("failed to provision the new devices of node %s. %+v", nodeName, err)
+	}
+}
+
+// newDevicesSelected returns whether one of the new devices of the node is available and selected by the storage spec
+// of the node. Only the nodes listed in the storage spec are orchestrated for their new devices.
+func (c *Cluster) newDevicesSelected(nodeName string, added []sys.LocalDisk) bool {
+	n := c.storageNode(nodeName)
+	if n == nil {
+		logger.Debugf("ignoring the new devices of node %s that is not listed in the storage nodes", nodeName)
+		return false
+	}
+
+	for i := range added {
+		disk := &added[i]
+		if !disk.Available {
+			logger.Infof("new device %s on node %s cannot be used by an osd: %s", disk.Name, nodeName, disk.RejectedReason)
+			continue
+		}
+		matched, err := discover.MatchesSelection(disk, n.Devices, n.Selection.DeviceFilter, n.Selection.DeviceSelector,
+			n.Selection.GetUseAllDevices())
+		if err != nil {
+			logger.Warningf("failed to match the new device %s on node %s. %+v", disk.Name, nodeName, err)
+			continue
+		}
+		if matched {
+			logger.Infof("new device %s on node %s is selected for an osd", disk.Name, nodeName)
+			return true
+		}
+	}
+	return false
+}
+
+// startSingleNode orchestrates the osds of a node in the storage spec for its new devices without orchestrating the other
+// nodes. The osds of the node are only removed by the orchestration of the cluster.
+func (c *Cluster) startSingleNode(nodeName string) error {
+	n := c.storageNode(nodeName)
+	if n == nil {
+		return fmt.Errorf("node %s is not in the storage spec", nodeName)
+	}
+
+	lock := orchestrationLock(c.Namespace)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := makeOrchestrationStatusMap(c.context.Clientset, c.Namespace, &c.ownerRef); err != nil {
+		return fmt.Errorf("failed to make OSD orchestration status config map: %+v", err)
+	}
+	defer c.suspendScrubbing()()
+
+	logger.Infof("orchestrating the osds of node %s for its new devices", nodeName)
+	errorMessages := c.orchestrateNodes([]rookalpha.Node{*n}, 1, c.addNodeDevices)
+	if len(errorMessages) > 0 {
+		return fmt.Errorf("%s", strings.Join(errorMessages, "\n"))
+	}
+	logger.Infof("completed orchestrating the osds of node %s", nodeName)
+	return nil
+}
+
+// returns the resolved storage spec of the node, or nil if the node is not in the storage spec
+func (c *Cluster) storageNode(nodeName string) *rookalpha.Node {
+	if c.Storage.UseAllNodes {
+		// the osd daemon set does not orchestrate a node on its own
+		return nil
+	}
+	for i := range c.Storage.Nodes {
+		if c.Storage.Nodes[i].Name == nodeName {
+			return c.resolveNode(c.Storage.Nodes[i])
+		}
+	}
+	return nil
+}
+
+// returns the devices of the new configmap that are not in the old configmap. A disk that replaces another disk under
+// the same name is told apart by its identity.
+func addedDevices(oldCM, newCM *v1.ConfigMap) []sys.LocalDisk {
+	var oldDevices, newDevices []sys.LocalDisk
+	if err := json.Unmarshal([]byte(oldCM.Data[discoverDaemon.LocalDiskCMData]), &oldDevices); err != nil {
+		// without the old devices it is not known which devices are new
+		logger.Warningf("failed to unmarshal the devices of configmap %s. %+v", oldCM.Name, err)
+		return nil
+	}
+	if err := json.Unmarshal([]byte(newCM.Data[discoverDaemon.LocalDiskCMData]), &newDevices); err != nil {
+		logger.Warningf("failed to unmarshal the devices of configmap %s. %+v", newCM.Name, err)
+		return nil
+	}
+
+	known := map[string]bool{}
+	for i := range oldDevices {
+		known[deviceIdentity(&oldDevices[i])] = true
+	}
+	var added []sys.LocalDisk
+	for i, d := range newDevices {
+		if !known[deviceIdentity(&newDevices[i])] {
+			added = append(added, d)
+		}
+	}
+	return added
+}
+
+// returns the name of the device with its world wide name or serial, which do not change when the device is partitioned
+// like its uuid
+func deviceIdentity(d *sys.LocalDisk) string {
+	switch {
+	case d.WWN != "":
+		return fmt.Sprintf("%s/%s%s", d.Name, d.WWN, d.WWNVendorExtension)
+	case d.Serial != "":
+		return fmt.Sprintf("%s/%s", d.Name, d.Serial)
+	}
+	return d.Name
+}
+
+func orchestrationLock(namespace string) *sync.Mutex {
+	orchestrationLocks.Lock()
+	defer orchestrationLocks.Unlock()
+	lock, ok := orchestrationLocks.locks[namespace]
+	if !ok {
+		lock = &sync.Mutex{}
+		orchestrationLocks.locks[namespace] = lock
+	}
+	return lock
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"testing"
+
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	discoverDaemon "github.com/rook/rook/pkg/daemon/discover"
+	"github.com/rook/rook/pkg/util/sys"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+)
+
+func TestAddedDevices(t *testing.T) {
+	cm := func(devices string) *v1.ConfigMap {
+		return &v1.ConfigMap{Data: map[string]string{discoverDaemon.LocalDiskCMData: devices}}
+	}
+
+	added := addedDevices(cm(`[{"name":"sda"}]`), cm(`[{"name":"sda","health":{"passed":true}},{"name":"sdb","available":true}]`))
+	assert.Equal(t, []sys.LocalDisk{{Name: "sdb", Available: true}}, added)
+
+	// removed devices and changes to the known devices are not new devices
+	assert.Nil(t, addedDevices(cm(`[{"name":"sda"},{"name":"sdb"}]`), cm(`[{"name":"sdb","size":1024}]`)))
+
+	// a disk replacing another disk under the same name is new
+	added = addedDevices(cm(`[{"name":"sda","serial":"disk1"},{"name":"sdb","wwn":"0x5000c500a1b2c3d4"}]`),
+		cm(`[{"name":"sda","serial":"disk2"},{"name":"sdb","wwn":"0x5000c500a1b2c3d4"}]`))
+	assert.Equal(t, []sys.LocalDisk{{Name: "sda", Serial: "disk2"}}, added)
+
+	// the new devices are not known without the old devices
+	assert.Nil(t, addedDevices(cm(""), cm(`[{"name":"sda"}]`)))
+}
+
+func TestNewDevicesSelected(t *testing.T) {
+	useAllDevices := true
+	c := &Cluster{Storage: rookalpha.StorageScopeSpec{Nodes: []rookalpha.Node{
+		{Name: "node1", Selection: rookalpha.Selection{DeviceFilter: "^sd[b-z]$"}},
+		{Name: "node2"},
+	}}}
+	c.Storage.UseAllDevices = &useAllDevices
+
+	// the device must be available and match the filter of the node
+	assert.True(t, c.newDevicesSelected("node1", []sys.LocalDisk{{Name: "sdc", Available: true}}))
+	assert.False(t, c.newDevicesSelected("node1", []sys.LocalDisk{{Name: "sda", Available: true}}))
+	assert.False(t, c.newDevicesSelected("node1", []sys.LocalDisk{{Name: "sdc", RejectedReason: "has a filesystem: ext4"}}))
+
+	// the node uses all the devices of the cluster
+	assert.True(t, c.newDevicesSelected("node2", []sys.LocalDisk{{Name: "sda"}, {Name: "nvme0n1", Available: true}}))
+
+	// the nodes that are not in the storage spec are not orchestrated
+	assert.False(t, c.newDevicesSelected("node3", []sys.LocalDisk{{Name: "sdc", Available: true}}))
+	c.Storage.UseAllNodes = true
+	assert.False(t, c.newDevicesSelected("node1", []sys.LocalDisk{{Name: "sdc", Available: true}}))
+}
@@ -21,9 +21,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/pkg/capnslog"
+	cephv1alpha1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1alpha1"
 	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
 	"github.com/rook/rook/pkg/clusterd"
 	"github.com/rook/rook/pkg/daemon/ceph/client"
@@ -55,6 +57,8 @@ const (
 	appName                          = "rook-ceph-osd"
 	appNameFmt                       = "rook-ceph-osd-%s"
 	clusterAvailableSpaceReserve     = 0.05
+	// the number of times the status map is updated again when it was changed by another node at the same time
+	statusUpdateRetries = 5
 )
 
 var clusterAccessRules = []v1beta1.PolicyRule{
@@ -63,6 +67,12 @@ var clusterAccessRules = []v1beta1.PolicyRule{
 		Resources: []string{"configmaps"},
 		Verbs:     []string{"get", "list", "watch", "create", "update", "delete"},
 	},
+	{
+		// the keys of encrypted osds are stored in secrets
+		APIGroups: []string{""},
+		Resources: []string{"secrets"},
+		Verbs:     []string{"get", "create", "delete"},
+	},
 }
 
 // Cluster keeps track of the OSDs
@@ -77,6 +87,15 @@ type Cluster struct {
 	HostNetwork     bool
 	resources       v1.ResourceRequirements
 	ownerRef        metav1.OwnerReference
+	// the IDs of the OSDs whose failed devices are being replaced
+	ReplaceOSDs []int
+	// the windows in which the OSDs are allowed to scrub
+	ScrubSchedule *cephv1alpha1.ScrubScheduleSpec
+	// the number of nodes whose OSDs are orchestrated at the same time
+	NodeConcurrency int
+	// the reasons why the selected devices cannot be used by an osd, by node and device name
+	rejectedDevices map[string]map[string]string
+	rejectedLock    sync.Mutex
 }
 
 // New creates an instance of the OSD manager
@@ -100,6 +119,24 @@ func New(context *clusterd.Context, namespace, version string, storageSpec rooka
 type OrchestrationStatus struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	// the OSDs that were prepared on a node whose OSDs run in their own pods
+	OSDs []OSDInfo `json:"osds,omitempty"`
+	// the IDs of the OSDs of the node when the agent completed the orchestration, nil when the status does not report
+	// the OSDs of the node
+	OSDIDs []int `json:"osdIDs"`
+	// set when the orchestration of the node was only triggered by new devices. The agent keeps all the OSDs of the
+	// node until the orchestration is completed.
+	KeepOSDs bool `json:"keepOSDs,omitempty"`
+}
+
+// OSDInfo is an OSD that was prepared on a node to run in its own pod
+type OSDInfo struct {
+	ID   int    `json:"id"`
+	UUID string `json:"uuid"`
+	// the root dir of the OSD, which holds the admin socket of the running OSD
+	DataPath string `json:"dataPath"`
+	// the directory the OSD is stored in, empty if the OSD is on a device
+	Directory string `json:"directory,omitempty"`
 }
 
 // Start the osd management
@@ -112,8 +149,8 @@ func (c *Cluster) Start() error {
 		logger.Warningf("failed to init RBAC for OSDs. %+v", err)
 	}
 
-	if c.Storage.UseAllNodes == false && len(c.Storage.Nodes) == 0 {
-		logger.Warningf("useAllNodes is set to false and no nodes are specified, no OSD pods are going to be created")
+	if c.Storage.UseAllNodes == false && len(c.Storage.Nodes) == 0 && len(c.Storage.StorageClassDeviceSets) == 0 {
+		logger.Warningf("useAllNodes is set to false and no nodes or device sets are specified, no OSD pods are going to be created")
 	}
 
 	// ensure the orchestration status map is created
@@ -121,17 +158,28 @@ func (c *Cluster) Start() error {
 		return fmt.Errorf("failed to make OSD orchestration status config map: %+v", err)
 	}
 
-	// disable scrubbing during orchestration and ensure it gets enabled again afterwards
-	if o, err := client.DisableScrubbing(c.context, c.Namespace); err != nil {
-		logger.Warningf("failed to disable scrubbing: %+v. %s", err, o)
+	// the new osds whose weight is raised in steps are recorded in the weight ramp map
+	if err := makeWeightRampMap(c.context.Clientset, c.Namespace, &c.ownerRef); err != nil {
+		return err
 	}
-	defer func() {
-		if o, err := client.EnableScrubbing(c.context, c.Namespace); err != nil {
-			logger.Warningf("failed to enable scrubbing: %+v. %s", err, o)
-		}
-	}()
+
+	// the nodes whose new devices are discovered are not orchestrated at the same time
+	lock := orchestrationLock(c.Namespace)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// disable scrubbing during orchestration and ensure it gets enabled again afterwards
+	defer c.suspendScrubbing()()
+
+	// the rejected devices are found again during this orchestration
+	c.rejectedLock.Lock()
+	c.rejectedDevices = map[string]map[string]string{}
+	c.rejectedLock.Unlock()
 
 	if c.Storage.UseAllNodes {
+		// the daemon set selects the same devices on every node with discovered devices
+		c.recordAllRejectedDevices(c.Storage.Selection)
+
 		// make a daemonset for all nodes in the cluster
 		storeConfig := config.ToStoreConfig(c.Storage.Config)
 		metadataDevice := config.MetadataDevice(c.Storage.Config)
@@ -146,70 +194,49 @@ func (c *Cluster) Start() error {
 			logger.Infof("osd daemon set started")
 		}
 
+		// the device sets are not tied to nodes, they are still started in addition to the daemon set
+		errorMessages := make([]string, 0)
+		c.startDeviceSets(&errorMessages)
+		if len(errorMessages) > 0 {
+			return fmt.Errorf("%d failures encountered while running osd device sets in namespace %s: %+v",
+				len(errorMessages), c.Namespace, strings.Join(errorMessages, "\n"))
+		}
+
 		return nil
 	}
 
 	// orchestrate individual nodes, starting with any that are still ongoing (in the case that we
 	// are resuming a previous orchestration attempt)
-	if inProgressNode, status := c.findInProgressNode(); inProgressNode != "" {
-		logger.Infof("resuming orchestration of in progress node %s, status: %+v", inProgressNode, status)
-		if err := c.waitForCompletion(inProgressNode); err != nil {
-			logger.Warningf("failed waiting for in progress node %s, will continue with orchestration.  %+v", inProgressNode, err)
+	c.orchestrateNodes(c.findInProgressNodes(), c.NodeConcurrency, func(n rookalpha.Node, errorMessages *[]string) {
+		logger.Infof("resuming orchestration of in progress node %s", n.Name)
+		if err := c.waitForCompletion(n.Name); err != nil {
+			logger.Warningf("failed waiting for in progress node %s, will continue with orchestration.  %+v", n.Name, err)
 		}
-	}
+	})
 
 	errorMessages := make([]string, 0)
 
-	// start with nodes currently in the storage spec
-	for i := range c.Storage.Nodes {
-		// fully resolve the storage config and resources for this node
-		n := c.resolveNode(c.Storage.Nodes[i])
-		storeConfig := config.ToStoreConfig(n.Config)
-		metadataDevice := config.MetadataDevice(n.Config)
-
-		// update the orchestration status of this node to the starting state
-		status := OrchestrationStatus{Status: OrchestrationStatusStarting}
-		if err := UpdateOrchestrationStatusMap(c.context.Clientset, c.Namespace, n.Name, status); err != nil {
-			errorMessages = append(errorMessages, fmt.Sprintf("failed to set orchestration starting status for node %s: %+v", n.Name, err))
-			continue
-		}
-		devicesToUse := n.Devices
-		availDev, deviceErr := discover.GetAvailableDevices(c.context, n.Name, c.Namespace, n.Devices, n.Selection.DeviceFilter, n.Selection.GetUseAllDevices())
-		if deviceErr != nil {
-			logger.Warningf("failed to get devices for node %s cluster %s: %v", n.Name, c.Namespace, deviceErr)
-		} else {
-			devicesToUse = availDev
-			logger.Infof("avail devices for node %s: %+v", n.Name, availDev)
-		}
-		// create the replicaSet that will run the OSDs for this node
-		rs := c.makeReplicaSet(n.Name, devicesToUse, n.Selection, n.Resources, storeConfig, metadataDevice, n.Location)
-		_, err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Create(rs)
-		if err != nil {
-			if !errors.IsAlreadyExists(err) {
-				// we failed to create the replica set, update the orchestration status for this node
-				message := fmt.Sprintf("failed to create osd replica set for node %s. %+v", n.Name, err)
-				c.handleOrchestrationFailure(*n, message, &errorMessages)
-				continue
-			} else {
-				// TODO: if the replica set already exists, we may need to edit the pod template spec, for example if device filter has changed
-				message := fmt.Sprintf("osd replica set already exists for node %s", n.Name)
-				logger.Info(message)
-				status := OrchestrationStatus{Status: OrchestrationStatusCompleted, Message: message}
-				if err := UpdateOrchestrationStatusMap(c.context.Clientset, c.Namespace, n.Name, status); err != nil {
-					errorMessages = append(errorMessages, fmt.Sprintf("failed to set orchestration status for node %s, status: %+v: %+v", n.Name, status, err))
-					continue
-				}
-			}
-		} else {
-			logger.Infof("osd replica set started for node %s", n.Name)
-		}
+	// destroy the OSDs that are being replaced before their nodes are orchestrated to provision the new devices
+	if err := c.destroyReplacedOSDs(); err != nil {
+		errorMessages = append(errorMessages, fmt.Sprintf("failed to destroy the osds to replace. %+v", err))
+	}
 
-		// wait for the current node's orchestration to be completed
-		if err := c.waitForCompletion(n.Name); err != nil {
-			errorMessages = append(errorMessages, err.Error())
-			continue
-		}
+	// start with nodes currently in the storage spec, fully resolving the storage config and resources of each node
+	nodes := make([]rookalpha.Node, len(c.Storage.Nodes))
+	for i := range c.Storage.Nodes {
+		nodes[i] = *c.resolveNode(c.Storage.Nodes[i])
 	}
+	concurrency := c.NodeConcurrency
+	if concurrency > 1 && c.isFilestoreConversionPending(nodes) {
+		// the agent of a node converts its osds one at a time, only one node converts its osds so that a single osd of
+		// the cluster is out for its conversion
+		logger.Infof("orchestrating one node at a time while filestore osds are converted to bluestore")
+		concurrency = 1
+	}
+	errorMessages = append(errorMessages, c.orchestrateNodes(nodes, concurrency, c.startNode)...)
+
+	// start the OSDs on volumes claimed by the storage class device sets
+	c.startDeviceSets(&errorMessages)
 
 	// find all removed nodes (if any) and start orchestration to remove them from the cluster
 	removedNodes, err := c.findRemovedNodes()
@@ -217,68 +244,280 @@ func (c *Cluster) Start() error {
 		return fmt.Errorf("failed to find removed nodes: %+v", err)
 	}
 
-	for i := range removedNodes {
-		n := removedNodes[i]
-		storeConfig := config.ToStoreConfig(n.Config)
-		metadataDevice := config.MetadataDevice(n.Config)
+	// the nodes are removed one at a time since it is only safe to remove a node when the rest of the cluster can take
+	// its data
+	errorMessages = append(errorMessages, c.orchestrateNodes(removedNodes, 1, c.removeNode)...)
 
-		if err := c.isSafeToRemoveNode(n); err != nil {
-			message := fmt.Sprintf("skipping the removal of node %s because it is not safe to do so: %+v", n.Name, err)
-			c.handleOrchestrationFailure(n, message, &errorMessages)
-			continue
-		}
+	if len(errorMessages) == 0 {
+		logger.Infof("completed running osds in namespace %s", c.Namespace)
+		return nil
+	}
 
-		logger.Infof("removing node %s from the cluster", n.Name)
+	return fmt.Errorf("%d failures encountered while running osds in namespace %s: %+v",
+		len(errorMessages), c.Namespace, strings.Join(errorMessages, "\n"))
+}
 
-		// update the orchestration status of this removed node to the starting state
-		if err := UpdateOrchestrationStatusMap(c.context.Clientset, c.Namespace, n.Name, OrchestrationStatus{Status: OrchestrationStatusStarting}); err != nil {
-			errorMessages = append(errorMessages, fmt.Sprintf("failed to set orchestration starting status for removed node %s: %+v", n.Name, err))
-			continue
-		}
+// suspendScrubbing disables scrubbing while the osds are orchestrated. The returned function enables scrubbing again,
+// unless the scrub schedule does not allow scrubbing at that time.
+func (c *Cluster) suspendScrubbing() func() {
+	holdScrubSchedule(c.Namespace)
+	if o, err := client.DisableScrubbing(c.context, c.Namespace); err != nil {
+		logger.Warningf("failed to disable scrubbing: %+v. %s", err, o)
+	}
 
-		// trigger orchestration on the removed node by telling it not to use any storage at all.  note that the directories are still passed in
-		// so that the pod will be able to mount them and migrate data from them.
-		rs := c.makeReplicaSet(n.Name, nil, rookalpha.Selection{DeviceFilter: "none", Directories: n.Directories},
-			v1.ResourceRequirements{}, storeConfig, metadataDevice, n.Location)
-		rs, err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Update(rs)
+	return func() {
+		defer releaseScrubSchedule(c.Namespace)
+		permitted, err := scrubPermitted(c.ScrubSchedule, time.Now())
 		if err != nil {
-			message := fmt.Sprintf("failed to update osd replica set for removed node %s. %+v", n.Name, err)
-			c.handleOrchestrationFailure(n, message, &errorMessages)
-			continue
-		} else {
-			logger.Infof("osd replica set updated for node %s", n.Name)
+			logger.Warningf("ignoring invalid scrub schedule. %+v", err)
+		} else if !permitted {
+			logger.Infof("leaving scrubbing disabled outside of the scrub schedule")
+			return
 		}
+		if o, err := client.EnableScrubbing(c.context, c.Namespace); err != nil {
+			logger.Warningf("failed to enable scrubbing: %+v. %s", err, o)
+		}
+	}
+}
 
-		// delete the pod associated with the replica set so that it will be restarted with the new template
-		if err := c.deleteOSDPod(rs); err != nil {
-			message := fmt.Sprintf("failed to find and delete OSD pod for replica set %s. %+v", rs.Name, err)
-			c.handleOrchestrationFailure(n, message, &errorMessages)
-			continue
+// orchestrateNodes runs the orchestration of the nodes with at most the given number of nodes at the same time. The
+// nodes are orchestrated independently, the failures of a node do not stop the orchestration of the other nodes.
+// Returns the failures of all the nodes.
+func (c *Cluster) orchestrateNodes(nodes []rookalpha.Node, concurrency int,
+	orchestrate func(n rookalpha.Node, errorMessages *[]string)) []string {
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	errorMessages := make([]string, 0)
+	limit := make(chan struct{}, concurrency)
+	for i := range nodes {
+		n := nodes[i]
+		limit <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+
+			nodeErrors := make([]string, 0)
+			orchestrate(n, &nodeErrors)
+			lock.Lock()
+			errorMessages = append(errorMessages, nodeErrors...)
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return errorMessages
+}
+
+// startNode orchestrates the OSDs of a node in the storage spec
+func (c *Cluster) startNode(n rookalpha.Node, errorMessages *[]string) {
+	c.orchestrateNode(n, false, errorMessages)
+}
+
+// addNodeDevices orchestrates the OSDs of a node in the storage spec for the devices plugged into it. None of the OSDs
+// of the node are removed, even if their devices were deselected.
+func (c *Cluster) addNodeDevices(n rookalpha.Node, errorMessages *[]string) {
+	c.orchestrateNode(n, true, errorMessages)
+}
+
+func (c *Cluster) orchestrateNode(n rookalpha.Node, keepOSDs bool, errorMessages *[]string) {
+	storeConfig := config.ToStoreConfig(n.Config)
+	metadataDevice := config.MetadataDevice(n.Config)
+
+	// update the orchestration status of this node to the starting state. the status tells the agent whether to keep
+	// the osds of the node, which must not be in the pod template since it would change the template on every run.
+	status := OrchestrationStatus{Status: OrchestrationStatusStarting, KeepOSDs: keepOSDs}
+	if err := UpdateOrchestrationStatusMap(c.context.Clientset, c.Namespace, n.Name, status); err != nil {
+		*errorMessages = append(*errorMessages, fmt.Sprintf("failed to set orchestration starting status for node %s: %+v", n.Name, err))
+		return
+	}
+	devicesToUse := n.Devices
+	selection := n.Selection
+	var drained []string
+	availDev, deviceErr := discover.GetAvailableDevices(c.context, n.Name, c.Namespace, n.Devices, n.Selection.DeviceFilter,
+		n.Selection.DeviceSelector, n.Selection.GetUseAllDevices())
+	if deviceErr != nil {
+		if len(n.Devices) == 0 && n.Selection.DeviceSelector != nil {
+			// the selector can only be resolved with the discovered devices. the devices of the node must not be
+			// deselected because the discovery failed.
+			message := fmt.Sprintf("failed to get the devices matching the device selector on node %s. %+v", n.Name, deviceErr)
+			c.handleOrchestrationFailure(n, message, errorMessages)
+			return
+		}
+		logger.Warningf("failed to get devices for node %s cluster %s: %v", n.Name, c.Namespace, deviceErr)
+	} else {
+		devicesToUse = availDev
+		logger.Infof("avail devices for node %s: %+v", n.Name, availDev)
+		c.recordRejectedDevices(n.Name, availDev)
+
+		// the devices predicted to fail by their health are not provisioned, and their osds are drained if configured
+		if policy := config.FailingDevices(n.Config); policy != config.FailingDevicesUse && len(devicesToUse) > 0 {
+			healthy, failing, err := discover.FilterFailingDevices(c.context, n.Name, devicesToUse, policy == config.FailingDevicesDrain)
+			if err != nil {
+				logger.Warningf("failed to check the health of the devices of node %s. %+v", n.Name, err)
+			} else if len(healthy) == 0 {
+				message := fmt.Sprintf("all the selected devices of node %s are predicted to fail: %v", n.Name, failing)
+				c.handleOrchestrationFailure(n, message, errorMessages)
+				return
+			} else {
+				devicesToUse = healthy
+				if policy == config.FailingDevicesDrain {
+					drained = failing
+				}
+			}
 		}
+	}
+	deviceSelection := getDeviceSelection(n, availDev, drained)
+	if n.Selection.DeviceSelector != nil {
+		// the agent is given the list of devices matching the selector instead of the filter, which it cannot narrow down
+		selection.DeviceFilter = ""
+		selection.UseAllDevices = nil
+	}
 
-		// wait for the removed node's orchestration to be completed
-		if err := c.waitForCompletion(n.Name); err != nil {
-			errorMessages = append(errorMessages, err.Error())
-			continue
+	// the agent provisions the new devices of the node with the IDs of the destroyed osds it is replacing
+	replaceOSDs, err := c.getReplacedOSDsForNode(n)
+	if err != nil {
+		c.handleOrchestrationFailure(n, err.Error(), errorMessages)
+		return
+	}
+
+	if config.DedicatedPods(n.Config) {
+		// each osd of the node runs in its own pod after the osds are prepared
+		c.startDedicatedNode(n, devicesToUse, selection, storeConfig, metadataDevice, replaceOSDs, deviceSelection, errorMessages)
+		return
+	}
+
+	// the osds of the node may have run in their own pods before, the single pod of the node takes them over
+	if err := c.deleteDedicatedPods(n.Name); err != nil {
+		c.handleOrchestrationFailure(n, err.Error(), errorMessages)
+		return
+	}
+
+	// create the replicaSet that will run the OSDs for this node
+	rs := c.makeReplicaSet(n.Name, devicesToUse, selection, n.Resources, storeConfig, metadataDevice, n.Location)
+	setReplaceOSDsEnvVar(&rs.Spec.Template, replaceOSDs)
+	setDeviceSelectionEnvVar(&rs.Spec.Template, deviceSelection)
+	_, err = c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Create(rs)
+	if err != nil {
+		if !errors.IsAlreadyExists(err) {
+			// we failed to create the replica set, update the orchestration status for this node
+			message := fmt.Sprintf("failed to create osd replica set for node %s. %+v", n.Name, err)
+			c.handleOrchestrationFailure(n, message, errorMessages)
+			return
 		}
 
-		// orchestration of the removed node completed, we can delete the replica set now
-		if err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Delete(rs.Name, &metav1.DeleteOptions{}); err != nil {
-			errorMessages = append(errorMessages, fmt.Sprintf("failed to delete replica set %s: %+v", rs.Name, err))
-			continue
+		// the replica set already exists, update it if the storage selection or settings of the node have changed
+		updated, err := c.updateReplicaSet(n.Name, rs)
+		if err != nil {
+			c.handleOrchestrationFailure(n, err.Error(), errorMessages)
+			return
+		}
+		if !updated {
+			message := fmt.Sprintf("osd replica set already exists for node %s", n.Name)
+			logger.Info(message)
+			status := OrchestrationStatus{Status: OrchestrationStatusCompleted, Message: message}
+			if err := UpdateOrchestrationStatusMap(c.context.Clientset, c.Namespace, n.Name, status); err != nil {
+				*errorMessages = append(*errorMessages, fmt.Sprintf("failed to set orchestration status for node %s, status: %+v: %+v", n.Name, status, err))
+				return
+			}
 		}
+	} else {
+		logger.Infof("osd replica set started for node %s", n.Name)
 	}
 
-	if len(errorMessages) == 0 {
-		logger.Infof("completed running osds in namespace %s", c.Namespace)
-		return nil
+	// wait for the current node's orchestration to be completed
+	if err := c.waitForCompletion(n.Name); err != nil {
+		*errorMessages = append(*errorMessages, err.Error())
+		return
 	}
 
-	return fmt.Errorf("%d failures encountered while running osds in namespace %s: %+v",
-		len(errorMessages), c.Namespace, strings.Join(errorMessages, "\n"))
+	// the osds of the removed devices and directories are purged, they don't need to be mounted anymore
+	if err := c.dropRemovedStorage(n.Name, rs.Name); err != nil {
+		*errorMessages = append(*errorMessages, err.Error())
+	}
 }
 
+// removeNode orchestrates the removal of the OSDs of a node that is no longer in the storage spec
+func (c *Cluster) removeNode(n rookalpha.Node, errorMessages *[]string) {
+	storeConfig := config.ToStoreConfig(n.Config)
+	metadataDevice := config.MetadataDevice(n.Config)
+
+	if err := c.isSafeToRemoveNode(n); err != nil {
+		message := fmt.Sprintf("skipping the removal of node %s because it is not safe to do so: %+v", n.Name, err)
+		c.handleOrchestrationFailure(n, message, errorMessages)
+		return
+	}
+
+	logger.Infof("removing node %s from the cluster", n.Name)
+
+	// update the orchestration status of this removed node to the starting state
+	if err := UpdateOrchestrationStatusMap(c.context.Clientset, c.Namespace, n.Name, OrchestrationStatus{Status: OrchestrationStatusStarting}); err != nil {
+		*errorMessages = append(*errorMessages, fmt.Sprintf("failed to set orchestration starting status for removed node %s: %+v", n.Name, err))
+		return
+	}
+
+	if config.DedicatedPods(n.Config) {
+		c.removeDedicatedNode(n, errorMessages)
+		return
+	}
+
+	// trigger orchestration on the removed node by telling it not to use any storage at all.  note that the directories are still passed in
+	// so that the pod will be able to mount them and migrate data from them.
+	rs := c.makeReplicaSet(n.Name, nil, rookalpha.Selection{DeviceFilter: "none", Directories: n.Directories},
+		v1.ResourceRequirements{}, storeConfig, metadataDevice, n.Location)
+	rs, err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Update(rs)
+	if err != nil {
+		message := fmt.Sprintf("failed to update osd replica set for removed node %s. %+v", n.Name, err)
+		c.handleOrchestrationFailure(n, message, errorMessages)
+		return
+	}
+	logger.Infof("osd replica set updated for node %s", n.Name)
+
+	// delete the pod associated with the replica set so that it will be restarted with the new template
+	if err := c.deleteOSDPod(rs); err != nil {
+		message := fmt.Sprintf("failed to find and delete OSD pod for replica set %s. %+v", rs.Name, err)
+		c.handleOrchestrationFailure(n, message, errorMessages)
+		return
+	}
+
+	// wait for the removed node's orchestration to be completed
+	if err := c.waitForCompletion(n.Name); err != nil {
+		*errorMessages = append(*errorMessages, err.Error())
+		return
+	}
+
+	// orchestration of the removed node completed, we can delete the replica set now
+	if err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Delete(rs.Name, &metav1.DeleteOptions{}); err != nil {
+		*errorMessages = append(*errorMessages, fmt.Sprintf("failed to delete replica set %s: %+v", rs.Name, err))
+	}
+}
+
+// UpdateOrchestrationStatusMap sets the orchestration status of a node in the status map. The status of the node is
+// set again when the map was changed for another node at the same time.
 func UpdateOrchestrationStatusMap(clientset kubernetes.Interface, namespace string, node string, status OrchestrationStatus) error {
+	var err error
+	for i := 0; i <= statusUpdateRetries; i++ {
+		err = updateOrchestrationStatusMap(clientset, namespace, node, status)
+		if err == nil || !errors.IsConflict(err) {
+			break
+		}
+		logger.Infof("orchestration status map changed while updating the status of node %s, trying again", node)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update OSD orchestration status for node %s, status %+v.  %+v", node, status, err)
+	}
+
+	return nil
+}
+
+func updateOrchestrationStatusMap(clientset kubernetes.Interface, namespace string, node string, status OrchestrationStatus) error {
 	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(OrchestrationStatusMapName, metav1.GetOptions{})
 	if err != nil {
 		if !errors.IsNotFound(err) {
@@ -304,12 +543,8 @@ func UpdateOrchestrationStatusMap(clientset kubernetes.Interface, namespace stri
 	// update the status map with the given status now
 	s, _ := json.Marshal(status)
 	cm.Data[node] = string(s)
-	cm, err = clientset.CoreV1().ConfigMaps(namespace).Update(cm)
-	if err != nil {
-		return fmt.Errorf("failed to update OSD orchestration status for node %s, status %+v.  %+v", node, status, err)
-	}
-
-	return nil
+	_, err = clientset.CoreV1().ConfigMaps(namespace).Update(cm)
+	return err
 }
 
 func makeOrchestrationStatusMap(clientset kubernetes.Interface, namespace string, ownerRef *metav1.OwnerReference) error {
@@ -349,6 +584,18 @@ func (c *Cluster) handleOrchestrationFailure(n rookalpha.Node, message string, e
 	*errorMessages = append(*errorMessages, message)
 }
 
+// GetOrchestrationStatus returns the orchestration status of the node, or nil if the node has no status
+func GetOrchestrationStatus(clientset kubernetes.Interface, namespace, node string) (*OrchestrationStatus, error) {
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(OrchestrationStatusMapName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get the orchestration status of node %s. %+v", node, err)
+	}
+	return parseOrchestrationStatus(cm.Data, node), nil
+}
+
 func isStatusCompleted(status OrchestrationStatus) bool {
 	return status.Status == OrchestrationStatusCompleted || status.Status == OrchestrationStatusFailed
 }
@@ -373,17 +620,14 @@ func parseOrchestrationStatus(data map[string]string, node string) *Orchestratio
 	return &status
 }
 
-func (c *Cluster) findInProgressNode() (string, *OrchestrationStatus) {
+// findInProgressNodes returns the nodes whose orchestration was started but has not completed
+func (c *Cluster) findInProgressNodes() []rookalpha.Node {
 	cm, err := c.context.Clientset.CoreV1().ConfigMaps(c.Namespace).Get(OrchestrationStatusMapName, metav1.GetOptions{})
 	if err != nil {
-		return "", nil
-	}
-
-	if len(cm.Data) == 0 {
-		// no orchestration status available, no in progress node
-		return "", nil
+		return nil
 	}
 
+	var nodes []rookalpha.Node
 	for node, statusRaw := range cm.Data {
 		var status OrchestrationStatus
 		if err := json.Unmarshal([]byte(statusRaw), &status); err != nil {
@@ -392,13 +636,13 @@ func (c *Cluster) findInProgressNode() (string, *OrchestrationStatus) {
 		}
 
 		if !isStatusCompleted(status) {
-			// found an in progress node, return it
-			return node, &status
+			// found an in progress node
+			logger.Infof("found in progress node %s, status: %+v", node, status)
+			nodes = append(nodes, rookalpha.Node{Name: node})
 		}
 	}
 
-	// didn't find any in progress nodes
-	return "", nil
+	return nodes
 }
 
 func (c *Cluster) waitForCompletion(node string) error {
@@ -512,8 +756,16 @@ func (c *Cluster) discoverStorageNodes() ([]rookalpha.Node, error) {
 		return nil, fmt.Errorf("failed to list osd replica sets: %+v", err)
 	}
 
-	discoveredNodes = make([]rookalpha.Node, len(osdReplicaSets.Items))
-	for i, osdReplicaSet := range osdReplicaSets.Items {
+	discoveredNodes = make([]rookalpha.Node, 0, len(osdReplicaSets.Items))
+	for _, osdReplicaSet := range osdReplicaSets.Items {
+		if isDeviceSetReplicaSet(osdReplicaSet) {
+			// replica sets of device sets are not tied to a storage node
+			continue
+		}
+		if isDeploymentReplicaSet(osdReplicaSet) {
+			// the osd deployments are discovered below
+			continue
+		}
 		osdPodSpec := osdReplicaSet.Spec.Template.Spec
 
 		// get the node name from the node selector
@@ -541,7 +793,18 @@ func (c *Cluster) discoverStorageNodes() ([]rookalpha.Node, error) {
 			Config:   getConfigFromContainer(osdContainer),
 		}
 
-		discoveredNodes[i] = node
+		discoveredNodes = append(discoveredNodes, node)
+	}
+
+	// the nodes whose osds run in their own pods
+	dedicatedNodes, err := c.discoverDedicatedNodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range dedicatedNodes {
+		if !containsNode(discoveredNodes, node.Name) {
+			discoveredNodes = append(discoveredNodes, node)
+		}
 	}
 
 	return discoveredNodes, nil
@@ -638,6 +901,28 @@ func (c *Cluster) deleteOSDPod(rs *extensions.ReplicaSet) error {
 	return err
 }
 
+// determines if the agent of one of the nodes will convert filestore osds to bluestore. A node whose partition scheme
+// cannot be loaded is assumed to have osds to convert.
+func (c *Cluster) isFilestoreConversionPending(nodes []rookalpha.Node) bool {
+	kv := k8sutil.NewConfigMapKVStore(c.Namespace, c.context.Clientset, c.ownerRef)
+	for _, n := range nodes {
+		if config.ToStoreConfig(n.Config).StoreType != config.Bluestore || config.DedicatedPods(n.Config) {
+			// the osds in dedicated pods are not converted by their agent
+			continue
+		}
+
+		scheme, err := config.LoadScheme(kv, config.GetConfigStoreName(n.Name))
+		if err != nil {
+			logger.Warningf("failed to load the partition scheme of node %s. %+v", n.Name, err)
+			return true
+		}
+		if len(config.FilestoreConversions(scheme)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Cluster) getOSDsForNode(node rookalpha.Node) ([]int, error) {
 	kv := k8sutil.NewConfigMapKVStore(c.Namespace, c.context.Clientset, c.ownerRef)
 
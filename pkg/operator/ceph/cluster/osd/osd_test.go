@@ -18,6 +18,7 @@ package osd
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -29,6 +30,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"k8s.io/api/core/v1"
 	corev1 "k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -193,6 +195,35 @@ func TestAddNodeFailure(t *testing.T) {
 	assert.NotNil(t, startErr)
 }
 
+func TestAddNodeDevicesKeepsTemplate(t *testing.T) {
+	node := rookalpha.Node{Name: "node1", Selection: rookalpha.Selection{Devices: []rookalpha.Device{{Name: "sdx"}}}}
+
+	// the replica set and the status of the node are captured when the replica set is created
+	clientset := fake.NewSimpleClientset()
+	var templates []v1.PodTemplateSpec
+	var statuses []OrchestrationStatus
+	clientset.PrependReactor("create", "replicasets", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+		rs := action.(k8stesting.CreateAction).GetObject().(*extensions.ReplicaSet)
+		templates = append(templates, rs.Spec.Template)
+		status, err := GetOrchestrationStatus(clientset, "ns", node.Name)
+		assert.Nil(t, err)
+		statuses = append(statuses, *status)
+		return true, nil, fmt.Errorf("mock failed to create replica set")
+	})
+	c := New(&clusterd.Context{Clientset: clientset, ConfigDir: "/var/lib/rook", Executor: &exectest.MockExecutor{}}, "ns", "myversion",
+		rookalpha.StorageScopeSpec{Nodes: []rookalpha.Node{node}}, "", rookalpha.Placement{}, false, v1.ResourceRequirements{},
+		metav1.OwnerReference{})
+
+	// the osds are kept by the orchestration for new devices through the status of the node, the template does not change
+	var errorMessages []string
+	c.startNode(node, &errorMessages)
+	c.addNodeDevices(node, &errorMessages)
+	assert.Equal(t, 2, len(templates))
+	assert.Empty(t, podTemplateChanges(templates[0], templates[1]))
+	assert.False(t, statuses[0].KeepOSDs)
+	assert.True(t, statuses[1].KeepOSDs)
+}
+
 func TestOrchestrationStatus(t *testing.T) {
 	clientset := fake.NewSimpleClientset()
 	c := New(&clusterd.Context{Clientset: clientset, ConfigDir: "/var/lib/rook", Executor: &exectest.MockExecutor{}}, "ns", "myversion",
@@ -224,6 +255,74 @@ func TestOrchestrationStatus(t *testing.T) {
 	retrievedStatus := parseOrchestrationStatus(statusMap.Data, nodeName)
 	assert.NotNil(t, retrievedStatus)
 	assert.Equal(t, status, *retrievedStatus)
+
+	// the status of a node is read by its agent, a node without a status has none
+	status.KeepOSDs = true
+	err = UpdateOrchestrationStatusMap(c.context.Clientset, c.Namespace, nodeName, status)
+	assert.Nil(t, err)
+	retrievedStatus, err = GetOrchestrationStatus(c.context.Clientset, c.Namespace, nodeName)
+	assert.Nil(t, err)
+	assert.Equal(t, status, *retrievedStatus)
+	retrievedStatus, err = GetOrchestrationStatus(c.context.Clientset, c.Namespace, "othernode")
+	assert.Nil(t, err)
+	assert.Nil(t, retrievedStatus)
+}
+
+func TestOrchestrateNodes(t *testing.T) {
+	c := &Cluster{}
+	nodes := []rookalpha.Node{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}, {Name: "e"}}
+
+	// the first node fails right away, the others wait until they are released
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	started := make(chan string, 2*len(nodes))
+	release := make(chan struct{})
+	orchestrate := func(n rookalpha.Node, errorMessages *[]string) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		started <- n.Name
+
+		if n.Name == "a" {
+			*errorMessages = append(*errorMessages, "node a failed")
+		} else {
+			<-release
+		}
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+	}
+
+	result := make(chan []string)
+	go func() {
+		result <- c.orchestrateNodes(nodes, 2, orchestrate)
+	}()
+
+	// the failed node does not hold up the next node, but no more than two nodes are orchestrated at the same time
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+	select {
+	case name := <-started:
+		assert.Fail(t, fmt.Sprintf("node %s started while two nodes are being orchestrated", name))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	errorMessages := <-result
+	assert.Equal(t, []string{"node a failed"}, errorMessages)
+	assert.Equal(t, 2, maxRunning)
+	assert.Equal(t, 2, len(started))
+
+	// the nodes are orchestrated one at a time without a concurrency
+	maxRunning = 0
+	errorMessages = c.orchestrateNodes(nodes[1:], 0, orchestrate)
+	assert.Equal(t, 0, len(errorMessages))
+	assert.Equal(t, 1, maxRunning)
 }
 
 func mockNodeOrchestrationCompletion(c *Cluster, nodeName string, statusMapWatcher *watch.FakeWatcher) {
@@ -268,3 +367,27 @@ func waitForOrchestrationCompletion(c *Cluster, nodeName string, startCompleted
 		<-time.After(50 * time.Millisecond)
 	}
 }
+
+func TestIsFilestoreConversionPending(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	c := New(&clusterd.Context{Clientset: clientset, ConfigDir: "/var/lib/rook", Executor: &exectest.MockExecutor{}}, "ns", "myversion",
+		rookalpha.StorageScopeSpec{}, "", rookalpha.Placement{}, false, v1.ResourceRequirements{}, metav1.OwnerReference{})
+
+	// node1 has a filestore osd
+	entry := config.NewPerfSchemeEntry(config.Filestore)
+	entry.ID = 1
+	assert.Nil(t, config.PopulateCollocatedPerfSchemeEntry(entry, "sda", config.StoreConfig{StoreType: config.Filestore}))
+	scheme := config.NewPerfScheme()
+	scheme.Entries = append(scheme.Entries, entry)
+	kv := k8sutil.NewConfigMapKVStore(c.Namespace, clientset, metav1.OwnerReference{})
+	assert.Nil(t, scheme.SaveScheme(kv, config.GetConfigStoreName("node1")))
+
+	// the osd is converted once the store type of the node is bluestore
+	bluestore := map[string]string{config.StoreTypeKey: config.Bluestore}
+	assert.False(t, c.isFilestoreConversionPending([]rookalpha.Node{{Name: "node1"}, {Name: "node2", Config: bluestore}}))
+	assert.True(t, c.isFilestoreConversionPending([]rookalpha.Node{{Name: "node1", Config: bluestore}}))
+
+	// the agent does not convert the osds in dedicated pods
+	dedicated := map[string]string{config.StoreTypeKey: config.Bluestore, config.DedicatedPodsKey: "true"}
+	assert.False(t, c.isFilestoreConversionPending([]rookalpha.Node{{Name: "node1", Config: dedicated}}))
+}
@@ -18,6 +18,7 @@ limitations under the License.
 package osd
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -33,12 +34,26 @@ import (
 )
 
 const (
-	dataDirsEnvVarName          = "ROOK_DATA_DIRECTORIES"
-	osdStoreEnvVarName          = "ROOK_OSD_STORE"
-	osdDatabaseSizeEnvVarName   = "ROOK_OSD_DATABASE_SIZE"
-	osdWalSizeEnvVarName        = "ROOK_OSD_WAL_SIZE"
-	osdJournalSizeEnvVarName    = "ROOK_OSD_JOURNAL_SIZE"
-	osdMetadataDeviceEnvVarName = "ROOK_METADATA_DEVICE"
+	nodeNameEnvVarName               = "ROOK_NODE_NAME"
+	dataDevicesEnvVarName            = "ROOK_DATA_DEVICES"
+	dataDirsEnvVarName               = "ROOK_DATA_DIRECTORIES"
+	osdStoreEnvVarName               = "ROOK_OSD_STORE"
+	osdDatabaseSizeEnvVarName        = "ROOK_OSD_DATABASE_SIZE"
+	osdWalSizeEnvVarName             = "ROOK_OSD_WAL_SIZE"
+	osdJournalSizeEnvVarName         = "ROOK_OSD_JOURNAL_SIZE"
+	osdMetadataDeviceEnvVarName      = "ROOK_METADATA_DEVICE"
+	osdProvisionerEnvVarName         = "ROOK_OSD_PROVISIONER"
+	osdEncryptedDeviceEnvVarName     = "ROOK_OSD_ENCRYPTED_DEVICE"
+	osdWeightRampStepEnvVarName      = "ROOK_OSD_WEIGHT_RAMP_STEP"
+	osdMemoryLimitEnvVarName         = "ROOK_OSD_MEMORY_LIMIT"
+	osdsPerDeviceEnvVarName          = "ROOK_OSDS_PER_DEVICE"
+	osdDatabaseSizePercentEnvVarName = "ROOK_OSD_DATABASE_SIZE_PERCENT"
+	osdWalSizePercentEnvVarName      = "ROOK_OSD_WAL_SIZE_PERCENT"
+	osdAutoMetadataSizeEnvVarName    = "ROOK_OSD_AUTO_METADATA_SIZE"
+	dataDeviceConfigEnvVarName       = "ROOK_DATA_DEVICE_CONFIG"
+	deviceFilterEnvVarName           = "ROOK_DATA_DEVICE_FILTER"
+	devicesVolumeName                = "devices"
+	udevVolumeName                   = "udev"
 )
 
 func (c *Cluster) makeDaemonSet(selection rookalpha.Selection, storeConfig config.StoreConfig, metadataDevice, location string) *extensions.DaemonSet {
@@ -103,9 +118,9 @@ func (c *Cluster) podTemplateSpec(devices []rookalpha.Device, selection rookalph
 	// by default, don't define any volume config unless it is required
 	if len(devices) > 0 || selection.DeviceFilter != "" || selection.GetUseAllDevices() || metadataDevice != "" {
 		// create volume config for the data dir and /dev so the pod can access devices on the host
-		devVolume := v1.Volume{Name: "devices", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/dev"}}}
+		devVolume := v1.Volume{Name: devicesVolumeName, VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/dev"}}}
 		volumes = append(volumes, devVolume)
-		udevVolume := v1.Volume{Name: "udev", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/run/udev"}}}
+		udevVolume := v1.Volume{Name: udevVolumeName, VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/run/udev"}}}
 		volumes = append(volumes, udevVolume)
 	}
 
@@ -165,9 +180,12 @@ func (c *Cluster) osdContainer(devices []rookalpha.Device, selection rookalpha.S
 	if len(devices) > 0 {
 		deviceNames := make([]string, len(devices))
 		for i := range devices {
-			deviceNames[i] = devices[i].Name
+			deviceNames[i] = deviceID(devices[i])
 		}
 		envVars = append(envVars, dataDevicesEnvVar(strings.Join(deviceNames, ",")))
+		if deviceConfig, ok := dataDeviceConfigEnvVar(devices); ok {
+			envVars = append(envVars, deviceConfig)
+		}
 		devMountNeeded = true
 	} else if selection.DeviceFilter != "" {
 		envVars = append(envVars, deviceFilterEnvVar(selection.DeviceFilter))
@@ -187,9 +205,9 @@ func (c *Cluster) osdContainer(devices []rookalpha.Device, selection rookalpha.S
 		k8sutil.ConfigOverrideMount(),
 	}
 	if devMountNeeded {
-		devMount := v1.VolumeMount{Name: "devices", MountPath: "/dev"}
+		devMount := v1.VolumeMount{Name: devicesVolumeName, MountPath: "/dev"}
 		volumeMounts = append(volumeMounts, devMount)
-		udevMount := v1.VolumeMount{Name: "udev", MountPath: "/run/udev"}
+		udevMount := v1.VolumeMount{Name: udevVolumeName, MountPath: "/run/udev"}
 		volumeMounts = append(volumeMounts, udevMount)
 	}
 
@@ -223,10 +241,43 @@ func (c *Cluster) osdContainer(devices []rookalpha.Device, selection rookalpha.S
 		envVars = append(envVars, osdJournalSizeEnvVar(storeConfig.JournalSizeMB))
 	}
 
+	if storeConfig.Provisioner != "" {
+		envVars = append(envVars, osdProvisionerEnvVar(storeConfig.Provisioner))
+	}
+
+	if storeConfig.EncryptedDevice {
+		envVars = append(envVars, osdEncryptedDeviceEnvVar())
+	}
+
+	if storeConfig.WeightRampStep != 0 {
+		envVars = append(envVars, osdWeightRampStepEnvVar(storeConfig.WeightRampStep))
+	}
+
+	if storeConfig.OSDsPerDevice != 0 {
+		envVars = append(envVars, osdsPerDeviceEnvVar(storeConfig.OSDsPerDevice))
+	}
+
+	if storeConfig.DatabaseSizePercent != 0 {
+		envVars = append(envVars, osdSizePercentEnvVar(osdDatabaseSizePercentEnvVarName, storeConfig.DatabaseSizePercent))
+	}
+
+	if storeConfig.WalSizePercent != 0 {
+		envVars = append(envVars, osdSizePercentEnvVar(osdWalSizePercentEnvVarName, storeConfig.WalSizePercent))
+	}
+
+	if storeConfig.AutoMetadataSize {
+		envVars = append(envVars, osdAutoMetadataSizeEnvVar())
+	}
+
 	if location != "" {
 		envVars = append(envVars, rookalpha.LocationEnvVar(location))
 	}
 
+	if _, ok := resources.Limits[v1.ResourceMemory]; ok {
+		// the osds divide the memory limit of the container between them
+		envVars = append(envVars, osdMemoryLimitEnvVar())
+	}
+
 	privileged := false
 	// elevate to be privileged if it is going to mount devices
 	if devMountNeeded {
@@ -257,15 +308,44 @@ func (c *Cluster) osdContainer(devices []rookalpha.Device, selection rookalpha.S
 }
 
 func nodeNameEnvVar() v1.EnvVar {
-	return v1.EnvVar{Name: "ROOK_NODE_NAME", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "spec.nodeName"}}}
+	return v1.EnvVar{Name: nodeNameEnvVarName, ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "spec.nodeName"}}}
 }
 
 func dataDevicesEnvVar(dataDevices string) v1.EnvVar {
-	return v1.EnvVar{Name: "ROOK_DATA_DEVICES", Value: dataDevices}
+	return v1.EnvVar{Name: dataDevicesEnvVarName, Value: dataDevices}
+}
+
+// passes the config of each device that has its own config to the osd pod
+func dataDeviceConfigEnvVar(devices []rookalpha.Device) (v1.EnvVar, bool) {
+	deviceConfig := map[string]map[string]string{}
+	for _, device := range devices {
+		if len(device.Config) > 0 {
+			deviceConfig[deviceID(device)] = device.Config
+		}
+	}
+	if len(deviceConfig) == 0 {
+		return v1.EnvVar{}, false
+	}
+
+	b, err := json.Marshal(deviceConfig)
+	if err != nil {
+		logger.Warningf("failed to marshal the config of devices %+v. %+v", devices, err)
+		return v1.EnvVar{}, false
+	}
+
+	return v1.EnvVar{Name: dataDeviceConfigEnvVarName, Value: string(b)}, true
+}
+
+// deviceID returns how the device is passed to the agent, which resolves a full path to the current name of the device
+func deviceID(device rookalpha.Device) string {
+	if device.FullPath != "" {
+		return device.FullPath
+	}
+	return device.Name
 }
 
 func deviceFilterEnvVar(filter string) v1.EnvVar {
-	return v1.EnvVar{Name: "ROOK_DATA_DEVICE_FILTER", Value: filter}
+	return v1.EnvVar{Name: deviceFilterEnvVarName, Value: filter}
 }
 
 func metadataDeviceEnvVar(metadataDevice string) v1.EnvVar {
@@ -292,6 +372,36 @@ func osdJournalSizeEnvVar(journalSize int) v1.EnvVar {
 	return v1.EnvVar{Name: osdJournalSizeEnvVarName, Value: strconv.Itoa(journalSize)}
 }
 
+func osdProvisionerEnvVar(provisioner string) v1.EnvVar {
+	return v1.EnvVar{Name: osdProvisionerEnvVarName, Value: provisioner}
+}
+
+func osdEncryptedDeviceEnvVar() v1.EnvVar {
+	return v1.EnvVar{Name: osdEncryptedDeviceEnvVarName, Value: "true"}
+}
+
+func osdWeightRampStepEnvVar(step float64) v1.EnvVar {
+	return v1.EnvVar{Name: osdWeightRampStepEnvVarName, Value: strconv.FormatFloat(step, 'f', -1, 64)}
+}
+
+func osdsPerDeviceEnvVar(count int) v1.EnvVar {
+	return v1.EnvVar{Name: osdsPerDeviceEnvVarName, Value: strconv.Itoa(count)}
+}
+
+func osdSizePercentEnvVar(name string, percent float64) v1.EnvVar {
+	return v1.EnvVar{Name: name, Value: strconv.FormatFloat(percent, 'f', -1, 64)}
+}
+
+func osdAutoMetadataSizeEnvVar() v1.EnvVar {
+	return v1.EnvVar{Name: osdAutoMetadataSizeEnvVarName, Value: "true"}
+}
+
+// passes the memory limit of the container in bytes through the downward api
+func osdMemoryLimitEnvVar() v1.EnvVar {
+	return v1.EnvVar{Name: osdMemoryLimitEnvVarName,
+		ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{Resource: "limits.memory"}}}
+}
+
 func getDirectoriesFromContainer(osdContainer v1.Container) []rookalpha.Directory {
 	var dirsArg string
 	for _, envVar := range osdContainer.Env {
@@ -328,6 +438,20 @@ func getConfigFromContainer(osdContainer v1.Container) map[string]string {
 			cfg[config.JournalSizeMBKey] = envVar.Value
 		case osdMetadataDeviceEnvVarName:
 			cfg[config.MetadataDeviceKey] = envVar.Value
+		case osdProvisionerEnvVarName:
+			cfg[config.ProvisionerKey] = envVar.Value
+		case osdEncryptedDeviceEnvVarName:
+			cfg[config.EncryptedDeviceKey] = envVar.Value
+		case osdWeightRampStepEnvVarName:
+			cfg[config.WeightRampStepKey] = envVar.Value
+		case osdsPerDeviceEnvVarName:
+			cfg[config.OSDsPerDeviceKey] = envVar.Value
+		case osdDatabaseSizePercentEnvVarName:
+			cfg[config.DatabaseSizePercentKey] = envVar.Value
+		case osdWalSizePercentEnvVarName:
+			cfg[config.WalSizePercentKey] = envVar.Value
+		case osdAutoMetadataSizeEnvVarName:
+			cfg[config.AutoMetadataSizeKey] = envVar.Value
 		}
 	}
 
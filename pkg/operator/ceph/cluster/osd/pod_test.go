@@ -169,6 +169,21 @@ func TestStorageSpecDevicesAndDirectories(t *testing.T) {
 	// container command should have the given dir and device
 	verifyEnvVar(t, container.Env, "ROOK_DATA_DIRECTORIES", "/rook/dir1", true)
 	verifyEnvVar(t, container.Env, "ROOK_DATA_DEVICES", "sda", true)
+	verifyEnvVar(t, container.Env, dataDeviceConfigEnvVarName, "", false)
+
+	// the config of each device is passed to the pod
+	devices := []rookalpha.Device{{Name: "sda", Config: map[string]string{config.MetadataDeviceKey: "nvme01"}}, {Name: "sdb"}}
+	replicaSet = c.makeReplicaSet(n.Name, devices, n.Selection, v1.ResourceRequirements{}, config.StoreConfig{}, "", n.Location)
+	container = replicaSet.Spec.Template.Spec.Containers[0]
+	verifyEnvVar(t, container.Env, "ROOK_DATA_DEVICES", "sda,sdb", true)
+	verifyEnvVar(t, container.Env, dataDeviceConfigEnvVarName, `{"sda":{"metadataDevice":"nvme01"}}`, true)
+
+	// devices with a full path are passed to the pod by their path
+	devices = []rookalpha.Device{{FullPath: "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4", Config: map[string]string{config.MetadataDeviceKey: "nvme01"}}, {Name: "sdb"}}
+	replicaSet = c.makeReplicaSet(n.Name, devices, n.Selection, v1.ResourceRequirements{}, config.StoreConfig{}, "", n.Location)
+	container = replicaSet.Spec.Template.Spec.Containers[0]
+	verifyEnvVar(t, container.Env, "ROOK_DATA_DEVICES", "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4,sdb", true)
+	verifyEnvVar(t, container.Env, dataDeviceConfigEnvVarName, `{"/dev/disk/by-id/wwn-0x5000c500a1b2c3d4":{"metadataDevice":"nvme01"}}`, true)
 }
 
 func TestStorageSpecConfig(t *testing.T) {
@@ -178,11 +193,14 @@ func TestStorageSpecConfig(t *testing.T) {
 				Name:     "node1",
 				Location: "rack=foo",
 				Config: map[string]string{
-					"storeType":      "bluestore",
-					"databaseSizeMB": "10",
-					"walSizeMB":      "20",
-					"journalSizeMB":  "30",
-					"metadataDevice": "nvme093",
+					"storeType":           "bluestore",
+					"databaseSizeMB":      "10",
+					"walSizeMB":           "20",
+					"journalSizeMB":       "30",
+					"metadataDevice":      "nvme093",
+					"encryptedDevice":     "true",
+					"databaseSizePercent": "2.5",
+					"autoMetadataSize":    "true",
 				},
 				Selection: rookalpha.Selection{
 					Directories: []rookalpha.Directory{{Path: "/rook/storageDir472"}},
@@ -217,6 +235,11 @@ func TestStorageSpecConfig(t *testing.T) {
 	verifyEnvVar(t, container.Env, "ROOK_OSD_JOURNAL_SIZE", "30", true)
 	verifyEnvVar(t, container.Env, "ROOK_LOCATION", "rack=foo", true)
 	verifyEnvVar(t, container.Env, "ROOK_METADATA_DEVICE", "nvme093", true)
+	verifyEnvVar(t, container.Env, "ROOK_OSD_ENCRYPTED_DEVICE", "true", true)
+	verifyEnvVar(t, container.Env, "ROOK_OSD_DATABASE_SIZE_PERCENT", "2.5", true)
+	verifyEnvVar(t, container.Env, "ROOK_OSD_AUTO_METADATA_SIZE", "true", true)
+	assert.True(t, storeConfig.EncryptedDevice)
+	assert.Equal(t, 2.5, storeConfig.DatabaseSizePercent)
 
 	assert.Equal(t, "100", container.Resources.Limits.Cpu().String())
 	assert.Equal(t, "1337", container.Resources.Requests.Memory().String())
@@ -228,6 +251,28 @@ func TestStorageSpecConfig(t *testing.T) {
 	assert.Equal(t, n.Directories, discoveredDirs)
 }
 
+func TestMemoryLimitEnvVar(t *testing.T) {
+	c := New(&clusterd.Context{Clientset: fake.NewSimpleClientset(), Executor: &exectest.MockExecutor{}}, "ns", "rook/rook:myversion",
+		rookalpha.StorageScopeSpec{}, "", rookalpha.Placement{}, false, v1.ResourceRequirements{}, metav1.OwnerReference{})
+
+	// without a limit the downward api would give the memory of the node, so the limit is not passed
+	resources := v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceMemory: resource.MustParse("1Gi")}}
+	container := c.osdContainer(nil, rookalpha.Selection{}, resources, config.StoreConfig{}, "", "")
+	_, ok := envVarValues(container.Env)[osdMemoryLimitEnvVarName]
+	assert.False(t, ok)
+
+	resources.Limits = v1.ResourceList{v1.ResourceMemory: resource.MustParse("4Gi")}
+	container = c.osdContainer(nil, rookalpha.Selection{}, resources, config.StoreConfig{}, "", "")
+	var limitVar *v1.EnvVar
+	for i, e := range container.Env {
+		if e.Name == osdMemoryLimitEnvVarName {
+			limitVar = &container.Env[i]
+		}
+	}
+	assert.NotNil(t, limitVar)
+	assert.Equal(t, "limits.memory", limitVar.ValueFrom.ResourceFieldRef.Resource)
+}
+
 func TestHostNetwork(t *testing.T) {
 	storageSpec := rookalpha.StorageScopeSpec{
 		Nodes: []rookalpha.Node{
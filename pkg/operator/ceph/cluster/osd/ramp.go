@@ -0,0 +1,388 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cephv1alpha1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1alpha1"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/client"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// WeightRampMapName is the name of the config map with the progress of the OSDs whose weight is changed in steps
+	WeightRampMapName      = "rook-ceph-osd-weight-ramp"
+	weightRampMapKeyFmt    = "osd.%d"
+	weightRampMapKeyPrefix = "osd."
+
+	// WeightRampStateRampingUp is the state of a new OSD whose weight is being raised to its full weight
+	WeightRampStateRampingUp = "rampingUp"
+	// WeightRampStateDraining is the state of a removed OSD whose weight is being lowered to 0
+	WeightRampStateDraining = "draining"
+	// WeightRampStateCompleted is the state of an OSD that reached its target weight
+	WeightRampStateCompleted = "completed"
+
+	pgStateActiveClean = "active+clean"
+)
+
+var (
+	// WeightRampInterval is the interval at which the weight of the ramping OSDs is raised by another step
+	WeightRampInterval = 60 * time.Second
+)
+
+// WeightRamp is the progress of changing the CRUSH weight of an OSD in steps
+type WeightRamp struct {
+	State string `json:"state"`
+	// the CRUSH weight the OSD will have at the end of the ramp
+	TargetWeight float64 `json:"targetWeight"`
+	// the current CRUSH weight of the OSD
+	Weight float64 `json:"weight"`
+	// the weight that is added or removed at each step
+	StepWeight float64 `json:"stepWeight"`
+}
+
+// NewWeightRamp returns the ramp of an OSD from its current weight to the target weight in steps of the given fraction
+// of the larger of the two weights
+func NewWeightRamp(weight, targetWeight, step float64) WeightRamp {
+	state := WeightRampStateRampingUp
+	fullWeight := targetWeight
+	if targetWeight < weight {
+		state = WeightRampStateDraining
+		fullWeight = weight
+	}
+
+	ramp := WeightRamp{State: state, TargetWeight: RoundWeight(targetWeight), Weight: RoundWeight(weight),
+		StepWeight: RoundWeight(fullWeight * step)}
+	if ramp.Done() {
+		ramp.State = WeightRampStateCompleted
+	}
+	return ramp
+}
+
+// Done returns whether the OSD reached its target weight
+func (r WeightRamp) Done() bool {
+	if r.State == WeightRampStateDraining {
+		return r.Weight <= r.TargetWeight
+	}
+	return r.Weight >= r.TargetWeight
+}
+
+// NextWeight returns the weight of the OSD after the next step, which never goes past the target weight
+func (r WeightRamp) NextWeight() float64 {
+	if r.State == WeightRampStateDraining {
+		next := RoundWeight(r.Weight - r.StepWeight)
+		if next < r.TargetWeight || r.StepWeight <= 0 {
+			return r.TargetWeight
+		}
+		return next
+	}
+
+	next := RoundWeight(r.Weight + r.StepWeight)
+	if next > r.TargetWeight || r.StepWeight <= 0 {
+		return r.TargetWeight
+	}
+	return next
+}
+
+// Step changes the CRUSH weight of the OSD by a step and returns the new state of the ramp
+func (r WeightRamp) Step(context *clusterd.Context, clusterName string, id int) (WeightRamp, error) {
+	next := r.NextWeight()
+	if o, err := client.CrushReweight(context, clusterName, id, next); err != nil {
+		return r, fmt.Errorf("failed to reweight osd.%d to %.4f: %+v. %s", id, next, err, o)
+	}
+
+	logger.Infof("osd.%d weight changed from %.4f to %.4f on the way to %.4f", id, r.Weight, next, r.TargetWeight)
+	r.Weight = next
+	if r.Done() {
+		r.State = WeightRampStateCompleted
+	}
+	return r, nil
+}
+
+// RoundWeight rounds a CRUSH weight to the precision of the CRUSH map
+func RoundWeight(weight float64) float64 {
+	rounded, _ := strconv.ParseFloat(fmt.Sprintf("%.4f", weight), 64)
+	return rounded
+}
+
+// CheckPGsClean returns an error if any of the placement groups are not active+clean, in which case the data is still
+// moving from the last weight change
+func CheckPGsClean(context *clusterd.Context, clusterName string) error {
+	if err := client.IsClusterClean(context, clusterName); err != nil {
+		return err
+	}
+
+	pgDump, err := client.GetPGDumpBrief(context, clusterName)
+	if err != nil {
+		return err
+	}
+	for _, pg := range pgDump {
+		if pg.State != pgStateActiveClean {
+			return fmt.Errorf("pg %s is %s", pg.ID, pg.State)
+		}
+	}
+	return nil
+}
+
+// UpdateWeightRamp records the progress of the weight ramp of an OSD. The map is shared by the agents of all the nodes,
+// the ramp is recorded again on the latest map when another ramp was recorded at the same time.
+func UpdateWeightRamp(clientset kubernetes.Interface, namespace string, id int, ramp WeightRamp) error {
+	var err error
+	for i := 0; i <= statusUpdateRetries; i++ {
+		err = updateWeightRamp(clientset, namespace, id, ramp)
+		if err == nil || !errors.IsConflict(err) {
+			break
+		}
+		logger.Infof("weight ramp map changed while updating the weight ramp of osd.%d, trying again", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update the weight ramp of osd.%d. %+v", id, err)
+	}
+	return nil
+}
+
+func updateWeightRamp(clientset kubernetes.Interface, namespace string, id int, ramp WeightRamp) error {
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(WeightRampMapName, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+
+		// the map is created by the operator, but the first ramp may be recorded before that
+		if err := makeWeightRampMap(clientset, namespace, nil); err != nil {
+			return err
+		}
+		cm, err = clientset.CoreV1().ConfigMaps(namespace).Get(WeightRampMapName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+
+	s, _ := json.Marshal(ramp)
+	cm.Data[fmt.Sprintf(weightRampMapKeyFmt, id)] = string(s)
+	_, err = clientset.CoreV1().ConfigMaps(namespace).Update(cm)
+	return err
+}
+
+// DeleteWeightRamp forgets the weight ramp of an OSD that was removed
+func DeleteWeightRamp(clientset kubernetes.Interface, namespace string, id int) error {
+	var err error
+	for i := 0; i <= statusUpdateRetries; i++ {
+		err = deleteWeightRamp(clientset, namespace, id)
+		if err == nil || !errors.IsConflict(err) {
+			break
+		}
+		logger.Infof("weight ramp map changed while deleting the weight ramp of osd.%d, trying again", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete the weight ramp of osd.%d. %+v", id, err)
+	}
+	return nil
+}
+
+func deleteWeightRamp(clientset kubernetes.Interface, namespace string, id int) error {
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(WeightRampMapName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	key := fmt.Sprintf(weightRampMapKeyFmt, id)
+	if _, ok := cm.Data[key]; !ok {
+		return nil
+	}
+	delete(cm.Data, key)
+	_, err = clientset.CoreV1().ConfigMaps(namespace).Update(cm)
+	return err
+}
+
+// GetWeightRamp returns the recorded weight ramp of an OSD, nil if the OSD has none
+func GetWeightRamp(clientset kubernetes.Interface, namespace string, id int) (*WeightRamp, error) {
+	ramps, err := loadWeightRamps(clientset, namespace)
+	if err != nil {
+		return nil, err
+	}
+	ramp, ok := ramps[id]
+	if !ok {
+		return nil, nil
+	}
+	return &ramp, nil
+}
+
+// loads the weight ramps of the OSDs by their IDs
+func loadWeightRamps(clientset kubernetes.Interface, namespace string) (map[int]WeightRamp, error) {
+	ramps := map[int]WeightRamp{}
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(WeightRampMapName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ramps, nil
+		}
+		return nil, fmt.Errorf("failed to get the osd weight ramps. %+v", err)
+	}
+
+	for key, val := range cm.Data {
+		id, err := strconv.Atoi(strings.TrimPrefix(key, weightRampMapKeyPrefix))
+		if err != nil {
+			logger.Warningf("skipping invalid weight ramp key %s", key)
+			continue
+		}
+		var ramp WeightRamp
+		if err := json.Unmarshal([]byte(val), &ramp); err != nil {
+			logger.Warningf("skipping invalid weight ramp of osd.%d. %+v", id, err)
+			continue
+		}
+		ramps[id] = ramp
+	}
+	return ramps, nil
+}
+
+func makeWeightRampMap(clientset kubernetes.Interface, namespace string, ownerRef *metav1.OwnerReference) error {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      WeightRampMapName,
+			Namespace: namespace,
+		},
+		Data: map[string]string{},
+	}
+	if ownerRef != nil {
+		cm.OwnerReferences = []metav1.OwnerReference{*ownerRef}
+	}
+
+	if _, err := clientset.CoreV1().ConfigMaps(namespace).Create(cm); err != nil && !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create the osd weight ramps map. %+v", err)
+	}
+	return nil
+}
+
+// WeightRamper raises the weight of the new OSDs in steps and reports the progress of the ramps in the cluster status
+type WeightRamper struct {
+	context     *clusterd.Context
+	namespace   string
+	clusterName string
+}
+
+// NewWeightRamper creates a new WeightRamper object
+func NewWeightRamper(context *clusterd.Context, namespace, clusterName string) *WeightRamper {
+	return &WeightRamper{context: context, namespace: namespace, clusterName: clusterName}
+}
+
+// Run periodically raises the weight of the new OSDs by a step when the data from the previous step finished moving
+func (r *WeightRamper) Run(stopCh chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			logger.Infof("stopping the osd weight ramps in namespace %s", r.namespace)
+			return
+
+		case <-time.After(WeightRampInterval):
+			if err := r.rampUp(); err != nil {
+				logger.Warningf("failed to ramp up osd weights. %+v", err)
+			}
+			if err := r.updateStatus(); err != nil {
+				logger.Warningf("failed to report the osd weight ramps. %+v", err)
+			}
+		}
+	}
+}
+
+func (r *WeightRamper) rampUp() error {
+	ramps, err := loadWeightRamps(r.context.Clientset, r.namespace)
+	if err != nil {
+		return err
+	}
+
+	var ids []int
+	for id, ramp := range ramps {
+		if ramp.State == WeightRampStateRampingUp {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Ints(ids)
+
+	// the next step is only taken after the data from the last step finished moving
+	if err := CheckPGsClean(r.context, r.namespace); err != nil {
+		logger.Infof("waiting for the pgs to be clean before raising the weight of osds %v. %+v", ids, err)
+		return nil
+	}
+
+	for _, id := range ids {
+		ramp, err := ramps[id].Step(r.context, r.namespace, id)
+		if err != nil {
+			return err
+		}
+		if err := UpdateWeightRamp(r.context.Clientset, r.namespace, id, ramp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateStatus reports the ramps in progress in the status of the cluster
+func (r *WeightRamper) updateStatus() error {
+	ramps, err := loadWeightRamps(r.context.Clientset, r.namespace)
+	if err != nil {
+		return err
+	}
+	ramping := weightRampStatus(ramps)
+
+	return UpdateClusterStatus(r.context, r.namespace, r.clusterName, func(status *cephv1alpha1.ClusterStatus) bool {
+		if reflect.DeepEqual(status.WeightRamps, ramping) {
+			return false
+		}
+		status.WeightRamps = ramping
+		return true
+	})
+}
+
+// returns the ramps that are in progress, sorted by OSD
+func weightRampStatus(ramps map[int]WeightRamp) []cephv1alpha1.OSDWeightRampStatus {
+	var ids []int
+	for id, ramp := range ramps {
+		if ramp.State != WeightRampStateCompleted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	var status []cephv1alpha1.OSDWeightRampStatus
+	for _, id := range ids {
+		ramp := ramps[id]
+		status = append(status, cephv1alpha1.OSDWeightRampStatus{OSD: id, State: ramp.State, Weight: ramp.Weight,
+			TargetWeight: ramp.TargetWeight})
+	}
+	return status
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	cephv1alpha1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1alpha1"
+	rookfake "github.com/rook/rook/pkg/client/clientset/versioned/fake"
+	"github.com/rook/rook/pkg/clusterd"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	testclient "k8s.io/client-go/testing"
+)
+
+func TestWeightRamp(t *testing.T) {
+	// a new osd of weight 2 is raised in steps of 0.5 from its initial weight
+	ramp := NewWeightRamp(0.5, 2, 0.25)
+	assert.Equal(t, WeightRampStateRampingUp, ramp.State)
+	assert.Equal(t, 0.5, ramp.StepWeight)
+	assert.False(t, ramp.Done())
+	assert.Equal(t, 1.0, ramp.NextWeight())
+
+	// the last step does not go past the full weight
+	ramp.Weight = 1.8
+	assert.Equal(t, 2.0, ramp.NextWeight())
+
+	// a removed osd is drained to 0 in steps of its current weight
+	ramp = NewWeightRamp(3, 0, 0.5)
+	assert.Equal(t, WeightRampStateDraining, ramp.State)
+	assert.Equal(t, 1.5, ramp.StepWeight)
+	assert.Equal(t, 1.5, ramp.NextWeight())
+	ramp.Weight = 1
+	assert.Equal(t, 0.0, ramp.NextWeight())
+
+	// an osd that already has its weight is not ramped
+	ramp = NewWeightRamp(2, 2, 0.1)
+	assert.Equal(t, WeightRampStateCompleted, ramp.State)
+	assert.True(t, ramp.Done())
+}
+
+func TestWeightRamperRampUp(t *testing.T) {
+	clean := false
+	var reweights []string
+	executor := &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+			if args[0] == "status" {
+				if !clean {
+					return `{"pgmap":{"num_pgs":100,"pgs_by_state":[{"state_name":"active+clean","count":90},` +
+						`{"state_name":"active+remapped+backfilling","count":10}]}}`, nil
+				}
+				return `{"pgmap":{"num_pgs":100,"pgs_by_state":[{"state_name":"active+clean","count":100}]}}`, nil
+			}
+			if args[0] == "pg" && args[1] == "dump" {
+				return `[{"pgid":"1.ef","state":"active+clean","up":[1,2,3],"up_primary":1,"acting":[1,2,3],"acting_primary":1}]`, nil
+			}
+			if args[0] == "osd" && args[1] == "crush" && args[2] == "reweight" {
+				reweights = append(reweights, strings.Join(args[3:5], " "))
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %v", args)
+		},
+	}
+	clientset := fake.NewSimpleClientset()
+	rookClientset := rookfake.NewSimpleClientset(&cephv1alpha1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "mycluster", Namespace: "ns"}})
+	r := NewWeightRamper(&clusterd.Context{Clientset: clientset, RookClientset: rookClientset, Executor: executor}, "ns", "mycluster")
+
+	// osd.1 is being raised to its full weight, osd.2 is being drained by its agent
+	assert.Nil(t, UpdateWeightRamp(clientset, "ns", 1, NewWeightRamp(0.4, 2, 0.2)))
+	assert.Nil(t, UpdateWeightRamp(clientset, "ns", 2, NewWeightRamp(2, 0, 0.2)))
+
+	// the weight is not raised while data is still moving
+	assert.Nil(t, r.rampUp())
+	assert.Equal(t, 0, len(reweights))
+
+	clean = true
+	assert.Nil(t, r.rampUp())
+	assert.Equal(t, []string{"osd.1 0.8000"}, reweights)
+	ramps, err := loadWeightRamps(clientset, "ns")
+	assert.Nil(t, err)
+	assert.Equal(t, 0.8, ramps[1].Weight)
+	assert.Equal(t, WeightRampStateRampingUp, ramps[1].State)
+	assert.Equal(t, 2.0, ramps[2].Weight)
+
+	// the ramps in progress are reported in the cluster status
+	assert.Nil(t, r.updateStatus())
+	cluster, err := rookClientset.CephV1alpha1().Clusters("ns").Get("mycluster", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []cephv1alpha1.OSDWeightRampStatus{
+		{OSD: 1, State: WeightRampStateRampingUp, Weight: 0.8, TargetWeight: 2},
+		{OSD: 2, State: WeightRampStateDraining, Weight: 2, TargetWeight: 0},
+	}, cluster.Status.WeightRamps)
+
+	// the ramp is completed when the osd reaches its full weight
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, r.rampUp())
+	}
+	assert.Equal(t, []string{"osd.1 0.8000", "osd.1 1.2000", "osd.1 1.6000", "osd.1 2.0000"}, reweights)
+	ramps, err = loadWeightRamps(clientset, "ns")
+	assert.Nil(t, err)
+	assert.Equal(t, WeightRampStateCompleted, ramps[1].State)
+	assert.Nil(t, r.rampUp())
+	assert.Equal(t, 4, len(reweights))
+	assert.Nil(t, r.updateStatus())
+	cluster, err = rookClientset.CephV1alpha1().Clusters("ns").Get("mycluster", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []cephv1alpha1.OSDWeightRampStatus{{OSD: 2, State: WeightRampStateDraining, Weight: 2, TargetWeight: 0}},
+		cluster.Status.WeightRamps)
+
+	// the ramp is forgotten when the osd is removed
+	assert.Nil(t, DeleteWeightRamp(clientset, "ns", 1))
+	ramps, err = loadWeightRamps(clientset, "ns")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ramps))
+}
+
+func TestWeightRampConflict(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	assert.Nil(t, UpdateWeightRamp(clientset, "ns", 1, NewWeightRamp(0.4, 2, 0.2)))
+
+	// the ramps are recorded again when the map was changed by the agent of another node
+	conflicts := 2
+	clientset.PrependReactor("update", "configmaps", func(action testclient.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			conflicts--
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, WeightRampMapName, nil)
+		}
+		return false, nil, nil
+	})
+	assert.Nil(t, UpdateWeightRamp(clientset, "ns", 2, NewWeightRamp(2, 0, 0.2)))
+	assert.Equal(t, 0, conflicts)
+	ramps, err := loadWeightRamps(clientset, "ns")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ramps))
+
+	conflicts = 1
+	assert.Nil(t, DeleteWeightRamp(clientset, "ns", 1))
+	assert.Equal(t, 0, conflicts)
+	ramps, err = loadWeightRamps(clientset, "ns")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ramps))
+
+	// the update gives up when the conflicts do not stop
+	conflicts = statusUpdateRetries + 1
+	assert.NotNil(t, UpdateWeightRamp(clientset, "ns", 3, NewWeightRamp(0.4, 2, 0.2)))
+	assert.Equal(t, 0, conflicts)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"os"
+	"sort"
+
+	cephv1alpha1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1alpha1"
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"github.com/rook/rook/pkg/operator/discover"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+)
+
+// records the devices selected for the osds of the node that discovery found cannot be used by an osd
+func (c *Cluster) recordRejectedDevices(nodeName string, devices []rookalpha.Device) {
+	rejected, err := discover.GetRejectedDevices(c.context, nodeName, devices)
+	if err != nil {
+		logger.Warningf("failed to get the rejected devices of node %s. %+v", nodeName, err)
+		return
+	}
+	for name, reason := range rejected {
+		logger.Warningf("device %s on node %s cannot be used by an osd: %s", name, nodeName, reason)
+	}
+
+	c.rejectedLock.Lock()
+	defer c.rejectedLock.Unlock()
+	if c.rejectedDevices == nil {
+		c.rejectedDevices = map[string]map[string]string{}
+	}
+	c.rejectedDevices[nodeName] = rejected
+}
+
+// records the rejected devices of all the nodes with discovered devices, which are all selected by the osd daemon set
+func (c *Cluster) recordAllRejectedDevices(selection rookalpha.Selection) {
+	allDevices, err := discover.ListDevices(c.context, os.Getenv(k8sutil.PodNamespaceEnvVar), "")
+	if err != nil {
+		logger.Warningf("failed to get the rejected devices. %+v", err)
+		return
+	}
+
+	for nodeName := range allDevices {
+		devices, err := discover.GetAvailableDevices(c.context, nodeName, c.Namespace, selection.Devices, selection.DeviceFilter,
+			selection.DeviceSelector, selection.GetUseAllDevices())
+		if err != nil {
+			logger.Warningf("failed to get the devices of node %s. %+v", nodeName, err)
+			continue
+		}
+		c.recordRejectedDevices(nodeName, devices)
+	}
+}
+
+// RejectedDevices returns the devices selected for the OSDs that cannot be used by an OSD, found during the last
+// orchestration, sorted by node and device name
+func (c *Cluster) RejectedDevices() []cephv1alpha1.RejectedDevice {
+	c.rejectedLock.Lock()
+	defer c.rejectedLock.Unlock()
+
+	var nodes []string
+	for nodeName := range c.rejectedDevices {
+		nodes = append(nodes, nodeName)
+	}
+	sort.Strings(nodes)
+
+	var result []cephv1alpha1.RejectedDevice
+	for _, nodeName := range nodes {
+		var names []string
+		for name := range c.rejectedDevices[nodeName] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			result = append(result, cephv1alpha1.RejectedDevice{Node: nodeName, Name: name, Reason: c.rejectedDevices[nodeName][name]})
+		}
+	}
+	return result
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"os"
+	"testing"
+
+	cephv1alpha1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1alpha1"
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"github.com/rook/rook/pkg/clusterd"
+	discoverDaemon "github.com/rook/rook/pkg/daemon/discover"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRejectedDevices(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	os.Setenv(k8sutil.PodNamespaceEnvVar, "rook-system")
+	defer os.Unsetenv(k8sutil.PodNamespaceEnvVar)
+	devices := map[string]string{
+		"node1": `[{"name":"sdb","rejectedReason":"has a filesystem: xfs"},{"name":"sda","rejectedReason":"read-only device"},{"name":"sdc"}]`,
+		"node0": `[{"name":"sda","rejectedReason":"has partitions not created by rook: sda1"},{"name":"sdb"}]`,
+	}
+	for nodeName, data := range devices {
+		cm := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   discoverDaemon.LocalDiskCMName + nodeName,
+				Labels: map[string]string{k8sutil.AppAttr: discoverDaemon.AppName, discoverDaemon.NodeAttr: nodeName},
+			},
+			Data: map[string]string{discoverDaemon.LocalDiskCMData: data},
+		}
+		_, err := clientset.CoreV1().ConfigMaps("rook-system").Create(cm)
+		assert.Nil(t, err)
+	}
+	c := &Cluster{context: &clusterd.Context{Clientset: clientset}, Namespace: "ns"}
+	assert.Nil(t, c.RejectedDevices())
+
+	// only the selected devices are rejected
+	c.recordRejectedDevices("node1", []rookalpha.Device{{Name: "sdb"}, {Name: "sdc"}})
+	assert.Equal(t, []cephv1alpha1.RejectedDevice{{Node: "node1", Name: "sdb", Reason: "has a filesystem: xfs"}}, c.RejectedDevices())
+
+	// all the devices of all the nodes are selected
+	useAllDevices := true
+	c.recordAllRejectedDevices(rookalpha.Selection{UseAllDevices: &useAllDevices})
+	assert.Equal(t, []cephv1alpha1.RejectedDevice{
+		{Node: "node0", Name: "sda", Reason: "has partitions not created by rook: sda1"},
+		{Node: "node1", Name: "sda", Reason: "read-only device"},
+		{Node: "node1", Name: "sdb", Reason: "has a filesystem: xfs"},
+	}, c.RejectedDevices())
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"github.com/rook/rook/pkg/daemon/ceph/client"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ReplaceOSDsAnnotation is the annotation on the cluster with the comma separated IDs of the OSDs whose failed devices
+	// are being replaced
+	ReplaceOSDsAnnotation  = "ceph.rook.io/replace-osds"
+	replaceOSDsEnvVarName  = "ROOK_REPLACE_OSDS"
+	destroyedOSDsMapName   = "rook-ceph-osd-destroyed"
+	destroyedOSDsMapVal    = "destroyed"
+	destroyedOSDsMapKeyFmt = "osd.%d"
+)
+
+// ParseReplaceOSDs parses the comma separated OSD IDs of the replace OSDs annotation. Invalid IDs are skipped.
+func ParseReplaceOSDs(value string) []int {
+	var ids []int
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		id, err := strconv.Atoi(s)
+		if err != nil || id < 0 {
+			logger.Warningf("skipping invalid osd id %q to replace", s)
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+	return ids
+}
+
+// destroyReplacedOSDs marks out and destroys the OSDs that are being replaced. A destroyed OSD keeps its ID and its
+// position and weight in the CRUSH map, which are given to the new device that replaces the failed device so that the
+// data only moves once. Each OSD is only destroyed once while it is being replaced, the record of it is cleared when the
+// OSD is removed from the annotation.
+func (c *Cluster) destroyReplacedOSDs() error {
+	cm, err := c.context.Clientset.CoreV1().ConfigMaps(c.Namespace).Get(destroyedOSDsMapName, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to get the destroyed osds. %+v", err)
+		}
+		if len(c.ReplaceOSDs) == 0 {
+			return nil
+		}
+
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            destroyedOSDsMapName,
+				Namespace:       c.Namespace,
+				OwnerReferences: []metav1.OwnerReference{c.ownerRef},
+			},
+			Data: map[string]string{},
+		}
+		if cm, err = c.context.Clientset.CoreV1().ConfigMaps(c.Namespace).Create(cm); err != nil {
+			return fmt.Errorf("failed to create the destroyed osds map. %+v", err)
+		}
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+
+	// forget the OSDs that are no longer being replaced
+	changed := false
+	for key := range cm.Data {
+		if !c.isReplacingOSDKey(key) {
+			delete(cm.Data, key)
+			changed = true
+		}
+	}
+
+	var destroyErr error
+	for _, id := range c.ReplaceOSDs {
+		key := fmt.Sprintf(destroyedOSDsMapKeyFmt, id)
+		if _, ok := cm.Data[key]; ok {
+			// the OSD was already destroyed, it may already be running on its new device
+			continue
+		}
+
+		if err := c.destroyOSD(id); err != nil {
+			destroyErr = err
+			continue
+		}
+		cm.Data[key] = destroyedOSDsMapVal
+		changed = true
+	}
+
+	if changed {
+		if _, err := c.context.Clientset.CoreV1().ConfigMaps(c.Namespace).Update(cm); err != nil {
+			return fmt.Errorf("failed to update the destroyed osds map. %+v", err)
+		}
+	}
+
+	return destroyErr
+}
+
+func (c *Cluster) destroyOSD(id int) error {
+	dump, err := client.GetOSDDump(c.context, c.Namespace)
+	if err != nil {
+		return fmt.Errorf("failed to get the osd map to replace osd.%d. %+v", id, err)
+	}
+	up, _, err := dump.StatusByID(int64(id))
+	if err != nil {
+		return fmt.Errorf("failed to replace osd.%d. %+v", id, err)
+	}
+	if dump.IsDestroyed(id) {
+		logger.Infof("osd.%d was already destroyed", id)
+		return nil
+	}
+	if up == 1 {
+		return fmt.Errorf("osd.%d is still up, it can only be replaced after its device failed", id)
+	}
+
+	logger.Infof("destroying osd.%d to replace its device", id)
+	if o, err := client.OSDOut(c.context, c.Namespace, id); err != nil {
+		return fmt.Errorf("failed to mark osd.%d out. %+v. %s", id, err, o)
+	}
+	if o, err := client.OSDDestroy(c.context, c.Namespace, id); err != nil {
+		return fmt.Errorf("failed to destroy osd.%d. %+v. %s", id, err, o)
+	}
+
+	return nil
+}
+
+func (c *Cluster) isReplacingOSDKey(key string) bool {
+	for _, id := range c.ReplaceOSDs {
+		if key == fmt.Sprintf(destroyedOSDsMapKeyFmt, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// getReplacedOSDsForNode gets the OSDs that are being replaced on the given node, including the OSDs whose failed
+// devices were already dropped by the node and that are waiting for a new device
+func (c *Cluster) getReplacedOSDsForNode(node rookalpha.Node) ([]int, error) {
+	if len(c.ReplaceOSDs) == 0 {
+		return nil, nil
+	}
+
+	kv := k8sutil.NewConfigMapKVStore(c.Namespace, c.context.Clientset, c.ownerRef)
+	scheme, err := config.LoadScheme(kv, config.GetConfigStoreName(node.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the partition scheme of node %s. %+v", node.Name, err)
+	}
+
+	onNode := map[int]bool{}
+	for _, entry := range scheme.Entries {
+		onNode[entry.ID] = true
+	}
+	for _, id := range scheme.ReplacedOSDs {
+		onNode[id] = true
+	}
+
+	var ids []int
+	for _, id := range c.ReplaceOSDs {
+		if onNode[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// setReplaceOSDsEnvVar passes the OSDs that are being replaced on a node to its agent
+func setReplaceOSDsEnvVar(podSpec *v1.PodTemplateSpec, ids []int) {
+	if len(ids) == 0 {
+		return
+	}
+
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = strconv.Itoa(id)
+	}
+	container := &podSpec.Spec.Containers[0]
+	container.Env = append(container.Env, v1.EnvVar{Name: replaceOSDsEnvVarName, Value: strings.Join(values, ",")})
+}
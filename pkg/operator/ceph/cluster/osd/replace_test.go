@@ -0,0 +1,120 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseReplaceOSDs(t *testing.T) {
+	assert.Equal(t, []int{1, 3, 12}, ParseReplaceOSDs("12, 3,1"))
+	assert.Equal(t, []int{4}, ParseReplaceOSDs("4,osd.5,-1,"))
+	assert.Nil(t, ParseReplaceOSDs(""))
+}
+
+func TestDestroyReplacedOSDs(t *testing.T) {
+	// osd.1 and osd.2 are down, osd.3 is still up
+	commands := []string{}
+	executor := &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+			if args[0] == "osd" && args[1] == "dump" {
+				return `{"osds":[{"osd":1,"up":0,"in":1,"state":["exists"]},{"osd":2,"up":0,"in":0,"state":["destroyed","exists"]},` +
+					`{"osd":3,"up":1,"in":1,"state":["exists","up"]}]}`, nil
+			}
+			if args[0] == "osd" && (args[1] == "out" || args[1] == "destroy") {
+				commands = append(commands, strings.Join(args[:3], " "))
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %v", args)
+		},
+	}
+	clientset := fake.NewSimpleClientset()
+	c := New(&clusterd.Context{Clientset: clientset, Executor: executor}, "ns", "myversion",
+		rookalpha.StorageScopeSpec{}, "", rookalpha.Placement{}, false, v1.ResourceRequirements{}, metav1.OwnerReference{})
+
+	// nothing is recorded while no osds are being replaced
+	err := c.destroyReplacedOSDs()
+	assert.Nil(t, err)
+	_, err = clientset.CoreV1().ConfigMaps(c.Namespace).Get(destroyedOSDsMapName, metav1.GetOptions{})
+	assert.NotNil(t, err)
+
+	// osd.1 is destroyed, osd.2 was already destroyed and osd.3 cannot be destroyed while it is up
+	c.ReplaceOSDs = []int{1, 2, 3}
+	err = c.destroyReplacedOSDs()
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"osd out 1", "osd destroy 1"}, commands)
+	cm, err := clientset.CoreV1().ConfigMaps(c.Namespace).Get(destroyedOSDsMapName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"osd.1": "destroyed", "osd.2": "destroyed"}, cm.Data)
+
+	// the destroyed osds are not destroyed again, even after they were recreated on their new devices
+	commands = []string{}
+	c.ReplaceOSDs = []int{1, 2}
+	err = c.destroyReplacedOSDs()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(commands))
+
+	// the record is cleared when the osds are no longer being replaced
+	c.ReplaceOSDs = []int{2}
+	err = c.destroyReplacedOSDs()
+	assert.Nil(t, err)
+	cm, err = clientset.CoreV1().ConfigMaps(c.Namespace).Get(destroyedOSDsMapName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"osd.2": "destroyed"}, cm.Data)
+}
+
+func TestReplacedOSDsForNode(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	c := New(&clusterd.Context{Clientset: clientset, Executor: &exectest.MockExecutor{}}, "ns", "myversion",
+		rookalpha.StorageScopeSpec{}, "", rookalpha.Placement{}, false, v1.ResourceRequirements{}, metav1.OwnerReference{})
+
+	// osd.1 runs on node1 and the failed device of osd.2 was already dropped
+	kv := k8sutil.NewConfigMapKVStore(c.Namespace, clientset, metav1.OwnerReference{})
+	scheme := config.NewPerfScheme()
+	entry := config.NewPerfSchemeEntry(config.Bluestore)
+	entry.ID = 1
+	scheme.Entries = append(scheme.Entries, entry)
+	scheme.ReplacedOSDs = []int{2}
+	assert.Nil(t, scheme.SaveScheme(kv, config.GetConfigStoreName("node1")))
+
+	c.ReplaceOSDs = []int{1, 2, 5}
+	ids, err := c.getReplacedOSDsForNode(rookalpha.Node{Name: "node1"})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2}, ids)
+	ids, err = c.getReplacedOSDsForNode(rookalpha.Node{Name: "node2"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ids))
+
+	// the ids are passed to the agent of the node
+	rs := c.makeReplicaSet("node1", []rookalpha.Device{{Name: "sda"}}, rookalpha.Selection{}, v1.ResourceRequirements{},
+		config.StoreConfig{}, "", "")
+	setReplaceOSDsEnvVar(&rs.Spec.Template, []int{1, 2})
+	assert.Equal(t, "1,2", envVarValues(rs.Spec.Template.Spec.Containers[0].Env)[replaceOSDsEnvVarName])
+}
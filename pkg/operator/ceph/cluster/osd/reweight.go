@@ -0,0 +1,209 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	cephv1alpha1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1alpha1"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/client"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultReweightMaxChange = 0.05
+	defaultReweightThreshold = 0.05
+	maxOverrideReweight      = 1.0
+
+	reweightEventReason = "OSDReweighted"
+)
+
+var (
+	// ReweightInterval is the interval at which the utilization of the OSDs is checked for reweighting
+	ReweightInterval = 10 * time.Minute
+)
+
+// a change of the weight of an OSD decided from its utilization
+type osdReweight struct {
+	id          int
+	utilization float64
+	ratio       float64
+	weight      float64
+	newWeight   float64
+}
+
+// Reweighter changes the weight of the OSDs whose utilization drifts from the average utilization of the cluster
+type Reweighter struct {
+	context     *clusterd.Context
+	namespace   string
+	clusterName string
+}
+
+// NewReweighter creates a new Reweighter object
+func NewReweighter(context *clusterd.Context, namespace, clusterName string) *Reweighter {
+	return &Reweighter{context: context, namespace: namespace, clusterName: clusterName}
+}
+
+// Run periodically reweights the OSDs when reweighting is enabled in the cluster spec
+func (r *Reweighter) Run(stopCh chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			logger.Infof("stopping the osd reweighting in namespace %s", r.namespace)
+			return
+
+		case <-time.After(ReweightInterval):
+			if err := r.reweight(); err != nil {
+				logger.Warningf("failed to reweight osds. %+v", err)
+			}
+		}
+	}
+}
+
+func (r *Reweighter) reweight() error {
+	// the spec is read at every cycle so that the reweighting can be turned on and off while the cluster is running
+	cluster, err := r.context.RookClientset.CephV1alpha1().Clusters(r.namespace).Get(r.clusterName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get cluster %s. %+v", r.clusterName, err)
+	}
+	spec := cluster.Spec.Reweight
+	if !spec.Enabled {
+		return nil
+	}
+
+	// the utilization is only measured again after the data from the last changes finished moving
+	if err := CheckPGsClean(r.context, r.namespace); err != nil {
+		logger.Infof("waiting for the pgs to be clean before reweighting the osds. %+v", err)
+		return nil
+	}
+
+	ramps, err := loadWeightRamps(r.context.Clientset, r.namespace)
+	if err != nil {
+		return err
+	}
+	usage, err := client.GetOSDUsage(r.context, r.namespace)
+	if err != nil {
+		return fmt.Errorf("failed to get the osd usage. %+v", err)
+	}
+	changes, err := computeReweights(usage, spec, ramps)
+	if err != nil {
+		return err
+	}
+
+	weightName := "reweight"
+	if spec.UseCrushWeight {
+		weightName = "crush weight"
+	}
+	ref := v1.ObjectReference{
+		APIVersion: cephv1alpha1.SchemeGroupVersion.String(),
+		Kind:       "Cluster",
+		Name:       cluster.Name,
+		Namespace:  cluster.Namespace,
+		UID:        cluster.UID,
+	}
+	for _, c := range changes {
+		if spec.UseCrushWeight {
+			_, err = client.CrushReweight(r.context, r.namespace, c.id, c.newWeight)
+		} else {
+			_, err = client.OSDReweight(r.context, r.namespace, c.id, c.newWeight)
+		}
+		if err != nil {
+			return err
+		}
+
+		message := fmt.Sprintf("osd.%d is %.1f%% full, %.2f times the average utilization. its %s changed from %.4f to %.4f",
+			c.id, c.utilization, c.ratio, weightName, c.weight, c.newWeight)
+		logger.Info(message)
+		if err := k8sutil.RecordEvent(r.context.Clientset, ref, v1.EventTypeNormal, reweightEventReason, message); err != nil {
+			logger.Warningf("%+v", err)
+		}
+	}
+	return nil
+}
+
+// computes the new weight of the OSDs whose utilization is too far from the average. Each weight is moved towards the
+// weight that would bring the OSD to the average utilization, by at most the max change of the spec.
+func computeReweights(usage *client.OSDUsage, spec cephv1alpha1.ReweightSpec, ramps map[int]WeightRamp) ([]osdReweight, error) {
+	maxChange := spec.MaxChange
+	if maxChange <= 0 {
+		maxChange = defaultReweightMaxChange
+	}
+	threshold := spec.Threshold
+	if threshold <= 0 {
+		threshold = defaultReweightThreshold
+	}
+
+	average, err := usage.Summary.AverageUtil.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the average utilization %s. %+v", usage.Summary.AverageUtil, err)
+	}
+	if average <= 0 {
+		return nil, nil
+	}
+
+	var changes []osdReweight
+	for _, osd := range usage.OSDNodes {
+		// the weight of the osds being raised or drained in steps is left to their ramps
+		if ramp, ok := ramps[osd.ID]; ok && ramp.State != WeightRampStateCompleted {
+			continue
+		}
+
+		utilization, err := osd.Utilization.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the utilization of osd.%d. %+v", osd.ID, err)
+		}
+		crushWeight, err := osd.CrushWeight.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the crush weight of osd.%d. %+v", osd.ID, err)
+		}
+		reweight, err := osd.Reweight.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the reweight of osd.%d. %+v", osd.ID, err)
+		}
+
+		// osds that are out or do not have any data yet are not measured
+		if crushWeight <= 0 || reweight <= 0 || utilization <= 0 {
+			continue
+		}
+		ratio := utilization / average
+		if math.Abs(ratio-1) <= threshold {
+			continue
+		}
+
+		weight := reweight
+		if spec.UseCrushWeight {
+			weight = crushWeight
+		}
+		factor := math.Max(1-maxChange, math.Min(1+maxChange, 1/ratio))
+		newWeight := RoundWeight(weight * factor)
+		if !spec.UseCrushWeight && newWeight > maxOverrideReweight {
+			newWeight = maxOverrideReweight
+		}
+		if newWeight == RoundWeight(weight) {
+			continue
+		}
+
+		changes = append(changes, osdReweight{id: osd.ID, utilization: utilization, ratio: ratio, weight: weight, newWeight: newWeight})
+	}
+	return changes, nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	cephv1alpha1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1alpha1"
+	rookfake "github.com/rook/rook/pkg/client/clientset/versioned/fake"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/client"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const osdDfOutput = `{"nodes":[
+{"id":0,"name":"osd.0","crush_weight":2.0,"reweight":1.0,"utilization":60.0},
+{"id":1,"name":"osd.1","crush_weight":1.0,"reweight":0.9,"utilization":40.0},
+{"id":2,"name":"osd.2","crush_weight":1.0,"reweight":1.0,"utilization":51.0},
+{"id":3,"name":"osd.3","crush_weight":1.0,"reweight":1.0,"utilization":70.0},
+{"id":4,"name":"osd.4","crush_weight":1.0,"reweight":1.0,"utilization":30.0},
+{"id":5,"name":"osd.5","crush_weight":1.0,"reweight":0.0,"utilization":0.0}],
+"summary":{"average_utilization":50.0}}`
+
+func TestComputeReweights(t *testing.T) {
+	executor := &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+			return osdDfOutput, nil
+		},
+	}
+	usage, err := client.GetOSDUsage(&clusterd.Context{Executor: executor}, "ns")
+	assert.Nil(t, err)
+	ramps := map[int]WeightRamp{3: NewWeightRamp(0.5, 1, 0.5)}
+
+	// the reweight is moved towards the average utilization by the default max change. osd.2 is close enough to the
+	// average, osd.3 is still being ramped up, osd.4 is already at the highest reweight and osd.5 is out.
+	changes, err := computeReweights(usage, cephv1alpha1.ReweightSpec{}, ramps)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(changes))
+	assert.Equal(t, 0, changes[0].id)
+	assert.Equal(t, 1.2, changes[0].ratio)
+	assert.Equal(t, 0.95, changes[0].newWeight)
+	assert.Equal(t, 1, changes[1].id)
+	assert.Equal(t, 0.945, changes[1].newWeight)
+
+	// the crush weight can be changed instead, within the configured max change and threshold
+	spec := cephv1alpha1.ReweightSpec{UseCrushWeight: true, MaxChange: 0.1, Threshold: 0.3}
+	changes, err = computeReweights(usage, spec, ramps)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(changes))
+	assert.Equal(t, 4, changes[0].id)
+	assert.Equal(t, 1.0, changes[0].weight)
+	assert.Equal(t, 1.1, changes[0].newWeight)
+
+	spec.Threshold = 0.1
+	changes, err = computeReweights(usage, spec, ramps)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(changes))
+	assert.Equal(t, 1.8, changes[0].newWeight)
+}
+
+func TestReweighterReweight(t *testing.T) {
+	var reweights []string
+	executor := &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+			if args[0] == "status" {
+				return `{"pgmap":{"num_pgs":100,"pgs_by_state":[{"state_name":"active+clean","count":100}]}}`, nil
+			}
+			if args[0] == "pg" && args[1] == "dump" {
+				return `[{"pgid":"1.ef","state":"active+clean","up":[1,2,3],"up_primary":1,"acting":[1,2,3],"acting_primary":1}]`, nil
+			}
+			if args[0] == "osd" && args[1] == "df" {
+				return osdDfOutput, nil
+			}
+			if args[0] == "osd" && args[1] == "reweight" {
+				reweights = append(reweights, strings.Join(args[2:4], " "))
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %v", args)
+		},
+	}
+	cluster := &cephv1alpha1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "mycluster", Namespace: "ns"}}
+	rookClientset := rookfake.NewSimpleClientset(cluster)
+	clientset := fake.NewSimpleClientset()
+	context := &clusterd.Context{Clientset: clientset, RookClientset: rookClientset, Executor: executor}
+	r := NewReweighter(context, "ns", "mycluster")
+
+	// nothing is done until the reweighting is enabled
+	assert.Nil(t, r.reweight())
+	assert.Equal(t, 0, len(reweights))
+
+	cluster.Spec.Reweight = cephv1alpha1.ReweightSpec{Enabled: true}
+	_, err := rookClientset.CephV1alpha1().Clusters("ns").Update(cluster)
+	assert.Nil(t, err)
+	assert.Nil(t, r.reweight())
+	assert.Equal(t, []string{"0 0.9500", "1 0.9450"}, reweights)
+
+	// each decision is reported as an event on the cluster
+	events, err := clientset.CoreV1().Events("ns").List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events.Items))
+	for _, event := range events.Items {
+		assert.Equal(t, reweightEventReason, event.Reason)
+		assert.Equal(t, "mycluster", event.InvolvedObject.Name)
+		assert.Contains(t, event.Message, "reweight changed from")
+	}
+}
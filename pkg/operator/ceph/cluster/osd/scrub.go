@@ -0,0 +1,366 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cephv1alpha1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1alpha1"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/daemon/ceph/client"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// the ceph defaults of the scrub hours, which allow the osds to scrub at any hour
+	defaultScrubBeginHour = 0
+	defaultScrubEndHour   = 24
+
+	// ScrubHoursMapName is the name of the config map with the scrub hours last applied to the OSDs, which the agents
+	// set in the config of the OSDs they start
+	ScrubHoursMapName = "rook-ceph-osd-scrub-hours"
+	// ScrubBeginHourKey is the key of the hour at which the OSDs start to scrub in the scrub hours map
+	ScrubBeginHourKey = "beginHour"
+	// ScrubEndHourKey is the key of the hour at which the OSDs stop starting scrubs in the scrub hours map
+	ScrubEndHourKey = "endHour"
+)
+
+var (
+	// ScrubScheduleInterval is the interval at which the scrub schedule is enforced
+	ScrubScheduleInterval = 60 * time.Second
+
+	// the namespaces in which the osds are being orchestrated with scrubbing disabled. The scrub schedule does not
+	// change the scrub flags until the orchestration is done.
+	scrubHolds = struct {
+		sync.Mutex
+		count map[string]int
+	}{count: map[string]int{}}
+)
+
+// the scrub settings applied to the osds
+type scrubSettings struct {
+	permitted bool
+	beginHour int
+	endHour   int
+}
+
+// ScrubScheduler allows the OSDs to scrub only in the windows of the scrub schedule of the cluster
+type ScrubScheduler struct {
+	context     *clusterd.Context
+	namespace   string
+	clusterName string
+	// the settings last applied to the osds, nil until they are applied
+	applied *scrubSettings
+}
+
+// NewScrubScheduler creates a new ScrubScheduler object
+func NewScrubScheduler(context *clusterd.Context, namespace, clusterName string) *ScrubScheduler {
+	return &ScrubScheduler{context: context, namespace: namespace, clusterName: clusterName}
+}
+
+// Run periodically sets the scrub flags and hours of the OSDs from the scrub schedule in the cluster spec
+func (s *ScrubScheduler) Run(stopCh chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			logger.Infof("stopping the scrub schedule in namespace %s", s.namespace)
+			return
+
+		case <-time.After(ScrubScheduleInterval):
+			if err := s.enforce(time.Now()); err != nil {
+				logger.Warningf("failed to enforce the scrub schedule. %+v", err)
+			}
+		}
+	}
+}
+
+func (s *ScrubScheduler) enforce(now time.Time) error {
+	cluster, err := s.context.RookClientset.CephV1alpha1().Clusters(s.namespace).Get(s.clusterName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get cluster %s. %+v", s.clusterName, err)
+	}
+
+	// without a schedule the scrub flags are left alone, unless they were set by a schedule that was removed
+	schedule := cluster.Spec.ScrubSchedule
+	if schedule == nil && s.applied == nil && cluster.Status.ScrubPermitted == nil {
+		return nil
+	}
+
+	settings := scrubSettings{permitted: true, beginHour: defaultScrubBeginHour, endHour: defaultScrubEndHour}
+	if schedule != nil {
+		settings.permitted, err = scrubPermitted(schedule, now)
+		if err != nil {
+			return fmt.Errorf("invalid scrub schedule. %+v", err)
+		}
+		settings.beginHour, settings.endHour = osdScrubHours(schedule, now)
+	}
+
+	if scrubScheduleHeld(s.namespace) {
+		// the flags are applied again after the orchestration restored them
+		logger.Debugf("not enforcing the scrub schedule during the osd orchestration")
+		s.applied = nil
+		return nil
+	}
+
+	if s.applied == nil || *s.applied != settings {
+		if err := s.apply(settings); err != nil {
+			return err
+		}
+	}
+	if schedule == nil {
+		s.applied = nil
+	}
+	return s.updateStatus(schedule != nil, settings.permitted)
+}
+
+func (s *ScrubScheduler) apply(settings scrubSettings) error {
+	// the hours are injected into the osds that are running and recorded for the osds that start later, the scrub
+	// flags are enforced for all of them
+	if o, err := client.SetScrubHours(s.context, s.namespace, settings.beginHour, settings.endHour); err != nil {
+		logger.Warningf("failed to set the scrub hours of the osds to %d-%d. %+v. %s", settings.beginHour, settings.endHour, err, o)
+	}
+	if err := saveScrubHours(s.context.Clientset, s.namespace, settings.beginHour, settings.endHour); err != nil {
+		logger.Warningf("failed to record the scrub hours of the osds. %+v", err)
+	}
+
+	if settings.permitted {
+		logger.Infof("allowing the osds to scrub")
+		if o, err := client.EnableScrubbing(s.context, s.namespace); err != nil {
+			return fmt.Errorf("failed to enable scrubbing. %+v. %s", err, o)
+		}
+	} else {
+		logger.Infof("preventing the osds from scrubbing outside of the scrub schedule")
+		if o, err := client.DisableScrubbing(s.context, s.namespace); err != nil {
+			return fmt.Errorf("failed to disable scrubbing. %+v. %s", err, o)
+		}
+	}
+
+	s.applied = &settings
+	return nil
+}
+
+func (s *ScrubScheduler) updateStatus(scheduled, permitted bool) error {
+	var scrubPermitted *bool
+	if scheduled {
+		scrubPermitted = &permitted
+	}
+
+	return UpdateClusterStatus(s.context, s.namespace, s.clusterName, func(status *cephv1alpha1.ClusterStatus) bool {
+		old := status.ScrubPermitted
+		if (scrubPermitted == nil && old == nil) || (scrubPermitted != nil && old != nil && *scrubPermitted == *old) {
+			return false
+		}
+		status.ScrubPermitted = scrubPermitted
+		return true
+	})
+}
+
+// returns whether the schedule allows the osds to scrub at the given time. Scrubbing is always allowed without a
+// schedule.
+func scrubPermitted(schedule *cephv1alpha1.ScrubScheduleSpec, now time.Time) (bool, error) {
+	if schedule == nil {
+		return true, nil
+	}
+	if err := validateScrubSchedule(schedule); err != nil {
+		return false, err
+	}
+
+	local := now.In(scrubScheduleLocation(schedule))
+	if len(schedule.Hours) == 0 {
+		return scrubDayPermitted(schedule, local.Weekday()), nil
+	}
+	for _, hours := range schedule.Hours {
+		if !hourInRange(local.Hour(), hours) {
+			continue
+		}
+
+		// the hours after midnight of a range that wraps past midnight belong to the day the range began on
+		day := local.Weekday()
+		if hours.Begin > hours.End && local.Hour() < hours.End {
+			day = (day + 6) % 7
+		}
+		if scrubDayPermitted(schedule, day) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// returns whether the schedule allows scrubbing on the day. Scrubbing is allowed on all days when no days are set.
+func scrubDayPermitted(schedule *cephv1alpha1.ScrubScheduleSpec, day time.Weekday) bool {
+	if len(schedule.Days) == 0 {
+		return true
+	}
+	for _, d := range schedule.Days {
+		if weekday, _ := parseWeekday(d); weekday == day {
+			return true
+		}
+	}
+	return false
+}
+
+// records the scrub hours applied to the osds
+func saveScrubHours(clientset kubernetes.Interface, namespace string, beginHour, endHour int) error {
+	data := map[string]string{ScrubBeginHourKey: strconv.Itoa(beginHour), ScrubEndHourKey: strconv.Itoa(endHour)}
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ScrubHoursMapName, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to get the scrub hours map. %+v", err)
+		}
+		cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: ScrubHoursMapName, Namespace: namespace}, Data: data}
+		if _, err := clientset.CoreV1().ConfigMaps(namespace).Create(cm); err != nil {
+			return fmt.Errorf("failed to create the scrub hours map. %+v", err)
+		}
+		return nil
+	}
+
+	cm.Data = data
+	if _, err := clientset.CoreV1().ConfigMaps(namespace).Update(cm); err != nil {
+		return fmt.Errorf("failed to update the scrub hours map. %+v", err)
+	}
+	return nil
+}
+
+// returns the scrub hours of the osds from the hour range of the schedule that contains the given time, or else the
+// range that begins next. The hours are converted from the time zone of the schedule to UTC, the time of the osds.
+// Since the osds only take whole hours, a range in a time zone whose offset is not a whole number of hours is widened
+// to the whole UTC hours that contain it. The scrub flags still keep the osds from scrubbing outside of the range.
+func osdScrubHours(schedule *cephv1alpha1.ScrubScheduleSpec, now time.Time) (int, int) {
+	if len(schedule.Hours) == 0 {
+		return defaultScrubBeginHour, defaultScrubEndHour
+	}
+
+	local := now.In(scrubScheduleLocation(schedule))
+	hours := schedule.Hours[0]
+	nextBegin := 24
+	for _, h := range schedule.Hours {
+		if hourInRange(local.Hour(), h) {
+			hours = h
+			break
+		}
+		if wait := (h.Begin - local.Hour() + 24) % 24; wait < nextBegin {
+			nextBegin = wait
+			hours = h
+		}
+	}
+
+	if hours.Begin == hours.End {
+		return defaultScrubBeginHour, defaultScrubEndHour
+	}
+	_, offset := local.Zone()
+	begin := hours.Begin*3600 - offset
+	end := hours.End*3600 - offset
+	return utcHour(floorDiv(begin, 3600)), utcHour(floorDiv(end+3599, 3600))
+}
+
+// returns the quotient rounded down, also for negative numbers
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b < 0 {
+		q--
+	}
+	return q
+}
+
+// returns the hour of the day of an hour that may be on the previous or next day
+func utcHour(hour int) int {
+	return (hour%24 + 24) % 24
+}
+
+// returns whether the hour is in the range. As with the scrub hours of ceph, a range that ends at the hour it begins
+// covers the whole day.
+func hourInRange(hour int, hours cephv1alpha1.HourRange) bool {
+	if hours.Begin == hours.End {
+		return true
+	}
+	if hours.Begin < hours.End {
+		return hour >= hours.Begin && hour < hours.End
+	}
+	return hour >= hours.Begin || hour < hours.End
+}
+
+func validateScrubSchedule(schedule *cephv1alpha1.ScrubScheduleSpec) error {
+	if schedule.TimeZone != "" {
+		if _, err := time.LoadLocation(schedule.TimeZone); err != nil {
+			return fmt.Errorf("unknown time zone %s. %+v", schedule.TimeZone, err)
+		}
+	}
+	for _, day := range schedule.Days {
+		if _, err := parseWeekday(day); err != nil {
+			return err
+		}
+	}
+	for _, hours := range schedule.Hours {
+		if hours.Begin < 0 || hours.Begin > 23 || hours.End < 0 || hours.End > 24 {
+			return fmt.Errorf("invalid hour range %d-%d", hours.Begin, hours.End)
+		}
+	}
+	return nil
+}
+
+func scrubScheduleLocation(schedule *cephv1alpha1.ScrubScheduleSpec) *time.Location {
+	if schedule.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(schedule.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// parses the full or three letter name of a day of the week
+func parseWeekday(day string) (time.Weekday, error) {
+	day = strings.ToLower(day)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if day == name || day == name[:3] {
+			return d, nil
+		}
+	}
+	return time.Sunday, fmt.Errorf("invalid day of the week %s", day)
+}
+
+// prevents the scrub schedule from changing the scrub flags while the osds are orchestrated
+func holdScrubSchedule(namespace string) {
+	scrubHolds.Lock()
+	defer scrubHolds.Unlock()
+	scrubHolds.count[namespace]++
+}
+
+func releaseScrubSchedule(namespace string) {
+	scrubHolds.Lock()
+	defer scrubHolds.Unlock()
+	scrubHolds.count[namespace]--
+	if scrubHolds.count[namespace] <= 0 {
+		delete(scrubHolds.count, namespace)
+	}
+}
+
+func scrubScheduleHeld(namespace string) bool {
+	scrubHolds.Lock()
+	defer scrubHolds.Unlock()
+	return scrubHolds.count[namespace] > 0
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	cephv1alpha1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1alpha1"
+	rookfake "github.com/rook/rook/pkg/client/clientset/versioned/fake"
+	"github.com/rook/rook/pkg/clusterd"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestScrubPermitted(t *testing.T) {
+	// saturday 2018-06-16 at 23:30 UTC, which is sunday 08:30 in tokyo
+	now := time.Date(2018, 6, 16, 23, 30, 0, 0, time.UTC)
+
+	permitted, err := scrubPermitted(nil, now)
+	assert.Nil(t, err)
+	assert.True(t, permitted)
+
+	// the hours wrap past midnight
+	schedule := &cephv1alpha1.ScrubScheduleSpec{Hours: []cephv1alpha1.HourRange{{Begin: 22, End: 6}}}
+	permitted, err = scrubPermitted(schedule, now)
+	assert.Nil(t, err)
+	assert.True(t, permitted)
+	schedule.Hours = []cephv1alpha1.HourRange{{Begin: 1, End: 6}, {Begin: 12, End: 23}}
+	permitted, err = scrubPermitted(schedule, now)
+	assert.Nil(t, err)
+	assert.False(t, permitted)
+
+	// the days and hours are in the time zone of the schedule
+	schedule = &cephv1alpha1.ScrubScheduleSpec{Days: []string{"Saturday"}}
+	permitted, err = scrubPermitted(schedule, now)
+	assert.Nil(t, err)
+	assert.True(t, permitted)
+	schedule.TimeZone = "Asia/Tokyo"
+	permitted, err = scrubPermitted(schedule, now)
+	assert.Nil(t, err)
+	assert.False(t, permitted)
+	schedule.Days = []string{"sat", "sun"}
+	schedule.Hours = []cephv1alpha1.HourRange{{Begin: 8, End: 9}}
+	permitted, err = scrubPermitted(schedule, now)
+	assert.Nil(t, err)
+	assert.True(t, permitted)
+
+	// a range that wraps past midnight continues on the next day, which is checked as the day the range began on
+	schedule = &cephv1alpha1.ScrubScheduleSpec{Days: []string{"saturday"}, Hours: []cephv1alpha1.HourRange{{Begin: 22, End: 6}}}
+	permitted, err = scrubPermitted(schedule, now)
+	assert.Nil(t, err)
+	assert.True(t, permitted)
+	sundayNight := time.Date(2018, 6, 17, 3, 0, 0, 0, time.UTC)
+	permitted, err = scrubPermitted(schedule, sundayNight)
+	assert.Nil(t, err)
+	assert.True(t, permitted)
+	permitted, err = scrubPermitted(schedule, sundayNight.Add(24*time.Hour))
+	assert.Nil(t, err)
+	assert.False(t, permitted)
+	permitted, err = scrubPermitted(schedule, time.Date(2018, 6, 16, 3, 0, 0, 0, time.UTC))
+	assert.Nil(t, err)
+	assert.False(t, permitted)
+
+	// invalid schedules
+	_, err = scrubPermitted(&cephv1alpha1.ScrubScheduleSpec{Days: []string{"someday"}}, now)
+	assert.NotNil(t, err)
+	_, err = scrubPermitted(&cephv1alpha1.ScrubScheduleSpec{Hours: []cephv1alpha1.HourRange{{Begin: 24, End: 2}}}, now)
+	assert.NotNil(t, err)
+	_, err = scrubPermitted(&cephv1alpha1.ScrubScheduleSpec{TimeZone: "Nowhere/Atlantis"}, now)
+	assert.NotNil(t, err)
+}
+
+func TestOSDScrubHours(t *testing.T) {
+	now := time.Date(2018, 6, 16, 23, 30, 0, 0, time.UTC)
+
+	// the osds can scrub at any hour when the schedule does not restrict the hours
+	begin, end := osdScrubHours(&cephv1alpha1.ScrubScheduleSpec{Days: []string{"saturday"}}, now)
+	assert.Equal(t, 0, begin)
+	assert.Equal(t, 24, end)
+
+	// the range that contains the current hour is used, or else the range that begins next
+	schedule := &cephv1alpha1.ScrubScheduleSpec{Hours: []cephv1alpha1.HourRange{{Begin: 12, End: 14}, {Begin: 22, End: 24}}}
+	begin, end = osdScrubHours(schedule, now)
+	assert.Equal(t, 22, begin)
+	assert.Equal(t, 0, end)
+	schedule.Hours = []cephv1alpha1.HourRange{{Begin: 12, End: 14}, {Begin: 2, End: 4}}
+	begin, end = osdScrubHours(schedule, now)
+	assert.Equal(t, 2, begin)
+	assert.Equal(t, 4, end)
+
+	// the hours are converted to the UTC time of the osds
+	schedule.TimeZone = "Asia/Tokyo"
+	begin, end = osdScrubHours(schedule, now)
+	assert.Equal(t, 3, begin)
+	assert.Equal(t, 5, end)
+
+	// the hours of a time zone with a half hour offset are widened to whole hours, 12:00-14:00 in india is 06:30-08:30
+	schedule.TimeZone = "Asia/Kolkata"
+	begin, end = osdScrubHours(schedule, now)
+	assert.Equal(t, 6, begin)
+	assert.Equal(t, 9, end)
+
+	// 02:00-04:00 in newfoundland is 04:30-06:30 in the summer
+	schedule.TimeZone = "America/St_Johns"
+	schedule.Hours = []cephv1alpha1.HourRange{{Begin: 2, End: 4}}
+	begin, end = osdScrubHours(schedule, now)
+	assert.Equal(t, 4, begin)
+	assert.Equal(t, 7, end)
+}
+
+func TestScrubSchedulerEnforce(t *testing.T) {
+	var commands []string
+	executor := &exectest.MockExecutor{
+		MockExecuteCommandWithOutputFile: func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
+			commands = append(commands, strings.Join(args[:3], " "))
+			return "", nil
+		},
+	}
+	cluster := &cephv1alpha1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "mycluster", Namespace: "ns"}}
+	rookClientset := rookfake.NewSimpleClientset(cluster)
+	clientset := fake.NewSimpleClientset()
+	context := &clusterd.Context{Clientset: clientset, RookClientset: rookClientset, Executor: executor}
+	s := NewScrubScheduler(context, "ns", "mycluster")
+	getStatus := func() *bool {
+		c, err := rookClientset.CephV1alpha1().Clusters("ns").Get("mycluster", metav1.GetOptions{})
+		assert.Nil(t, err)
+		return c.Status.ScrubPermitted
+	}
+
+	// the scrub flags are left alone without a schedule
+	night := time.Date(2018, 6, 16, 23, 30, 0, 0, time.UTC)
+	day := time.Date(2018, 6, 17, 10, 0, 0, 0, time.UTC)
+	assert.Nil(t, s.enforce(day))
+	assert.Equal(t, 0, len(commands))
+	assert.Nil(t, getStatus())
+
+	// scrubbing is only allowed at night
+	cluster.Spec.ScrubSchedule = &cephv1alpha1.ScrubScheduleSpec{Hours: []cephv1alpha1.HourRange{{Begin: 22, End: 6}}}
+	_, err := rookClientset.CephV1alpha1().Clusters("ns").Update(cluster)
+	assert.Nil(t, err)
+	assert.Nil(t, s.enforce(day))
+	assert.Equal(t, []string{"tell osd.* injectargs", "osd set noscrub", "osd set nodeep-scrub"}, commands)
+	assert.False(t, *getStatus())
+
+	// the hours are recorded for the osds that start later
+	cm, err := clientset.CoreV1().ConfigMaps("ns").Get(ScrubHoursMapName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"beginHour": "22", "endHour": "6"}, cm.Data)
+
+	// the flags are only changed when the window opens or closes
+	commands = nil
+	assert.Nil(t, s.enforce(day.Add(time.Hour)))
+	assert.Equal(t, 0, len(commands))
+	assert.Nil(t, s.enforce(night))
+	assert.Equal(t, []string{"tell osd.* injectargs", "osd unset noscrub", "osd unset nodeep-scrub"}, commands)
+	assert.True(t, *getStatus())
+
+	// the flags are not changed during the osd orchestration
+	commands = nil
+	holdScrubSchedule("ns")
+	assert.Nil(t, s.enforce(day))
+	assert.Equal(t, 0, len(commands))
+	releaseScrubSchedule("ns")
+	assert.Nil(t, s.enforce(day))
+	assert.Equal(t, []string{"tell osd.* injectargs", "osd set noscrub", "osd set nodeep-scrub"}, commands)
+
+	// scrubbing is allowed again when the schedule is removed
+	commands = nil
+	cluster, err = rookClientset.CephV1alpha1().Clusters("ns").Get("mycluster", metav1.GetOptions{})
+	assert.Nil(t, err)
+	cluster.Spec.ScrubSchedule = nil
+	_, err = rookClientset.CephV1alpha1().Clusters("ns").Update(cluster)
+	assert.Nil(t, err)
+	assert.Nil(t, s.enforce(day))
+	assert.Equal(t, []string{"tell osd.* injectargs", "osd unset noscrub", "osd unset nodeep-scrub"}, commands)
+	assert.Nil(t, getStatus())
+	cm, err = clientset.CoreV1().ConfigMaps("ns").Get(ScrubHoursMapName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"beginHour": "0", "endHour": "24"}, cm.Data)
+	commands = nil
+	assert.Nil(t, s.enforce(day))
+	assert.Equal(t, 0, len(commands))
+}
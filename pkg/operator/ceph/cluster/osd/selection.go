@@ -0,0 +1,92 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	deviceSelectionEnvVarName = "ROOK_DEVICE_SELECTION"
+)
+
+// DeviceSelection is the selection of devices declared for a node in the storage spec. The devices passed to the agent
+// to provision are narrowed down to the available devices discovered on the node, so a device that is missing from
+// them may just not have been discovered. The agent only removes the OSDs on the devices that are deselected by the
+// declared selection, unless the orchestration status of the node asks to keep the OSDs.
+type DeviceSelection struct {
+	// the names or paths of the devices listed for the node, or the devices matching the device selector
+	Devices []string `json:"devices,omitempty"`
+	// the filter of the device names, or "all" to use all the devices
+	Filter string `json:"filter,omitempty"`
+	// the devices were matched with the discovered devices, a device that is not found on the node is still selected
+	Discovered bool `json:"discovered,omitempty"`
+	// the devices that are taken out of the selection since they are predicted to fail and drained
+	Drained []string `json:"drained,omitempty"`
+}
+
+// getDeviceSelection returns the devices declared for the node. The devices matching a device selector are only known
+// from the discovered devices.
+func getDeviceSelection(n rookalpha.Node, matched []rookalpha.Device, drained []string) DeviceSelection {
+	selection := DeviceSelection{Drained: drained}
+	switch {
+	case len(n.Devices) > 0:
+		for _, device := range n.Devices {
+			selection.Devices = append(selection.Devices, deviceID(device))
+		}
+	case n.Selection.DeviceSelector != nil:
+		for _, device := range matched {
+			selection.Devices = append(selection.Devices, deviceID(device))
+		}
+		selection.Discovered = true
+	case n.Selection.DeviceFilter != "":
+		selection.Filter = n.Selection.DeviceFilter
+	case n.Selection.GetUseAllDevices():
+		selection.Filter = "all"
+	}
+	return selection
+}
+
+// setDeviceSelectionEnvVar passes the devices declared for a node to its agent
+func setDeviceSelectionEnvVar(podSpec *v1.PodTemplateSpec, selection DeviceSelection) {
+	b, err := json.Marshal(selection)
+	if err != nil {
+		logger.Warningf("failed to marshal the device selection %+v. %+v", selection, err)
+		return
+	}
+
+	container := &podSpec.Spec.Containers[0]
+	container.Env = append(container.Env, v1.EnvVar{Name: deviceSelectionEnvVarName, Value: string(b)})
+}
+
+// ParseDeviceSelection parses the devices declared for a node, nil if they were not passed to the agent
+func ParseDeviceSelection(value string) (*DeviceSelection, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var selection DeviceSelection
+	if err := json.Unmarshal([]byte(value), &selection); err != nil {
+		return nil, fmt.Errorf("invalid device selection %s. %+v", value, err)
+	}
+	return &selection, nil
+}
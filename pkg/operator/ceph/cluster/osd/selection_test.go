@@ -0,0 +1,66 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"testing"
+
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+)
+
+func TestGetDeviceSelection(t *testing.T) {
+	useAllDevices := true
+	matched := []rookalpha.Device{{Name: "sdb"}}
+
+	// the declared device list is passed instead of the discovered devices
+	n := rookalpha.Node{Name: "node1", Devices: []rookalpha.Device{{Name: "sda"}, {FullPath: "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4"}}}
+	selection := getDeviceSelection(n, matched, nil)
+	assert.Equal(t, []string{"sda", "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4"}, selection.Devices)
+	assert.False(t, selection.Discovered)
+
+	// the devices matching a selector are only known from discovery
+	n = rookalpha.Node{Name: "node1", Selection: rookalpha.Selection{DeviceFilter: "^sd",
+		DeviceSelector: &rookalpha.DeviceSelector{}}}
+	selection = getDeviceSelection(n, matched, []string{"sdc"})
+	assert.Equal(t, []string{"sdb"}, selection.Devices)
+	assert.Equal(t, "", selection.Filter)
+	assert.True(t, selection.Discovered)
+	assert.Equal(t, []string{"sdc"}, selection.Drained)
+
+	// the filter and all devices are passed as a filter
+	n = rookalpha.Node{Name: "node1", Selection: rookalpha.Selection{DeviceFilter: "^sd"}}
+	assert.Equal(t, DeviceSelection{Filter: "^sd"}, getDeviceSelection(n, matched, nil))
+	n = rookalpha.Node{Name: "node1", Selection: rookalpha.Selection{UseAllDevices: &useAllDevices}}
+	assert.Equal(t, DeviceSelection{Filter: "all"}, getDeviceSelection(n, matched, nil))
+
+	// the selection is passed to the agent in its env
+	podSpec := v1.PodTemplateSpec{Spec: v1.PodSpec{Containers: []v1.Container{{}}}}
+	setDeviceSelectionEnvVar(&podSpec, DeviceSelection{Devices: []string{"sda"}, Drained: []string{"sdc"}})
+	value := envVarValues(podSpec.Spec.Containers[0].Env)[deviceSelectionEnvVarName]
+	parsed, err := ParseDeviceSelection(value)
+	assert.Nil(t, err)
+	assert.Equal(t, &DeviceSelection{Devices: []string{"sda"}, Drained: []string{"sdc"}}, parsed)
+
+	parsed, err = ParseDeviceSelection("")
+	assert.Nil(t, err)
+	assert.Nil(t, parsed)
+	_, err = ParseDeviceSelection("{")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	cephv1alpha1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1alpha1"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	// the reason of the events about the orchestration of the osds of a node is this prefix followed by the state
+	orchestrationEventReasonPrefix = "OSDOrchestration"
+)
+
+// StatusMirror mirrors the orchestration status of the OSDs of each node from the orchestration status map into the
+// status of the cluster, and records an event for each change of the status of a node
+type StatusMirror struct {
+	context     *clusterd.Context
+	namespace   string
+	clusterName string
+}
+
+// NewStatusMirror creates an instance of the status mirror
+func NewStatusMirror(context *clusterd.Context, namespace, clusterName string) *StatusMirror {
+	return &StatusMirror{context: context, namespace: namespace, clusterName: clusterName}
+}
+
+// Run watches the orchestration status map until the stop channel is closed
+func (m *StatusMirror) Run(stopCh chan struct{}) {
+	selector := fields.OneTermEqualSelector(api.ObjectNameField, OrchestrationStatusMapName).String()
+	source := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return m.context.Clientset.CoreV1().ConfigMaps(m.namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return m.context.Clientset.CoreV1().ConfigMaps(m.namespace).Watch(options)
+		},
+	}
+
+	_, controller := cache.NewInformer(source, &v1.ConfigMap{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			m.onChange(nil, obj)
+		},
+		UpdateFunc: m.onChange,
+	})
+	logger.Infof("mirroring the osd orchestration status into cluster %s in namespace %s", m.clusterName, m.namespace)
+	controller.Run(stopCh)
+	logger.Infof("stopping the osd orchestration status mirror in namespace %s", m.namespace)
+}
+
+func (m *StatusMirror) onChange(oldObj, newObj interface{}) {
+	var oldData map[string]string
+	if oldCM, ok := oldObj.(*v1.ConfigMap); ok {
+		oldData = oldCM.Data
+	}
+	newCM, ok := newObj.(*v1.ConfigMap)
+	if !ok {
+		return
+	}
+	if err := m.mirror(oldData, newCM.Data, oldObj != nil); err != nil {
+		logger.Warningf("failed to mirror the osd orchestration status. %+v", err)
+	}
+}
+
+// mirror updates the status of the cluster with the orchestration status of the nodes. An event is recorded for the
+// nodes whose status changed, unless the previous status of the nodes is not known.
+func (m *StatusMirror) mirror(oldData, newData map[string]string, recordEvents bool) error {
+	var cluster *cephv1alpha1.Cluster
+	var err error
+	for i := 0; i <= statusUpdateRetries; i++ {
+		cluster, err = m.context.RookClientset.CephV1alpha1().Clusters(m.namespace).Get(m.clusterName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get cluster %s. %+v", m.clusterName, err)
+		}
+
+		nodes := mirrorNodeStatus(cluster.Status.OSDNodes, newData)
+		if reflect.DeepEqual(cluster.Status.OSDNodes, nodes) {
+			break
+		}
+		cluster.Status.OSDNodes = nodes
+		_, err = m.context.RookClientset.CephV1alpha1().Clusters(m.namespace).Update(cluster)
+		if err == nil || !errors.IsConflict(err) {
+			break
+		}
+		logger.Infof("cluster %s changed while updating its osd orchestration status, trying again", m.clusterName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update the osd orchestration status of cluster %s. %+v", m.clusterName, err)
+	}
+
+	if !recordEvents {
+		return nil
+	}
+	ref := v1.ObjectReference{
+		APIVersion: cephv1alpha1.SchemeGroupVersion.String(),
+		Kind:       "Cluster",
+		Name:       cluster.Name,
+		Namespace:  cluster.Namespace,
+		UID:        cluster.UID,
+	}
+	for _, node := range sortedKeys(newData) {
+		status := parseOrchestrationStatus(newData, node)
+		if status == nil {
+			continue
+		}
+		old := parseOrchestrationStatus(oldData, node)
+		if old != nil && old.Status == status.Status && old.Message == status.Message {
+			continue
+		}
+
+		eventType, reason, message := orchestrationEvent(node, status)
+		if err := k8sutil.RecordEvent(m.context.Clientset, ref, eventType, reason, message); err != nil {
+			logger.Warningf("%+v", err)
+		}
+	}
+	return nil
+}
+
+// UpdateClusterStatus changes the status of the cluster with the given function, which returns false when the status
+// does not need to change. The status is changed again on the latest cluster when the cluster was changed at the same
+// time by another update.
+func UpdateClusterStatus(context *clusterd.Context, namespace, name string, change func(status *cephv1alpha1.ClusterStatus) bool) error {
+	for i := 0; i <= statusUpdateRetries; i++ {
+		cluster, err := context.RookClientset.CephV1alpha1().Clusters(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get cluster %s. %+v", name, err)
+		}
+		if !change(&cluster.Status) {
+			return nil
+		}
+
+		_, err = context.RookClientset.CephV1alpha1().Clusters(namespace).Update(cluster)
+		if err == nil {
+			return nil
+		}
+		if !errors.IsConflict(err) {
+			return fmt.Errorf("failed to update the status of cluster %s. %+v", name, err)
+		}
+		logger.Infof("cluster %s changed while updating its status, trying again", name)
+	}
+	return fmt.Errorf("failed to update the status of cluster %s after %d retries", name, statusUpdateRetries)
+}
+
+// returns the status of the nodes in the status map, sorted by node. The IDs of the osds of a node are kept from the
+// previous status until the agent of the node reports them again.
+func mirrorNodeStatus(previous []cephv1alpha1.OSDNodeStatus, data map[string]string) []cephv1alpha1.OSDNodeStatus {
+	previousOSDs := map[string][]int{}
+	for _, node := range previous {
+		previousOSDs[node.Node] = node.OSDs
+	}
+
+	var nodes []cephv1alpha1.OSDNodeStatus
+	for _, node := range sortedKeys(data) {
+		status := parseOrchestrationStatus(data, node)
+		if status == nil {
+			continue
+		}
+		osds := previousOSDs[node]
+		if status.OSDIDs != nil {
+			osds = nil
+			if len(status.OSDIDs) > 0 {
+				osds = status.OSDIDs
+			}
+		}
+		nodes = append(nodes, cephv1alpha1.OSDNodeStatus{Node: node, State: status.Status, Message: status.Message, OSDs: osds})
+	}
+	return nodes
+}
+
+// returns the type, reason and message of the event about the orchestration status of a node
+func orchestrationEvent(node string, status *OrchestrationStatus) (string, string, string) {
+	eventType := v1.EventTypeNormal
+	if status.Status == OrchestrationStatusFailed {
+		eventType = v1.EventTypeWarning
+	}
+	reason := orchestrationEventReasonPrefix
+	if status.Status != "" {
+		reason += strings.ToUpper(status.Status[:1]) + status.Status[1:]
+	}
+
+	message := fmt.Sprintf("osd orchestration status of node %s is %s", node, status.Status)
+	if status.Status == OrchestrationStatusCompleted && status.OSDIDs != nil {
+		ids := make([]int, len(status.OSDIDs))
+		copy(ids, status.OSDIDs)
+		sort.Ints(ids)
+		message = fmt.Sprintf("%s with osds %v", message, ids)
+	}
+	if status.Message != "" {
+		message = fmt.Sprintf("%s: %s", message, status.Message)
+	}
+	return eventType, reason, message
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"encoding/json"
+	"testing"
+
+	cephv1alpha1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1alpha1"
+	rookfake "github.com/rook/rook/pkg/client/clientset/versioned/fake"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	testclient "k8s.io/client-go/testing"
+)
+
+func statusData(t *testing.T, statuses map[string]OrchestrationStatus) map[string]string {
+	data := map[string]string{}
+	for node, status := range statuses {
+		s, err := json.Marshal(status)
+		assert.Nil(t, err)
+		data[node] = string(s)
+	}
+	return data
+}
+
+func TestMirrorNodeStatus(t *testing.T) {
+	previous := []cephv1alpha1.OSDNodeStatus{
+		{Node: "node1", State: OrchestrationStatusCompleted, OSDs: []int{0, 1}},
+		{Node: "node2", State: OrchestrationStatusCompleted, OSDs: []int{2}},
+	}
+
+	// the ids are kept while the operator orchestrates a node again, and replaced when the agent reports them
+	data := statusData(t, map[string]OrchestrationStatus{
+		"node2": {Status: OrchestrationStatusCompleted, OSDIDs: []int{}},
+		"node1": {Status: OrchestrationStatusStarting},
+		"node3": {Status: OrchestrationStatusFailed, Message: "no devices"},
+	})
+	nodes := mirrorNodeStatus(previous, data)
+	assert.Equal(t, []cephv1alpha1.OSDNodeStatus{
+		{Node: "node1", State: OrchestrationStatusStarting, OSDs: []int{0, 1}},
+		{Node: "node2", State: OrchestrationStatusCompleted},
+		{Node: "node3", State: OrchestrationStatusFailed, Message: "no devices"},
+	}, nodes)
+
+	assert.Nil(t, mirrorNodeStatus(previous, map[string]string{}))
+}
+
+func TestStatusMirror(t *testing.T) {
+	cluster := &cephv1alpha1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "mycluster", Namespace: "ns"}}
+	rookClientset := rookfake.NewSimpleClientset(cluster)
+	clientset := fake.NewSimpleClientset()
+	context := &clusterd.Context{Clientset: clientset, RookClientset: rookClientset}
+	m := NewStatusMirror(context, "ns", "mycluster")
+
+	// the initial status is mirrored without events since the previous status is not known
+	started := statusData(t, map[string]OrchestrationStatus{"node1": {Status: OrchestrationStatusStarting}})
+	assert.Nil(t, m.mirror(nil, started, false))
+	cluster, err := rookClientset.CephV1alpha1().Clusters("ns").Get("mycluster", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []cephv1alpha1.OSDNodeStatus{{Node: "node1", State: OrchestrationStatusStarting}}, cluster.Status.OSDNodes)
+	events, err := clientset.CoreV1().Events("ns").List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(events.Items))
+
+	// each transition of a node is reported
+	completed := statusData(t, map[string]OrchestrationStatus{
+		"node1": {Status: OrchestrationStatusCompleted, OSDIDs: []int{3, 1}},
+		"node2": {Status: OrchestrationStatusFailed, Message: "timed out"},
+	})
+	assert.Nil(t, m.mirror(started, completed, true))
+	cluster, err = rookClientset.CephV1alpha1().Clusters("ns").Get("mycluster", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []cephv1alpha1.OSDNodeStatus{
+		{Node: "node1", State: OrchestrationStatusCompleted, OSDs: []int{3, 1}},
+		{Node: "node2", State: OrchestrationStatusFailed, Message: "timed out"},
+	}, cluster.Status.OSDNodes)
+
+	events, err = clientset.CoreV1().Events("ns").List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events.Items))
+	reasons := map[string]v1.Event{}
+	for _, event := range events.Items {
+		assert.Equal(t, "mycluster", event.InvolvedObject.Name)
+		reasons[event.Reason] = event
+	}
+	assert.Equal(t, v1.EventTypeNormal, reasons["OSDOrchestrationCompleted"].Type)
+	assert.Equal(t, "osd orchestration status of node node1 is completed with osds [1 3]", reasons["OSDOrchestrationCompleted"].Message)
+	assert.Equal(t, v1.EventTypeWarning, reasons["OSDOrchestrationFailed"].Type)
+	assert.Equal(t, "osd orchestration status of node node2 is failed: timed out", reasons["OSDOrchestrationFailed"].Message)
+
+	// the same status is not reported again
+	assert.Nil(t, m.mirror(completed, completed, true))
+	events, err = clientset.CoreV1().Events("ns").List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events.Items))
+}
+
+func TestUpdateClusterStatus(t *testing.T) {
+	cluster := &cephv1alpha1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "mycluster", Namespace: "ns"}}
+	rookClientset := rookfake.NewSimpleClientset(cluster)
+	context := &clusterd.Context{RookClientset: rookClientset}
+
+	// the first update conflicts with another update of the cluster and is tried again
+	conflicts := 1
+	rookClientset.PrependReactor("update", "clusters", func(action testclient.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			conflicts--
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "clusters"}, "mycluster", nil)
+		}
+		return false, nil, nil
+	})
+	changes := 0
+	err := UpdateClusterStatus(context, "ns", "mycluster", func(status *cephv1alpha1.ClusterStatus) bool {
+		changes++
+		status.Message = "updated"
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, changes)
+	updated, err := rookClientset.CephV1alpha1().Clusters("ns").Get("mycluster", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "updated", updated.Status.Message)
+
+	// the cluster is not updated when the status does not change
+	conflicts = 1
+	err = UpdateClusterStatus(context, "ns", "mycluster", func(status *cephv1alpha1.ClusterStatus) bool { return false })
+	assert.Nil(t, err)
+	assert.Equal(t, 1, conflicts)
+
+	// the update gives up on other errors
+	rookClientset.PrependReactor("update", "clusters", func(action testclient.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewBadRequest("invalid")
+	})
+	err = UpdateClusterStatus(context, "ns", "mycluster", func(status *cephv1alpha1.ClusterStatus) bool { return true })
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// updateReplicaSet updates an existing OSD replica set if its pod template no longer matches the desired template, for
+// example after devices or directories were added to or removed from the storage selection. The OSD pod is deleted so
+// that it is restarted with the new template, where the agent prepares the new storage and removes the deselected
+// storage. Returns false if the replica set was already up to date.
+func (c *Cluster) updateReplicaSet(name string, rs *extensions.ReplicaSet) (bool, error) {
+	existing, err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Get(rs.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get osd replica set %s. %+v", rs.Name, err)
+	}
+
+	changes := podTemplateChanges(existing.Spec.Template, rs.Spec.Template)
+	if len(changes) == 0 {
+		return false, nil
+	}
+
+	message := fmt.Sprintf("updating osd replica set for %s: %s", name, strings.Join(changes, ", "))
+	logger.Info(message)
+	status := OrchestrationStatus{Status: OrchestrationStatusStarting, Message: message}
+	if err := UpdateOrchestrationStatusMap(c.context.Clientset, c.Namespace, name, status); err != nil {
+		return false, fmt.Errorf("failed to set orchestration status for %s, status: %+v: %+v", name, status, err)
+	}
+
+	// devices and directories that are no longer selected stay mounted so that the pod can migrate the data off of them
+	keepRemovedStorage(existing.Spec.Template, &rs.Spec.Template)
+
+	updated, err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Update(rs)
+	if err != nil {
+		return false, fmt.Errorf("failed to update osd replica set %s. %+v", rs.Name, err)
+	}
+	logger.Infof("osd replica set updated for %s", name)
+
+	// delete the pod associated with the replica set so that it will be restarted with the new template
+	if err := c.deleteOSDPod(updated); err != nil {
+		return false, fmt.Errorf("failed to find and delete OSD pod for replica set %s. %+v", rs.Name, err)
+	}
+
+	return true, nil
+}
+
+// podTemplateChanges returns the differences between the pod template of an existing OSD replica set and the desired
+// template. Only the settings generated by the operator are compared since the API server sets defaults on many of the
+// other fields.
+func podTemplateChanges(existing, desired v1.PodTemplateSpec) []string {
+	changes := []string{}
+	if len(existing.Spec.Containers) == 0 || len(desired.Spec.Containers) == 0 {
+		return append(changes, "osd container changed")
+	}
+	existingContainer := existing.Spec.Containers[0]
+	desiredContainer := desired.Spec.Containers[0]
+
+	// the storage selection and settings of the node are passed to the agent in the env vars
+	existingEnv := envVarValues(existingContainer.Env)
+	desiredEnv := envVarValues(desiredContainer.Env)
+	for _, name := range sortedKeys(desiredEnv) {
+		value, ok := existingEnv[name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("%s added", name))
+		} else if value != desiredEnv[name] {
+			changes = append(changes, fmt.Sprintf("%s changed from %q to %q", name, value, desiredEnv[name]))
+		}
+	}
+	for _, name := range sortedKeys(existingEnv) {
+		if _, ok := desiredEnv[name]; !ok {
+			changes = append(changes, fmt.Sprintf("%s removed", name))
+		}
+	}
+
+	// all the desired volumes must be mounted. volumes of removed devices and directories may remain mounted.
+	existingVolumes := map[string]v1.Volume{}
+	for _, volume := range existing.Spec.Volumes {
+		existingVolumes[volume.Name] = volume
+	}
+	for _, volume := range desired.Spec.Volumes {
+		e, ok := existingVolumes[volume.Name]
+		if !ok || !sameVolumeSource(e, volume) {
+			changes = append(changes, fmt.Sprintf("volume %s changed", volume.Name))
+		}
+	}
+	existingMounts := map[string]string{}
+	for _, mount := range existingContainer.VolumeMounts {
+		existingMounts[mount.Name] = mount.MountPath
+	}
+	for _, mount := range desiredContainer.VolumeMounts {
+		if path, ok := existingMounts[mount.Name]; !ok || path != mount.MountPath {
+			changes = append(changes, fmt.Sprintf("volume mount %s changed", mount.Name))
+		}
+	}
+
+	if !sameResourceList(existingContainer.Resources.Limits, desiredContainer.Resources.Limits) ||
+		!sameResourceList(existingContainer.Resources.Requests, desiredContainer.Resources.Requests) {
+		changes = append(changes, "resources changed")
+	}
+
+	if (len(existing.Spec.NodeSelector) > 0 || len(desired.Spec.NodeSelector) > 0) &&
+		!reflect.DeepEqual(existing.Spec.NodeSelector, desired.Spec.NodeSelector) {
+		changes = append(changes, "node selector changed")
+	}
+	if !reflect.DeepEqual(existing.Spec.Affinity, desired.Spec.Affinity) {
+		changes = append(changes, "affinity changed")
+	}
+	if (len(existing.Spec.Tolerations) > 0 || len(desired.Spec.Tolerations) > 0) &&
+		!reflect.DeepEqual(existing.Spec.Tolerations, desired.Spec.Tolerations) {
+		changes = append(changes, "tolerations changed")
+	}
+
+	return changes
+}
+
+// keepRemovedStorage adds the volumes of the devices and directories in the existing template that are not in the
+// desired template. The removed storage is not passed to the agent anymore, which will remove the OSDs running on it.
+func keepRemovedStorage(existing v1.PodTemplateSpec, desired *v1.PodTemplateSpec) {
+	if len(existing.Spec.Containers) == 0 || len(desired.Spec.Containers) == 0 {
+		return
+	}
+	container := &desired.Spec.Containers[0]
+
+	mounted := map[string]bool{}
+	for _, volume := range desired.Spec.Volumes {
+		mounted[volume.Name] = true
+	}
+	keep := func(name, path string) {
+		desired.Spec.Volumes = append(desired.Spec.Volumes, v1.Volume{
+			Name:         name,
+			VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: path}},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{Name: name, MountPath: path})
+		mounted[name] = true
+	}
+
+	// the host devices stay mounted if all the devices were removed from the selection
+	for _, volume := range existing.Spec.Volumes {
+		if (volume.Name == devicesVolumeName || volume.Name == udevVolumeName) && volume.HostPath != nil && !mounted[volume.Name] {
+			logger.Infof("devices were removed from the selection, keeping %s mounted to remove their osds", volume.HostPath.Path)
+			keep(volume.Name, volume.HostPath.Path)
+			privileged := true
+			if container.SecurityContext == nil {
+				container.SecurityContext = &v1.SecurityContext{}
+			}
+			container.SecurityContext.Privileged = &privileged
+		}
+	}
+
+	desiredDirs := map[string]bool{}
+	for _, dir := range getDirectoriesFromContainer(*container) {
+		desiredDirs[dir.Path] = true
+	}
+	for _, dir := range getDirectoriesFromContainer(existing.Spec.Containers[0]) {
+		volumeName := k8sutil.PathToVolumeName(dir.Path)
+		if desiredDirs[dir.Path] || mounted[volumeName] {
+			continue
+		}
+
+		logger.Infof("directory %s was removed from the selection, keeping it mounted to remove its osd", dir.Path)
+		keep(volumeName, dir.Path)
+	}
+}
+
+// dropRemovedStorage removes the volumes that were kept mounted by keepRemovedStorage from the template of the OSD
+// replica set once the orchestration of the node has completed, at which point the agent has purged the OSDs of the
+// removed devices and directories. The running pod is not restarted for this, it releases the mounts when it restarts.
+func (c *Cluster) dropRemovedStorage(name, replicaSetName string) error {
+	rs, err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Get(replicaSetName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get osd replica set %s. %+v", replicaSetName, err)
+	}
+
+	removed := removedStorageVolumes(rs.Spec.Template)
+	if len(removed) == 0 {
+		return nil
+	}
+
+	template := &rs.Spec.Template
+	var volumes []v1.Volume
+	for _, volume := range template.Spec.Volumes {
+		if removed[volume.Name] {
+			logger.Infof("osds of %s on %s were removed, dropping it from the osd replica set for %s", volume.Name, volume.HostPath.Path, name)
+			continue
+		}
+		volumes = append(volumes, volume)
+	}
+	template.Spec.Volumes = volumes
+
+	container := &template.Spec.Containers[0]
+	var mounts []v1.VolumeMount
+	for _, mount := range container.VolumeMounts {
+		if !removed[mount.Name] {
+			mounts = append(mounts, mount)
+		}
+	}
+	container.VolumeMounts = mounts
+	if removed[devicesVolumeName] && container.SecurityContext != nil {
+		// the pod was only privileged to remove the osds of the devices
+		privileged := false
+		container.SecurityContext.Privileged = &privileged
+	}
+
+	if _, err := c.context.Clientset.Extensions().ReplicaSets(c.Namespace).Update(rs); err != nil {
+		return fmt.Errorf("failed to drop the removed storage from osd replica set %s. %+v", replicaSetName, err)
+	}
+	return nil
+}
+
+// removedStorageVolumes returns the names of the host volumes of the template that were kept mounted for devices or
+// directories that are no longer passed to the agent
+func removedStorageVolumes(template v1.PodTemplateSpec) map[string]bool {
+	removed := map[string]bool{}
+	if len(template.Spec.Containers) == 0 {
+		return removed
+	}
+	container := template.Spec.Containers[0]
+	env := envVarValues(container.Env)
+
+	dirs := map[string]bool{}
+	for _, dir := range getDirectoriesFromContainer(container) {
+		dirs[k8sutil.PathToVolumeName(dir.Path)] = true
+	}
+	_, devices := env[dataDevicesEnvVarName]
+	_, filter := env[deviceFilterEnvVarName]
+	_, metadataDevice := env[osdMetadataDeviceEnvVarName]
+	devicesSelected := devices || filter || metadataDevice
+
+	for _, volume := range template.Spec.Volumes {
+		if volume.HostPath == nil || volume.Name == k8sutil.DataDirVolume {
+			continue
+		}
+		switch {
+		case volume.Name == devicesVolumeName || volume.Name == udevVolumeName:
+			if !devicesSelected {
+				removed[volume.Name] = true
+			}
+		case volume.Name == k8sutil.PathToVolumeName(volume.HostPath.Path):
+			if !dirs[volume.Name] {
+				removed[volume.Name] = true
+			}
+		}
+	}
+	return removed
+}
+
+func envVarValues(env []v1.EnvVar) map[string]string {
+	values := map[string]string{}
+	for _, e := range env {
+		if e.ValueFrom != nil && e.ValueFrom.FieldRef != nil {
+			// the api version of the field is defaulted by the API server, only the field path is generated
+			values[e.Name] = e.ValueFrom.FieldRef.FieldPath
+			continue
+		}
+		values[e.Name] = e.Value
+	}
+	return values
+}
+
+func sameVolumeSource(existing, desired v1.Volume) bool {
+	switch {
+	case desired.HostPath != nil:
+		return existing.HostPath != nil && existing.HostPath.Path == desired.HostPath.Path
+	case desired.ConfigMap != nil:
+		return existing.ConfigMap != nil && existing.ConfigMap.Name == desired.ConfigMap.Name
+	case desired.PersistentVolumeClaim != nil:
+		return existing.PersistentVolumeClaim != nil && existing.PersistentVolumeClaim.ClaimName == desired.PersistentVolumeClaim.ClaimName
+	case desired.EmptyDir != nil:
+		return existing.EmptyDir != nil
+	}
+	return true
+}
+
+func sameResourceList(existing, desired v1.ResourceList) bool {
+	if len(existing) != len(desired) {
+		return false
+	}
+	for name, quantity := range desired {
+		e, ok := existing[name]
+		if !ok || e.Cmp(quantity) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
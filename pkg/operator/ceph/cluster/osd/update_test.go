@@ -0,0 +1,193 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osd for the Ceph OSDs.
+package osd
+
+import (
+	"testing"
+
+	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/cluster/osd/config"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPodTemplateChanges(t *testing.T) {
+	c := New(&clusterd.Context{Clientset: fake.NewSimpleClientset(), ConfigDir: "/var/lib/rook", Executor: &exectest.MockExecutor{}}, "ns", "rook/rook:myversion",
+		rookalpha.StorageScopeSpec{}, "", rookalpha.Placement{}, false, v1.ResourceRequirements{}, metav1.OwnerReference{})
+	selection := rookalpha.Selection{Directories: []rookalpha.Directory{{Path: "/rook/storage1"}}}
+	devices := []rookalpha.Device{{Name: "sda"}}
+	desired := c.makeReplicaSet("node1", devices, selection, v1.ResourceRequirements{}, config.StoreConfig{}, "", "").Spec.Template
+
+	// the same template has no changes, even with the defaults set by the API server
+	existing := c.makeReplicaSet("node1", devices, selection, v1.ResourceRequirements{}, config.StoreConfig{}, "", "").Spec.Template
+	mode := int32(420)
+	for i := range existing.Spec.Volumes {
+		if existing.Spec.Volumes[i].ConfigMap != nil {
+			existing.Spec.Volumes[i].ConfigMap.DefaultMode = &mode
+		}
+	}
+	for i := range existing.Spec.Containers[0].Env {
+		if existing.Spec.Containers[0].Env[i].ValueFrom != nil {
+			existing.Spec.Containers[0].Env[i].ValueFrom.FieldRef.APIVersion = "v1"
+		}
+	}
+	assert.Equal(t, 0, len(podTemplateChanges(existing, desired)))
+
+	// a device is added
+	devices = append(devices, rookalpha.Device{Name: "sdb"})
+	desired = c.makeReplicaSet("node1", devices, selection, v1.ResourceRequirements{}, config.StoreConfig{}, "", "").Spec.Template
+	changes := podTemplateChanges(existing, desired)
+	assert.Equal(t, 1, len(changes))
+	assert.Equal(t, `ROOK_DATA_DEVICES changed from "sda" to "sda,sdb"`, changes[0])
+
+	// a directory is added and the resources changed
+	selection.Directories = append(selection.Directories, rookalpha.Directory{Path: "/rook/storage2"})
+	resources := v1.ResourceRequirements{Limits: v1.ResourceList{v1.ResourceMemory: resource.MustParse("1Gi")}}
+	desired = c.makeReplicaSet("node1", devices[:1], selection, resources, config.StoreConfig{}, "", "").Spec.Template
+	changes = podTemplateChanges(existing, desired)
+	assert.Contains(t, changes, `ROOK_DATA_DIRECTORIES changed from "/rook/storage1" to "/rook/storage1,/rook/storage2"`)
+	assert.Contains(t, changes, "volume rook-storage2 changed")
+	assert.Contains(t, changes, "volume mount rook-storage2 changed")
+	assert.Contains(t, changes, "resources changed")
+
+	// equal quantities in different formats are not a change
+	existing.Spec.Containers[0].Resources = v1.ResourceRequirements{Limits: v1.ResourceList{v1.ResourceMemory: resource.MustParse("1024Mi")}}
+	desired = c.makeReplicaSet("node1", devices[:1], rookalpha.Selection{Directories: selection.Directories[:1]}, resources, config.StoreConfig{}, "", "").Spec.Template
+	assert.Equal(t, 0, len(podTemplateChanges(existing, desired)))
+}
+
+func TestUpdateReplicaSet(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	c := New(&clusterd.Context{Clientset: clientset, ConfigDir: "/var/lib/rook", Executor: &exectest.MockExecutor{}}, "ns", "rook/rook:myversion",
+		rookalpha.StorageScopeSpec{}, "", rookalpha.Placement{}, false, v1.ResourceRequirements{}, metav1.OwnerReference{})
+
+	// an osd replica set and its pod are running with a device and two directories
+	selection := rookalpha.Selection{Directories: []rookalpha.Directory{{Path: "/rook/storage1"}, {Path: "/rook/storage2"}}}
+	rs := c.makeReplicaSet("node1", []rookalpha.Device{{Name: "sda"}}, selection, v1.ResourceRequirements{}, config.StoreConfig{}, "", "")
+	_, err := clientset.Extensions().ReplicaSets(c.Namespace).Create(rs)
+	assert.Nil(t, err)
+	osdPod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:            "osdPod",
+		Labels:          map[string]string{k8sutil.AppAttr: appName},
+		OwnerReferences: []metav1.OwnerReference{{Name: rs.Name}}}}
+	_, err = clientset.CoreV1().Pods(c.Namespace).Create(osdPod)
+	assert.Nil(t, err)
+
+	// nothing to update when the selection did not change
+	rs = c.makeReplicaSet("node1", []rookalpha.Device{{Name: "sda"}}, selection, v1.ResourceRequirements{}, config.StoreConfig{}, "", "")
+	updated, err := c.updateReplicaSet("node1", rs)
+	assert.Nil(t, err)
+	assert.False(t, updated)
+
+	// add a device and remove a directory
+	selection.Directories = selection.Directories[:1]
+	rs = c.makeReplicaSet("node1", []rookalpha.Device{{Name: "sda"}, {Name: "sdb"}}, selection, v1.ResourceRequirements{}, config.StoreConfig{}, "", "")
+	updated, err = c.updateReplicaSet("node1", rs)
+	assert.Nil(t, err)
+	assert.True(t, updated)
+
+	rs, err = clientset.Extensions().ReplicaSets(c.Namespace).Get(rs.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	container := rs.Spec.Template.Spec.Containers[0]
+	env := envVarValues(container.Env)
+	assert.Equal(t, "sda,sdb", env[dataDevicesEnvVarName])
+	assert.Equal(t, "/rook/storage1", env[dataDirsEnvVarName])
+
+	// the removed directory is still mounted so that its osd can be removed
+	foundVolume := false
+	for _, volume := range rs.Spec.Template.Spec.Volumes {
+		if volume.Name == "rook-storage2" {
+			foundVolume = true
+			assert.Equal(t, "/rook/storage2", volume.HostPath.Path)
+		}
+	}
+	assert.True(t, foundVolume)
+	foundMount := false
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == "rook-storage2" {
+			foundMount = true
+			assert.Equal(t, "/rook/storage2", mount.MountPath)
+		}
+	}
+	assert.True(t, foundMount)
+
+	// the pod was deleted to restart with the new template and the update is tracked in the orchestration status
+	pods, err := clientset.CoreV1().Pods(c.Namespace).List(metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(pods.Items))
+	cm, err := clientset.CoreV1().ConfigMaps(c.Namespace).Get(OrchestrationStatusMapName, metav1.GetOptions{})
+	assert.Nil(t, err)
+	status := parseOrchestrationStatus(cm.Data, "node1")
+	assert.Equal(t, OrchestrationStatusStarting, status.Status)
+	assert.Contains(t, status.Message, "ROOK_DATA_DEVICES")
+
+	// the mount of the removed directory does not trigger another update
+	rs = c.makeReplicaSet("node1", []rookalpha.Device{{Name: "sda"}, {Name: "sdb"}}, selection, v1.ResourceRequirements{}, config.StoreConfig{}, "", "")
+	updated, err = c.updateReplicaSet("node1", rs)
+	assert.Nil(t, err)
+	assert.False(t, updated)
+
+	// remove all the devices, the host devices stay mounted so that their osds can be removed
+	_, err = clientset.CoreV1().Pods(c.Namespace).Create(osdPod)
+	assert.Nil(t, err)
+	rs = c.makeReplicaSet("node1", nil, selection, v1.ResourceRequirements{}, config.StoreConfig{}, "", "")
+	updated, err = c.updateReplicaSet("node1", rs)
+	assert.Nil(t, err)
+	assert.True(t, updated)
+
+	rs, err = clientset.Extensions().ReplicaSets(c.Namespace).Get(rs.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	container = rs.Spec.Template.Spec.Containers[0]
+	_, ok := envVarValues(container.Env)[dataDevicesEnvVarName]
+	assert.False(t, ok)
+	foundVolume = false
+	for _, volume := range rs.Spec.Template.Spec.Volumes {
+		if volume.Name == devicesVolumeName {
+			foundVolume = true
+			assert.Equal(t, "/dev", volume.HostPath.Path)
+		}
+	}
+	assert.True(t, foundVolume)
+	assert.True(t, *container.SecurityContext.Privileged)
+
+	// the removed storage is dropped once the osds of the node were removed, the selected directory stays mounted
+	err = c.dropRemovedStorage("node1", rs.Name)
+	assert.Nil(t, err)
+	rs, err = clientset.Extensions().ReplicaSets(c.Namespace).Get(rs.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	container = rs.Spec.Template.Spec.Containers[0]
+	volumes := map[string]bool{}
+	for _, volume := range rs.Spec.Template.Spec.Volumes {
+		volumes[volume.Name] = true
+	}
+	assert.False(t, volumes[devicesVolumeName])
+	assert.False(t, volumes[udevVolumeName])
+	assert.False(t, volumes["rook-storage2"])
+	assert.True(t, volumes["rook-storage1"])
+	for _, mount := range container.VolumeMounts {
+		assert.NotEqual(t, devicesVolumeName, mount.Name)
+	}
+	assert.False(t, *container.SecurityContext.Privileged)
+	assert.Equal(t, 0, len(removedStorageVolumes(rs.Spec.Template)))
+}
@@ -226,6 +226,7 @@ func ModelToSpec(pool model.Pool) cephv1alpha1.PoolSpec {
 	return cephv1alpha1.PoolSpec{
 		FailureDomain: pool.FailureDomain,
 		CrushRoot:     pool.CrushRoot,
+		DeviceClass:   pool.DeviceClass,
 		Replicated:    cephv1alpha1.ReplicatedSpec{Size: pool.ReplicatedConfig.Size},
 		ErasureCoded:  cephv1alpha1.ErasureCodedSpec{CodingChunks: ec.CodingChunkCount, DataChunks: ec.DataChunkCount, Algorithm: ec.Algorithm},
 	}
@@ -255,7 +256,7 @@ func ValidatePoolSpec(context *clusterd.Context, namespace string, p *cephv1alph
 
 	var crush ceph.CrushMap
 	var err error
-	if p.FailureDomain != "" || p.CrushRoot != "" {
+	if p.FailureDomain != "" || p.CrushRoot != "" || p.DeviceClass != "" {
 		crush, err = ceph.GetCrushMap(context, namespace)
 		if err != nil {
 			return fmt.Errorf("failed to get crush map. %+v", err)
@@ -290,6 +291,20 @@ func ValidatePoolSpec(context *clusterd.Context, namespace string, p *cephv1alph
 		}
 	}
 
+	// validate the device class if specified
+	if p.DeviceClass != "" {
+		found := false
+		for _, d := range crush.Devices {
+			if d.Class == p.DeviceClass {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("no osds found with device class %s", p.DeviceClass)
+		}
+	}
+
 	return nil
 }
 
@@ -76,7 +76,8 @@ func TestValidateCrushProperties(t *testing.T) {
 	executor.MockExecuteCommandWithOutputFile = func(debug bool, actionName, command, outputFile string, args ...string) (string, error) {
 		logger.Infof("Command: %s %v", command, args)
 		if args[1] == "crush" && args[2] == "dump" {
-			return `{"types":[{"type_id": 0,"name": "osd"}],"buckets":[{"id": -1,"name":"default"},{"id": -2,"name":"good"}]}`, nil
+			return `{"devices":[{"id": 0,"name":"osd.0","class":"ssd"}],"types":[{"type_id": 0,"name": "osd"}],` +
+				`"buckets":[{"id": -1,"name":"default"},{"id": -2,"name":"good"}]}`, nil
 		}
 		return "", fmt.Errorf("unexpected ceph command '%v'", args)
 	}
@@ -107,6 +108,16 @@ func TestValidateCrushProperties(t *testing.T) {
 	p.Spec.CrushRoot = "good"
 	err = ValidatePool(context, p)
 	assert.Nil(t, err)
+
+	// fail with a device class that no osd has
+	p.Spec.DeviceClass = "hdd"
+	err = ValidatePool(context, p)
+	assert.NotNil(t, err)
+
+	// succeed with a device class of an osd
+	p.Spec.DeviceClass = "ssd"
+	err = ValidatePool(context, p)
+	assert.Nil(t, err)
 }
 
 func TestCreatePool(t *testing.T) {
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"strings"
 
 	"github.com/coreos/pkg/capnslog"
 	rookalpha "github.com/rook/rook/pkg/apis/rook.io/v1alpha2"
@@ -42,6 +43,7 @@ const (
 	discoverDaemonsetName             = "rook-discover"
 	discoverDaemonsetTolerationEnv    = "DISCOVER_TOLERATION"
 	discoverDaemonsetTolerationKeyEnv = "DISCOVER_TOLERATION_KEY"
+	discoverDeviceHealthEnv           = "DISCOVER_DEVICE_HEALTH"
 )
 
 var logger = capnslog.NewPackageLogger("github.com/rook/rook", "op-discover")
@@ -82,7 +84,10 @@ func (d *Discover) Start(namespace, discoverImage string) error {
 }
 
 func (d *Discover) createDiscoverDaemonSet(namespace, discoverImage string) error {
-	privileged := false
+	// the health of the devices is read with smartctl, which needs access to the devices of the host. The pod is only
+	// privileged when the health of the devices is enabled in the operator.
+	deviceHealth := os.Getenv(discoverDeviceHealthEnv) == "true"
+	privileged := deviceHealth
 	ds := &extensions.DaemonSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: discoverDaemonsetName,
@@ -162,6 +167,11 @@ func (d *Discover) createDiscoverDaemonSet(namespace, discoverImage string) erro
 		},
 	}
 
+	if deviceHealth {
+		container := &ds.Spec.Template.Spec.Containers[0]
+		container.Env = append(container.Env, v1.EnvVar{Name: discoverDaemon.DeviceHealthEnvVar, Value: "true"})
+	}
+
 	// Add toleration if any
 	tolerationValue := os.Getenv(discoverDaemonsetTolerationEnv)
 	if tolerationValue != "" {
@@ -218,9 +228,13 @@ func ListDevices(context *clusterd.Context, namespace, nodeName string) (map[str
 	return devices, nil
 }
 
-func GetAvailableDevices(context *clusterd.Context, nodeName, clusterName string, devices []rookalpha.Device, filter string, useAllDevices bool) ([]rookalpha.Device, error) {
+// GetAvailableDevices returns the devices on the node that are selected by the device list, the device filter, the device
+// selector or by using all the devices, in that order of priority. The device selector narrows down the devices matching
+// the filter, or all the devices of the node if there is no filter.
+func GetAvailableDevices(context *clusterd.Context, nodeName, clusterName string, devices []rookalpha.Device, filter string,
+	selector *rookalpha.DeviceSelector, useAllDevices bool) ([]rookalpha.Device, error) {
 	results := []rookalpha.Device{}
-	if len(devices) == 0 && len(filter) == 0 && !useAllDevices {
+	if len(devices) == 0 && len(filter) == 0 && selector == nil && !useAllDevices {
 		return results, nil
 	}
 	namespace := os.Getenv(k8sutil.PodNamespaceEnvVar)
@@ -235,21 +249,33 @@ func GetAvailableDevices(context *clusterd.Context, nodeName, clusterName string
 	if len(devices) > 0 {
 		for i := range devices {
 			for j := range nodeDevices {
-				if devices[i].Name == nodeDevices[j].Name {
+				if matchDevice(devices[i], &nodeDevices[j]) {
 					results = append(results, devices[i])
 				}
 			}
 		}
-	} else if len(filter) >= 0 {
+	} else if len(filter) > 0 || selector != nil {
 		for i := range nodeDevices {
-			//TODO support filter based on other keys
-			matched, err := regexp.Match(filter, []byte(nodeDevices[i].Name))
-			if err == nil && matched {
-				d := rookalpha.Device{
-					Name: nodeDevices[i].Name,
+			if len(filter) > 0 {
+				matched, err := regexp.Match(filter, []byte(nodeDevices[i].Name))
+				if err != nil || !matched {
+					continue
+				}
+			}
+			if selector != nil {
+				matched, err := matchDeviceSelector(selector, nodeDevices[i])
+				if err != nil {
+					return []rookalpha.Device{}, fmt.Errorf("invalid device selector. %+v", err)
+				}
+				if !matched {
+					logger.Debugf("device %s on node %s does not match the device selector", nodeDevices[i].Name, nodeName)
+					continue
 				}
-				results = append(results, d)
 			}
+			d := rookalpha.Device{
+				Name: nodeDevices[i].Name,
+			}
+			results = append(results, d)
 		}
 	} else if useAllDevices {
 		for i := range nodeDevices {
@@ -262,3 +288,165 @@ func GetAvailableDevices(context *clusterd.Context, nodeName, clusterName string
 
 	return results, nil
 }
+
+// MatchesSelection returns whether the discovered device is selected by the device list, the device filter, the device
+// selector or by using all the devices, in that order of priority like GetAvailableDevices
+func MatchesSelection(disk *sys.LocalDisk, devices []rookalpha.Device, filter string, selector *rookalpha.DeviceSelector,
+	useAllDevices bool) (bool, error) {
+	if len(devices) > 0 {
+		for _, device := range devices {
+			if matchDevice(device, disk) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if len(filter) == 0 && selector == nil {
+		return useAllDevices, nil
+	}
+	if len(filter) > 0 {
+		matched, err := regexp.Match(filter, []byte(disk.Name))
+		if err != nil {
+			return false, fmt.Errorf("invalid device filter. %+v", err)
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	if selector != nil {
+		matched, err := matchDeviceSelector(selector, *disk)
+		if err != nil {
+			return false, fmt.Errorf("invalid device selector. %+v", err)
+		}
+		return matched, nil
+	}
+	return true, nil
+}
+
+// FilterFailingDevices leaves out the devices of the node whose failure is predicted by their health. The devices that
+// are not used by an OSD yet are left out so that no OSD is provisioned on them. The devices that are in use are only
+// left out if they are drained, which removes their OSDs from the cluster. Returns the devices that are kept and the
+// names of the devices that are predicted to fail.
+func FilterFailingDevices(context *clusterd.Context, nodeName string, devices []rookalpha.Device, drain bool) ([]rookalpha.Device, []string, error) {
+	namespace := os.Getenv(k8sutil.PodNamespaceEnvVar)
+	allDevices, err := ListDevices(context, namespace, nodeName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kept := []rookalpha.Device{}
+	var failing []string
+	nodeDevices := allDevices[nodeName]
+	for _, device := range devices {
+		keep := true
+		for i := range nodeDevices {
+			disk := &nodeDevices[i]
+			if !matchDevice(device, disk) || disk.Health == nil || !disk.Health.FailurePredicted {
+				continue
+			}
+
+			failing = append(failing, disk.Name)
+			inUse := len(disk.Partitions) > 0 || disk.Filesystem != ""
+			if inUse && !drain {
+				logger.Warningf("device %s on node %s is predicted to fail, its osd keeps running until it is drained. health: %+v",
+					disk.Name, nodeName, *disk.Health)
+			} else {
+				logger.Warningf("leaving out device %s on node %s that is predicted to fail. in use: %t. health: %+v",
+					disk.Name, nodeName, inUse, *disk.Health)
+				keep = false
+			}
+			break
+		}
+		if keep {
+			kept = append(kept, device)
+		}
+	}
+
+	return kept, failing, nil
+}
+
+// GetRejectedDevices returns the reasons why the devices of the node cannot be used by an OSD, by device name, for the
+// devices that discovery found to be unusable. Only the devices that are selected for the OSDs of the node are checked.
+func GetRejectedDevices(context *clusterd.Context, nodeName string, devices []rookalpha.Device) (map[string]string, error) {
+	namespace := os.Getenv(k8sutil.PodNamespaceEnvVar)
+	allDevices, err := ListDevices(context, namespace, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	rejected := map[string]string{}
+	nodeDevices := allDevices[nodeName]
+	for _, device := range devices {
+		for i := range nodeDevices {
+			disk := &nodeDevices[i]
+			if matchDevice(device, disk) && disk.RejectedReason != "" {
+				rejected[disk.Name] = disk.RejectedReason
+				break
+			}
+		}
+	}
+
+	return rejected, nil
+}
+
+// matchDevice returns whether the device in the storage selection refers to the discovered device. The full path or a
+// name starting with /dev/ are matched against the persistent links of the device since its name could change.
+func matchDevice(device rookalpha.Device, disk *sys.LocalDisk) bool {
+	if device.FullPath != "" {
+		return sys.HasDevicePath(disk, device.FullPath)
+	}
+	return device.Name == disk.Name || sys.HasDevicePath(disk, device.Name)
+}
+
+// matchDeviceSelector returns whether the device matches all the attributes specified in the selector
+func matchDeviceSelector(selector *rookalpha.DeviceSelector, device sys.LocalDisk) (bool, error) {
+	if selector.MinSize != nil && device.Size < uint64(selector.MinSize.Value()) {
+		return false, nil
+	}
+	if selector.MaxSize != nil && device.Size > uint64(selector.MaxSize.Value()) {
+		return false, nil
+	}
+	if selector.Rotational != nil && device.Rotational != *selector.Rotational {
+		return false, nil
+	}
+
+	patterns := []struct {
+		pattern string
+		values  []string
+	}{
+		{selector.Vendor, []string{device.Vendor}},
+		{selector.Model, []string{device.Model}},
+		{selector.WWN, []string{device.WWN, device.WWNVendorExtension}},
+		{selector.Serial, []string{device.Serial}},
+		// the device links are the persistent paths of the device, such as /dev/disk/by-id/... and /dev/disk/by-path/...
+		{selector.DevicePath, append([]string{"/dev/" + device.Name}, strings.Fields(device.DevLinks)...)},
+	}
+	for _, p := range patterns {
+		if p.pattern == "" {
+			continue
+		}
+		matched, err := matchAny(p.pattern, p.values)
+		if err != nil {
+			return false, err
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func matchAny(pattern string, values []string) (bool, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	for _, value := range values {
+		if value != "" && re.MatchString(value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
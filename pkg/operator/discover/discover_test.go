@@ -26,10 +26,12 @@ import (
 	discoverDaemon "github.com/rook/rook/pkg/daemon/discover"
 	"github.com/rook/rook/pkg/operator/k8sutil"
 	"github.com/rook/rook/pkg/operator/test"
+	"github.com/rook/rook/pkg/util/sys"
 
 	"github.com/stretchr/testify/assert"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -71,6 +73,20 @@ func TestStartDiscoveryDaemonset(t *testing.T) {
 	image := agentDS.Spec.Template.Spec.Containers[0].Image
 	assert.Equal(t, "rook/rook:myversion", image)
 	assert.Nil(t, agentDS.Spec.Template.Spec.Tolerations)
+
+	// the pod is privileged to read the health of the devices only when enabled
+	os.Setenv(discoverDeviceHealthEnv, "true")
+	defer os.Unsetenv(discoverDeviceHealthEnv)
+	err = clientset.Extensions().DaemonSets(namespace).Delete("rook-discover", &metav1.DeleteOptions{})
+	assert.Nil(t, err)
+	err = a.Start(namespace, "rook/rook:myversion")
+	assert.Nil(t, err)
+	agentDS, err = clientset.Extensions().DaemonSets(namespace).Get("rook-discover", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.True(t, *agentDS.Spec.Template.Spec.Containers[0].SecurityContext.Privileged)
+	envs = agentDS.Spec.Template.Spec.Containers[0].Env
+	assert.Equal(t, 3, len(envs))
+	assert.Equal(t, v1.EnvVar{Name: discoverDaemon.DeviceHealthEnvVar, Value: "true"}, envs[2])
 }
 
 func TestGetAvailableDevices(t *testing.T) {
@@ -109,19 +125,184 @@ func TestGetAvailableDevices(t *testing.T) {
 		{
 			Name: "foo",
 		},
+		{
+			FullPath: "/dev/disk/by-id/wwn-0x6001405fc00c75fb4c243aa9d61987bd",
+		},
+		{
+			Name: "/dev/disk/by-path/ip-127.0.0.1:3260-iscsi-iqn.2016-06.world.srv:storage.target01-lun-1",
+		},
 	}
 
 	nodeDevices, err := ListDevices(context, ns, "" /* all nodes */)
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(nodeDevices))
 
-	devices, err := GetAvailableDevices(context, nodeName, ns, d, "^sd.", false)
+	// the devices are matched by their name or their persistent paths
+	devices, err := GetAvailableDevices(context, nodeName, ns, d, "^sd.", nil, false)
 	assert.Nil(t, err)
-	assert.Equal(t, 1, len(devices))
-	devices, err = GetAvailableDevices(context, nodeName, ns, nil, "^sd.", false)
+	assert.Equal(t, 3, len(devices))
+	assert.Equal(t, "sdc", devices[0].Name)
+	assert.Equal(t, "/dev/disk/by-id/wwn-0x6001405fc00c75fb4c243aa9d61987bd", devices[1].FullPath)
+	devices, err = GetAvailableDevices(context, nodeName, ns, nil, "^sd.", nil, false)
 	assert.Nil(t, err)
 	assert.Equal(t, 4, len(devices))
-	devices, err = GetAvailableDevices(context, nodeName, ns, nil, "", true)
+	devices, err = GetAvailableDevices(context, nodeName, ns, nil, "", nil, true)
 	assert.Nil(t, err)
 	assert.Equal(t, 5, len(devices))
+
+	// the non-rotational devices larger than 100GB
+	rotational := false
+	minSize := resource.MustParse("100G")
+	selector := &rookalpha.DeviceSelector{MinSize: &minSize, Rotational: &rotational}
+	devices, err = GetAvailableDevices(context, nodeName, ns, nil, "", selector, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(devices))
+	assert.Equal(t, "nvme0n1", devices[0].Name)
+
+	// the selector narrows down the devices matching the filter
+	maxSize := resource.MustParse("5Gi")
+	selector = &rookalpha.DeviceSelector{MaxSize: &maxSize, Vendor: "^LIO"}
+	devices, err = GetAvailableDevices(context, nodeName, ns, nil, "^sd[a-c]", selector, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(devices))
+	assert.Equal(t, "sdb", devices[0].Name)
+	assert.Equal(t, "sdc", devices[1].Name)
+
+	// the model, serial, wwn and device paths are regular expressions
+	selector = &rookalpha.DeviceSelector{Model: "disk0[12]", Serial: "^3600"}
+	devices, err = GetAvailableDevices(context, nodeName, ns, nil, "", selector, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(devices))
+	selector = &rookalpha.DeviceSelector{WWN: "0x600140568c0bd28d"}
+	devices, err = GetAvailableDevices(context, nodeName, ns, nil, "", selector, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(devices))
+	assert.Equal(t, "sdc", devices[0].Name)
+	selector = &rookalpha.DeviceSelector{DevicePath: "^/dev/disk/by-path/.*-lun-[01]$"}
+	devices, err = GetAvailableDevices(context, nodeName, ns, nil, "", selector, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(devices))
+	selector = &rookalpha.DeviceSelector{DevicePath: "^/dev/nvme"}
+	devices, err = GetAvailableDevices(context, nodeName, ns, nil, "", selector, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(devices))
+
+	// an invalid selector is an error
+	selector = &rookalpha.DeviceSelector{Vendor: "["}
+	_, err = GetAvailableDevices(context, nodeName, ns, nil, "", selector, false)
+	assert.NotNil(t, err)
+}
+
+func TestFilterFailingDevices(t *testing.T) {
+	clientset := test.New(3)
+	ns := "rook-system"
+	nodeName := "node123"
+	os.Setenv(k8sutil.PodNamespaceEnvVar, ns)
+	defer os.Unsetenv(k8sutil.PodNamespaceEnvVar)
+
+	// sda and sdb are predicted to fail, sdb already has the partitions of an osd
+	data := map[string]string{discoverDaemon.LocalDiskCMData: `[
+{"name":"sda","health":{"passed":true,"attributes":{"Current_Pending_Sector":8},"failurePredicted":true}},
+{"name":"sdb","Partitions":[{"Name":"sdb1"}],"health":{"passed":false,"failurePredicted":true}},
+{"name":"sdc","health":{"passed":true,"failurePredicted":false}},
+{"name":"sdd"}]`}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "local-device-" + nodeName,
+			Namespace: ns,
+			Labels: map[string]string{
+				k8sutil.AppAttr:         discoverDaemon.AppName,
+				discoverDaemon.NodeAttr: nodeName,
+			},
+		},
+		Data: data,
+	}
+	_, err := clientset.CoreV1().ConfigMaps(ns).Create(cm)
+	assert.Nil(t, err)
+	context := &clusterd.Context{Clientset: clientset}
+	d := []rookalpha.Device{{Name: "sda"}, {Name: "sdb"}, {Name: "sdc"}, {Name: "sdd"}}
+
+	// no new osd is provisioned on the failing device, the osd on the other failing device keeps running
+	devices, failing, err := FilterFailingDevices(context, nodeName, d, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []rookalpha.Device{{Name: "sdb"}, {Name: "sdc"}, {Name: "sdd"}}, devices)
+	assert.Equal(t, []string{"sda", "sdb"}, failing)
+
+	// the osd on the failing device is drained
+	devices, failing, err = FilterFailingDevices(context, nodeName, d, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []rookalpha.Device{{Name: "sdc"}, {Name: "sdd"}}, devices)
+	assert.Equal(t, []string{"sda", "sdb"}, failing)
+}
+
+func TestGetRejectedDevices(t *testing.T) {
+	clientset := test.New(3)
+	ns := "rook-system"
+	nodeName := "node123"
+	os.Setenv(k8sutil.PodNamespaceEnvVar, ns)
+	defer os.Unsetenv(k8sutil.PodNamespaceEnvVar)
+
+	data := map[string]string{discoverDaemon.LocalDiskCMData: `[
+{"name":"sda","devLinks":"/dev/disk/by-id/ata-sda","available":false,"rejectedReason":"has a filesystem: ext4"},
+{"name":"sdb","available":false,"rejectedReason":"has partitions not created by rook: sdb1"},
+{"name":"sdc","available":true},
+{"name":"sdd"}]`}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "local-device-" + nodeName,
+			Namespace: ns,
+			Labels: map[string]string{
+				k8sutil.AppAttr:         discoverDaemon.AppName,
+				discoverDaemon.NodeAttr: nodeName,
+			},
+		},
+		Data: data,
+	}
+	_, err := clientset.CoreV1().ConfigMaps(ns).Create(cm)
+	assert.Nil(t, err)
+	context := &clusterd.Context{Clientset: clientset}
+
+	// only the selected devices are checked, the devices discovered without a verdict are not rejected
+	d := []rookalpha.Device{{Name: "/dev/disk/by-id/ata-sda"}, {Name: "sdc"}, {Name: "sdd"}}
+	rejected, err := GetRejectedDevices(context, nodeName, d)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"sda": "has a filesystem: ext4"}, rejected)
+
+	rejected, err = GetRejectedDevices(context, "othernode", d)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(rejected))
+}
+
+func TestMatchesSelection(t *testing.T) {
+	disk := &sys.LocalDisk{Name: "sdb", DevLinks: "/dev/disk/by-id/ata-SAMSUNG_123", Size: 1024 * 1024 * 1024, Rotational: true}
+
+	// the device list takes priority
+	matched, err := MatchesSelection(disk, []rookalpha.Device{{Name: "sdc"}}, "sd.*", nil, true)
+	assert.Nil(t, err)
+	assert.False(t, matched)
+	matched, err = MatchesSelection(disk, []rookalpha.Device{{FullPath: "/dev/disk/by-id/ata-SAMSUNG_123"}}, "", nil, false)
+	assert.Nil(t, err)
+	assert.True(t, matched)
+
+	// the selector narrows down the devices matching the filter
+	matched, err = MatchesSelection(disk, nil, "^sd[a-z]$", nil, false)
+	assert.Nil(t, err)
+	assert.True(t, matched)
+	rotational := false
+	matched, err = MatchesSelection(disk, nil, "^sd[a-z]$", &rookalpha.DeviceSelector{Rotational: &rotational}, false)
+	assert.Nil(t, err)
+	assert.False(t, matched)
+	matched, err = MatchesSelection(disk, nil, "^nvme", nil, true)
+	assert.Nil(t, err)
+	assert.False(t, matched)
+	_, err = MatchesSelection(disk, nil, "[", nil, false)
+	assert.NotNil(t, err)
+
+	// all the devices
+	matched, err = MatchesSelection(disk, nil, "", nil, true)
+	assert.Nil(t, err)
+	assert.True(t, matched)
+	matched, err = MatchesSelection(disk, nil, "", nil, false)
+	assert.Nil(t, err)
+	assert.False(t, matched)
 }
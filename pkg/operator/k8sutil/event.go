@@ -0,0 +1,54 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package k8sutil for Kubernetes helpers.
+package k8sutil
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const eventSourceComponent = "rook-ceph-operator"
+
+// RecordEvent creates an event about the given object, which is shown when the object is described with kubectl
+func RecordEvent(clientset kubernetes.Interface, obj v1.ObjectReference, eventType, reason, message string) error {
+	now := metav1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			// the name of an event only needs to be unique, it follows the convention of the kubernetes event recorder
+			Name:      fmt.Sprintf("%s.%x", obj.Name, now.UnixNano()),
+			Namespace: obj.Namespace,
+		},
+		InvolvedObject: obj,
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         v1.EventSource{Component: eventSourceComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := clientset.CoreV1().Events(obj.Namespace).Create(event); err != nil {
+		return fmt.Errorf("failed to record event %s on %s %s. %+v", reason, obj.Kind, obj.Name, err)
+	}
+	return nil
+}
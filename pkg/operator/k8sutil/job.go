@@ -0,0 +1,53 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package k8sutil for Kubernetes helpers.
+package k8sutil
+
+import (
+	"fmt"
+
+	batch "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RunReplaceableJob runs a job, replacing any previous run of the job. The pod template of a job cannot be updated, so
+// a job that already exists is deleted with its pods before the job is created again.
+func RunReplaceableJob(clientset kubernetes.Interface, job *batch.Job) error {
+	if err := DeleteJob(clientset, job.Namespace, job.Name); err != nil {
+		return fmt.Errorf("failed to remove the previous run of job %s. %+v", job.Name, err)
+	}
+
+	logger.Infof("starting job %s", job.Name)
+	if _, err := clientset.BatchV1().Jobs(job.Namespace).Create(job); err != nil {
+		return fmt.Errorf("failed to create job %s. %+v", job.Name, err)
+	}
+	return nil
+}
+
+// DeleteJob makes a best effort at deleting a job and its pods, then waits for them to be deleted
+func DeleteJob(clientset kubernetes.Interface, namespace, name string) error {
+	logger.Infof("removing %s job if it exists", name)
+	deleteAction := func(options *metav1.DeleteOptions) error {
+		return clientset.BatchV1().Jobs(namespace).Delete(name, options)
+	}
+	getAction := func() error {
+		_, err := clientset.BatchV1().Jobs(namespace).Get(name, metav1.GetOptions{})
+		return err
+	}
+	return deletePodsAndWait(namespace, name, deleteAction, getAction)
+}
@@ -39,6 +39,11 @@ func NewConfigMapKVStore(namespace string, clientset kubernetes.Interface, owner
 	}
 }
 
+// OwnerRef gets the owner of the config maps of the store
+func (kv *ConfigMapKVStore) OwnerRef() metav1.OwnerReference {
+	return kv.ownerRef
+}
+
 func (kv *ConfigMapKVStore) GetValue(storeName, key string) (string, error) {
 	cm, err := kv.clientset.CoreV1().ConfigMaps(kv.namespace).Get(storeName, metav1.GetOptions{})
 	if err != nil {
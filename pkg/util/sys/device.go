@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -31,10 +32,16 @@ const (
 	SSDType   = "ssd"
 	PartType  = "part"
 	CryptType = "crypt"
+	LVMType   = "lvm"
 	sgdisk    = "sgdisk"
 	mountCmd  = "mount"
+
+	// LVMPhysicalVolumeFS is the filesystem type of a device that is an LVM physical volume
+	LVMPhysicalVolumeFS = "LVM2_member"
 )
 
+var cephVolumeLVName = regexp.MustCompile("^ceph--[0-9a-f-]+-osd--(block|db|wal)--[0-9a-f-]+$")
+
 type Partition struct {
 	Name       string
 	Size       uint64
@@ -68,6 +75,8 @@ type LocalDisk struct {
 	Partitions []Partition
 	// Filesystem is the filesystem currently on the device
 	Filesystem string `json:"filesystem"`
+	// LogicalVolumes are the names of the logical volumes on the device when it is an LVM physical volume
+	LogicalVolumes []string `json:"logicalVolumes,omitempty"`
 	// Vendor is the device vendor
 	Vendor string `json:"vendor"`
 	// Model is the device model
@@ -78,6 +87,44 @@ type LocalDisk struct {
 	WWNVendorExtension string `json:"wwnVendorExtension"`
 	// Empty checks whether the device is completely empty
 	Empty bool `json:"empty"`
+	// Health is the SMART health of the device, nil if the device does not report it
+	Health *DeviceHealth `json:"health,omitempty"`
+	// Available is whether the device can be used by an OSD
+	Available bool `json:"available"`
+	// RejectedReason is why the device cannot be used by an OSD, empty if it is available
+	RejectedReason string `json:"rejectedReason,omitempty"`
+}
+
+// HasDevicePath returns whether the path refers to the disk, either by its kernel name under /dev or by one of its
+// persistent links such as /dev/disk/by-id/... or /dev/disk/by-path/...
+func HasDevicePath(disk *LocalDisk, path string) bool {
+	if path == "" {
+		return false
+	}
+	if path == "/dev/"+disk.Name {
+		return true
+	}
+	for _, link := range strings.Fields(disk.DevLinks) {
+		if link == path {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPersistentDevicePath returns a path of the disk that does not change when the disk is renamed by the kernel. The
+// by-id links are preferred since by-path links change when the disk is moved to another port or controller.
+func GetPersistentDevicePath(disk *LocalDisk) string {
+	byPath := ""
+	for _, link := range strings.Fields(disk.DevLinks) {
+		if strings.HasPrefix(link, "/dev/disk/by-id/") {
+			return link
+		}
+		if byPath == "" && strings.HasPrefix(link, "/dev/disk/by-path/") {
+			byPath = link
+		}
+	}
+	return byPath
 }
 
 func ListDevices(executor exec.Executor) ([]string, error) {
@@ -164,6 +211,38 @@ func GetDevicePropertiesFromPath(devicePath string, executor exec.Executor) (map
 	return parseKeyValuePairString(output), nil
 }
 
+// GetDeviceLogicalVolumes returns the device mapper names of the logical volumes on the device
+func GetDeviceLogicalVolumes(device string, executor exec.Executor) ([]string, error) {
+	cmd := fmt.Sprintf("lsblk /dev/%s logical volumes", device)
+	output, err := executor.ExecuteCommandWithOutput(false, cmd, "lsblk", fmt.Sprintf("/dev/%s", device),
+		"--pairs", "--output", "NAME,TYPE,PKNAME")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the logical volumes of device %s. %+v", device, err)
+	}
+
+	var volumes []string
+	for _, info := range strings.Split(output, "\n") {
+		props := parseKeyValuePairString(info)
+		if props["TYPE"] == LVMType && props["PKNAME"] == device {
+			volumes = append(volumes, props["NAME"])
+		}
+	}
+	return volumes, nil
+}
+
+// GetDeviceName returns the kernel name of the device at the given path, such as the device node of a raw block volume
+// that is attached to a pod under a path chosen by the pod
+func GetDeviceName(devicePath string, executor exec.Executor) (string, error) {
+	cmd := fmt.Sprintf("lsblk %s name", devicePath)
+	output, err := executor.ExecuteCommandWithOutput(false, cmd, "lsblk", devicePath,
+		"--nodeps", "--noheadings", "--output", "KNAME")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
 func GetUdevInfo(device string, executor exec.Executor) (map[string]string, error) {
 	cmd := fmt.Sprintf("udevadm info %s", device)
 	output, err := executor.ExecuteCommandWithOutput(false, cmd, "udevadm", "info", "--query=property", fmt.Sprintf("/dev/%s", device))
@@ -351,6 +430,21 @@ func RookOwnsPartitions(partitions []Partition) bool {
 	return true
 }
 
+// CephVolumeOwnsVolumes returns whether the logical volumes were all created by ceph-volume for OSDs. The device mapper
+// name of such a volume joins its volume group ceph-<uuid> and its name osd-block-<uuid>, osd-db-<uuid> or
+// osd-wal-<uuid>, with the dashes in each of them doubled.
+func CephVolumeOwnsVolumes(volumes []string) bool {
+	if len(volumes) == 0 {
+		return false
+	}
+	for _, v := range volumes {
+		if !cephVolumeLVName.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
 // finds the disk uuid in the output of sgdisk
 func parseUUID(device, output string) (string, error) {
 
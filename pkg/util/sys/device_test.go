@@ -239,7 +239,43 @@ NAME="sda6" SIZE="134217728" TYPE="part" PKNAME="sda"`, nil
 	assert.Equal(t, 0, len(partitions))
 }
 
+func TestGetDeviceLogicalVolumes(t *testing.T) {
+	executor := &exectest.MockExecutor{
+		MockExecuteCommandWithOutput: func(debug bool, actionName string, command string, arg ...string) (string, error) {
+			return `NAME="sdb" TYPE="disk" PKNAME=""
+NAME="ceph--4f2b1c6e--8a4d--4c1e--9b7a--2d5e3f6a7b8c-osd--block--0e1f2a3b--4c5d--6e7f--8091--a2b3c4d5e6f7" TYPE="lvm" PKNAME="sdb"
+NAME="ceph--4f2b1c6e--8a4d--4c1e--9b7a--2d5e3f6a7b8c-osd--db--1a2b3c4d--5e6f--7a8b--9c0d--e1f2a3b4c5d6" TYPE="lvm" PKNAME="sdb"`, nil
+		},
+	}
+
+	volumes, err := GetDeviceLogicalVolumes("sdb", executor)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(volumes))
+	assert.True(t, CephVolumeOwnsVolumes(volumes))
+
+	// the volumes of other volume groups are not owned by the osds
+	assert.False(t, CephVolumeOwnsVolumes(append(volumes, "centos-home")))
+	assert.False(t, CephVolumeOwnsVolumes(nil))
+}
+
 func TestParseUdevInfo(t *testing.T) {
 	m := parseUdevInfo(udevOutput)
 	assert.Equal(t, m["ID_FS_TYPE"], "ext2")
 }
+
+func TestDevicePaths(t *testing.T) {
+	disk := &LocalDisk{Name: "sdb", DevLinks: "/dev/disk/by-path/pci-0000:00:1f.2-ata-2 /dev/disk/by-id/wwn-0x5000c500a1b2c3d4  /dev/disk/by-id/ata-ST1000_Z1D2"}
+	assert.True(t, HasDevicePath(disk, "/dev/sdb"))
+	assert.True(t, HasDevicePath(disk, "/dev/disk/by-id/ata-ST1000_Z1D2"))
+	assert.True(t, HasDevicePath(disk, "/dev/disk/by-path/pci-0000:00:1f.2-ata-2"))
+	assert.False(t, HasDevicePath(disk, "/dev/sdc"))
+	assert.False(t, HasDevicePath(disk, "sdb"))
+	assert.False(t, HasDevicePath(disk, ""))
+
+	// the first by-id link is preferred over the by-path links
+	assert.Equal(t, "/dev/disk/by-id/wwn-0x5000c500a1b2c3d4", GetPersistentDevicePath(disk))
+	disk.DevLinks = "/dev/disk/by-path/pci-0000:00:1f.2-ata-2"
+	assert.Equal(t, "/dev/disk/by-path/pci-0000:00:1f.2-ata-2", GetPersistentDevicePath(disk))
+	disk.DevLinks = ""
+	assert.Equal(t, "", GetPersistentDevicePath(disk))
+}
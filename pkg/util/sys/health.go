@@ -0,0 +1,174 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sys
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rook/rook/pkg/util/exec"
+)
+
+const (
+	smartctlCmd = "smartctl"
+
+	// the ATA attributes of the sectors that could not be read, which predict the failure of the device
+	currentPendingSectorAttr = "Current_Pending_Sector"
+	offlineUncorrectableAttr = "Offline_Uncorrectable"
+	// the ATA attributes of the sectors that were remapped and the errors that could not be corrected
+	reallocatedSectorAttr = "Reallocated_Sector_Ct"
+	reportedUncorrectAttr = "Reported_Uncorrect"
+	// the NVMe health log fields, with the spaces of their names replaced by underscores
+	criticalWarningAttr = "Critical_Warning"
+	percentageUsedAttr  = "Percentage_Used"
+	mediaErrorsAttr     = "Media_and_Data_Integrity_Errors"
+	availableSpareAttr  = "Available_Spare"
+	// the SCSI count of the defects found since the device was manufactured
+	grownDefectsAttr = "Elements_in_grown_defect_list"
+)
+
+// the health attributes that are collected from the ATA attribute table or the NVMe and SCSI health logs
+var healthAttributes = map[string]bool{
+	currentPendingSectorAttr: true,
+	offlineUncorrectableAttr: true,
+	reallocatedSectorAttr:    true,
+	reportedUncorrectAttr:    true,
+	criticalWarningAttr:      true,
+	percentageUsedAttr:       true,
+	mediaErrorsAttr:          true,
+	availableSpareAttr:       true,
+	grownDefectsAttr:         true,
+}
+
+// DeviceHealth is the health of a device reported by its SMART self-assessment and attributes
+type DeviceHealth struct {
+	// Passed is whether the device passed its overall health self-assessment
+	Passed bool `json:"passed"`
+	// Attributes are the raw values of the attributes that tell about the wear and errors of the device
+	Attributes map[string]int64 `json:"attributes,omitempty"`
+	// FailurePredicted is whether the device is expected to fail soon, from its self-assessment or its attributes
+	FailurePredicted bool `json:"failurePredicted"`
+}
+
+// GetDeviceHealth gets the health of the device with smartctl. An error is returned if smartctl is not available or
+// the device does not report its health, for example virtual disks or disks that are in standby.
+func GetDeviceHealth(device string, executor exec.Executor) (*DeviceHealth, error) {
+	cmd := fmt.Sprintf("get health of device %s", device)
+	// the disks in standby are not spun up. smartctl exits with an error status when the device failed or some of its
+	// attributes are past their threshold, the output still has the health of the device.
+	output, err := executor.ExecuteCommandWithOutput(true, cmd, smartctlCmd, "--health", "--attributes", "--nocheck=standby",
+		fmt.Sprintf("/dev/%s", device))
+	health := parseDeviceHealth(output)
+	if health == nil {
+		if err != nil {
+			return nil, fmt.Errorf("command %s failed: %+v", cmd, err)
+		}
+		return nil, fmt.Errorf("device %s did not report its health", device)
+	}
+
+	return health, nil
+}
+
+// parses the output of smartctl for ATA, NVMe and SCSI devices. Returns nil if the output does not have the result of
+// the health self-assessment.
+func parseDeviceHealth(output string) *DeviceHealth {
+	health := &DeviceHealth{Attributes: map[string]int64{}}
+	assessed := false
+	inAttributeTable := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			inAttributeTable = false
+			continue
+		}
+
+		if strings.HasPrefix(line, "SMART overall-health self-assessment test result:") {
+			// ATA and NVMe devices
+			assessed = true
+			health.Passed = strings.HasPrefix(fieldValue(line), "PASSED")
+			continue
+		}
+		if strings.HasPrefix(line, "SMART Health Status:") {
+			// SCSI devices
+			assessed = true
+			health.Passed = fieldValue(line) == "OK"
+			continue
+		}
+
+		if strings.HasPrefix(line, "ID# ATTRIBUTE_NAME") {
+			inAttributeTable = true
+			continue
+		}
+		if inAttributeTable {
+			// ID# ATTRIBUTE_NAME FLAG VALUE WORST THRESH TYPE UPDATED WHEN_FAILED RAW_VALUE
+			fields := strings.Fields(line)
+			if len(fields) >= 10 && healthAttributes[fields[1]] {
+				if val, err := parseHealthValue(fields[9]); err == nil {
+					health.Attributes[fields[1]] = val
+				}
+			}
+			continue
+		}
+
+		// the NVMe and SCSI health logs have a field on each line
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		name := strings.Replace(strings.TrimSpace(line[:i]), " ", "_", -1)
+		if healthAttributes[name] {
+			if val, err := parseHealthValue(fieldValue(line)); err == nil {
+				health.Attributes[name] = val
+			}
+		}
+	}
+
+	if !assessed {
+		return nil
+	}
+	health.FailurePredicted = failurePredicted(health)
+	return health
+}
+
+// a device is expected to fail when it fails its self-assessment, when some of its sectors cannot be read or when the
+// NVMe device warns about its state or is worn out
+func failurePredicted(health *DeviceHealth) bool {
+	if !health.Passed {
+		return true
+	}
+	a := health.Attributes
+	return a[currentPendingSectorAttr] > 0 || a[offlineUncorrectableAttr] > 0 ||
+		a[criticalWarningAttr] != 0 || a[mediaErrorsAttr] > 0 || a[percentageUsedAttr] >= 100
+}
+
+func fieldValue(line string) string {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(line[i+1:])
+}
+
+// parses values such as "0", "0x04", "3%", "1,024" and "35 (Min/Max 20/45)"
+func parseHealthValue(raw string) (int64, error) {
+	fields := strings.Fields(raw)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty value")
+	}
+	val := strings.Replace(strings.TrimSuffix(fields[0], "%"), ",", "", -1)
+	return strconv.ParseInt(val, 0, 64)
+}
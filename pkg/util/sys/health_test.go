@@ -0,0 +1,110 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sys
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	exectest "github.com/rook/rook/pkg/util/exec/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const ataHealthOutput = `smartctl 6.5 2016-05-07 r4318 [x86_64-linux-4.4.0-127-generic] (local build)
+Copyright (C) 2002-16, Bruce Allen, Christian Franke, www.smartmontools.org
+
+=== START OF READ SMART DATA SECTION ===
+SMART overall-health self-assessment test result: PASSED
+
+SMART Attributes Data Structure revision number: 16
+Vendor Specific SMART Attributes with Thresholds:
+ID# ATTRIBUTE_NAME          FLAG     VALUE WORST THRESH TYPE      UPDATED  WHEN_FAILED RAW_VALUE
+  1 Raw_Read_Error_Rate     0x000f   117   099   006    Pre-fail  Always       -       148426912
+  5 Reallocated_Sector_Ct   0x0033   100   100   010    Pre-fail  Always       -       8
+187 Reported_Uncorrect      0x0032   100   100   000    Old_age   Always       -       0
+194 Temperature_Celsius     0x0022   035   045   000    Old_age   Always       -       35 (0 20 0 0 0)
+197 Current_Pending_Sector  0x0012   100   100   000    Old_age   Always       -       16
+198 Offline_Uncorrectable   0x0010   100   100   000    Old_age   Offline      -       0
+`
+
+const nvmeHealthOutput = `smartctl 6.6 2017-11-05 r4594 [x86_64-linux-4.15.0-23-generic] (local build)
+
+=== START OF SMART DATA SECTION ===
+SMART overall-health self-assessment test result: PASSED
+
+SMART/Health Information (NVMe Log 0x02, NSID 0x1)
+Critical Warning:                   0x00
+Temperature:                        38 Celsius
+Available Spare:                    100%
+Available Spare Threshold:          10%
+Percentage Used:                    3%
+Data Units Read:                    1,205,449 [617 GB]
+Media and Data Integrity Errors:    0
+`
+
+func TestParseDeviceHealth(t *testing.T) {
+	// the pending sectors of the ata device predict its failure even though it passed its self-assessment
+	health := parseDeviceHealth(ataHealthOutput)
+	assert.NotNil(t, health)
+	assert.True(t, health.Passed)
+	assert.True(t, health.FailurePredicted)
+	assert.Equal(t, map[string]int64{"Reallocated_Sector_Ct": 8, "Reported_Uncorrect": 0, "Current_Pending_Sector": 16,
+		"Offline_Uncorrectable": 0}, health.Attributes)
+
+	health = parseDeviceHealth(nvmeHealthOutput)
+	assert.NotNil(t, health)
+	assert.True(t, health.Passed)
+	assert.False(t, health.FailurePredicted)
+	assert.Equal(t, map[string]int64{"Critical_Warning": 0, "Available_Spare": 100, "Percentage_Used": 3,
+		"Media_and_Data_Integrity_Errors": 0}, health.Attributes)
+
+	// the nvme device warns that its spare capacity is running out
+	health = parseDeviceHealth(strings.Replace(nvmeHealthOutput, "0x00", "0x01", 1))
+	assert.True(t, health.FailurePredicted)
+
+	// scsi devices report the status of their health
+	health = parseDeviceHealth("SMART Health Status: FAILURE PREDICTION THRESHOLD EXCEEDED [asc=5d, ascq=10]\n" +
+		"Elements in grown defect list: 12")
+	assert.NotNil(t, health)
+	assert.False(t, health.Passed)
+	assert.True(t, health.FailurePredicted)
+	assert.Equal(t, int64(12), health.Attributes["Elements_in_grown_defect_list"])
+
+	// the health is not known without the self-assessment
+	assert.Nil(t, parseDeviceHealth("SMART support is: Unavailable - device lacks SMART capability."))
+}
+
+func TestGetDeviceHealth(t *testing.T) {
+	executor := &exectest.MockExecutor{
+		MockExecuteCommandWithOutput: func(debug bool, actionName string, command string, args ...string) (string, error) {
+			assert.Equal(t, "smartctl", command)
+			if args[len(args)-1] == "/dev/sda" {
+				// the exit status has a bit set when an attribute is past its threshold
+				return ataHealthOutput, fmt.Errorf("exit status 64")
+			}
+			return "Device is in STANDBY mode, exit(2)", fmt.Errorf("exit status 2")
+		},
+	}
+
+	health, err := GetDeviceHealth("sda", executor)
+	assert.Nil(t, err)
+	assert.True(t, health.FailurePredicted)
+
+	health, err = GetDeviceHealth("sdb", executor)
+	assert.NotNil(t, err)
+	assert.Nil(t, health)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sys
+
+import (
+	"bytes"
+	"path"
+	"strings"
+)
+
+const (
+	// the actions of the uevents about devices
+	UEventAdd    = "add"
+	UEventRemove = "remove"
+	UEventChange = "change"
+
+	// the subsystem of the block devices and the type of the partitions
+	BlockSubsystem = "block"
+	PartitionType  = "partition"
+)
+
+// UEvent is an event sent by the kernel when a device is added, removed or changed
+type UEvent struct {
+	// Action is the action on the device, such as add, remove or change
+	Action string
+	// DevPath is the path of the device under /sys
+	DevPath string
+	// Subsystem is the subsystem of the device, such as block
+	Subsystem string
+	// DevName is the name of the device under /dev
+	DevName string
+	// DevType is the type of the device, such as disk or partition
+	DevType string
+}
+
+// UEventListener receives the uevents of the kernel
+type UEventListener struct {
+	fd int
+}
+
+// Parent returns the name of the disk of a partition from the device path of the partition, which is under the device
+// path of the disk
+func (e *UEvent) Parent() string {
+	if e.DevType != PartitionType {
+		return ""
+	}
+	return path.Base(path.Dir(e.DevPath))
+}
+
+// parses a uevent of the kernel, which is a header followed by the properties of the event, all separated by null
+// characters. Returns nil for the events sent by udev, which have a binary header.
+func parseUEvent(msg []byte) *UEvent {
+	if bytes.HasPrefix(msg, []byte("libudev")) {
+		return nil
+	}
+
+	fields := bytes.Split(msg, []byte{0})
+	if len(fields) < 2 || !bytes.Contains(fields[0], []byte("@")) {
+		return nil
+	}
+
+	event := &UEvent{}
+	for _, field := range fields[1:] {
+		pair := strings.SplitN(string(field), "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		switch pair[0] {
+		case "ACTION":
+			event.Action = pair[1]
+		case "DEVPATH":
+			event.DevPath = pair[1]
+		case "SUBSYSTEM":
+			event.Subsystem = pair[1]
+		case "DEVNAME":
+			// the name is relative to /dev, but it could be an absolute path
+			event.DevName = strings.TrimPrefix(pair[1], "/dev/")
+		case "DEVTYPE":
+			event.DevType = pair[1]
+		}
+	}
+
+	if event.Action == "" {
+		return nil
+	}
+	return event
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sys
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	// the netlink multicast group of the uevents sent by the kernel. udev sends the events it processed to group 2,
+	// which is only received in the network namespace of the host.
+	kernelUEventGroup = 1
+	// the uevents are at most a few KB
+	uEventBufferSize = 64 * 1024
+)
+
+// NewUEventListener starts listening to the uevents of the kernel
+func NewUEventListener() (*UEventListener, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the uevent socket. %+v", err)
+	}
+
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: kernelUEventGroup}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind the uevent socket. %+v", err)
+	}
+
+	return &UEventListener{fd: fd}, nil
+}
+
+// Read waits for the next uevent. Returns nil for the messages that are not uevents of the kernel.
+func (l *UEventListener) Read() (*UEvent, error) {
+	buf := make([]byte, uEventBufferSize)
+	n, from, err := syscall.Recvfrom(l.fd, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the kernel sends messages from port 0, the messages of other processes are ignored
+	if addr, ok := from.(*syscall.SockaddrNetlink); !ok || addr.Pid != 0 {
+		return nil, nil
+	}
+	return parseUEvent(buf[:n]), nil
+}
+
+// Close stops listening to the uevents
+func (l *UEventListener) Close() error {
+	return syscall.Close(l.fd)
+}
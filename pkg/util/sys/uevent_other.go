@@ -0,0 +1,39 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// +build !linux
+
+package sys
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// NewUEventListener fails since the uevents are only sent by the linux kernel
+func NewUEventListener() (*UEventListener, error) {
+	return nil, fmt.Errorf("uevents are not supported on %s", runtime.GOOS)
+}
+
+// Read is not supported without the uevents
+func (l *UEventListener) Read() (*UEvent, error) {
+	return nil, fmt.Errorf("uevents are not supported on %s", runtime.GOOS)
+}
+
+// Close does nothing without the uevents
+func (l *UEventListener) Close() error {
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2018 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sys
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUEvent(t *testing.T) {
+	msg := strings.Join([]string{
+		"add@/devices/pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0/block/sdb/sdb1",
+		"ACTION=add",
+		"DEVPATH=/devices/pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0/block/sdb/sdb1",
+		"SUBSYSTEM=block",
+		"MAJOR=8",
+		"MINOR=17",
+		"DEVNAME=sdb1",
+		"DEVTYPE=partition",
+		"PARTN=1",
+		"SEQNUM=2345",
+		""}, "\x00")
+	event := parseUEvent([]byte(msg))
+	assert.NotNil(t, event)
+	assert.Equal(t, UEventAdd, event.Action)
+	assert.Equal(t, BlockSubsystem, event.Subsystem)
+	assert.Equal(t, "sdb1", event.DevName)
+	assert.Equal(t, PartitionType, event.DevType)
+	assert.Equal(t, "sdb", event.Parent())
+
+	// disks do not have a parent
+	event = parseUEvent([]byte("remove@/devices/virtual/block/loop0\x00ACTION=remove\x00DEVPATH=/devices/virtual/block/loop0\x00" +
+		"SUBSYSTEM=block\x00DEVNAME=/dev/loop0\x00DEVTYPE=disk\x00"))
+	assert.NotNil(t, event)
+	assert.Equal(t, UEventRemove, event.Action)
+	assert.Equal(t, "loop0", event.DevName)
+	assert.Equal(t, "", event.Parent())
+
+	// the events of udev and the invalid messages are ignored
+	assert.Nil(t, parseUEvent([]byte("libudev\x00\xfe\xed\xca\xfe\x28\x00\x00\x00ACTION=add\x00")))
+	assert.Nil(t, parseUEvent([]byte("garbage")))
+	assert.Nil(t, parseUEvent([]byte("add@/devices/virtual/block/loop0\x00SUBSYSTEM=block\x00")))
+}